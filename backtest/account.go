@@ -0,0 +1,165 @@
+package backtest
+
+import (
+	"context"
+	"strings"
+
+	"github.com/jackpopper/bitflyer"
+)
+
+var (
+	_ bitflyer.MarketData    = (*Backtest)(nil)
+	_ bitflyer.Trader        = (*Backtest)(nil)
+	_ bitflyer.ParentTrader  = (*Backtest)(nil)
+	_ bitflyer.AccountReader = (*Backtest)(nil)
+)
+
+// ** bitflyer.MarketData
+// 再生中の板と約定から作る
+func (b *Backtest) GetMarkets(ctx context.Context) (*bitflyer.Markets, error) {
+	data := bitflyer.Markets{{ProductCode: b.ProductCode}}
+	return &data, nil
+}
+
+// GetBoard は最後のスナップショット。なければ直前の約定価格を仲値とした空の板
+func (b *Backtest) GetBoard(ctx context.Context, productCode string) (*bitflyer.Board, error) {
+	if err := b.checkProduct(productCode); err != nil {
+		return nil, err
+	}
+	if b.board == nil {
+		return &bitflyer.Board{MidPrice: b.lastPrice}, nil
+	}
+	// 約定した分を除くので写しを返す
+	return copyBoard(b.board), nil
+}
+
+func (b *Backtest) GetTicker(ctx context.Context, productCode string) (*bitflyer.Ticker, error) {
+	if err := b.checkProduct(productCode); err != nil {
+		return nil, err
+	}
+	t := &bitflyer.Ticker{
+		ProductCode: b.ProductCode,
+		Timestamp:   bitflyer.Time{Time: b.now},
+		BestBid:     b.lastPrice,
+		BestAsk:     b.lastPrice,
+		Ltp:         b.lastPrice,
+	}
+	if n := len(b.recent); n > 0 {
+		t.TickID = b.recent[n-1].ID
+	}
+	if b.board != nil {
+		if len(b.board.Bids) > 0 {
+			t.BestBid, t.BestBidSize = b.board.Bids[0].Price, b.board.Bids[0].Size
+		}
+		if len(b.board.Asks) > 0 {
+			t.BestAsk, t.BestAskSize = b.board.Asks[0].Price, b.board.Asks[0].Size
+		}
+		for _, l := range b.board.Bids {
+			t.TotalBidDepth = t.TotalBidDepth.Add(l.Size)
+		}
+		for _, l := range b.board.Asks {
+			t.TotalAskDepth = t.TotalAskDepth.Add(l.Size)
+		}
+	}
+	return t, nil
+}
+
+// GetExecutions は直近500件までの市場の約定を新しい順に返す
+func (b *Backtest) GetExecutions(ctx context.Context, productCode string, page *bitflyer.Page) (*bitflyer.Executions, error) {
+	if err := b.checkProduct(productCode); err != nil {
+		return nil, err
+	}
+	data := bitflyer.Executions{}
+	for i := len(b.recent) - 1; i >= 0 && i >= len(b.recent)-maxRecent && len(data) < page.Limit(); i-- {
+		if page.Contains(b.recent[i].ID) {
+			data = append(data, b.recent[i])
+		}
+	}
+	return &data, nil
+}
+
+func (b *Backtest) GetHealth(ctx context.Context) (*bitflyer.Status, error) {
+	return &bitflyer.Status{Status: "NORMAL"}, nil
+}
+
+func (b *Backtest) GetChats(ctx context.Context, fromDate string) (*bitflyer.Chats, error) {
+	return &bitflyer.Chats{}, nil
+}
+
+// ** bitflyer.AccountReader
+// GetMyBalance は円の資金と、銘柄の通貨の建玉を返す。売り越していれば負になる
+func (b *Backtest) GetMyBalance(ctx context.Context) (*bitflyer.Balance, error) {
+	data := bitflyer.Balance{
+		{CurrencyCode: "JPY", Amount: b.cash, Available: b.cash},
+	}
+	if base := b.baseCurrency(); base != "JPY" {
+		data = append(data, bitflyer.Balance{{CurrencyCode: base, Amount: b.position, Available: b.position}}...)
+	}
+	return &data, nil
+}
+
+func (b *Backtest) baseCurrency() string {
+	return strings.Split(strings.TrimPrefix(b.ProductCode, "FX_"), "_")[0]
+}
+
+// GetMyCollateral は最初の資金に確定損益を足したものを証拠金とする
+func (b *Backtest) GetMyCollateral(ctx context.Context) (*bitflyer.Collateral, error) {
+	collateral := b.Cash.Add(b.realized)
+	data := &bitflyer.Collateral{
+		Collateral:        collateral,
+		OpenPositionPnl:   b.openPnl(),
+		RequireCollateral: b.requireCollateral(),
+	}
+	if data.RequireCollateral.Sign() > 0 {
+		data.KeepRate = collateral.Add(data.OpenPositionPnl).Div(data.RequireCollateral, 8).Float64()
+	}
+	return data, nil
+}
+
+func (b *Backtest) openPnl() bitflyer.Decimal {
+	return b.lastPrice.Sub(b.avgPrice).Mul(b.position)
+}
+
+// requireCollateral は建玉の必要証拠金。倍率はbitflyer.PaperLeverage
+func (b *Backtest) requireCollateral() bitflyer.Decimal {
+	return b.position.Abs().Mul(b.avgPrice).Div(bitflyer.NewDecimalFromInt(bitflyer.PaperLeverage), 8)
+}
+
+// GetMyPositions は建玉をひとつにまとめて返す
+func (b *Backtest) GetMyPositions(ctx context.Context, productCode string) (*bitflyer.Positions, error) {
+	if err := b.checkProduct(productCode); err != nil {
+		return nil, err
+	}
+	data := bitflyer.Positions{}
+	if b.position.IsZero() {
+		return &data, nil
+	}
+
+	side := bitflyer.SideBuy
+	if b.position.Sign() < 0 {
+		side = bitflyer.SideSell
+	}
+	data = append(data, bitflyer.Positions{{
+		ProductCode:       b.ProductCode,
+		Side:              side,
+		Price:             b.avgPrice,
+		Size:              b.position.Abs(),
+		RequireCollateral: b.requireCollateral(),
+		OpenDate:          bitflyer.Time{Time: b.now},
+		Leverage:          bitflyer.PaperLeverage,
+		Pnl:               b.openPnl(),
+	}}...)
+	return &data, nil
+}
+
+// GetMyTradingCommission はFeeがRateFeeならTakerの率を返す
+func (b *Backtest) GetMyTradingCommission(ctx context.Context, productCode string) (*bitflyer.TradingCommission, error) {
+	if err := b.checkProduct(productCode); err != nil {
+		return nil, err
+	}
+	var rate bitflyer.Decimal
+	if r, ok := b.Fee.(RateFee); ok {
+		rate = r.Taker
+	}
+	return &bitflyer.TradingCommission{CommissionRate: rate}, nil
+}
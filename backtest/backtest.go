@@ -0,0 +1,347 @@
+// Package backtest replays recorded executions against a simulated exchange
+// 記録した約定を時刻順に再生し、戦略の注文を手元で約定させて成績を出す
+package backtest
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/jackpopper/bitflyer"
+)
+
+// Backtest は1銘柄の取引所を模す。
+// bitflyer.MarketData, Trader, ParentTrader, AccountReaderを実装するので、実取引と同じ戦略のコードをそのまま動かせる。
+// 成行と板に届く指値はその時点の板 (なければ直前の約定価格) で約定し、
+// 板に残った指値は価格を越えた市場の約定があれば指値で約定する。約定の規則はbitflyer.PaperExchangeと同じ。
+// 円建ての資金と、買いを正とする建玉で損益を計算し、資金や証拠金の不足は確かめない
+type Backtest struct {
+	ProductCode string
+	// 最初の資金 (円)
+	Cash bitflyer.Decimal
+	// 発注と取消が取引所に届くまでの遅れ。nilなら遅れなし
+	Latency LatencyModel
+	// 手数料。nilなら無料
+	Fee FeeModel
+	// 板のスナップショット。時刻順に並べる。なければ約定価格だけで約定させる
+	Boards []Snapshot
+
+	now       time.Time
+	start     time.Time
+	lastPrice bitflyer.Decimal
+	board     *bitflyer.Board
+	boardIdx  int
+	// 直近の市場の約定 (古い順)
+	recent bitflyer.Executions
+
+	ex      *bitflyer.PaperExchange
+	orders  []*order // 取引所に届く前のものも含む
+	byPaper map[*bitflyer.PaperOrder]*order
+	parents []*parent
+	fills   []Fill
+	// 次のイベントで戦略に渡す約定
+	pending []Fill
+
+	cash     bitflyer.Decimal
+	position bitflyer.Decimal
+	avgPrice bitflyer.Decimal
+	realized bitflyer.Decimal
+	fees     bitflyer.Decimal
+	turnover bitflyer.Decimal
+	volume   bitflyer.Decimal
+	peak     bitflyer.Decimal
+	maxDD    bitflyer.Decimal
+	maxDDPct float64
+}
+
+// Snapshot はある時刻の板
+type Snapshot struct {
+	Time  time.Time
+	Board *bitflyer.Board
+}
+
+// Event は戦略に渡す出来事
+type Event struct {
+	Time time.Time
+	// 市場の約定。板のイベントならnil
+	Execution *bitflyer.Execution
+	// 板のスナップショット。約定のイベントならnil
+	Board *bitflyer.Board
+	// このイベントまでに約定した自分の注文
+	Fills []Fill
+}
+
+// Strategy はイベントごとに呼ばれる。エラーを返すと再生を止める
+type Strategy func(ev *Event) error
+
+// Fill は自分の注文の約定
+type Fill struct {
+	Time                    time.Time
+	ChildOrderAcceptanceID  string
+	ParentOrderAcceptanceID string
+	Side                    bitflyer.Side
+	Price                   bitflyer.Decimal
+	Size                    bitflyer.Decimal
+	// 手数料 (円)
+	Fee bitflyer.Decimal
+	// 板に置いた注文が約定したならtrue、板を取ったならfalse
+	Maker bool
+}
+
+type LatencyModel interface {
+	// Latency は時刻tに出した発注や取消が取引所に届くまでの時間
+	Latency(t time.Time) time.Duration
+}
+
+// FixedLatency は常に同じ遅れ
+type FixedLatency time.Duration
+
+func (l FixedLatency) Latency(time.Time) time.Duration {
+	return time.Duration(l)
+}
+
+type FeeModel interface {
+	// Fee は約定1件の手数料 (円)
+	Fee(f *Fill) bitflyer.Decimal
+}
+
+// RateFee は約定代金に率をかけた手数料
+type RateFee struct {
+	Maker bitflyer.Decimal
+	Taker bitflyer.Decimal
+}
+
+func (r RateFee) Fee(f *Fill) bitflyer.Decimal {
+	if f.Maker {
+		return f.Price.Mul(f.Size).Mul(r.Maker)
+	}
+	return f.Price.Mul(f.Size).Mul(r.Taker)
+}
+
+// Report はバックテストの成績。建玉は最後の約定価格で評価する
+type Report struct {
+	Start         time.Time
+	End           time.Time
+	InitialEquity bitflyer.Decimal
+	FinalEquity   bitflyer.Decimal
+	// 手数料を引いた損益 (円)
+	PnL         bitflyer.Decimal
+	RealizedPnL bitflyer.Decimal
+	Fees        bitflyer.Decimal
+	// 資産の最高値からの最大の下落 (円) と、そのときの最高値に対する比率
+	MaxDrawdown     bitflyer.Decimal
+	MaxDrawdownRate float64
+	// 約定代金の合計と約定数量の合計
+	Turnover bitflyer.Decimal
+	Volume   bitflyer.Decimal
+	// 最後の建玉。買いが正
+	Position bitflyer.Decimal
+	Orders   int
+	Fills    []Fill
+}
+
+func New(productCode string, cash bitflyer.Decimal) *Backtest {
+	return &Backtest{ProductCode: productCode, Cash: cash}
+}
+
+// Now はバックテストの中の現在時刻
+func (b *Backtest) Now() time.Time {
+	return b.now
+}
+
+// ** 再生
+// Run はexecsを古い順に再生する。GetExecutionsの結果のように新しい順でもよい
+func (b *Backtest) Run(execs bitflyer.Executions, strategy Strategy) (*Report, error) {
+	sorted := append(bitflyer.Executions(nil), execs...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].ID < sorted[j].ID })
+
+	for i := range sorted {
+		if err := b.Step(&sorted[i], strategy); err != nil {
+			return b.Report(), err
+		}
+	}
+	return b.Report(), nil
+}
+
+// RunFiles はbitflyer.Downloaderが書いたディレクトリの約定を再生する
+func (b *Backtest) RunFiles(dir string, strategy Strategy) (*Report, error) {
+	err := bitflyer.ReadExecutionChunks(dir, func(e *bitflyer.Execution) error {
+		return b.Step(e, strategy)
+	})
+	return b.Report(), err
+}
+
+// Step は約定を1件再生する。その時刻までの板のスナップショットを先に再生する
+func (b *Backtest) Step(e *bitflyer.Execution, strategy Strategy) error {
+	if b.start.IsZero() {
+		b.start = e.ExecDate.Time
+		b.cash = b.Cash
+		b.peak = b.Cash
+	}
+
+	for b.boardIdx < len(b.Boards) && !b.Boards[b.boardIdx].Time.After(e.ExecDate.Time) {
+		s := b.Boards[b.boardIdx]
+		b.boardIdx++
+		b.advance(s.Time)
+		b.setBoard(s.Board)
+		if err := b.emit(&Event{Time: b.now, Board: s.Board}, strategy); err != nil {
+			return err
+		}
+	}
+
+	b.advance(e.ExecDate.Time)
+	b.exchange().Feed(b.ProductCode, e)
+	b.mark(e.Price)
+	b.trigger(e.Price)
+
+	b.recent = append(b.recent, *e)
+	if len(b.recent) > 2*maxRecent {
+		b.recent = append(bitflyer.Executions(nil), b.recent[len(b.recent)-maxRecent:]...)
+	}
+
+	return b.emit(&Event{Time: b.now, Execution: e}, strategy)
+}
+
+func (b *Backtest) emit(ev *Event, strategy Strategy) error {
+	ev.Fills, b.pending = b.pending, nil
+	if strategy == nil {
+		return nil
+	}
+	return strategy(ev)
+}
+
+// advance は時刻をtまで進め、それまでに取引所に届く発注と取消を処理し、期限切れの注文を失効させる
+func (b *Backtest) advance(t time.Time) {
+	if t.After(b.now) {
+		b.now = t
+	}
+
+	for _, pa := range b.parents {
+		if pa.pending && !pa.activeAt.After(b.now) {
+			b.activateParent(pa)
+		}
+		if pa.active() && !pa.cancelAt.IsZero() && !pa.cancelAt.After(b.now) {
+			b.cancelParent(pa, bitflyer.StateCanceled)
+		}
+		if pa.active() && b.now.After(pa.expire) {
+			b.cancelParent(pa, bitflyer.StateExpired)
+		}
+	}
+	for _, o := range b.orders {
+		if o.pending && !o.activeAt.After(b.now) {
+			b.activate(o)
+		}
+		if o.active() && !o.cancelAt.IsZero() && !o.cancelAt.After(b.now) {
+			b.exchange().Cancel(o.PaperOrder)
+		}
+		if o.active() && b.now.After(o.ExpireDate.Time) {
+			b.exchange().Expire(o.PaperOrder)
+		}
+	}
+}
+
+// exchange は注文を約定させるbitflyer.PaperExchange。資金と建玉はapplyで計算するのでAccountは使わない
+func (b *Backtest) exchange() *bitflyer.PaperExchange {
+	if b.ex == nil {
+		b.ex = &bitflyer.PaperExchange{
+			Now: func() time.Time { return b.now },
+			FormatID: func(kind string, id int) string {
+				return fmt.Sprintf("BT-%s-%06d", kind, id)
+			},
+			Commission: b.commission,
+			OnFill:     b.filled,
+			OnCancel:   b.canceled,
+		}
+		b.byPaper = map[*bitflyer.PaperOrder]*order{}
+	}
+	return b.ex
+}
+
+func (b *Backtest) latency() time.Duration {
+	if b.Latency == nil {
+		return 0
+	}
+	return b.Latency.Latency(b.now)
+}
+
+// ** 損益
+// apply は約定を資金と建玉に反映する
+func (b *Backtest) apply(side bitflyer.Side, price, size, fee bitflyer.Decimal) {
+	signed := size
+	if side == bitflyer.SideSell {
+		signed = size.Neg()
+	}
+
+	pos := b.position
+	switch {
+	case pos.IsZero() || pos.Sign() == signed.Sign():
+		b.avgPrice = b.avgPrice.Mul(pos.Abs()).Add(price.Mul(size)).Div(pos.Abs().Add(size), 8)
+	default:
+		closed := pos.Abs()
+		if size.Cmp(closed) < 0 {
+			closed = size
+		}
+		if pos.Sign() > 0 {
+			b.realized = b.realized.Add(price.Sub(b.avgPrice).Mul(closed))
+		} else {
+			b.realized = b.realized.Add(b.avgPrice.Sub(price).Mul(closed))
+		}
+		if size.Cmp(pos.Abs()) > 0 {
+			b.avgPrice = price
+		}
+	}
+	b.position = pos.Add(signed)
+	if b.position.IsZero() {
+		b.avgPrice = bitflyer.Decimal{}
+	}
+
+	b.cash = b.cash.Sub(signed.Mul(price)).Sub(fee)
+	b.realized = b.realized.Sub(fee)
+	b.fees = b.fees.Add(fee)
+	b.turnover = b.turnover.Add(price.Mul(size))
+	b.volume = b.volume.Add(size)
+}
+
+func (b *Backtest) equity() bitflyer.Decimal {
+	return b.cash.Add(b.position.Mul(b.lastPrice))
+}
+
+// mark は約定価格で資産を評価し、最大ドローダウンを更新する
+func (b *Backtest) mark(price bitflyer.Decimal) {
+	b.lastPrice = price
+
+	eq := b.equity()
+	if eq.Cmp(b.peak) > 0 {
+		b.peak = eq
+	}
+	if dd := b.peak.Sub(eq); dd.Cmp(b.maxDD) > 0 {
+		b.maxDD = dd
+		if b.peak.Sign() > 0 {
+			b.maxDDPct = dd.Div(b.peak, 8).Float64()
+		}
+	}
+}
+
+// Report はここまでの成績
+func (b *Backtest) Report() *Report {
+	eq := b.equity()
+	if b.start.IsZero() {
+		eq = b.Cash
+	}
+	return &Report{
+		Start:           b.start,
+		End:             b.now,
+		InitialEquity:   b.Cash,
+		FinalEquity:     eq,
+		PnL:             eq.Sub(b.Cash),
+		RealizedPnL:     b.realized,
+		Fees:            b.fees,
+		MaxDrawdown:     b.maxDD,
+		MaxDrawdownRate: b.maxDDPct,
+		Turnover:        b.turnover,
+		Volume:          b.volume,
+		Position:        b.position,
+		Orders:          len(b.orders),
+		Fills:           append([]Fill(nil), b.fills...),
+	}
+}
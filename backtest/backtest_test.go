@@ -0,0 +1,364 @@
+package backtest_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jackpopper/bitflyer"
+	"github.com/jackpopper/bitflyer/backtest"
+)
+
+var base = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func d(s string) bitflyer.Decimal {
+	return bitflyer.MustDecimal(s)
+}
+
+// executions は1秒ごとの約定
+func executions(prices ...string) bitflyer.Executions {
+	var execs bitflyer.Executions
+	for i, p := range prices {
+		execs = append(execs, bitflyer.Execution{
+			ID:       i + 1,
+			Side:     bitflyer.SideBuy,
+			Price:    d(p),
+			Size:     d("1"),
+			ExecDate: bitflyer.Time{Time: base.Add(time.Duration(i) * time.Second)},
+		})
+	}
+	return execs
+}
+
+// at はi番目の約定のときにfを呼ぶ戦略
+func at(i int, f func(ev *backtest.Event) error) backtest.Strategy {
+	n := 0
+	return func(ev *backtest.Event) error {
+		if ev.Execution == nil {
+			return nil
+		}
+		n++
+		if n == i {
+			return f(ev)
+		}
+		return nil
+	}
+}
+
+func checkDecimal(t *testing.T, name string, got bitflyer.Decimal, want string) {
+	t.Helper()
+	if !got.Equal(d(want)) {
+		t.Errorf("%s = %s, want %s", name, got, want)
+	}
+}
+
+func TestBacktestMarket(t *testing.T) {
+	ctx := context.Background()
+	bt := backtest.New("FX_BTC_JPY", d("1000000"))
+	bt.Fee = backtest.RateFee{Taker: d("0.001")}
+
+	report, err := bt.Run(executions("100", "110", "90", "120"), func(ev *backtest.Event) error {
+		switch ev.Execution.ID {
+		case 1:
+			_, err := bt.SendChildorder(ctx, &bitflyer.Childorder{ProductCode: "FX_BTC_JPY", ChildOrderType: bitflyer.OrderTypeMarket, Side: bitflyer.SideBuy, Size: d("0.3")})
+			return err
+		case 3:
+			_, err := bt.SendChildorder(ctx, &bitflyer.Childorder{ProductCode: "FX_BTC_JPY", ChildOrderType: bitflyer.OrderTypeMarket, Side: bitflyer.SideSell, Size: d("0.1")})
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(report.Fills) != 2 || report.Fills[0].Maker || report.Fills[1].Maker {
+		t.Fatalf("fills = %+v", report.Fills)
+	}
+	checkDecimal(t, "fee", report.Fills[0].Fee, "0.03")
+	checkDecimal(t, "fee", report.Fills[1].Fee, "0.009")
+	// 100で0.3買い、90で0.1売り、120で評価
+	checkDecimal(t, "position", report.Position, "0.2")
+	checkDecimal(t, "fees", report.Fees, "0.039")
+	checkDecimal(t, "realized", report.RealizedPnL, "-1.039")
+	checkDecimal(t, "pnl", report.PnL, "2.961")
+	checkDecimal(t, "turnover", report.Turnover, "39")
+	checkDecimal(t, "volume", report.Volume, "0.4")
+	// 最高値は110で評価したとき、最安値は90で評価したとき
+	checkDecimal(t, "max drawdown", report.MaxDrawdown, "6")
+	if report.MaxDrawdownRate <= 0 {
+		t.Errorf("max drawdown rate = %v", report.MaxDrawdownRate)
+	}
+
+	pos, err := bt.GetMyPositions(ctx, "FX_BTC_JPY")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*pos) != 1 || (*pos)[0].Side != bitflyer.SideBuy || !(*pos)[0].Price.Equal(d("100")) || (*pos)[0].Leverage != bitflyer.PaperLeverage {
+		t.Errorf("positions = %+v", pos)
+	}
+	c, err := bt.GetMyCollateral(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkDecimal(t, "open pnl", c.OpenPositionPnl, "4")
+	checkDecimal(t, "require collateral", c.RequireCollateral, "10")
+}
+
+func TestBacktestLimit(t *testing.T) {
+	ctx := context.Background()
+	bt := backtest.New("FX_BTC_JPY", d("1000000"))
+	bt.Fee = backtest.RateFee{Maker: d("-0.001"), Taker: d("0.002")}
+
+	var id string
+	var fills []backtest.Fill
+	strategy := func(ev *backtest.Event) error {
+		fills = append(fills, ev.Fills...)
+		if ev.Execution.ID == 1 {
+			res, err := bt.SendChildorder(ctx, &bitflyer.Childorder{ProductCode: "FX_BTC_JPY", ChildOrderType: bitflyer.OrderTypeLimit, Side: bitflyer.SideBuy, Price: d("95"), Size: d("1")})
+			if err != nil {
+				return err
+			}
+			id = res.ChildOrderAcceptanceID
+		}
+		return nil
+	}
+	// 95ちょうどでは約定せず、越えたら指値で約定する
+	report, err := bt.Run(executions("100", "95", "94", "99"), strategy)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(fills) != 1 || !fills[0].Maker || !fills[0].Price.Equal(d("95")) || fills[0].ChildOrderAcceptanceID != id {
+		t.Fatalf("fills = %+v", fills)
+	}
+	if !fills[0].Time.Equal(base.Add(2 * time.Second)) {
+		t.Errorf("fill time = %s", fills[0].Time)
+	}
+	checkDecimal(t, "fees", report.Fees, "-0.095")
+	checkDecimal(t, "pnl", report.PnL, "4.095")
+
+	orders, err := bt.GetMyChildorders(ctx, "FX_BTC_JPY", nil, bitflyer.StateCompleted, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*orders) != 1 || (*orders)[0].ChildOrderAcceptanceID != id || !(*orders)[0].ExecutedSize.Equal(d("1")) {
+		t.Errorf("orders = %+v", orders)
+	}
+	execs, err := bt.GetMyExecutions(ctx, "FX_BTC_JPY", nil, "", id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*execs) != 1 || !(*execs)[0].Commission.Equal(d("-0.095")) {
+		t.Errorf("executions = %+v", execs)
+	}
+}
+
+func TestBacktestLatency(t *testing.T) {
+	ctx := context.Background()
+	bt := backtest.New("FX_BTC_JPY", d("1000000"))
+	bt.Latency = backtest.FixedLatency(1500 * time.Millisecond)
+
+	var id string
+	report, err := bt.Run(executions("100", "101", "102", "103", "104"), func(ev *backtest.Event) error {
+		switch ev.Execution.ID {
+		case 1:
+			res, err := bt.SendChildorder(ctx, &bitflyer.Childorder{ProductCode: "FX_BTC_JPY", ChildOrderType: bitflyer.OrderTypeMarket, Side: bitflyer.SideBuy, Size: d("1")})
+			if err != nil {
+				return err
+			}
+			// 取引所に届く前は一覧に出ない
+			orders, _ := bt.GetMyChildorders(ctx, "FX_BTC_JPY", nil, "", "")
+			if len(*orders) != 0 {
+				t.Errorf("pending orders = %+v", orders)
+			}
+			id = res.ChildOrderAcceptanceID
+		case 3:
+			res, err := bt.SendChildorder(ctx, &bitflyer.Childorder{ProductCode: "FX_BTC_JPY", ChildOrderType: bitflyer.OrderTypeLimit, Side: bitflyer.SideBuy, Price: d("90"), Size: d("1")})
+			if err != nil {
+				return err
+			}
+			// 取消も遅れて届く
+			return bt.CancelChildorder(ctx, &bitflyer.Childorder{ProductCode: "FX_BTC_JPY", ChildOrderAcceptanceID: res.ChildOrderAcceptanceID})
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 1.5秒後の最初の約定 (102) の時刻に直前の価格 (101) で約定する
+	if len(report.Fills) != 1 || report.Fills[0].ChildOrderAcceptanceID != id || !report.Fills[0].Price.Equal(d("101")) {
+		t.Fatalf("fills = %+v", report.Fills)
+	}
+	if !report.Fills[0].Time.Equal(base.Add(2 * time.Second)) {
+		t.Errorf("fill time = %s", report.Fills[0].Time)
+	}
+	orders, err := bt.GetMyChildorders(ctx, "FX_BTC_JPY", nil, bitflyer.StateCanceled, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*orders) != 1 {
+		t.Errorf("canceled orders = %+v", orders)
+	}
+}
+
+func TestBacktestBoard(t *testing.T) {
+	ctx := context.Background()
+	bt := backtest.New("FX_BTC_JPY", d("1000000"))
+	bt.Boards = []backtest.Snapshot{{
+		Time: base,
+		Board: &bitflyer.Board{
+			MidPrice: d("100.5"),
+			Bids:     []bitflyer.PriceLevel{{Price: d("100"), Size: d("1")}},
+			Asks:     []bitflyer.PriceLevel{{Price: d("101"), Size: d("0.5")}, {Price: d("102"), Size: d("1")}},
+		},
+	}}
+
+	report, err := bt.Run(executions("100"), at(1, func(ev *backtest.Event) error {
+		_, err := bt.SendChildorder(ctx, &bitflyer.Childorder{ProductCode: "FX_BTC_JPY", ChildOrderType: bitflyer.OrderTypeMarket, Side: bitflyer.SideBuy, Size: d("1")})
+		return err
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Fills) != 2 || !report.Fills[0].Price.Equal(d("101")) || !report.Fills[1].Price.Equal(d("102")) {
+		t.Fatalf("fills = %+v", report.Fills)
+	}
+	checkDecimal(t, "turnover", report.Turnover, "101.5")
+}
+
+func TestBacktestBoardRematch(t *testing.T) {
+	ctx := context.Background()
+	bt := backtest.New("FX_BTC_JPY", d("1000000"))
+	bt.Boards = []backtest.Snapshot{{
+		Time:  base,
+		Board: &bitflyer.Board{MidPrice: d("104"), Bids: []bitflyer.PriceLevel{{Price: d("103"), Size: d("1")}}, Asks: []bitflyer.PriceLevel{{Price: d("105"), Size: d("1")}}},
+	}, {
+		Time:  base.Add(time.Second),
+		Board: &bitflyer.Board{MidPrice: d("101.5"), Bids: []bitflyer.PriceLevel{{Price: d("101"), Size: d("1")}}, Asks: []bitflyer.PriceLevel{{Price: d("102"), Size: d("1.5")}}},
+	}}
+
+	var ids []string
+	var board *bitflyer.Board
+	n := 0
+	_, err := bt.Run(executions("104", "104"), func(ev *backtest.Event) error {
+		if ev.Execution == nil {
+			return nil
+		}
+		n++
+		switch n {
+		case 1:
+			// 板に届かない指値を2つ置く
+			for i := 0; i < 2; i++ {
+				acc, err := bt.SendChildorder(ctx, &bitflyer.Childorder{ProductCode: "FX_BTC_JPY", ChildOrderType: bitflyer.OrderTypeLimit, Side: bitflyer.SideBuy, Price: d("103"), Size: d("1")})
+				if err != nil {
+					return err
+				}
+				ids = append(ids, acc.ChildOrderAcceptanceID)
+			}
+		case 2:
+			var err error
+			board, err = bt.GetBoard(ctx, "FX_BTC_JPY")
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 新しい板の102の1.5枚を古い注文から取り合う
+	for i, want := range []struct{ executed, outstanding string }{{"1", "0"}, {"0.5", "0.5"}} {
+		orders, err := bt.GetMyChildorder(ctx, "FX_BTC_JPY", "", ids[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		o := (*orders)[0]
+		checkDecimal(t, "executed", o.ExecutedSize, want.executed)
+		checkDecimal(t, "outstanding", o.OutstandingSize, want.outstanding)
+		if o.ExecutedSize.Sign() > 0 {
+			checkDecimal(t, "price", o.AveragePrice, "102")
+		}
+	}
+	// 取った気配は板から除き、渡されたスナップショットは変えない
+	if len(board.Asks) != 0 {
+		t.Errorf("asks = %+v", board.Asks)
+	}
+	checkDecimal(t, "snapshot ask", bt.Boards[1].Board.Asks[0].Size, "1.5")
+}
+
+func TestBacktestParentorder(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("ifdoco", func(t *testing.T) {
+		bt := backtest.New("FX_BTC_JPY", d("1000000"))
+		var id string
+		report, err := bt.Run(executions("100", "99", "98", "104", "106", "110"), at(1, func(ev *backtest.Event) error {
+			res, err := bt.SendParentrder(ctx, &bitflyer.Parentorder{
+				OrderMethod: bitflyer.MethodIFDOCO,
+				Parameters: []bitflyer.ParentorderParameter{
+					{ProductCode: "FX_BTC_JPY", ConditionType: bitflyer.ConditionLimit, Side: bitflyer.SideBuy, Price: d("99"), Size: d("1")},
+					{ProductCode: "FX_BTC_JPY", ConditionType: bitflyer.ConditionLimit, Side: bitflyer.SideSell, Price: d("105"), Size: d("1")},
+					{ProductCode: "FX_BTC_JPY", ConditionType: bitflyer.ConditionStop, Side: bitflyer.SideSell, TriggerPrice: d("95"), Size: d("1")},
+				},
+			})
+			if err != nil {
+				return err
+			}
+			id = res.ParentOrderAcceptanceID
+			return nil
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// 98で買い、106で利確し、STOPは取り消す
+		if len(report.Fills) != 2 || !report.Fills[0].Price.Equal(d("99")) || !report.Fills[1].Price.Equal(d("105")) {
+			t.Fatalf("fills = %+v", report.Fills)
+		}
+		for _, f := range report.Fills {
+			if f.ParentOrderAcceptanceID != id {
+				t.Errorf("fill parent = %q, want %q", f.ParentOrderAcceptanceID, id)
+			}
+		}
+		checkDecimal(t, "realized", report.RealizedPnL, "6")
+		checkDecimal(t, "position", report.Position, "0")
+
+		pa, err := bt.GetMyParentorder(ctx, "", id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (*pa)[0].ParentOrderState != bitflyer.StateCompleted || !(*pa)[0].ExecutedSize.Equal(d("2")) {
+			t.Errorf("parent = %+v", (*pa)[0])
+		}
+		children, err := bt.GetMyChildorders(ctx, "FX_BTC_JPY", nil, "", (*pa)[0].ParentOrderID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(*children) != 2 {
+			t.Errorf("children = %+v", children)
+		}
+	})
+
+	t.Run("trail", func(t *testing.T) {
+		bt := backtest.New("FX_BTC_JPY", d("1000000"))
+		report, err := bt.Run(executions("100", "105", "110", "106", "104", "103"), at(1, func(ev *backtest.Event) error {
+			_, err := bt.SendParentrder(ctx, &bitflyer.Parentorder{
+				OrderMethod: bitflyer.MethodSimple,
+				Parameters: []bitflyer.ParentorderParameter{
+					{ProductCode: "FX_BTC_JPY", ConditionType: bitflyer.ConditionTrail, Side: bitflyer.SideSell, Size: d("0.5"), Offset: 5},
+				},
+			})
+			return err
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// 高値110から5下がった104で成行
+		if len(report.Fills) != 1 || !report.Fills[0].Price.Equal(d("104")) || report.Fills[0].Side != bitflyer.SideSell {
+			t.Fatalf("fills = %+v", report.Fills)
+		}
+		checkDecimal(t, "position", report.Position, "-0.5")
+	})
+}
@@ -0,0 +1,250 @@
+package backtest
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/jackpopper/bitflyer"
+)
+
+// maxRecent はGetExecutionsで返す直近の市場の約定の数
+const maxRecent = 500
+
+type order struct {
+	*bitflyer.PaperOrder
+	// 親注文から出た注文ならその条件
+	leg *leg
+
+	// まだ取引所に届いていなければtrue
+	pending  bool
+	activeAt time.Time
+	cancelAt time.Time
+}
+
+func (o *order) active() bool {
+	return !o.pending && o.ChildOrderState == bitflyer.StateActive
+}
+
+// parentOrderID は親注文から出た注文なら親の注文ID
+func (o *order) parentOrderID() string {
+	if o.leg == nil {
+		return ""
+	}
+	return o.leg.parent.orderID
+}
+
+func notFound() error {
+	return &bitflyer.APIError{HTTPStatus: http.StatusBadRequest, Status: bitflyer.StatusOrderNotFound, Message: "Order not found"}
+}
+
+func (b *Backtest) checkProduct(productCode string) error {
+	if productCode != b.ProductCode {
+		return fmt.Errorf("backtest: unknown product %q", productCode)
+	}
+	return nil
+}
+
+// ** 子注文の約定
+// place は注文を受け付ける。delayの後に取引所に届き、activateで板と突き合わせる
+func (b *Backtest) place(ch *bitflyer.Childorder, delay time.Duration) *order {
+	o := &order{
+		PaperOrder: b.exchange().NewOrder(ch, bitflyer.Decimal{}),
+		pending:    true,
+		activeAt:   b.now.Add(delay),
+	}
+	b.orders = append(b.orders, o)
+	b.byPaper[o.PaperOrder] = o
+
+	return o
+}
+
+// activate は取引所に届いた注文を板と突き合わせ、残りを板に置く。
+// 板がなければ直前の約定価格でいくらでも約定できるものとする
+func (b *Backtest) activate(o *order) {
+	o.pending = false
+
+	if b.board == nil {
+		board := &bitflyer.Board{MidPrice: b.lastPrice}
+		if b.lastPrice.Sign() > 0 {
+			levels := []bitflyer.PriceLevel{{Price: b.lastPrice, Size: o.OutstandingSize}}
+			board.Bids, board.Asks = levels, levels
+		}
+		// Accountを使わないので資金の不足では失敗しない
+		b.exchange().Place(o.PaperOrder, board)
+		return
+	}
+	execs, _ := b.exchange().Place(o.PaperOrder, b.board)
+	b.take(o.Side, execs)
+}
+
+// setBoard は板のスナップショットを差し替え、板に残っている注文を古い順に新しい板と突き合わせる。
+// 約定した分は写した板から除くので、同じ気配を2つの注文で取ることはない
+func (b *Backtest) setBoard(board *bitflyer.Board) {
+	b.board = copyBoard(board)
+	for _, o := range b.orders {
+		if o.active() {
+			b.take(o.Side, b.exchange().Match(o.PaperOrder, b.board))
+		}
+	}
+}
+
+func copyBoard(board *bitflyer.Board) *bitflyer.Board {
+	return &bitflyer.Board{
+		MidPrice: board.MidPrice,
+		Bids:     append([]bitflyer.PriceLevel(nil), board.Bids...),
+		Asks:     append([]bitflyer.PriceLevel(nil), board.Asks...),
+	}
+}
+
+// take はsideの注文が約定した数量を板の反対側の気配から除く
+func (b *Backtest) take(side bitflyer.Side, execs []*bitflyer.PaperExecution) {
+	levels := &b.board.Asks
+	if side == bitflyer.SideSell {
+		levels = &b.board.Bids
+	}
+	for _, e := range execs {
+		for i := range *levels {
+			if (*levels)[i].Price.Equal(e.Price) {
+				(*levels)[i].Size = (*levels)[i].Size.Sub(e.Size)
+				break
+			}
+		}
+	}
+
+	rest := (*levels)[:0]
+	for _, l := range *levels {
+		if l.Size.Sign() > 0 {
+			rest = append(rest, l)
+		}
+	}
+	*levels = rest
+}
+
+// fill は約定1件を戦略に渡すFillにする
+func (b *Backtest) fill(po *bitflyer.PaperOrder, price, size bitflyer.Decimal, maker bool) Fill {
+	f := Fill{
+		Time:                   b.now,
+		ChildOrderAcceptanceID: po.ChildOrderAcceptanceID,
+		Side:                   po.Side,
+		Price:                  price,
+		Size:                   size,
+		Maker:                  maker,
+	}
+	if l := b.byPaper[po].leg; l != nil {
+		f.ParentOrderAcceptanceID = l.parent.acceptanceID
+	}
+	return f
+}
+
+// commission はFeeで約定1件の手数料 (円) を出す
+func (b *Backtest) commission(po *bitflyer.PaperOrder, price, size bitflyer.Decimal, maker bool) bitflyer.Decimal {
+	if b.Fee == nil {
+		return bitflyer.Decimal{}
+	}
+	f := b.fill(po, price, size, maker)
+	return b.Fee.Fee(&f)
+}
+
+// filled は約定を資金と建玉に反映し、親注文を進める
+func (b *Backtest) filled(po *bitflyer.PaperOrder, e *bitflyer.PaperExecution, maker bool) {
+	f := b.fill(po, e.Price, e.Size, maker)
+	f.Fee = e.Commission
+	b.apply(f.Side, f.Price, f.Size, f.Fee)
+	b.fills = append(b.fills, f)
+	b.pending = append(b.pending, f)
+
+	if o := b.byPaper[po]; o.leg != nil {
+		b.legFilled(o.leg)
+	}
+}
+
+func (b *Backtest) canceled(po *bitflyer.PaperOrder) {
+	o := b.byPaper[po]
+	o.pending = false
+	if o.leg != nil {
+		b.legFilled(o.leg)
+	}
+}
+
+// ** bitflyer.Trader
+func (b *Backtest) SendChildorder(ctx context.Context, ch *bitflyer.Childorder) (*bitflyer.ChildOrderAcceptanceID, error) {
+	if err := ch.Validate(); err != nil {
+		return nil, err
+	}
+	if err := b.checkProduct(ch.ProductCode); err != nil {
+		return nil, err
+	}
+
+	o := b.place(ch, b.latency())
+	if !o.activeAt.After(b.now) {
+		b.activate(o)
+	}
+
+	return &bitflyer.ChildOrderAcceptanceID{ChildOrderAcceptanceID: o.ChildOrderAcceptanceID}, nil
+}
+
+// requestCancel は取消を遅れの後に取引所に届ける
+func (b *Backtest) requestCancel(o *order) {
+	o.cancelAt = b.now.Add(b.latency())
+	if o.active() && !o.cancelAt.After(b.now) {
+		b.exchange().Cancel(o.PaperOrder)
+	}
+}
+
+func (b *Backtest) CancelChildorder(ctx context.Context, ch *bitflyer.Childorder) error {
+	if ch.ProductCode != b.ProductCode {
+		return notFound()
+	}
+	for _, o := range b.orders {
+		if o.ChildOrderState != bitflyer.StateActive {
+			continue
+		}
+		if (ch.ChildOrderID != "" && o.ChildOrderID == ch.ChildOrderID) ||
+			(ch.ChildOrderAcceptanceID != "" && o.ChildOrderAcceptanceID == ch.ChildOrderAcceptanceID) {
+			b.requestCancel(o)
+			return nil
+		}
+	}
+	return notFound()
+}
+
+func (b *Backtest) CancelAllChildorder(ctx context.Context, productCode string) error {
+	if err := b.checkProduct(productCode); err != nil {
+		return err
+	}
+	for _, o := range b.orders {
+		if o.ChildOrderState == bitflyer.StateActive {
+			b.requestCancel(o)
+		}
+	}
+	return nil
+}
+
+func (b *Backtest) GetMyChildorders(ctx context.Context, productCode string, page *bitflyer.Page, childOrderState bitflyer.OrderState, parentOrderID string) (*bitflyer.Childorders, error) {
+	data := b.exchange().Childorders(page, func(o *bitflyer.PaperOrder) bool {
+		return (productCode == "" || productCode == b.ProductCode) &&
+			(childOrderState == "" || o.ChildOrderState == childOrderState) &&
+			(parentOrderID == "" || b.byPaper[o].parentOrderID() == parentOrderID)
+	})
+	return &data, nil
+}
+
+func (b *Backtest) GetMyChildorder(ctx context.Context, productCode, childOrderID, childOrderAcceptanceID string) (*bitflyer.Childorders, error) {
+	data := b.exchange().Childorders(nil, func(o *bitflyer.PaperOrder) bool {
+		return productCode == b.ProductCode &&
+			(childOrderID == "" || o.ChildOrderID == childOrderID) &&
+			(childOrderAcceptanceID == "" || o.ChildOrderAcceptanceID == childOrderAcceptanceID)
+	})
+	return &data, nil
+}
+
+func (b *Backtest) GetMyExecutions(ctx context.Context, productCode string, page *bitflyer.Page, childOrderID, childOrderAcceptanceID string) (*bitflyer.Executions, error) {
+	data := b.exchange().Executions(page, func(e *bitflyer.PaperExecution) bool {
+		return (productCode == "" || productCode == b.ProductCode) &&
+			(childOrderID == "" || e.ChildOrderID == childOrderID) &&
+			(childOrderAcceptanceID == "" || e.ChildOrderAcceptanceID == childOrderAcceptanceID)
+	})
+	return &data, nil
+}
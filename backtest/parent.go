@@ -0,0 +1,343 @@
+package backtest
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackpopper/bitflyer"
+)
+
+// * 親注文
+// 取引所と同じく親注文の執行条件を約定価格で監視し、条件を満たしたら遅れなしに子注文を出す。
+// IFDは1つ目が約定し終えたら2つ目を、OCOはどちらかが約定したらもう一方を取り消す
+
+type legState int
+
+const (
+	// 前の注文が約定し終えるのを待っている
+	legWaiting legState = iota
+	// 執行条件を監視している
+	legArmed
+	// 子注文を出した
+	legPlaced
+	// 約定し終えたか取り消された
+	legDone
+)
+
+type leg struct {
+	parent *parent
+	index  int
+	param  bitflyer.ParentorderParameter
+	state  legState
+	child  *order
+	// TRAILで追う高値 (売り) か安値 (買い)
+	extreme bitflyer.Decimal
+}
+
+type parent struct {
+	id           int
+	acceptanceID string
+	orderID      string
+	method       bitflyer.OrderMethod
+	tif          bitflyer.TimeInForce
+	legs         []*leg
+	state        bitflyer.OrderState
+	date         time.Time
+	expire       time.Time
+
+	pending  bool
+	activeAt time.Time
+	cancelAt time.Time
+}
+
+func (pa *parent) active() bool {
+	return !pa.pending && pa.state == bitflyer.StateActive
+}
+
+// ocoSibling はOCOの組になっているもう一方の注文
+func (pa *parent) ocoSibling(l *leg) *leg {
+	first := -1
+	switch pa.method {
+	case bitflyer.MethodOCO:
+		first = 0
+	case bitflyer.MethodIFDOCO:
+		first = 1
+	}
+	switch {
+	case first < 0:
+		return nil
+	case l.index == first:
+		return pa.legs[first+1]
+	case l.index == first+1:
+		return pa.legs[first]
+	}
+	return nil
+}
+
+func (pa *parent) info(productCode string) bitflyer.ParentorderInfo {
+	first := pa.legs[0].param
+	var executed, cost, commission bitflyer.Decimal
+	for _, l := range pa.legs {
+		if l.child != nil {
+			executed = executed.Add(l.child.ExecutedSize)
+			cost = cost.Add(l.child.AveragePrice.Mul(l.child.ExecutedSize))
+			commission = commission.Add(l.child.TotalCommission)
+		}
+	}
+	var avg, outstanding bitflyer.Decimal
+	if executed.Sign() > 0 {
+		avg = cost.Div(executed, 8)
+	}
+	if rest := first.Size.Sub(executed); pa.state == bitflyer.StateActive && rest.Sign() > 0 {
+		outstanding = rest
+	}
+
+	return bitflyer.ParentorderInfo{
+		ID:                      pa.id,
+		ParentOrderID:           pa.orderID,
+		ProductCode:             productCode,
+		Side:                    first.Side,
+		ParentOrderType:         string(pa.method),
+		Price:                   first.Price,
+		AveragePrice:            avg,
+		Size:                    first.Size,
+		ParentOrderState:        pa.state,
+		ExpireDate:              bitflyer.Time{Time: pa.expire},
+		ParentOrderDate:         bitflyer.Time{Time: pa.date},
+		ParentOrderAcceptanceID: pa.acceptanceID,
+		OutstandingSize:         outstanding,
+		ExecutedSize:            executed,
+		TotalCommission:         commission,
+	}
+}
+
+// ** 執行
+func (b *Backtest) activateParent(pa *parent) {
+	pa.pending = false
+	b.arm(pa.legs[0])
+	if pa.method == bitflyer.MethodOCO {
+		b.arm(pa.legs[1])
+	}
+}
+
+// arm は執行条件の監視を始める。LIMITとMARKETはすぐに子注文を出す
+func (b *Backtest) arm(l *leg) {
+	if !l.parent.active() || l.state != legWaiting {
+		return
+	}
+	l.state = legArmed
+	switch l.param.ConditionType {
+	case bitflyer.ConditionLimit:
+		b.placeLeg(l, bitflyer.OrderTypeLimit, l.param.Price)
+	case bitflyer.ConditionMarket:
+		b.placeLeg(l, bitflyer.OrderTypeMarket, bitflyer.Decimal{})
+	default:
+		l.extreme = b.lastPrice
+		if b.lastPrice.Sign() > 0 {
+			b.check(l, b.lastPrice)
+		}
+	}
+}
+
+// trigger は約定価格で執行条件を確かめる
+func (b *Backtest) trigger(price bitflyer.Decimal) {
+	for _, pa := range b.parents {
+		if !pa.active() {
+			continue
+		}
+		for _, l := range pa.legs {
+			if l.state == legArmed {
+				b.check(l, price)
+			}
+		}
+	}
+}
+
+func (b *Backtest) check(l *leg, price bitflyer.Decimal) {
+	p := l.param
+	buy := p.Side == bitflyer.SideBuy
+	switch p.ConditionType {
+	case bitflyer.ConditionStop, bitflyer.ConditionStopLimit:
+		if c := price.Cmp(p.TriggerPrice); (buy && c < 0) || (!buy && c > 0) {
+			return
+		}
+		if p.ConditionType == bitflyer.ConditionStop {
+			b.placeLeg(l, bitflyer.OrderTypeMarket, bitflyer.Decimal{})
+		} else {
+			b.placeLeg(l, bitflyer.OrderTypeLimit, p.Price)
+		}
+	case bitflyer.ConditionTrail:
+		offset := bitflyer.NewDecimalFromInt(int64(p.Offset))
+		if buy {
+			if price.Cmp(l.extreme) < 0 {
+				l.extreme = price
+			}
+			if price.Cmp(l.extreme.Add(offset)) >= 0 {
+				b.placeLeg(l, bitflyer.OrderTypeMarket, bitflyer.Decimal{})
+			}
+		} else {
+			if price.Cmp(l.extreme) > 0 {
+				l.extreme = price
+			}
+			if price.Cmp(l.extreme.Sub(offset)) <= 0 {
+				b.placeLeg(l, bitflyer.OrderTypeMarket, bitflyer.Decimal{})
+			}
+		}
+	}
+}
+
+func (b *Backtest) placeLeg(l *leg, typ bitflyer.OrderType, price bitflyer.Decimal) {
+	pa := l.parent
+	o := b.place(&bitflyer.Childorder{
+		ProductCode:    b.ProductCode,
+		ChildOrderType: typ,
+		Side:           l.param.Side,
+		Price:          price,
+		Size:           l.param.Size,
+		TimeInForce:    pa.tif,
+	}, 0)
+	o.ExpireDate = bitflyer.Time{Time: pa.expire}
+	o.leg = l
+	l.child = o
+	l.state = legPlaced
+	b.activate(o)
+}
+
+// legFilled は子注文が約定したか取り消されたときに呼ばれ、次の注文の監視とOCOの取消を行う
+func (b *Backtest) legFilled(l *leg) {
+	pa, o := l.parent, l.child
+	// 取り消された注文が一部約定していても、もう一方は取り消さない
+	filled := o.ExecutedSize.Sign() > 0 && (o.ChildOrderState == bitflyer.StateActive || o.ChildOrderState == bitflyer.StateCompleted)
+	if sib := pa.ocoSibling(l); sib != nil && filled && sib.state != legDone {
+		b.cancelLeg(sib)
+	}
+	if o.ChildOrderState == bitflyer.StateActive {
+		return
+	}
+
+	l.state = legDone
+	if l.index == 0 && (pa.method == bitflyer.MethodIFD || pa.method == bitflyer.MethodIFDOCO) {
+		for _, next := range pa.legs[1:] {
+			if o.ChildOrderState == bitflyer.StateCompleted {
+				b.arm(next)
+			} else {
+				next.state = legDone
+			}
+		}
+	}
+	b.updateParent(pa)
+}
+
+func (b *Backtest) cancelLeg(l *leg) {
+	if l.state == legPlaced && l.child.ChildOrderState == bitflyer.StateActive {
+		b.exchange().Cancel(l.child.PaperOrder)
+		return
+	}
+	l.state = legDone
+}
+
+// updateParent はすべての注文が終わった親注文を完了にする
+func (b *Backtest) updateParent(pa *parent) {
+	if pa.state != bitflyer.StateActive {
+		return
+	}
+	for _, l := range pa.legs {
+		if l.state != legDone {
+			return
+		}
+	}
+	pa.state = bitflyer.StateCompleted
+}
+
+func (b *Backtest) cancelParent(pa *parent, state bitflyer.OrderState) {
+	pa.state = state
+	pa.pending = false
+	for _, l := range pa.legs {
+		if l.state != legDone {
+			b.cancelLeg(l)
+		}
+	}
+}
+
+// ** bitflyer.ParentTrader
+func (b *Backtest) SendParentrder(ctx context.Context, po *bitflyer.Parentorder) (*bitflyer.ParentOrderAcceptanceID, error) {
+	if err := po.Validate(); err != nil {
+		return nil, err
+	}
+	for _, p := range po.Parameters {
+		if err := b.checkProduct(p.ProductCode); err != nil {
+			return nil, err
+		}
+	}
+
+	expire := po.MinuteToExpire
+	if expire == 0 {
+		expire = 43200
+	}
+	id := b.exchange().NewID()
+	pa := &parent{
+		id:           id,
+		acceptanceID: fmt.Sprintf("BT-JRP-%06d", id),
+		orderID:      fmt.Sprintf("BT-JCP-%06d", id),
+		method:       po.OrderMethod,
+		tif:          po.TimeInForce,
+		state:        bitflyer.StateActive,
+		date:         b.now,
+		expire:       b.now.Add(time.Duration(expire) * time.Minute),
+		pending:      true,
+		activeAt:     b.now.Add(b.latency()),
+	}
+	for i, p := range po.Parameters {
+		pa.legs = append(pa.legs, &leg{parent: pa, index: i, param: p})
+	}
+	b.parents = append(b.parents, pa)
+	if !pa.activeAt.After(b.now) {
+		b.activateParent(pa)
+	}
+
+	return &bitflyer.ParentOrderAcceptanceID{ParentOrderAcceptanceID: pa.acceptanceID}, nil
+}
+
+func (b *Backtest) findParent(parentOrderID, parentOrderAcceptanceID string) *parent {
+	for _, pa := range b.parents {
+		if (parentOrderID != "" && pa.orderID == parentOrderID) ||
+			(parentOrderAcceptanceID != "" && pa.acceptanceID == parentOrderAcceptanceID) {
+			return pa
+		}
+	}
+	return nil
+}
+
+func (b *Backtest) CancelParentorder(ctx context.Context, po *bitflyer.Parentorder) error {
+	pa := b.findParent(po.ParentOrderID, po.ParentOrderAcceptanceID)
+	if pa == nil || pa.state != bitflyer.StateActive {
+		return notFound()
+	}
+	pa.cancelAt = b.now.Add(b.latency())
+	if pa.active() && !pa.cancelAt.After(b.now) {
+		b.cancelParent(pa, bitflyer.StateCanceled)
+	}
+	return nil
+}
+
+func (b *Backtest) GetMyParentorders(ctx context.Context, productCode string, page *bitflyer.Page, parentOrderState bitflyer.OrderState) (*bitflyer.Parentorders, error) {
+	data := bitflyer.Parentorders{}
+	for i := len(b.parents) - 1; i >= 0 && len(data) < page.Limit(); i-- {
+		pa := b.parents[i]
+		if pa.pending || (productCode != "" && productCode != b.ProductCode) ||
+			(parentOrderState != "" && pa.state != parentOrderState) || !page.Contains(pa.id) {
+			continue
+		}
+		data = append(data, pa.info(b.ProductCode))
+	}
+	return &data, nil
+}
+
+func (b *Backtest) GetMyParentorder(ctx context.Context, parentOrderID, parentOrderAcceptanceID string) (*bitflyer.Parentorders, error) {
+	pa := b.findParent(parentOrderID, parentOrderAcceptanceID)
+	if pa == nil || pa.pending {
+		return nil, notFound()
+	}
+	return &bitflyer.Parentorders{pa.info(b.ProductCode)}, nil
+}
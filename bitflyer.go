@@ -5,21 +5,17 @@ package bitflyer
 import (
 	"bytes"
 	"context"
-	"crypto/hmac"
-	"crypto/sha256"
-	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"net/http"
 	"net/url"
 	"path"
 	"strconv"
 	"strings"
-	"time"
 )
 
 const (
@@ -32,11 +28,26 @@ type Client struct {
 	HTTPClient *http.Client
 	APIKey     string
 	APISecret  string
+	// 設定するとAPIKey/APISecretの代わりに使う
+	Credentials CredentialsProvider
+	Signer      Signer
+	// nilならログを出さない
+	Logger Logger
+	// デコードと署名の間に挟むミドルウェア。先頭が外側
+	Middleware []Middleware
+	// nilなら集計しない
+	Metrics *Metrics
+	// nilならスパンを作らない
+	Tracer Tracer
+	// nilなら呼び出し回数を制限しない
+	RateLimiter *RateLimiter
+	// nilならリトライしない
+	RetryPolicy *RetryPolicy
 }
 
 func NewClient(apikey, apisecret string) *Client {
 	u := &url.URL{Scheme: "https", Host: BITFLYER_HOST, Path: fmt.Sprintf("/%s", API_VERSION)}
-	c := Client{URL: u, HTTPClient: &http.Client{}, APIKey: apikey, APISecret: apisecret}
+	c := Client{URL: u, HTTPClient: &http.Client{}, APIKey: apikey, APISecret: apisecret, RetryPolicy: DefaultRetryPolicy()}
 
 	return &c
 }
@@ -59,11 +70,23 @@ func (p *Page) setPage(v url.Values) {
 	}
 }
 
+// Contains はBeforeとAfterの範囲にidが入るか。nilならすべて入る
+func (p *Page) Contains(id int) bool {
+	return p == nil || ((p.Before == 0 || id < p.Before) && (p.After == 0 || id > p.After))
+}
+
+// Limit は1回に返す件数。nilかCountが0なら取引所の既定の100
+func (p *Page) Limit() int {
+	if p == nil || p.Count <= 0 {
+		return 100
+	}
+	return p.Count
+}
+
 func (c *Client) newRequest(ctx context.Context, method, spath string, values url.Values, body io.Reader) (*http.Request, error) {
 	u := *c.URL
 	u.Path = path.Join(c.URL.Path, spath)
 	u.RawQuery = values.Encode()
-	log.Printf("[request URL] %#v\n", u.String())
 
 	req, err := http.NewRequest(method, u.String(), body)
 	if err != nil {
@@ -76,49 +99,81 @@ func (c *Client) newRequest(ctx context.Context, method, spath string, values ur
 }
 
 func (c *Client) newPrivateRequest(ctx context.Context, method, spath string, values url.Values, body io.Reader) (*http.Request, error) {
-	req, err := c.newRequest(ctx, method, spath, values, body)
-	if err != nil {
-		return nil, err
-	}
-
 	var bodyText string
 	if body != nil {
-		bodyBytes, _ := ioutil.ReadAll(body)
+		bodyBytes, err := ioutil.ReadAll(body)
+		if err != nil {
+			return nil, err
+		}
 		bodyText = string(bodyBytes)
-	} else {
-		bodyText = ""
 	}
-	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
-	sign := c.createHMAC(timestamp+method+path.Join(c.URL.Path, spath)+bodyText, c.APISecret)
-	req.Header.Set("ACCESS-KEY", c.APIKey)
-	req.Header.Set("ACCESS-TIMESTAMP", timestamp)
-	req.Header.Set("ACCESS-SIGN", sign)
+	req, err := c.newRequest(ctx, method, spath, values, strings.NewReader(bodyText))
+	if err != nil {
+		return nil, err
+	}
+	// 署名はSignMiddlewareで送る直前に行う
 	req.Header.Set("Content-Type", "application/json")
 
 	return req, nil
 }
 
-func (c *Client) createHMAC(msg, key string) string {
-	mac := hmac.New(sha256.New, []byte(key))
-	mac.Write([]byte(msg))
-	return hex.EncodeToString(mac.Sum(nil))
+// endpoint はリクエストのAPIバージョン以下のパス ("board", "me/sendchildorder" など)
+func (c *Client) endpoint(req *http.Request) string {
+	return strings.TrimPrefix(strings.TrimPrefix(req.URL.Path, c.URL.Path), "/")
 }
 
 func (c *Client) getResponse(req *http.Request, data interface{}) error {
-	res, err := c.HTTPClient.Do(req)
-	defer res.Body.Close()
-	if err != nil {
-		return err
-	} else if res.StatusCode != http.StatusOK {
-		return errors.New(fmt.Sprintf("status code: %d", res.StatusCode))
+	if c.Tracer == nil {
+		return c.retryRequest(req, data)
 	}
 
-	if data != nil {
-		dec := json.NewDecoder(res.Body)
-		return dec.Decode(data)
-	} else {
-		return nil
-	}
+	req, span := c.startSpan(req)
+	err := c.retryRequest(req, data)
+	endSpan(span, err)
+
+	return err
+}
+
+func (c *Client) retryRequest(req *http.Request, data interface{}) error {
+	policy, check := c.retryPolicyFor(req)
+	for attempt := 1; ; attempt++ {
+		err := c.doRequest(req, data)
+		if err == nil || policy == nil || attempt >= policy.MaxAttempts ||
+			req.Context().Err() != nil || !policy.retryable(err) {
+			return err
+		}
+
+		delay := policy.backoff(attempt)
+		if e, ok := asAPIError(err); ok && e.RetryAfter > delay {
+			// MaxDelayより長く待てと言われたら諦める
+			if e.RetryAfter > policy.MaxDelay {
+				return err
+			}
+			delay = e.RetryAfter
+		}
+		c.log(req.Context(), slog.LevelInfo, "bitflyer: retrying",
+			"method", req.Method, "path", c.endpoint(req), "attempt", attempt, "delay", delay, "error", err)
+		if err := sleepContext(req.Context(), delay); err != nil {
+			return err
+		}
+		if check != nil {
+			applied, cerr := check(req.Context())
+			if cerr != nil {
+				return err
+			}
+			if applied {
+				return ErrAlreadyApplied
+			}
+		}
+		if req, err = rewindRequest(req); err != nil {
+			return err
+		}
+	}
+}
+
+func (c *Client) doRequest(req *http.Request, data interface{}) error {
+	_, err := c.handler()(&Call{Request: req, Endpoint: c.endpoint(req), Result: data})
+	return err
 }
 
 /*
@@ -165,15 +220,13 @@ func (c *Client) GetMarkets(ctx context.Context) (*Markets, error) {
 
 // ** 板情報
 type Board struct {
-	MidPrice float64 `json:"mid_price"`
-	Bids     []struct {
-		Price float64 `json:"price"`
-		Size  float64 `json:"size"`
-	} `json:"bids"`
-	Asks []struct {
-		Price float64 `json:"price"`
-		Size  float64 `json:"size"`
-	} `json:"asks"`
+	MidPrice Decimal      `json:"mid_price"`
+	Bids     []PriceLevel `json:"bids"`
+	Asks     []PriceLevel `json:"asks"`
+}
+type PriceLevel struct {
+	Price Decimal `json:"price"`
+	Size  Decimal `json:"size"`
 }
 
 func (c *Client) GetBoard(ctx context.Context, productCode string) (*Board, error) {
@@ -198,17 +251,17 @@ func (c *Client) GetBoard(ctx context.Context, productCode string) (*Board, erro
 // ** Ticker
 type Ticker struct {
 	ProductCode     string  `json:"product_code"`
-	Timestamp       string  `json:"timestamp"`
+	Timestamp       Time    `json:"timestamp"`
 	TickID          int     `json:"tick_id"`
-	BestBid         float64 `json:"best_bid"`
-	BestAsk         float64 `json:"best_ask"`
-	BestBidSize     float64 `json:"best_bid_size"`
-	BestAskSize     float64 `json:"best_ask_size"`
-	TotalBidDepth   float64 `json:"total_bid_depth"`
-	TotalAskDepth   float64 `json:"total_ask_depth"`
-	Ltp             float64 `json:"ltp"`
-	Volume          float64 `json:"volume"`
-	VolumeByProduct float64 `json:"volume_by_product"`
+	BestBid         Decimal `json:"best_bid"`
+	BestAsk         Decimal `json:"best_ask"`
+	BestBidSize     Decimal `json:"best_bid_size"`
+	BestAskSize     Decimal `json:"best_ask_size"`
+	TotalBidDepth   Decimal `json:"total_bid_depth"`
+	TotalAskDepth   Decimal `json:"total_ask_depth"`
+	Ltp             Decimal `json:"ltp"`
+	Volume          Decimal `json:"volume"`
+	VolumeByProduct Decimal `json:"volume_by_product"`
 }
 
 func (c *Client) GetTicker(ctx context.Context, productCode string) (*Ticker, error) {
@@ -230,14 +283,15 @@ func (c *Client) GetTicker(ctx context.Context, productCode string) (*Ticker, er
 }
 
 // ** 約定履歴
-type Executions []struct {
+type Executions []Execution
+type Execution struct {
 	ID                         int     `json:"id"`
 	ChildOrderID               string  `json:"child_order_id"`
-	Side                       string  `json:"side"`
-	Price                      float64 `json:"price"`
-	Size                       float64 `json:"size"`
-	Commission                 int     `json:"commission"`
-	ExecDate                   string  `json:"exec_date"`
+	Side                       Side    `json:"side"`
+	Price                      Decimal `json:"price"`
+	Size                       Decimal `json:"size"`
+	Commission                 Decimal `json:"commission"`
+	ExecDate                   Time    `json:"exec_date"`
 	BuyChildOrderAcceptanceID  string  `json:"buy_child_order_acceptance_id"`
 	SellChildOrderAcceptanceID string  `json:"sell_child_order_acceptance_id"`
 	ChildOrderAcceptanceID     string  `json:"child_order_acceptance_id"`
@@ -287,7 +341,7 @@ func (c *Client) GetHealth(ctx context.Context) (*Status, error) {
 type Chats []struct {
 	Nickname string `json:"nickname"`
 	Message  string `json:"message"`
-	Date     string `json:"date"`
+	Date     Time   `json:"date"`
 }
 
 func (c *Client) GetChats(ctx context.Context, fromDate string) (*Chats, error) {
@@ -331,8 +385,8 @@ func (c *Client) GetMyPermissions(ctx context.Context) (*Permissions, error) {
 // *** 資産残高を取得
 type Balance []struct {
 	CurrencyCode string  `json:"currency_code"`
-	Amount       float64 `json:"amount"`
-	Available    float64 `json:"available"`
+	Amount       Decimal `json:"amount"`
+	Available    Decimal `json:"available"`
 }
 
 func (c *Client) GetMyBalance(ctx context.Context) (*Balance, error) {
@@ -351,9 +405,9 @@ func (c *Client) GetMyBalance(ctx context.Context) (*Balance, error) {
 
 // *** 証拠金の状態を取得
 type Collateral struct {
-	Collateral        int     `json:"collateral"`
-	OpenPositionPnl   int     `json:"open_position_pnl"`
-	RequireCollateral int     `json:"require_collateral"`
+	Collateral        Decimal `json:"collateral"`
+	OpenPositionPnl   Decimal `json:"open_position_pnl"`
+	RequireCollateral Decimal `json:"require_collateral"`
 	KeepRate          float64 `json:"keep_rate"`
 }
 
@@ -394,15 +448,16 @@ func (c *Client) GetMyAddress(ctx context.Context) (*Address, error) {
 }
 
 // *** ビットコイン・イーサ預入履歴
-type Coinins []struct {
+type Coinins []Coinin
+type Coinin struct {
 	ID           int     `json:"id"`
 	OrderID      string  `json:"order_id"`
 	CurrencyCode string  `json:"currency_code"`
-	Amount       float64 `json:"amount"`
+	Amount       Decimal `json:"amount"`
 	Address      string  `json:"address"`
 	TxHash       string  `json:"tx_hash"`
 	Status       string  `json:"status"`
-	EventDate    string  `json:"event_date"`
+	EventDate    Time    `json:"event_date"`
 }
 
 func (c *Client) GetMyCoinins(ctx context.Context, page *Page) (*Coinins, error) {
@@ -424,17 +479,18 @@ func (c *Client) GetMyCoinins(ctx context.Context, page *Page) (*Coinins, error)
 }
 
 // *** ビットコイン・イーサ送付履歴
-type Coinouts []struct {
+type Coinouts []Coinout
+type Coinout struct {
 	ID            int     `json:"id"`
 	OrderID       string  `json:"order_id"`
 	CurrencyCode  string  `json:"currency_code"`
-	Amount        float64 `json:"amount"`
+	Amount        Decimal `json:"amount"`
 	Address       string  `json:"address"`
 	TxHash        string  `json:"tx_hash"`
-	Fee           float64 `json:"fee"`
-	AdditionalFee float64 `json:"additional_fee"`
+	Fee           Decimal `json:"fee"`
+	AdditionalFee Decimal `json:"additional_fee"`
 	Status        string  `json:"status"`
-	EventDate     string  `json:"event_date"`
+	EventDate     Time    `json:"event_date"`
 }
 
 func (c *Client) GetMyCoinouts(ctx context.Context, page *Page, messageID string) (*Coinouts, error) {
@@ -470,7 +526,7 @@ type BankAccounts []struct {
 }
 
 func (c *Client) GetMyBankAccounts(ctx context.Context) (*BankAccounts, error) {
-	req, err := c.newPrivateRequest(ctx, "GET", "me/getcoinins", nil, nil)
+	req, err := c.newPrivateRequest(ctx, "GET", "me/getbankaccounts", nil, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -484,13 +540,14 @@ func (c *Client) GetMyBankAccounts(ctx context.Context) (*BankAccounts, error) {
 }
 
 // *** 入金履歴
-type Deposits []struct {
-	ID           int    `json:"id"`
-	OrderID      string `json:"order_id"`
-	CurrencyCode string `json:"currency_code"`
-	Amount       int    `json:"amount"`
-	Status       string `json:"status"`
-	EventDate    string `json:"event_date"`
+type Deposits []Deposit
+type Deposit struct {
+	ID           int     `json:"id"`
+	OrderID      string  `json:"order_id"`
+	CurrencyCode string  `json:"currency_code"`
+	Amount       Decimal `json:"amount"`
+	Status       string  `json:"status"`
+	EventDate    Time    `json:"event_date"`
 }
 
 func (c *Client) GetMyDeposits(ctx context.Context, page *Page) (*Deposits, error) {
@@ -513,10 +570,10 @@ func (c *Client) GetMyDeposits(ctx context.Context, page *Page) (*Deposits, erro
 
 // *** 出金
 type Withdraw struct {
-	CurrencyCode  string `json:"currency_code"`
-	BankAccountID int    `json:"bank_account_id"`
-	Amount        int    `json:"amount"`
-	Code          string `json:"code"`
+	CurrencyCode  string  `json:"currency_code"`
+	BankAccountID int     `json:"bank_account_id"`
+	Amount        Decimal `json:"amount"`
+	Code          string  `json:"code"`
 }
 type WithdrawResponse struct {
 	MessageID    string      `json:"message_id"`
@@ -544,13 +601,14 @@ func (c *Client) Withdraw(ctx context.Context, wd *Withdraw) (*WithdrawResponse,
 }
 
 // *** 出金履歴
-type Withdrawals []struct {
-	ID           int    `json:"id"`
-	OrderID      string `json:"order_id"`
-	CurrencyCode string `json:"currency_code"`
-	Amount       int    `json:"amount"`
-	Status       string `json:"status"`
-	EventDate    string `json:"event_date"`
+type Withdrawals []Withdrawal
+type Withdrawal struct {
+	ID           int     `json:"id"`
+	OrderID      string  `json:"order_id"`
+	CurrencyCode string  `json:"currency_code"`
+	Amount       Decimal `json:"amount"`
+	Status       string  `json:"status"`
+	EventDate    Time    `json:"event_date"`
 }
 
 func (c *Client) GetMyWithdrawals(ctx context.Context, page *Page, messageID string) (*Withdrawals, error) {
@@ -577,21 +635,24 @@ func (c *Client) GetMyWithdrawals(ctx context.Context, page *Page, messageID str
 // ** トレード
 // *** 新規注文を出す
 type Childorder struct {
-	ProductCode            string  `json:"product_code"`
-	ChildOrderType         string  `json:"child_order_type"`
-	Side                   string  `json:"side"`
-	Price                  float64 `json:"price"`
-	Size                   float64 `json:"size"`
-	MinuteToExpire         int     `json:"minute_to_expire"`
-	TimeInForce            string  `json:"time_in_force"`
-	ChildOrderID           string  `json:"child_order_id"`
-	ChildOrderAcceptanceID string  `json:"child_order_acceptance_id"`
+	ProductCode            string      `json:"product_code"`
+	ChildOrderType         OrderType   `json:"child_order_type"`
+	Side                   Side        `json:"side"`
+	Price                  Decimal     `json:"price"`
+	Size                   Decimal     `json:"size"`
+	MinuteToExpire         int         `json:"minute_to_expire"`
+	TimeInForce            TimeInForce `json:"time_in_force"`
+	ChildOrderID           string      `json:"child_order_id"`
+	ChildOrderAcceptanceID string      `json:"child_order_acceptance_id"`
 }
 type ChildOrderAcceptanceID struct {
 	ChildOrderAcceptanceID string `json:"child_order_acceptance_id"`
 }
 
 func (c *Client) SendChildorder(ctx context.Context, ch *Childorder) (*ChildOrderAcceptanceID, error) {
+	if err := ch.Validate(); err != nil {
+		return nil, err
+	}
 	body, err := json.Marshal(&ch)
 	if err != nil {
 		return nil, err
@@ -627,27 +688,31 @@ func (c *Client) CancelChildorder(ctx context.Context, ch *Childorder) error {
 
 // *** 新規の親注文を出す（特殊注文）
 type Parentorder struct {
-	ID             int    `json:"id"`
-	ParentOrderID  string `json:"parent_order_id"`
-	OrderMethod    string `json:"order_method"`
-	MinuteToExpire int    `json:"minute_to_expire"`
-	TimeInForce    string `json:"time_in_force"`
-	Parameters     []struct {
-		ProductCode   string  `json:"product_code"`
-		ConditionType string  `json:"condition_type"`
-		Side          string  `json:"side"`
-		Price         float64 `json:"price"`
-		Size          float64 `json:"size"`
-		TriggerPrice  int     `json:"trigger_price,omitempty"`
-		Offset        int     `json:"offset"`
-	} `json:"parameters"`
-	ParentOrderAcceptanceID string `json:"parent_order_acceptance_id"`
+	ID                      int                    `json:"id"`
+	ParentOrderID           string                 `json:"parent_order_id"`
+	OrderMethod             OrderMethod            `json:"order_method"`
+	MinuteToExpire          int                    `json:"minute_to_expire"`
+	TimeInForce             TimeInForce            `json:"time_in_force"`
+	Parameters              []ParentorderParameter `json:"parameters"`
+	ParentOrderAcceptanceID string                 `json:"parent_order_acceptance_id"`
+}
+type ParentorderParameter struct {
+	ProductCode   string        `json:"product_code"`
+	ConditionType ConditionType `json:"condition_type"`
+	Side          Side          `json:"side"`
+	Price         Decimal       `json:"price"`
+	Size          Decimal       `json:"size"`
+	TriggerPrice  Decimal       `json:"trigger_price,omitzero"`
+	Offset        int           `json:"offset"`
 }
 type ParentOrderAcceptanceID struct {
 	ParentOrderAcceptanceID string `json:"parent_order_acceptance_id"`
 }
 
 func (c *Client) SendParentrder(ctx context.Context, pa *Parentorder) (*ParentOrderAcceptanceID, error) {
+	if err := pa.Validate(); err != nil {
+		return nil, err
+	}
 	body, err := json.Marshal(&pa)
 	if err != nil {
 		return nil, err
@@ -683,8 +748,11 @@ func (c *Client) CancelParentorder(ctx context.Context, pa *Parentorder) error {
 
 // *** すべての注文をキャンセルする
 func (c *Client) CancelAllChildorder(ctx context.Context, productCode string) error {
-	body := `{"product_code": "' + productCode + '"}`
-	req, err := c.newPrivateRequest(ctx, "POST", "me/cancelallchildorder", nil, strings.NewReader(body))
+	body, err := json.Marshal(map[string]string{"product_code": productCode})
+	if err != nil {
+		return err
+	}
+	req, err := c.newPrivateRequest(ctx, "POST", "me/cancelallchildorder", nil, bytes.NewReader(body))
 	if err != nil {
 		return err
 	}
@@ -695,26 +763,27 @@ func (c *Client) CancelAllChildorder(ctx context.Context, productCode string) er
 }
 
 // *** 注文の一覧を取得
-type Childorders []struct {
-	ID                     int     `json:"id"`
-	ChildOrderID           string  `json:"child_order_id"`
-	ProductCode            string  `json:"product_code"`
-	Side                   string  `json:"side"`
-	ChildOrderType         string  `json:"child_order_type"`
-	Price                  float64 `json:"price"`
-	AveragePrice           float64 `json:"average_price"`
-	Size                   float64 `json:"size"`
-	ChildOrderState        string  `json:"child_order_state"`
-	ExpireDate             string  `json:"expire_date"`
-	ChildOrderDate         string  `json:"child_order_date"`
-	ChildOrderAcceptanceID string  `json:"child_order_acceptance_id"`
-	OutstandingSize        float64 `json:"outstanding_size"`
-	CancelSize             float64 `json:"cancel_size"`
-	ExecutedSize           float64 `json:"executed_size"`
-	TotalCommission        int     `json:"total_commission"`
-}
-
-func (c *Client) GetMyChildorders(ctx context.Context, productCode string, page *Page, childOrderState, parentOrderID string) (*Childorders, error) {
+type Childorders []ChildorderInfo
+type ChildorderInfo struct {
+	ID                     int        `json:"id"`
+	ChildOrderID           string     `json:"child_order_id"`
+	ProductCode            string     `json:"product_code"`
+	Side                   Side       `json:"side"`
+	ChildOrderType         OrderType  `json:"child_order_type"`
+	Price                  Decimal    `json:"price"`
+	AveragePrice           Decimal    `json:"average_price"`
+	Size                   Decimal    `json:"size"`
+	ChildOrderState        OrderState `json:"child_order_state"`
+	ExpireDate             Time       `json:"expire_date"`
+	ChildOrderDate         Time       `json:"child_order_date"`
+	ChildOrderAcceptanceID string     `json:"child_order_acceptance_id"`
+	OutstandingSize        Decimal    `json:"outstanding_size"`
+	CancelSize             Decimal    `json:"cancel_size"`
+	ExecutedSize           Decimal    `json:"executed_size"`
+	TotalCommission        Decimal    `json:"total_commission"`
+}
+
+func (c *Client) GetMyChildorders(ctx context.Context, productCode string, page *Page, childOrderState OrderState, parentOrderID string) (*Childorders, error) {
 	v := url.Values{}
 	if productCode != "" {
 		v.Set("product_code", productCode)
@@ -723,7 +792,7 @@ func (c *Client) GetMyChildorders(ctx context.Context, productCode string, page
 		page.setPage(v)
 	}
 	if childOrderState != "" {
-		v.Set("child_order_state", childOrderState)
+		v.Set("child_order_state", string(childOrderState))
 	}
 	if parentOrderID != "" {
 		v.Set("parent_order_id", parentOrderID)
@@ -741,27 +810,52 @@ func (c *Client) GetMyChildorders(ctx context.Context, productCode string, page
 	return &data, nil
 }
 
+// GetMyChildorder は注文IDか受付IDで注文を1件引く。一覧の件数に関わらず見つかり、なければ空の配列を返す
+func (c *Client) GetMyChildorder(ctx context.Context, productCode, childOrderID, childOrderAcceptanceID string) (*Childorders, error) {
+	v := url.Values{}
+	v.Set("product_code", productCode)
+	if childOrderID != "" {
+		v.Set("child_order_id", childOrderID)
+	} else if childOrderAcceptanceID != "" {
+		v.Set("child_order_acceptance_id", childOrderAcceptanceID)
+	} else {
+		return nil, errors.New("nothing parameter")
+	}
+	req, err := c.newPrivateRequest(ctx, "GET", "me/getchildorders", v, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var data Childorders
+	if err := c.getResponse(req, &data); err != nil {
+		return nil, err
+	}
+
+	return &data, nil
+}
+
 // *** 親注文の一覧を取得
-type Parentorders []struct {
-	ID                      int     `json:"id"`
-	ParentOrderID           string  `json:"parent_order_id"`
-	ProductCode             string  `json:"product_code"`
-	Side                    string  `json:"side"`
-	ParentOrderType         string  `json:"parent_order_type"`
-	Price                   float64 `json:"price"`
-	AveragePrice            float64 `json:"average_price"`
-	Size                    float64 `json:"size"`
-	ParentOrderState        string  `json:"parent_order_state"`
-	ExpireDate              string  `json:"expire_date"`
-	ParentOrderDate         string  `json:"parent_order_date"`
-	ParentOrderAcceptanceID string  `json:"parent_order_acceptance_id"`
-	OutstandingSize         float64 `json:"outstanding_size"`
-	CancelSize              float64 `json:"cancel_size"`
-	ExecutedSize            float64 `json:"executed_size"`
-	TotalCommission         int     `json:"total_commission"`
-}
-
-func (c *Client) GetMyParentorders(ctx context.Context, productCode string, page *Page, parentOrderState string) (*Parentorders, error) {
+type Parentorders []ParentorderInfo
+type ParentorderInfo struct {
+	ID                      int        `json:"id"`
+	ParentOrderID           string     `json:"parent_order_id"`
+	ProductCode             string     `json:"product_code"`
+	Side                    Side       `json:"side"`
+	ParentOrderType         string     `json:"parent_order_type"`
+	Price                   Decimal    `json:"price"`
+	AveragePrice            Decimal    `json:"average_price"`
+	Size                    Decimal    `json:"size"`
+	ParentOrderState        OrderState `json:"parent_order_state"`
+	ExpireDate              Time       `json:"expire_date"`
+	ParentOrderDate         Time       `json:"parent_order_date"`
+	ParentOrderAcceptanceID string     `json:"parent_order_acceptance_id"`
+	OutstandingSize         Decimal    `json:"outstanding_size"`
+	CancelSize              Decimal    `json:"cancel_size"`
+	ExecutedSize            Decimal    `json:"executed_size"`
+	TotalCommission         Decimal    `json:"total_commission"`
+}
+
+func (c *Client) GetMyParentorders(ctx context.Context, productCode string, page *Page, parentOrderState OrderState) (*Parentorders, error) {
 	v := url.Values{}
 	if productCode != "" {
 		v.Set("product_code", productCode)
@@ -770,7 +864,7 @@ func (c *Client) GetMyParentorders(ctx context.Context, productCode string, page
 		page.setPage(v)
 	}
 	if parentOrderState != "" {
-		v.Set("parent_order_state", parentOrderState)
+		v.Set("parent_order_state", string(parentOrderState))
 	}
 	req, err := c.newPrivateRequest(ctx, "GET", "me/getparentorders", v, nil)
 	if err != nil {
@@ -836,7 +930,7 @@ type Executions []struct {
 	Price                  float64 `json:"price"`
 	Size                   float64 `json:"size"`
 	Commission             int     `json:"commission"`
-	ExecDate               string  `json:"exec_date"`
+	ExecDate               Time    `json:"exec_date"`
 	ChildOrderAcceptanceID string  `json:"child_order_acceptance_id"`
 }
 */
@@ -871,15 +965,15 @@ func (c *Client) GetMyExecutions(ctx context.Context, productCode string, page *
 // *** 建玉の一覧を取得
 type Positions []struct {
 	ProductCode         string  `json:"product_code"`
-	Side                string  `json:"side"`
-	Price               float64 `json:"price"`
-	Size                float64 `json:"size"`
-	Commission          int     `json:"commission"`
-	SwapPointAccumulate int     `json:"swap_point_accumulate"`
-	RequireCollateral   int     `json:"require_collateral"`
-	OpenDate            string  `json:"open_date"`
+	Side                Side    `json:"side"`
+	Price               Decimal `json:"price"`
+	Size                Decimal `json:"size"`
+	Commission          Decimal `json:"commission"`
+	SwapPointAccumulate Decimal `json:"swap_point_accumulate"`
+	RequireCollateral   Decimal `json:"require_collateral"`
+	OpenDate            Time    `json:"open_date"`
 	Leverage            int     `json:"leverage"`
-	Pnl                 int     `json:"pnl"`
+	Pnl                 Decimal `json:"pnl"`
 }
 
 func (c *Client) GetMyPositions(ctx context.Context, productCode string) (*Positions, error) {
@@ -902,7 +996,7 @@ func (c *Client) GetMyPositions(ctx context.Context, productCode string) (*Posit
 
 // *** 取引手数料を取得
 type TradingCommission struct {
-	CommissionRate float64 `json:"commission_rate"`
+	CommissionRate Decimal `json:"commission_rate"`
 }
 
 func (c *Client) GetMyTradingCommission(ctx context.Context, productCode string) (*TradingCommission, error) {
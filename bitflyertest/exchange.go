@@ -0,0 +1,386 @@
+package bitflyertest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackpopper/bitflyer"
+)
+
+// * 取引所の状態
+// 注文の約定、残高、証拠金と建玉はbitflyer.PaperExchangeで計算する。
+// 注文は板と突き合わせて約定させ、約定した分だけ板を減らす。板を差し替えると残っている注文も突き合わせる
+
+type exchange struct {
+	markets        []string
+	boards         map[string]*bitflyer.Board
+	executions     map[string][]bitflyer.Execution // 新しい順
+	paper          *bitflyer.PaperExchange
+	parentorders   []*bitflyer.ParentorderInfo
+	withdrawals    []withdrawal // 新しい順
+	commissionRate bitflyer.Decimal
+	health         string
+	tickID         int
+}
+
+type withdrawal struct {
+	bitflyer.Withdrawal
+	messageID string
+}
+
+func newExchange() exchange {
+	markets := make([]string, 0, len(bitflyer.ProductSpecs))
+	for code := range bitflyer.ProductSpecs {
+		markets = append(markets, code)
+	}
+	sort.Strings(markets)
+
+	return exchange{
+		markets:    markets,
+		boards:     map[string]*bitflyer.Board{},
+		executions: map[string][]bitflyer.Execution{},
+		paper:      &bitflyer.PaperExchange{Account: bitflyer.NewPaperAccount(), FormatID: orderID},
+		health:     "NORMAL",
+	}
+}
+
+// ** テストから状態を設定する
+// SetBoard は板を差し替え、残っている注文を新しい板と突き合わせる
+func (s *Server) SetBoard(productCode string, b *bitflyer.Board) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	nb := &bitflyer.Board{
+		MidPrice: b.MidPrice,
+		Bids:     append([]bitflyer.PriceLevel(nil), b.Bids...),
+		Asks:     append([]bitflyer.PriceLevel(nil), b.Asks...),
+	}
+	sort.Slice(nb.Bids, func(i, j int) bool { return nb.Bids[i].Price.Cmp(nb.Bids[j].Price) > 0 })
+	sort.Slice(nb.Asks, func(i, j int) bool { return nb.Asks[i].Price.Cmp(nb.Asks[j].Price) < 0 })
+	if nb.MidPrice.IsZero() && len(nb.Bids) > 0 && len(nb.Asks) > 0 {
+		nb.MidPrice = midPrice(nb.Bids[0].Price, nb.Asks[0].Price)
+	}
+	s.boards[productCode] = nb
+	s.addMarket(productCode)
+
+	for _, o := range s.paper.Orders() {
+		if o.ProductCode == productCode && o.ChildOrderState == bitflyer.StateActive {
+			s.consume(nb, o.Side, s.paper.Match(o, nb))
+		}
+	}
+}
+
+// AddExecutions は約定履歴に加える。IDと日時がゼロ値なら振る
+func (s *Server) AddExecutions(productCode string, execs ...bitflyer.Execution) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, e := range execs {
+		if e.ID == 0 {
+			e.ID = s.newID()
+		}
+		if e.ExecDate.IsZero() {
+			e.ExecDate = bitflyer.Time{Time: time.Now().UTC()}
+		}
+		s.executions[productCode] = append([]bitflyer.Execution{e}, s.executions[productCode]...)
+	}
+	s.addMarket(productCode)
+}
+
+// SetBalance は通貨の残高を設定する。注文で拘束している分は利用可能額から除く
+func (s *Server) SetBalance(currencyCode string, amount bitflyer.Decimal) {
+	s.mu.Lock()
+	s.paper.Account.SetBalance(currencyCode, amount)
+	s.mu.Unlock()
+}
+
+// Balance は通貨の残高と利用可能額
+func (s *Server) Balance(currencyCode string) (amount, available bitflyer.Decimal) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.paper.Account.Balance(currencyCode)
+}
+
+func (s *Server) SetCollateral(amount bitflyer.Decimal) {
+	s.mu.Lock()
+	s.paper.Account.SetCollateral(amount)
+	s.mu.Unlock()
+}
+
+func (s *Server) SetCommissionRate(rate bitflyer.Decimal) {
+	s.mu.Lock()
+	s.commissionRate = rate
+	s.mu.Unlock()
+}
+
+// SetHealth はgethealthが返す状態 ("NORMAL", "STOP" など)
+func (s *Server) SetHealth(status string) {
+	s.mu.Lock()
+	s.health = status
+	s.mu.Unlock()
+}
+
+// Orders は受け付けた注文を古い順に返す
+func (s *Server) Orders() []bitflyer.ChildorderInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	paper := s.paper.Orders()
+	orders := make([]bitflyer.ChildorderInfo, len(paper))
+	for i, o := range paper {
+		orders[i] = o.ChildorderInfo
+	}
+	return orders
+}
+
+func (s *Server) addMarket(productCode string) {
+	for _, m := range s.markets {
+		if m == productCode {
+			return
+		}
+	}
+	s.markets = append(s.markets, productCode)
+}
+
+func (s *Server) newID() int {
+	return s.paper.NewID()
+}
+
+func (s *Server) board(productCode string) *bitflyer.Board {
+	b, ok := s.boards[productCode]
+	if !ok {
+		b = &bitflyer.Board{Bids: []bitflyer.PriceLevel{}, Asks: []bitflyer.PriceLevel{}}
+		s.boards[productCode] = b
+	}
+	return b
+}
+
+// ** エンドポイント
+func (s *Server) routes() map[string]handlerFunc {
+	empty := func(r *http.Request, body []byte) (interface{}, error) { return []struct{}{}, nil }
+
+	return map[string]handlerFunc{
+		"markets":                 s.getMarkets,
+		"board":                   s.getBoard,
+		"ticker":                  s.getTicker,
+		"executions":              s.getExecutions,
+		"gethealth":               s.getHealth,
+		"getchats":                empty,
+		"me/getpermissions":       s.getPermissions,
+		"me/getbalance":           s.getBalance,
+		"me/getcollateral":        s.getCollateral,
+		"me/getaddress":           empty,
+		"me/getcoinins":           empty,
+		"me/getcoinouts":          empty,
+		"me/getbankaccounts":      empty,
+		"me/getdeposits":          empty,
+		"me/withdraw":             s.withdraw,
+		"me/getwithdrawals":       s.getWithdrawals,
+		"me/sendchildorder":       s.sendChildorder,
+		"me/cancelchildorder":     s.cancelChildorder,
+		"me/sendparentorder":      s.sendParentorder,
+		"me/cancelparentorder":    s.cancelParentorder,
+		"me/cancelallchildorder":  s.cancelAllChildorder,
+		"me/getchildorders":       s.getChildorders,
+		"me/getparentorders":      s.getParentorders,
+		"me/getparentorder":       s.getParentorder,
+		"me/getexecutions":        s.getMyExecutions,
+		"me/getpositions":         s.getPositions,
+		"me/gettradingcommission": s.getTradingCommission,
+	}
+}
+
+// *** Public API
+func (s *Server) getMarkets(r *http.Request, body []byte) (interface{}, error) {
+	type market struct {
+		ProductCode string `json:"product_code"`
+	}
+	data := make([]market, len(s.markets))
+	for i, m := range s.markets {
+		data[i] = market{ProductCode: m}
+	}
+	return data, nil
+}
+
+func (s *Server) productCode(q url.Values) (string, error) {
+	code := q.Get("product_code")
+	if code == "" {
+		code = "BTC_JPY"
+	}
+	for _, m := range s.markets {
+		if m == code {
+			return code, nil
+		}
+	}
+	return "", badRequest("Invalid product_code")
+}
+
+func (s *Server) getBoard(r *http.Request, body []byte) (interface{}, error) {
+	code, err := s.productCode(r.URL.Query())
+	if err != nil {
+		return nil, err
+	}
+	return s.board(code), nil
+}
+
+func (s *Server) getTicker(r *http.Request, body []byte) (interface{}, error) {
+	code, err := s.productCode(r.URL.Query())
+	if err != nil {
+		return nil, err
+	}
+
+	b := s.board(code)
+	s.tickID++
+	t := bitflyer.Ticker{
+		ProductCode: code,
+		Timestamp:   bitflyer.Time{Time: time.Now().UTC()},
+		TickID:      s.tickID,
+		Ltp:         b.MidPrice,
+	}
+	if len(b.Bids) > 0 {
+		t.BestBid, t.BestBidSize = b.Bids[0].Price, b.Bids[0].Size
+	}
+	if len(b.Asks) > 0 {
+		t.BestAsk, t.BestAskSize = b.Asks[0].Price, b.Asks[0].Size
+	}
+	for _, l := range b.Bids {
+		t.TotalBidDepth = t.TotalBidDepth.Add(l.Size)
+	}
+	for _, l := range b.Asks {
+		t.TotalAskDepth = t.TotalAskDepth.Add(l.Size)
+	}
+	for i, e := range s.executions[code] {
+		if i == 0 {
+			t.Ltp = e.Price
+		}
+		t.Volume = t.Volume.Add(e.Size)
+	}
+	t.VolumeByProduct = t.Volume
+
+	return t, nil
+}
+
+func (s *Server) getExecutions(r *http.Request, body []byte) (interface{}, error) {
+	q := r.URL.Query()
+	code, err := s.productCode(q)
+	if err != nil {
+		return nil, err
+	}
+	return paginate(s.executions[code], q, func(e bitflyer.Execution) int { return e.ID }), nil
+}
+
+func (s *Server) getHealth(r *http.Request, body []byte) (interface{}, error) {
+	return bitflyer.Status{Status: s.health}, nil
+}
+
+// queryPage はクエリのcount, before, after
+func queryPage(q url.Values) *bitflyer.Page {
+	var p bitflyer.Page
+	p.Count, _ = strconv.Atoi(q.Get("count"))
+	p.Before, _ = strconv.Atoi(q.Get("before"))
+	p.After, _ = strconv.Atoi(q.Get("after"))
+	return &p
+}
+
+// paginate はIDの新しい順に並んだitemsにcount, before, afterを適用する
+func paginate[T any](items []T, q url.Values, id func(T) int) []T {
+	page := queryPage(q)
+	data := []T{}
+	for _, v := range items {
+		if len(data) >= page.Limit() {
+			break
+		}
+		if page.Contains(id(v)) {
+			data = append(data, v)
+		}
+	}
+	return data
+}
+
+// *** 資産
+func (s *Server) getPermissions(r *http.Request, body []byte) (interface{}, error) {
+	perms := []string{}
+	for endpoint := range s.handlers {
+		if strings.HasPrefix(endpoint, "me/") {
+			perms = append(perms, "/"+bitflyer.API_VERSION+"/"+endpoint)
+		}
+	}
+	sort.Strings(perms)
+	return perms, nil
+}
+
+func (s *Server) getBalance(r *http.Request, body []byte) (interface{}, error) {
+	return s.paper.Account.Balances(), nil
+}
+
+func (s *Server) getCollateral(r *http.Request, body []byte) (interface{}, error) {
+	mids := map[string]bitflyer.Decimal{}
+	for _, code := range s.paper.Account.PositionProductCodes() {
+		mids[code] = s.board(code).MidPrice
+	}
+	return s.paper.Account.Collateral(mids), nil
+}
+
+func (s *Server) withdraw(r *http.Request, body []byte) (interface{}, error) {
+	var wd bitflyer.Withdraw
+	if err := json.Unmarshal(body, &wd); err != nil {
+		return nil, badRequest(err.Error())
+	}
+	if wd.Amount.Sign() <= 0 {
+		return nil, badRequest("Invalid amount")
+	}
+	amount, available := s.paper.Account.Balance(wd.CurrencyCode)
+	if available.Cmp(wd.Amount) < 0 {
+		return nil, &Error{Status: bitflyer.StatusInsufficientFunds, Message: "Insufficient funds"}
+	}
+	s.paper.Account.SetBalance(wd.CurrencyCode, amount.Sub(wd.Amount))
+
+	id := s.newID()
+	messageID := fmt.Sprintf("%d", id)
+	s.withdrawals = append([]withdrawal{{
+		Withdrawal: bitflyer.Withdrawal{
+			ID:           id,
+			OrderID:      fmt.Sprintf("MWD%s-%06d", time.Now().UTC().Format("20060102"), id),
+			CurrencyCode: wd.CurrencyCode,
+			Amount:       wd.Amount,
+			Status:       "COMPLETED",
+			EventDate:    bitflyer.Time{Time: time.Now().UTC()},
+		},
+		messageID: messageID,
+	}}, s.withdrawals...)
+
+	return bitflyer.WithdrawResponse{MessageID: messageID}, nil
+}
+
+func (s *Server) getWithdrawals(r *http.Request, body []byte) (interface{}, error) {
+	q := r.URL.Query()
+	data := []bitflyer.Withdrawal{}
+	for _, w := range s.withdrawals {
+		if m := q.Get("message_id"); m == "" || m == w.messageID {
+			data = append(data, w.Withdrawal)
+		}
+	}
+	return paginate(data, q, func(w bitflyer.Withdrawal) int { return w.ID }), nil
+}
+
+func (s *Server) getTradingCommission(r *http.Request, body []byte) (interface{}, error) {
+	if _, err := s.productCode(r.URL.Query()); err != nil {
+		return nil, err
+	}
+	return bitflyer.TradingCommission{CommissionRate: s.commissionRate}, nil
+}
+
+func (s *Server) getPositions(r *http.Request, body []byte) (interface{}, error) {
+	code := r.URL.Query().Get("product_code")
+	if !strings.HasPrefix(code, "FX_") {
+		return nil, badRequest("Invalid product_code")
+	}
+	return s.paper.Account.Positions(code, s.board(code).MidPrice), nil
+}
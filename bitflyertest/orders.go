@@ -0,0 +1,217 @@
+package bitflyertest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/jackpopper/bitflyer"
+)
+
+// * 注文
+
+func midPrice(bid, ask bitflyer.Decimal) bitflyer.Decimal {
+	return bid.Add(ask).Mul(bitflyer.NewDecimal(5, -1))
+}
+
+func orderID(prefix string, id int) string {
+	return fmt.Sprintf("%s%s-%06d", prefix, time.Now().UTC().Format("20060102"), id)
+}
+
+// apiError はbitflyer.PaperExchangeのエラーをエラーレスポンスにする
+func apiError(err error) error {
+	if e, ok := err.(*bitflyer.APIError); ok {
+		return &Error{HTTPStatus: e.HTTPStatus, Status: e.Status, Message: e.Message}
+	}
+	return err
+}
+
+// ** 子注文
+func (s *Server) sendChildorder(r *http.Request, body []byte) (interface{}, error) {
+	var ch bitflyer.Childorder
+	if err := json.Unmarshal(body, &ch); err != nil {
+		return nil, badRequest(err.Error())
+	}
+	if err := ch.Validate(); err != nil {
+		return nil, badRequest(err.Error())
+	}
+	if _, err := s.productCode(map[string][]string{"product_code": {ch.ProductCode}}); err != nil {
+		return nil, err
+	}
+	if s.health == "STOP" {
+		return nil, &Error{Status: bitflyer.StatusMarketClosed, Message: "Market is closed"}
+	}
+
+	o := s.paper.NewOrder(&ch, s.commissionRate)
+	b := s.board(ch.ProductCode)
+	execs, err := s.paper.Place(o, b)
+	if err != nil {
+		return nil, apiError(err)
+	}
+	s.consume(b, o.Side, execs)
+
+	return bitflyer.ChildOrderAcceptanceID{ChildOrderAcceptanceID: o.ChildOrderAcceptanceID}, nil
+}
+
+// consume は約定した分だけ板を減らす。約定は板の先頭から順に並んでいる
+func (s *Server) consume(b *bitflyer.Board, side bitflyer.Side, execs []*bitflyer.PaperExecution) {
+	levels := &b.Bids
+	if side == bitflyer.SideBuy {
+		levels = &b.Asks
+	}
+	for _, e := range execs {
+		l := &(*levels)[0]
+		if rest := l.Size.Sub(e.Size); rest.Sign() > 0 {
+			l.Size = rest
+		} else {
+			*levels = (*levels)[1:]
+		}
+	}
+	if len(b.Bids) > 0 && len(b.Asks) > 0 {
+		b.MidPrice = midPrice(b.Bids[0].Price, b.Asks[0].Price)
+	}
+}
+
+// publish は約定を公開の約定履歴に載せる
+func (s *Server) publish(o *bitflyer.PaperOrder, e *bitflyer.PaperExecution, maker bool) {
+	public := bitflyer.Execution{ID: e.ID, Side: o.Side, Price: e.Price, Size: e.Size, ExecDate: e.ExecDate}
+	if o.Side == bitflyer.SideBuy {
+		public.BuyChildOrderAcceptanceID = o.ChildOrderAcceptanceID
+	} else {
+		public.SellChildOrderAcceptanceID = o.ChildOrderAcceptanceID
+	}
+	s.executions[o.ProductCode] = append([]bitflyer.Execution{public}, s.executions[o.ProductCode]...)
+}
+
+func (s *Server) cancelChildorder(r *http.Request, body []byte) (interface{}, error) {
+	var ch bitflyer.Childorder
+	if err := json.Unmarshal(body, &ch); err != nil {
+		return nil, badRequest(err.Error())
+	}
+	o := s.paper.ActiveOrder(ch.ProductCode, ch.ChildOrderID, ch.ChildOrderAcceptanceID)
+	if o == nil {
+		return nil, &Error{Status: bitflyer.StatusOrderNotFound, Message: "Order not found"}
+	}
+	s.paper.Cancel(o)
+	return struct{}{}, nil
+}
+
+func (s *Server) cancelAllChildorder(r *http.Request, body []byte) (interface{}, error) {
+	var req struct {
+		ProductCode string `json:"product_code"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, badRequest(err.Error())
+	}
+	if _, err := s.productCode(map[string][]string{"product_code": {req.ProductCode}}); err != nil {
+		return nil, err
+	}
+	s.paper.CancelAll(req.ProductCode)
+	return struct{}{}, nil
+}
+
+func (s *Server) getChildorders(r *http.Request, body []byte) (interface{}, error) {
+	q := r.URL.Query()
+	return s.paper.Childorders(queryPage(q), func(o *bitflyer.PaperOrder) bool {
+		return (q.Get("product_code") == "" || o.ProductCode == q.Get("product_code")) &&
+			(q.Get("child_order_state") == "" || string(o.ChildOrderState) == q.Get("child_order_state")) &&
+			(q.Get("child_order_id") == "" || o.ChildOrderID == q.Get("child_order_id")) &&
+			(q.Get("child_order_acceptance_id") == "" || o.ChildOrderAcceptanceID == q.Get("child_order_acceptance_id"))
+	}), nil
+}
+
+func (s *Server) getMyExecutions(r *http.Request, body []byte) (interface{}, error) {
+	q := r.URL.Query()
+	return s.paper.Executions(queryPage(q), func(e *bitflyer.PaperExecution) bool {
+		return (q.Get("product_code") == "" || e.ProductCode == q.Get("product_code")) &&
+			(q.Get("child_order_id") == "" || e.ChildOrderID == q.Get("child_order_id")) &&
+			(q.Get("child_order_acceptance_id") == "" || e.ChildOrderAcceptanceID == q.Get("child_order_acceptance_id"))
+	}), nil
+}
+
+// ** 親注文
+// 受け付けて一覧に載せるだけで、執行はしない
+func (s *Server) sendParentorder(r *http.Request, body []byte) (interface{}, error) {
+	var pa bitflyer.Parentorder
+	if err := json.Unmarshal(body, &pa); err != nil {
+		return nil, badRequest(err.Error())
+	}
+	if err := pa.Validate(); err != nil {
+		return nil, badRequest(err.Error())
+	}
+
+	now := time.Now().UTC()
+	expire := pa.MinuteToExpire
+	if expire == 0 {
+		expire = 43200
+	}
+	id := s.newID()
+	first := pa.Parameters[0]
+	p := &bitflyer.ParentorderInfo{
+		ID:                      id,
+		ParentOrderID:           orderID("JCP", id),
+		ProductCode:             first.ProductCode,
+		Side:                    first.Side,
+		ParentOrderType:         string(pa.OrderMethod),
+		Price:                   first.Price,
+		Size:                    first.Size,
+		ParentOrderState:        bitflyer.StateActive,
+		ExpireDate:              bitflyer.Time{Time: now.Add(time.Duration(expire) * time.Minute)},
+		ParentOrderDate:         bitflyer.Time{Time: now},
+		ParentOrderAcceptanceID: orderID("JRF", id),
+		OutstandingSize:         first.Size,
+	}
+	s.parentorders = append(s.parentorders, p)
+
+	return bitflyer.ParentOrderAcceptanceID{ParentOrderAcceptanceID: p.ParentOrderAcceptanceID}, nil
+}
+
+func (s *Server) findParentorder(id, acceptanceID string) *bitflyer.ParentorderInfo {
+	for _, p := range s.parentorders {
+		if (id != "" && p.ParentOrderID == id) || (acceptanceID != "" && p.ParentOrderAcceptanceID == acceptanceID) {
+			return p
+		}
+	}
+	return nil
+}
+
+func (s *Server) cancelParentorder(r *http.Request, body []byte) (interface{}, error) {
+	var pa bitflyer.Parentorder
+	if err := json.Unmarshal(body, &pa); err != nil {
+		return nil, badRequest(err.Error())
+	}
+	p := s.findParentorder(pa.ParentOrderID, pa.ParentOrderAcceptanceID)
+	if p == nil || p.ParentOrderState != bitflyer.StateActive {
+		return nil, &Error{Status: bitflyer.StatusOrderNotFound, Message: "Order not found"}
+	}
+	p.ParentOrderState = bitflyer.StateCanceled
+	p.CancelSize = p.OutstandingSize
+	p.OutstandingSize = bitflyer.Decimal{}
+
+	return struct{}{}, nil
+}
+
+func (s *Server) getParentorders(r *http.Request, body []byte) (interface{}, error) {
+	q := r.URL.Query()
+	data := []bitflyer.ParentorderInfo{}
+	for i := len(s.parentorders) - 1; i >= 0; i-- {
+		p := s.parentorders[i]
+		if (q.Get("product_code") != "" && p.ProductCode != q.Get("product_code")) ||
+			(q.Get("parent_order_state") != "" && string(p.ParentOrderState) != q.Get("parent_order_state")) {
+			continue
+		}
+		data = append(data, *p)
+	}
+	return paginate(data, q, func(p bitflyer.ParentorderInfo) int { return p.ID }), nil
+}
+
+// getParentorder はClient.GetMyParentorderに合わせて1件の配列で返す
+func (s *Server) getParentorder(r *http.Request, body []byte) (interface{}, error) {
+	q := r.URL.Query()
+	p := s.findParentorder(q.Get("parent_order_id"), q.Get("parent_order_acceptance_id"))
+	if p == nil {
+		return nil, &Error{Status: bitflyer.StatusOrderNotFound, Message: "Order not found"}
+	}
+	return []bitflyer.ParentorderInfo{*p}, nil
+}
@@ -0,0 +1,306 @@
+package bitflyertest
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackpopper/bitflyer"
+)
+
+// * Realtime API
+// RealtimeServer はhttptest.Serverで動くRealtime API (JSON-RPC 2.0 over WebSocket) の偽サーバー。
+// subscribe, unsubscribe, authに応え、Publishしたメッセージを購読している接続に配る。
+// child_order_eventsとparent_order_eventsはauthしていないと購読できない
+type RealtimeServer struct {
+	*httptest.Server
+	APIKey    string
+	APISecret string
+
+	mu       sync.Mutex
+	sessions map[*rtSession]bool
+	connects int
+	pings    int
+	noPong   bool
+	// 状態が変わるたびに閉じて作り直す。Waitで待つのに使う
+	changed chan struct{}
+}
+
+type rtSession struct {
+	conn   *wsConn
+	authed bool
+	subs   map[string]bool
+}
+
+type rtRequest struct {
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+	ID     *int            `json:"id"`
+}
+
+type rtResponse struct {
+	Version string             `json:"jsonrpc"`
+	ID      int                `json:"id"`
+	Result  interface{}        `json:"result,omitempty"`
+	Error   *bitflyer.RPCError `json:"error,omitempty"`
+}
+
+type rtAuth struct {
+	APIKey    string `json:"api_key"`
+	Timestamp int64  `json:"timestamp"`
+	Nonce     string `json:"nonce"`
+	Signature string `json:"signature"`
+}
+
+func NewRealtimeServer() *RealtimeServer {
+	s := &RealtimeServer{
+		APIKey:    DefaultAPIKey,
+		APISecret: DefaultAPISecret,
+		sessions:  map[*rtSession]bool{},
+		changed:   make(chan struct{}),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+
+	return s
+}
+
+// Realtime はこのサーバーにつなぐRealtimeを返す。再接続の待ち時間は短くしてある
+func (s *RealtimeServer) Realtime(c *bitflyer.Client) *bitflyer.Realtime {
+	r := c.NewRealtime()
+	r.URL = "ws" + strings.TrimPrefix(s.URL, "http") + "/json-rpc"
+	r.ReconnectDelay = 10 * time.Millisecond
+	r.MaxReconnectDelay = 100 * time.Millisecond
+
+	return r
+}
+
+// ** 配信と障害の注入
+// Publish はchannelを購読している接続にmessageを送り、送った接続の数を返す
+func (s *RealtimeServer) Publish(channel string, message interface{}) int {
+	b, err := json.Marshal(map[string]interface{}{
+		"jsonrpc": "2.0",
+		"method":  "channelMessage",
+		"params":  map[string]interface{}{"channel": channel, "message": message},
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	n := 0
+	for _, ss := range s.subscribers(channel) {
+		if ss.conn.writeFrame(opText, b) == nil {
+			n++
+		}
+	}
+	return n
+}
+
+func (s *RealtimeServer) subscribers(channel string) []*rtSession {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var subs []*rtSession
+	for ss := range s.sessions {
+		if ss.subs[channel] {
+			subs = append(subs, ss)
+		}
+	}
+	return subs
+}
+
+// Disconnect はすべての接続を切る。Realtimeの再接続を試すのに使う
+func (s *RealtimeServer) Disconnect() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for ss := range s.sessions {
+		ss.conn.Close()
+	}
+}
+
+// SetPong はfalseならpingに応えない
+func (s *RealtimeServer) SetPong(pong bool) {
+	s.mu.Lock()
+	s.noPong = !pong
+	s.mu.Unlock()
+}
+
+// ** 状態
+// Connects は受け付けた接続の数 (切れたものも含む)
+func (s *RealtimeServer) Connects() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.connects
+}
+
+// Pings は受け取ったpingの数
+func (s *RealtimeServer) Pings() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.pings
+}
+
+// Subscribed はchannelを購読している接続があればtrue
+func (s *RealtimeServer) Subscribed(channel string) bool {
+	return len(s.subscribers(channel)) > 0
+}
+
+// Wait はcondがtrueになるまで待つ。condは接続や購読が変わるたびに呼ぶ
+func (s *RealtimeServer) Wait(ctx context.Context, cond func() bool) error {
+	for {
+		s.mu.Lock()
+		changed := s.changed
+		s.mu.Unlock()
+		if cond() {
+			return nil
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// notify はs.muを持って呼ぶ
+func (s *RealtimeServer) notify() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// ** 接続の処理
+func (s *RealtimeServer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrade(w, r)
+	if err != nil {
+		return
+	}
+	ss := &rtSession{conn: conn, subs: map[string]bool{}}
+
+	s.mu.Lock()
+	s.sessions[ss] = true
+	s.connects++
+	s.notify()
+	s.mu.Unlock()
+
+	defer func() {
+		conn.Close()
+		s.mu.Lock()
+		delete(s.sessions, ss)
+		s.notify()
+		s.mu.Unlock()
+	}()
+
+	for {
+		op, payload, err := conn.readFrame()
+		if err != nil {
+			return
+		}
+
+		switch op {
+		case opPing:
+			s.mu.Lock()
+			s.pings++
+			pong := !s.noPong
+			s.notify()
+			s.mu.Unlock()
+			if pong {
+				conn.writeFrame(opPong, payload)
+			}
+		case opClose:
+			conn.writeFrame(opClose, payload)
+			return
+		case opText:
+			if err := s.handle(ss, payload); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (s *RealtimeServer) handle(ss *rtSession, payload []byte) error {
+	var req rtRequest
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return err
+	}
+
+	result, rpcErr := s.call(ss, &req)
+	if req.ID == nil {
+		return nil
+	}
+	res := &rtResponse{Version: "2.0", ID: *req.ID, Result: result, Error: rpcErr}
+	b, err := json.Marshal(res)
+	if err != nil {
+		return err
+	}
+	return ss.conn.writeFrame(opText, b)
+}
+
+func (s *RealtimeServer) call(ss *rtSession, req *rtRequest) (interface{}, *bitflyer.RPCError) {
+	switch req.Method {
+	case "auth":
+		var p rtAuth
+		if err := json.Unmarshal(req.Params, &p); err != nil {
+			return nil, &bitflyer.RPCError{Code: -32602, Message: err.Error()}
+		}
+		if !s.verify(&p) {
+			return nil, &bitflyer.RPCError{Code: -32000, Message: "auth failed"}
+		}
+		s.mu.Lock()
+		ss.authed = true
+		s.notify()
+		s.mu.Unlock()
+		return true, nil
+
+	case "subscribe", "unsubscribe":
+		var p struct {
+			Channel string `json:"channel"`
+		}
+		if err := json.Unmarshal(req.Params, &p); err != nil || p.Channel == "" {
+			return nil, &bitflyer.RPCError{Code: -32602, Message: "invalid channel"}
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if req.Method == "unsubscribe" {
+			delete(ss.subs, p.Channel)
+		} else {
+			if isPrivateChannel(p.Channel) && !ss.authed {
+				return nil, &bitflyer.RPCError{Code: -32000, Message: "auth required"}
+			}
+			ss.subs[p.Channel] = true
+		}
+		s.notify()
+		return true, nil
+	}
+
+	return nil, &bitflyer.RPCError{Code: -32601, Message: fmt.Sprintf("method not found: %s", req.Method)}
+}
+
+// verify はHMAC-SHA256(timestamp + nonce)の署名を確かめる
+func (s *RealtimeServer) verify(p *rtAuth) bool {
+	if p.APIKey != s.APIKey {
+		return false
+	}
+	if d := time.Since(time.UnixMilli(p.Timestamp)); d > 5*time.Minute || d < -5*time.Minute {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, []byte(s.APISecret))
+	mac.Write([]byte(fmt.Sprintf("%d%s", p.Timestamp, p.Nonce)))
+	want := hex.EncodeToString(mac.Sum(nil))
+	return hmac.Equal([]byte(p.Signature), []byte(want))
+}
+
+func isPrivateChannel(channel string) bool {
+	return channel == "child_order_events" || channel == "parent_order_events"
+}
@@ -0,0 +1,295 @@
+// Package bitflyertest provides a fake bitFlyer Lightning server for tests
+// テスト用のbitFlyer Lightningの偽サーバー
+package bitflyertest
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackpopper/bitflyer"
+)
+
+// Server のAPIキーの初期値
+const (
+	DefaultAPIKey    = "test-api-key"
+	DefaultAPISecret = "test-api-secret"
+)
+
+// Server はhttptest.Serverで動く偽の取引所。
+// Clientが呼ぶすべてのエンドポイントに応え、Private APIは署名を確かめ、残高と注文をメモリに持つ
+type Server struct {
+	*httptest.Server
+	APIKey    string
+	APISecret string
+
+	mu       sync.Mutex
+	handlers map[string]handlerFunc
+	requests map[string]int
+	faults   map[string][]Fault
+	latency  map[string]time.Duration
+	// 回数制限。limitが0なら制限しない
+	limit     int
+	period    time.Duration
+	remaining int
+	reset     time.Time
+
+	exchange
+}
+
+// Error はbitFlyerのエラーレスポンス
+type Error struct {
+	HTTPStatus int    `json:"-"`
+	Status     int    `json:"status"`
+	Message    string `json:"error_message"`
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Fault は次の1回の呼び出しで起こす障害
+type Fault struct {
+	// 応答までの遅延
+	Delay time.Duration
+	// trueなら応答せずに接続を切る
+	CloseConnection bool
+	// 0でなければこのHTTPステータスのエラーを返す
+	HTTPStatus int
+	// bitFlyerのエラーコード。HTTPStatusが0なら400で返す
+	Status  int
+	Message string
+	// trueならリクエストを処理してから遅延、切断、エラーを起こす。
+	// 注文が受け付けられたのに応答が届かない場合を試すのに使う
+	AfterHandle bool
+}
+
+type handlerFunc func(r *http.Request, body []byte) (interface{}, error)
+
+func NewServer() *Server {
+	s := &Server{
+		APIKey:    DefaultAPIKey,
+		APISecret: DefaultAPISecret,
+		requests:  map[string]int{},
+		faults:    map[string][]Fault{},
+		latency:   map[string]time.Duration{},
+		exchange:  newExchange(),
+	}
+	s.paper.OnFill = s.publish
+	s.handlers = s.routes()
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+
+	return s
+}
+
+// Client はこのサーバーに向いたClientを返す
+func (s *Server) Client() *bitflyer.Client {
+	c := bitflyer.NewClient(s.APIKey, s.APISecret)
+	c.URL, _ = url.Parse(s.URL + "/" + bitflyer.API_VERSION)
+	c.HTTPClient = s.Server.Client()
+
+	return c
+}
+
+// ** 障害の注入
+// InjectFault はendpoint ("board", "me/sendchildorder" など) の次の呼び出しでfを起こす。
+// 複数回呼ぶと順に1回ずつ起こす
+func (s *Server) InjectFault(endpoint string, f Fault) {
+	s.mu.Lock()
+	s.faults[endpoint] = append(s.faults[endpoint], f)
+	s.mu.Unlock()
+}
+
+// SetLatency はendpointの応答をdだけ遅らせる。endpointが空ならすべて
+func (s *Server) SetLatency(endpoint string, d time.Duration) {
+	s.mu.Lock()
+	s.latency[endpoint] = d
+	s.mu.Unlock()
+}
+
+// SetRateLimit はperiodごとにlimit回を超えた呼び出しに429を返す。limitが0なら制限しない
+func (s *Server) SetRateLimit(limit int, period time.Duration) {
+	s.mu.Lock()
+	s.limit, s.period = limit, period
+	s.remaining, s.reset = limit, time.Now().Add(period)
+	s.mu.Unlock()
+}
+
+// Requests はendpointが呼ばれた回数 (エラーを返したものも含む)
+func (s *Server) Requests(endpoint string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.requests[endpoint]
+}
+
+// ** リクエストの処理
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	endpoint := strings.TrimPrefix(r.URL.Path, "/"+bitflyer.API_VERSION+"/")
+
+	s.mu.Lock()
+	s.requests[endpoint]++
+	var fault *Fault
+	if fs := s.faults[endpoint]; len(fs) > 0 {
+		fault = &fs[0]
+		s.faults[endpoint] = fs[1:]
+	}
+	delay := s.latency[""] + s.latency[endpoint]
+	limited := s.takeRateLimit(w.Header())
+	s.mu.Unlock()
+
+	if fault != nil && !fault.AfterHandle {
+		delay += fault.Delay
+	}
+	if !sleep(r, delay) {
+		return
+	}
+	if fault != nil && !fault.AfterHandle && s.injectFault(w, fault) {
+		return
+	}
+	if limited {
+		writeError(w, &Error{HTTPStatus: http.StatusTooManyRequests, Status: bitflyer.StatusOverAPILimit, Message: "Over API limit per period"})
+		return
+	}
+
+	data, err := s.handle(r, endpoint)
+	if fault != nil && fault.AfterHandle {
+		if !sleep(r, fault.Delay) || s.injectFault(w, fault) {
+			return
+		}
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(data)
+}
+
+func (s *Server) handle(r *http.Request, endpoint string) (interface{}, error) {
+	h, ok := s.handlers[endpoint]
+	if !ok {
+		return nil, &Error{HTTPStatus: http.StatusNotFound, Message: "Not Found"}
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, &Error{HTTPStatus: http.StatusBadRequest, Message: err.Error()}
+	}
+	if strings.HasPrefix(endpoint, "me/") {
+		if err := s.authenticate(r, body); err != nil {
+			return nil, err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return h(r, body)
+}
+
+// sleep はdだけ待つ。先にクライアントが切断すればfalse
+func sleep(r *http.Request, d time.Duration) bool {
+	if d <= 0 {
+		return true
+	}
+	select {
+	case <-time.After(d):
+		return true
+	case <-r.Context().Done():
+		return false
+	}
+}
+
+// injectFault は接続を切るかエラーを返す。応答を書いたらtrue
+func (s *Server) injectFault(w http.ResponseWriter, fault *Fault) bool {
+	if fault.CloseConnection {
+		if hj, ok := w.(http.Hijacker); ok {
+			if conn, _, err := hj.Hijack(); err == nil {
+				conn.Close()
+				return true
+			}
+		}
+	}
+	if fault.HTTPStatus != 0 || fault.Status != 0 {
+		writeError(w, &Error{HTTPStatus: fault.HTTPStatus, Status: fault.Status, Message: fault.Message})
+		return true
+	}
+	return false
+}
+
+// takeRateLimit は回数を1つ使い、X-RateLimit-*ヘッダを書く。回数が尽きていればtrue
+func (s *Server) takeRateLimit(h http.Header) bool {
+	if s.limit <= 0 {
+		return false
+	}
+
+	now := time.Now()
+	if !now.Before(s.reset) {
+		s.remaining, s.reset = s.limit, now.Add(s.period)
+	}
+	limited := s.remaining <= 0
+	if !limited {
+		s.remaining--
+	}
+	h.Set("X-RateLimit-Period", strconv.Itoa(int(s.period/time.Second)))
+	h.Set("X-RateLimit-Remaining", strconv.Itoa(s.remaining))
+	h.Set("X-RateLimit-Reset", strconv.FormatInt(s.reset.Unix(), 10))
+
+	return limited
+}
+
+// authenticate はACCESS-KEY, ACCESS-TIMESTAMP, ACCESS-SIGNを確かめる
+func (s *Server) authenticate(r *http.Request, body []byte) error {
+	unauthorized := func(msg string) error {
+		return &Error{HTTPStatus: http.StatusUnauthorized, Status: -500, Message: msg}
+	}
+
+	if r.Header.Get("ACCESS-KEY") != s.APIKey {
+		return unauthorized("Invalid API key")
+	}
+	timestamp := r.Header.Get("ACCESS-TIMESTAMP")
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return unauthorized("Invalid timestamp")
+	}
+	if d := time.Since(time.Unix(ts, 0)); d > 5*time.Minute || d < -5*time.Minute {
+		return unauthorized("Timestamp is too old")
+	}
+
+	mac := hmac.New(sha256.New, []byte(s.APISecret))
+	mac.Write([]byte(timestamp + r.Method + r.URL.RequestURI() + string(body)))
+	want := hex.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(r.Header.Get("ACCESS-SIGN")), []byte(want)) {
+		return unauthorized("Invalid signature")
+	}
+
+	return nil
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	e, ok := err.(*Error)
+	if !ok {
+		e = &Error{HTTPStatus: http.StatusInternalServerError, Message: err.Error()}
+	}
+	status := e.HTTPStatus
+	if status == 0 {
+		status = http.StatusBadRequest
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(e)
+}
+
+func badRequest(msg string) error {
+	return &Error{HTTPStatus: http.StatusBadRequest, Status: -100, Message: msg}
+}
@@ -0,0 +1,509 @@
+package bitflyertest_test
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/jackpopper/bitflyer"
+	"github.com/jackpopper/bitflyer/bitflyertest"
+)
+
+func newServer(t *testing.T) *bitflyertest.Server {
+	t.Helper()
+	s := bitflyertest.NewServer()
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestGetMyBankAccounts(t *testing.T) {
+	s := newServer(t)
+	c := s.Client()
+
+	if _, err := c.GetMyBankAccounts(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := s.Requests("me/getbankaccounts"); n != 1 {
+		t.Errorf("me/getbankaccounts requests = %d, want 1", n)
+	}
+	if n := s.Requests("me/getcoinins"); n != 0 {
+		t.Errorf("me/getcoinins requests = %d, want 0", n)
+	}
+}
+
+func TestCancelAllChildorder(t *testing.T) {
+	s := newServer(t)
+	s.SetBalance("BTC", bitflyer.MustDecimal("1"))
+	c := s.Client()
+	ctx := context.Background()
+
+	for _, price := range []string{"10000000", "10100000"} {
+		_, err := c.SendChildorder(ctx, &bitflyer.Childorder{
+			ProductCode:    "BTC_JPY",
+			ChildOrderType: bitflyer.OrderTypeLimit,
+			Side:           bitflyer.SideSell,
+			Price:          bitflyer.MustDecimal(price),
+			Size:           bitflyer.MustDecimal("0.01"),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.CancelAllChildorder(ctx, "BTC_JPY"); err != nil {
+		t.Fatal(err)
+	}
+	for _, o := range s.Orders() {
+		if o.ChildOrderState != bitflyer.StateCanceled {
+			t.Errorf("%s: state = %s, want %s", o.ChildOrderAcceptanceID, o.ChildOrderState, bitflyer.StateCanceled)
+		}
+	}
+}
+
+func d(s string) bitflyer.Decimal {
+	return bitflyer.MustDecimal(s)
+}
+
+func level(price, size string) bitflyer.PriceLevel {
+	return bitflyer.PriceLevel{Price: d(price), Size: d(size)}
+}
+
+func checkDecimal(t *testing.T, name string, got bitflyer.Decimal, want string) {
+	t.Helper()
+	if !got.Equal(d(want)) {
+		t.Errorf("%s = %s, want %s", name, got, want)
+	}
+}
+
+func checkBalance(t *testing.T, s *bitflyertest.Server, currency, amount, available string) {
+	t.Helper()
+	a, av := s.Balance(currency)
+	checkDecimal(t, currency+" amount", a, amount)
+	checkDecimal(t, currency+" available", av, available)
+}
+
+func apiError(t *testing.T, err error) *bitflyer.APIError {
+	t.Helper()
+	var e *bitflyer.APIError
+	if !errors.As(err, &e) {
+		t.Fatalf("error = %v, want *bitflyer.APIError", err)
+	}
+	return e
+}
+
+func TestPublicAPI(t *testing.T) {
+	s := newServer(t)
+	s.SetBoard("BTC_JPY", &bitflyer.Board{
+		Bids: []bitflyer.PriceLevel{level("99", "1"), level("100", "0.5")},
+		Asks: []bitflyer.PriceLevel{level("102", "2"), level("101", "1")},
+	})
+	s.AddExecutions("BTC_JPY", bitflyer.Execution{Side: bitflyer.SideBuy, Price: d("101"), Size: d("0.2")})
+	s.SetHealth("BUSY")
+	// Public APIは鍵がなくても呼べる
+	c := s.Client()
+	c.APIKey, c.APISecret = "", ""
+	ctx := context.Background()
+
+	markets, err := c.GetMarkets(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, m := range *markets {
+		found = found || m.ProductCode == "FX_BTC_JPY"
+	}
+	if !found {
+		t.Errorf("markets = %+v", *markets)
+	}
+
+	b, err := c.GetBoard(ctx, "BTC_JPY")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkDecimal(t, "best bid", b.Bids[0].Price, "100")
+	checkDecimal(t, "best ask", b.Asks[0].Price, "101")
+	checkDecimal(t, "mid price", b.MidPrice, "100.5")
+
+	tk, err := c.GetTicker(ctx, "BTC_JPY")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkDecimal(t, "ltp", tk.Ltp, "101")
+	checkDecimal(t, "best bid size", tk.BestBidSize, "0.5")
+	checkDecimal(t, "total ask depth", tk.TotalAskDepth, "3")
+	checkDecimal(t, "volume", tk.Volume, "0.2")
+
+	execs, err := c.GetExecutions(ctx, "BTC_JPY", &bitflyer.Page{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*execs) != 1 || (*execs)[0].Side != bitflyer.SideBuy {
+		t.Errorf("executions = %+v", *execs)
+	}
+
+	if h, err := c.GetHealth(ctx); err != nil || h.Status != "BUSY" {
+		t.Errorf("health = %+v, %v", h, err)
+	}
+	if n := s.Requests("board"); n != 1 {
+		t.Errorf("board requests = %d, want 1", n)
+	}
+}
+
+func TestSigning(t *testing.T) {
+	s := newServer(t)
+	s.SetBalance("JPY", d("1000"))
+	ctx := context.Background()
+
+	c := s.Client()
+	if _, err := c.GetMyBalance(ctx); err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	// クエリ文字列とPOSTの本文も署名に入る
+	if _, err := c.GetMyChildorders(ctx, "BTC_JPY", &bitflyer.Page{Count: 10, Before: 100}, bitflyer.StateActive, ""); err != nil {
+		t.Fatalf("GET with query: %v", err)
+	}
+	if _, err := c.Withdraw(ctx, &bitflyer.Withdraw{CurrencyCode: "JPY", BankAccountID: 1, Amount: d("100")}); err != nil {
+		t.Fatalf("POST: %v", err)
+	}
+
+	tests := []struct {
+		name        string
+		key, secret string
+	}{
+		{"wrong key", "wrong", bitflyertest.DefaultAPISecret},
+		{"wrong secret", bitflyertest.DefaultAPIKey, "wrong"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := s.Client()
+			c.APIKey, c.APISecret = tt.key, tt.secret
+			c.RetryPolicy = nil
+			_, err := c.GetMyBalance(ctx)
+			if e := apiError(t, err); e.HTTPStatus != 401 || e.Status != -500 {
+				t.Errorf("error = %+v", e)
+			}
+		})
+	}
+
+	// 鍵がなければ送らない
+	c = s.Client()
+	c.APIKey, c.APISecret = "", ""
+	n := s.Requests("me/getbalance")
+	if _, err := c.GetMyBalance(ctx); err == nil {
+		t.Error("GetMyBalance without credentials succeeded")
+	}
+	if got := s.Requests("me/getbalance"); got != n {
+		t.Errorf("requests = %d, want %d", got, n)
+	}
+	checkBalance(t, s, "JPY", "900", "900")
+}
+
+func TestErrors(t *testing.T) {
+	s := newServer(t)
+	s.SetBalance("JPY", d("10"))
+	s.SetBoard("BTC_JPY", &bitflyer.Board{Asks: []bitflyer.PriceLevel{level("100", "1")}})
+	c := s.Client()
+	c.RetryPolicy = nil
+	ctx := context.Background()
+
+	_, err := c.GetBoard(ctx, "NO_SUCH_PRODUCT")
+	if e := apiError(t, err); e.HTTPStatus != 400 || e.Status != -100 {
+		t.Errorf("unknown product: %+v", e)
+	}
+
+	buy := &bitflyer.Childorder{ProductCode: "BTC_JPY", ChildOrderType: bitflyer.OrderTypeLimit, Side: bitflyer.SideBuy, Price: d("100"), Size: d("1")}
+	if _, err := c.SendChildorder(ctx, buy); !bitflyer.IsInsufficientFunds(err) {
+		t.Errorf("insufficient funds: %v", err)
+	}
+	if err := c.CancelChildorder(ctx, &bitflyer.Childorder{ProductCode: "BTC_JPY", ChildOrderAcceptanceID: "JRF20240101-000000"}); !bitflyer.IsOrderNotFound(err) {
+		t.Errorf("order not found: %v", err)
+	}
+	if _, err := c.Withdraw(ctx, &bitflyer.Withdraw{CurrencyCode: "JPY", BankAccountID: 1, Amount: d("11")}); !bitflyer.IsInsufficientFunds(err) {
+		t.Errorf("withdraw: %v", err)
+	}
+
+	s.SetHealth("STOP")
+	buy.Size = d("0.01")
+	if _, err := c.SendChildorder(ctx, buy); !bitflyer.IsMaintenance(err) {
+		t.Errorf("market closed: %v", err)
+	}
+
+	s.InjectFault("me/getbalance", bitflyertest.Fault{HTTPStatus: 500, Message: "Internal Server Error"})
+	_, err = c.GetMyBalance(ctx)
+	if e := apiError(t, err); e.HTTPStatus != 500 || e.Message != "Internal Server Error" {
+		t.Errorf("injected fault: %+v", e)
+	}
+	checkBalance(t, s, "JPY", "10", "10")
+}
+
+func TestOrderLifecycle(t *testing.T) {
+	s := newServer(t)
+	s.SetBalance("JPY", d("1000"))
+	s.SetCommissionRate(d("0.001"))
+	s.SetBoard("BTC_JPY", &bitflyer.Board{
+		Bids: []bitflyer.PriceLevel{level("99", "1")},
+		Asks: []bitflyer.PriceLevel{level("100", "0.5"), level("101", "1")},
+	})
+	c := s.Client()
+	ctx := context.Background()
+
+	order := func(side bitflyer.Side, price, size string) string {
+		t.Helper()
+		res, err := c.SendChildorder(ctx, &bitflyer.Childorder{ProductCode: "BTC_JPY", ChildOrderType: bitflyer.OrderTypeLimit, Side: side, Price: d(price), Size: d(size)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res.ChildOrderAcceptanceID
+	}
+	get := func(id string) bitflyer.ChildorderInfo {
+		t.Helper()
+		for _, o := range s.Orders() {
+			if o.ChildOrderAcceptanceID == id {
+				return o
+			}
+		}
+		t.Fatalf("%s not found", id)
+		return bitflyer.ChildorderInfo{}
+	}
+
+	// 板の2本を取って約定する
+	id := order(bitflyer.SideBuy, "101", "0.7")
+	o := get(id)
+	if o.ChildOrderState != bitflyer.StateCompleted {
+		t.Errorf("state = %s", o.ChildOrderState)
+	}
+	checkDecimal(t, "executed size", o.ExecutedSize, "0.7")
+	checkDecimal(t, "average price", o.AveragePrice, "100.28571429")
+	checkDecimal(t, "commission", o.TotalCommission, "0.0007")
+	checkBalance(t, s, "JPY", "929.8", "929.8")
+	checkBalance(t, s, "BTC", "0.6993", "0.6993")
+
+	execs, err := c.GetMyExecutions(ctx, "BTC_JPY", &bitflyer.Page{}, "", id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*execs) != 2 || !(*execs)[0].Price.Equal(d("101")) || !(*execs)[1].Price.Equal(d("100")) {
+		t.Errorf("executions = %+v", *execs)
+	}
+	b, err := c.GetBoard(ctx, "BTC_JPY")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b.Asks) != 1 || !b.Asks[0].Size.Equal(d("0.8")) {
+		t.Errorf("asks = %+v", b.Asks)
+	}
+
+	// 板に載った注文は代金を拘束し、取り消すと戻す
+	id = order(bitflyer.SideBuy, "90", "0.1")
+	checkBalance(t, s, "JPY", "929.8", "920.8")
+	active, err := c.GetMyChildorders(ctx, "BTC_JPY", &bitflyer.Page{}, bitflyer.StateActive, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*active) != 1 || (*active)[0].ChildOrderAcceptanceID != id {
+		t.Errorf("active orders = %+v", *active)
+	}
+	cancel := &bitflyer.Childorder{ProductCode: "BTC_JPY", ChildOrderAcceptanceID: id}
+	if err := c.CancelChildorder(ctx, cancel); err != nil {
+		t.Fatal(err)
+	}
+	if o := get(id); o.ChildOrderState != bitflyer.StateCanceled || !o.CancelSize.Equal(d("0.1")) {
+		t.Errorf("canceled order = %+v", o)
+	}
+	checkBalance(t, s, "JPY", "929.8", "929.8")
+	if err := c.CancelChildorder(ctx, cancel); !bitflyer.IsOrderNotFound(err) {
+		t.Errorf("cancel twice: %v", err)
+	}
+
+	// 板を差し替えると残っている注文も約定する
+	// 売りは手数料の分も拘束する
+	id = order(bitflyer.SideSell, "105", "0.3")
+	checkBalance(t, s, "BTC", "0.6993", "0.3990")
+	s.SetBoard("BTC_JPY", &bitflyer.Board{Bids: []bitflyer.PriceLevel{level("106", "1")}, Asks: []bitflyer.PriceLevel{level("107", "1")}})
+	if o := get(id); o.ChildOrderState != bitflyer.StateCompleted || !o.AveragePrice.Equal(d("106")) {
+		t.Errorf("sell order = %+v", o)
+	}
+	checkBalance(t, s, "BTC", "0.3990", "0.3990")
+	checkBalance(t, s, "JPY", "961.6", "961.6")
+
+	balance, err := c.GetMyBalance(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range *balance {
+		if b.CurrencyCode == "JPY" && !b.Amount.Equal(d("961.6")) {
+			t.Errorf("GetMyBalance JPY = %s", b.Amount)
+		}
+	}
+}
+
+func TestTimeInForce(t *testing.T) {
+	s := newServer(t)
+	s.SetBalance("JPY", d("1000"))
+	s.SetBoard("BTC_JPY", &bitflyer.Board{Asks: []bitflyer.PriceLevel{level("100", "0.5")}})
+	c := s.Client()
+	ctx := context.Background()
+
+	for _, tt := range []struct {
+		tif      bitflyer.TimeInForce
+		executed string
+	}{
+		{bitflyer.TIFFOK, "0"},
+		{bitflyer.TIFIOC, "0.5"},
+	} {
+		res, err := c.SendChildorder(ctx, &bitflyer.Childorder{ProductCode: "BTC_JPY", ChildOrderType: bitflyer.OrderTypeLimit, Side: bitflyer.SideBuy, Price: d("100"), Size: d("1"), TimeInForce: tt.tif})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, o := range s.Orders() {
+			if o.ChildOrderAcceptanceID != res.ChildOrderAcceptanceID {
+				continue
+			}
+			if o.ChildOrderState != bitflyer.StateCanceled || !o.ExecutedSize.Equal(d(tt.executed)) {
+				t.Errorf("%s: order = %+v", tt.tif, o)
+			}
+		}
+	}
+	checkBalance(t, s, "JPY", "950", "950")
+}
+
+func TestFX(t *testing.T) {
+	s := newServer(t)
+	s.SetCollateral(d("10000"))
+	s.SetBoard("FX_BTC_JPY", &bitflyer.Board{
+		Bids: []bitflyer.PriceLevel{level("999", "10")},
+		Asks: []bitflyer.PriceLevel{level("1000", "10")},
+	})
+	c := s.Client()
+	c.RetryPolicy = nil
+	ctx := context.Background()
+
+	send := func(side bitflyer.Side, size string) error {
+		_, err := c.SendChildorder(ctx, &bitflyer.Childorder{ProductCode: "FX_BTC_JPY", ChildOrderType: bitflyer.OrderTypeMarket, Side: side, Size: d(size)})
+		return err
+	}
+	if err := send(bitflyer.SideBuy, "5"); err != nil {
+		t.Fatal(err)
+	}
+	positions, err := c.GetMyPositions(ctx, "FX_BTC_JPY")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*positions) != 1 {
+		t.Fatalf("positions = %+v", *positions)
+	}
+	p := (*positions)[0]
+	checkDecimal(t, "position size", p.Size, "5")
+	checkDecimal(t, "require collateral", p.RequireCollateral, "2500")
+	checkDecimal(t, "pnl", p.Pnl, "-2.5")
+
+	// 証拠金が足りない
+	if err := send(bitflyer.SideBuy, "15"); !bitflyer.IsInsufficientFunds(err) {
+		t.Errorf("insufficient margin: %v", err)
+	}
+
+	// 反対売買で決済し、損益を証拠金に入れる
+	if err := send(bitflyer.SideSell, "5"); err != nil {
+		t.Fatal(err)
+	}
+	positions, err = c.GetMyPositions(ctx, "FX_BTC_JPY")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*positions) != 0 {
+		t.Errorf("positions = %+v", *positions)
+	}
+	col, err := c.GetMyCollateral(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkDecimal(t, "collateral", col.Collateral, "9995")
+	checkDecimal(t, "require collateral", col.RequireCollateral, "0")
+}
+
+func TestPagination(t *testing.T) {
+	s := newServer(t)
+	s.SetBalance("JPY", d("1000"))
+	c := s.Client()
+	ctx := context.Background()
+
+	var ids []int
+	for i := 0; i < 10; i++ {
+		if _, err := c.SendChildorder(ctx, &bitflyer.Childorder{ProductCode: "BTC_JPY", ChildOrderType: bitflyer.OrderTypeLimit, Side: bitflyer.SideBuy, Price: d("90"), Size: d("0.01")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, o := range s.Orders() {
+		ids = append([]int{o.ID}, ids...)
+	}
+
+	page := func(p *bitflyer.Page) []int {
+		t.Helper()
+		orders, err := c.GetMyChildorders(ctx, "BTC_JPY", p, "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []int
+		for _, o := range *orders {
+			got = append(got, o.ID)
+		}
+		return got
+	}
+	tests := []struct {
+		name string
+		page bitflyer.Page
+		want []int
+	}{
+		{"all", bitflyer.Page{}, ids},
+		{"count", bitflyer.Page{Count: 3}, ids[:3]},
+		{"before", bitflyer.Page{Count: 3, Before: ids[2]}, ids[3:6]},
+		{"after", bitflyer.Page{After: ids[3]}, ids[:3]},
+		{"before and after", bitflyer.Page{Before: ids[1], After: ids[5]}, ids[2:5]},
+		{"before oldest", bitflyer.Page{Before: ids[9]}, nil},
+	}
+	for _, tt := range tests {
+		if got := page(&tt.page); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: ids = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParentorder(t *testing.T) {
+	s := newServer(t)
+	c := s.Client()
+	ctx := context.Background()
+
+	res, err := c.SendParentrder(ctx, &bitflyer.Parentorder{
+		OrderMethod: bitflyer.MethodIFD,
+		Parameters: []bitflyer.ParentorderParameter{
+			{ProductCode: "BTC_JPY", ConditionType: bitflyer.ConditionLimit, Side: bitflyer.SideBuy, Price: d("90"), Size: d("0.01")},
+			{ProductCode: "BTC_JPY", ConditionType: bitflyer.ConditionLimit, Side: bitflyer.SideSell, Price: d("110"), Size: d("0.01")},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := res.ParentOrderAcceptanceID
+
+	list, err := c.GetMyParentorders(ctx, "BTC_JPY", &bitflyer.Page{}, bitflyer.StateActive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*list) != 1 || (*list)[0].ParentOrderAcceptanceID != id || (*list)[0].ParentOrderType != "IFD" {
+		t.Errorf("parent orders = %+v", *list)
+	}
+
+	if err := c.CancelParentorder(ctx, &bitflyer.Parentorder{ParentOrderAcceptanceID: id}); err != nil {
+		t.Fatal(err)
+	}
+	p, err := c.GetMyParentorder(ctx, "", id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*p) != 1 || (*p)[0].ParentOrderState != bitflyer.StateCanceled {
+		t.Errorf("parent order = %+v", *p)
+	}
+	if err := c.CancelParentorder(ctx, &bitflyer.Parentorder{ParentOrderAcceptanceID: id}); !bitflyer.IsOrderNotFound(err) {
+		t.Errorf("cancel twice: %v", err)
+	}
+}
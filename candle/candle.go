@@ -0,0 +1,251 @@
+// Package candle aggregates bitFlyer executions into OHLCV candles
+// 約定からローソク足を作る
+package candle
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackpopper/bitflyer"
+)
+
+type Candle struct {
+	Start      time.Time
+	Open       bitflyer.Decimal
+	High       bitflyer.Decimal
+	Low        bitflyer.Decimal
+	Close      bitflyer.Decimal
+	Volume     bitflyer.Decimal
+	BuyVolume  bitflyer.Decimal
+	SellVolume bitflyer.Decimal
+	// 売買代金 (価格×数量の合計)
+	Turnover bitflyer.Decimal
+	// 出来高加重平均価格。小数点以下8桁に丸める
+	VWAP   bitflyer.Decimal
+	Trades int
+}
+
+func (c *Candle) add(e *bitflyer.Execution) {
+	if c.Trades == 0 {
+		c.Open, c.High, c.Low = e.Price, e.Price, e.Price
+	}
+	if e.Price.Cmp(c.High) > 0 {
+		c.High = e.Price
+	}
+	if e.Price.Cmp(c.Low) < 0 {
+		c.Low = e.Price
+	}
+	c.Close = e.Price
+	c.Volume = c.Volume.Add(e.Size)
+	c.Turnover = c.Turnover.Add(e.Price.Mul(e.Size))
+	if c.Volume.Sign() > 0 {
+		c.VWAP = c.Turnover.Div(c.Volume, 8)
+	} else {
+		c.VWAP = e.Price
+	}
+	switch e.Side {
+	case bitflyer.SideBuy:
+		c.BuyVolume = c.BuyVolume.Add(e.Size)
+	case bitflyer.SideSell:
+		c.SellVolume = c.SellVolume.Add(e.Size)
+	}
+	c.Trades++
+}
+
+// Aggregator は約定を時刻順に受け取り、確定した足を返す。
+// 確定済みの足(空白を埋めた足も含む)とそれより古い約定は捨てる
+type Aggregator struct {
+	Interval time.Duration
+	// 足の区切りをUTCの0時からずらす幅。日本時間の0時で日足を区切るなら+9時間
+	Offset time.Duration
+	// trueなら約定のなかった区間も直前の終値で埋めた足を出す
+	FillGaps bool
+
+	cur  *Candle
+	last *Candle
+}
+
+// NewAggregator はintervalが0以下ならpanicする
+func NewAggregator(interval time.Duration, fillGaps bool) *Aggregator {
+	a := &Aggregator{Interval: interval, FillGaps: fillGaps}
+	a.mustInterval()
+	return a
+}
+
+// mustInterval はIntervalが0以下ならpanicする。足を区切れず、空白を埋めるループも終わらない
+func (a *Aggregator) mustInterval() {
+	if a.Interval <= 0 {
+		panic(fmt.Sprintf("candle: non-positive interval %s", a.Interval))
+	}
+}
+
+func (a *Aggregator) start(t time.Time) time.Time {
+	a.mustInterval()
+	return t.UTC().Add(a.Offset).Truncate(a.Interval).Add(-a.Offset)
+}
+
+// Add は約定を足に加え、それによって確定した足を返す
+func (a *Aggregator) Add(e *bitflyer.Execution) []Candle {
+	start := a.start(e.ExecDate.Time)
+	if a.cur != nil && start.Before(a.cur.Start) {
+		return nil
+	}
+	if a.last != nil && !start.After(a.last.Start) {
+		return nil
+	}
+
+	closed := a.Advance(start)
+	if a.cur == nil {
+		a.cur = &Candle{Start: start}
+	}
+	a.cur.add(e)
+
+	return closed
+}
+
+// Advance は時刻tより前に終わる足を確定させる。
+// 約定がなくても時間の経過で足を閉じるのに使う
+func (a *Aggregator) Advance(t time.Time) []Candle {
+	a.mustInterval()
+	var closed []Candle
+	if a.cur != nil {
+		if t.Before(a.cur.Start.Add(a.Interval)) {
+			return nil
+		}
+		closed = append(closed, *a.cur)
+		a.last = a.cur
+		a.cur = nil
+	}
+
+	if a.FillGaps && a.last != nil {
+		for s := a.last.Start.Add(a.Interval); !t.Before(s.Add(a.Interval)); s = s.Add(a.Interval) {
+			p := a.last.Close
+			c := Candle{Start: s, Open: p, High: p, Low: p, Close: p, VWAP: p}
+			closed = append(closed, c)
+			a.last = &c
+		}
+	}
+
+	return closed
+}
+
+// Current は確定していない足
+func (a *Aggregator) Current() (Candle, bool) {
+	if a.cur == nil {
+		return Candle{}, false
+	}
+	return *a.cur, true
+}
+
+// Flush は確定していない足も確定させて返す
+func (a *Aggregator) Flush() []Candle {
+	if a.cur == nil {
+		return nil
+	}
+	c := *a.cur
+	a.last = a.cur
+	a.cur = nil
+
+	return []Candle{c}
+}
+
+// Aggregate は時刻順に並んだ約定をまとめて足にする。最後の足も含む
+func Aggregate(execs bitflyer.Executions, interval time.Duration, fillGaps bool) []Candle {
+	a := NewAggregator(interval, fillGaps)
+	var candles []Candle
+	for i := range execs {
+		candles = append(candles, a.Add(&execs[i])...)
+	}
+
+	return append(candles, a.Flush()...)
+}
+
+// FromExecutions はGetExecutionsの結果(新しい順)から足を作る
+func FromExecutions(execs *bitflyer.Executions, interval time.Duration, fillGaps bool) []Candle {
+	sorted := make(bitflyer.Executions, len(*execs))
+	for i, e := range *execs {
+		sorted[len(sorted)-1-i] = e
+	}
+
+	return Aggregate(sorted, interval, fillGaps)
+}
+
+// FromFiles はbitflyer.Downloaderが書いたディレクトリから足を作り、確定した順にfnへ渡す
+func FromFiles(dir string, a *Aggregator, fn func(Candle) error) error {
+	err := bitflyer.ReadExecutionChunks(dir, func(e *bitflyer.Execution) error {
+		for _, c := range a.Add(e) {
+			if err := fn(c); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, c := range a.Flush() {
+		if err := fn(c); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Stream はRealtime.SubscribeExecutionsなどから受け取った約定で足を作り、確定した足を流す。
+// 約定がなくても足の終わりを過ぎれば確定させる。inが閉じたら確定していない足も流して出力を閉じる。
+// ctxが終わったときは確定していない足を流さずに閉じる
+func Stream(ctx context.Context, a *Aggregator, in <-chan *bitflyer.Executions) <-chan Candle {
+	a.mustInterval()
+	out := make(chan Candle, 16)
+
+	go func() {
+		defer close(out)
+
+		d := a.Interval / 4
+		if d > time.Second {
+			d = time.Second
+		}
+		if d <= 0 {
+			d = a.Interval
+		}
+		tick := time.NewTicker(d)
+		defer tick.Stop()
+
+		send := func(candles []Candle) bool {
+			for _, c := range candles {
+				select {
+				case out <- c:
+				case <-ctx.Done():
+					return false
+				}
+			}
+			return true
+		}
+
+		for {
+			select {
+			case execs, ok := <-in:
+				if !ok {
+					send(a.Flush())
+					return
+				}
+				for i := range *execs {
+					if !send(a.Add(&(*execs)[i])) {
+						return
+					}
+				}
+			case now := <-tick.C:
+				if !send(a.Advance(now)) {
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return out
+}
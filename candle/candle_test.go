@@ -0,0 +1,223 @@
+package candle_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jackpopper/bitflyer"
+	"github.com/jackpopper/bitflyer/candle"
+)
+
+var base = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func execution(d time.Duration, price, size string, side bitflyer.Side) *bitflyer.Execution {
+	return &bitflyer.Execution{
+		Side:     side,
+		Price:    bitflyer.MustDecimal(price),
+		Size:     bitflyer.MustDecimal(size),
+		ExecDate: bitflyer.Time{Time: base.Add(d)},
+	}
+}
+
+func checkCandle(t *testing.T, c candle.Candle, start time.Duration, ohlcv ...string) {
+	t.Helper()
+	if !c.Start.Equal(base.Add(start)) {
+		t.Errorf("start = %s, want %s", c.Start, base.Add(start))
+	}
+	for i, got := range []bitflyer.Decimal{c.Open, c.High, c.Low, c.Close, c.Volume} {
+		if !got.Equal(bitflyer.MustDecimal(ohlcv[i])) {
+			t.Errorf("%s: ohlcv = %s %s %s %s %s, want %v", c.Start.Format(time.TimeOnly), c.Open, c.High, c.Low, c.Close, c.Volume, ohlcv)
+			return
+		}
+	}
+}
+
+func TestAggregate(t *testing.T) {
+	execs := bitflyer.Executions{
+		*execution(500*time.Millisecond, "100", "1", bitflyer.SideBuy),
+		*execution(700*time.Millisecond, "110", "1", bitflyer.SideSell),
+		*execution(3200*time.Millisecond, "105", "2", bitflyer.SideBuy),
+	}
+
+	cs := candle.Aggregate(execs, time.Second, false)
+	if len(cs) != 2 {
+		t.Fatalf("candles = %d, want 2", len(cs))
+	}
+	checkCandle(t, cs[0], 0, "100", "110", "100", "110", "2")
+	checkCandle(t, cs[1], 3*time.Second, "105", "105", "105", "105", "2")
+	c := cs[0]
+	if !c.BuyVolume.Equal(bitflyer.MustDecimal("1")) || !c.SellVolume.Equal(bitflyer.MustDecimal("1")) || c.Trades != 2 {
+		t.Errorf("buy = %s, sell = %s, trades = %d", c.BuyVolume, c.SellVolume, c.Trades)
+	}
+	if !c.Turnover.Equal(bitflyer.MustDecimal("210")) || !c.VWAP.Equal(bitflyer.MustDecimal("105")) {
+		t.Errorf("turnover = %s, vwap = %s", c.Turnover, c.VWAP)
+	}
+
+	// GetExecutionsの結果は新しい順
+	rev := bitflyer.Executions{execs[2], execs[1], execs[0]}
+	if cs := candle.FromExecutions(&rev, time.Second, false); len(cs) != 2 || !cs[0].Open.Equal(bitflyer.MustDecimal("100")) {
+		t.Errorf("FromExecutions = %+v", cs)
+	}
+}
+
+func TestAggregateFillGaps(t *testing.T) {
+	execs := bitflyer.Executions{
+		*execution(500*time.Millisecond, "100", "1", bitflyer.SideBuy),
+		*execution(700*time.Millisecond, "110", "1", bitflyer.SideSell),
+		*execution(3200*time.Millisecond, "105", "2", bitflyer.SideBuy),
+	}
+
+	cs := candle.Aggregate(execs, time.Second, true)
+	if len(cs) != 4 {
+		t.Fatalf("candles = %d, want 4", len(cs))
+	}
+	checkCandle(t, cs[0], 0, "100", "110", "100", "110", "2")
+	// 約定のない足は直前の終値で埋める
+	checkCandle(t, cs[1], time.Second, "110", "110", "110", "110", "0")
+	checkCandle(t, cs[2], 2*time.Second, "110", "110", "110", "110", "0")
+	checkCandle(t, cs[3], 3*time.Second, "105", "105", "105", "105", "2")
+	if cs[1].Trades != 0 || !cs[1].VWAP.Equal(bitflyer.MustDecimal("110")) {
+		t.Errorf("gap = %+v", cs[1])
+	}
+}
+
+func TestAggregatorLateExecution(t *testing.T) {
+	a := candle.NewAggregator(time.Minute, false)
+	if cs := a.Add(execution(10*time.Second, "100", "1", bitflyer.SideBuy)); len(cs) != 0 {
+		t.Fatalf("closed = %d", len(cs))
+	}
+	if cs := a.Add(execution(65*time.Second, "101", "1", bitflyer.SideBuy)); len(cs) != 1 {
+		t.Fatalf("closed = %d, want 1", len(cs))
+	}
+
+	// 確定した足の約定は捨てる
+	if cs := a.Add(execution(50*time.Second, "90", "1", bitflyer.SideBuy)); len(cs) != 0 {
+		t.Errorf("late execution closed %d candles", len(cs))
+	}
+	if c, _ := a.Current(); c.Trades != 1 || !c.Low.Equal(bitflyer.MustDecimal("101")) {
+		t.Errorf("current = %+v", c)
+	}
+
+	// Advanceで確定した足の約定も捨てる
+	if cs := a.Advance(base.Add(3 * time.Minute)); len(cs) != 1 {
+		t.Fatalf("advance closed = %d, want 1", len(cs))
+	}
+	if cs := a.Add(execution(90*time.Second, "90", "1", bitflyer.SideBuy)); len(cs) != 0 {
+		t.Errorf("late execution closed %d candles", len(cs))
+	}
+	if _, ok := a.Current(); ok {
+		t.Error("late execution opened a candle")
+	}
+	// 空白を埋めないなら、出していない足にはまだ入れられる
+	a.Add(execution(150*time.Second, "102", "1", bitflyer.SideBuy))
+	if c, ok := a.Current(); !ok || !c.Start.Equal(base.Add(2*time.Minute)) {
+		t.Errorf("current = %+v", c)
+	}
+}
+
+func TestAggregatorLateExecutionAfterGapFill(t *testing.T) {
+	a := candle.NewAggregator(time.Minute, true)
+	a.Add(execution(10*time.Second, "100", "1", bitflyer.SideBuy))
+	cs := a.Advance(base.Add(3 * time.Minute))
+	if len(cs) != 3 {
+		t.Fatalf("advance closed = %d, want 3", len(cs))
+	}
+
+	// 埋めた足の区間に届いた約定は捨てる
+	for _, d := range []time.Duration{30 * time.Second, 90 * time.Second, 150 * time.Second} {
+		if cs := a.Add(execution(d, "90", "1", bitflyer.SideBuy)); len(cs) != 0 {
+			t.Errorf("%s: closed %d candles", d, len(cs))
+		}
+		if _, ok := a.Current(); ok {
+			t.Errorf("%s: late execution opened a candle", d)
+		}
+	}
+
+	cs = a.Add(execution(190*time.Second, "103", "1", bitflyer.SideBuy))
+	if len(cs) != 0 {
+		t.Errorf("closed = %d", len(cs))
+	}
+	cs = a.Flush()
+	if len(cs) != 1 {
+		t.Fatalf("flush = %d, want 1", len(cs))
+	}
+	checkCandle(t, cs[0], 3*time.Minute, "103", "103", "103", "103", "1")
+
+	// Flushした足の約定も捨てる
+	if cs := a.Add(execution(200*time.Second, "90", "1", bitflyer.SideBuy)); len(cs) != 0 {
+		t.Errorf("closed = %d", len(cs))
+	}
+	if _, ok := a.Current(); ok {
+		t.Error("late execution opened a candle")
+	}
+}
+
+func TestAggregatorOffset(t *testing.T) {
+	jst := time.FixedZone("JST", 9*60*60)
+	a := candle.NewAggregator(24*time.Hour, false)
+	a.Offset = 9 * time.Hour
+
+	// 日本時間の1月1日23:59と1月2日0:00
+	a.Add(execution(14*time.Hour+59*time.Minute, "100", "1", bitflyer.SideBuy))
+	cs := a.Add(execution(15*time.Hour, "101", "1", bitflyer.SideBuy))
+	cs = append(cs, a.Flush()...)
+	if len(cs) != 2 {
+		t.Fatalf("candles = %d, want 2", len(cs))
+	}
+	for i, want := range []time.Time{
+		time.Date(2024, 1, 1, 0, 0, 0, 0, jst),
+		time.Date(2024, 1, 2, 0, 0, 0, 0, jst),
+	} {
+		if !cs[i].Start.Equal(want) {
+			t.Errorf("start = %s, want %s", cs[i].Start.In(jst), want)
+		}
+	}
+
+	// 1時間足の区切りはずらしても変わらない
+	h := candle.NewAggregator(time.Hour, false)
+	h.Offset = 9 * time.Hour
+	h.Add(execution(90*time.Minute, "100", "1", bitflyer.SideBuy))
+	if c, _ := h.Current(); !c.Start.Equal(base.Add(time.Hour)) {
+		t.Errorf("start = %s", c.Start)
+	}
+}
+
+func TestAggregatorInterval(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		fn   func()
+	}{
+		{"NewAggregator", func() { candle.NewAggregator(0, true) }},
+		{"Advance", func() { (&candle.Aggregator{FillGaps: true}).Advance(base) }},
+		{"Stream", func() { candle.Stream(context.Background(), &candle.Aggregator{Interval: -time.Second}, nil) }},
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%s: no panic", tt.name)
+				}
+			}()
+			tt.fn()
+		}()
+	}
+}
+
+func TestStream(t *testing.T) {
+	in := make(chan *bitflyer.Executions)
+	out := candle.Stream(context.Background(), candle.NewAggregator(time.Hour, false), in)
+
+	in <- &bitflyer.Executions{*execution(0, "100", "1", bitflyer.SideBuy), *execution(time.Hour, "110", "2", bitflyer.SideSell)}
+	checkCandle(t, <-out, 0, "100", "100", "100", "100", "1")
+
+	// inが閉じたら確定していない足も流す
+	close(in)
+	c, ok := <-out
+	if !ok {
+		t.Fatal("partial candle dropped")
+	}
+	checkCandle(t, c, time.Hour, "110", "110", "110", "110", "2")
+	if _, ok := <-out; ok {
+		t.Error("out not closed")
+	}
+}
@@ -0,0 +1,170 @@
+package bitflyer
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// * 認証情報と署名
+// Private APIとRealtime APIの認証はSignerを通して署名する。
+// ClientにSignerがなければCredentials(それもなければAPIKey/APISecret)を使ってHMAC-SHA256で署名する
+
+var ErrNoCredentials = errors.New("bitflyer: no credentials")
+
+type Credentials struct {
+	APIKey    string `json:"api_key"`
+	APISecret string `json:"api_secret"`
+}
+
+type CredentialsProvider interface {
+	Credentials(ctx context.Context) (Credentials, error)
+}
+
+// Signer はmessageに署名し、署名に使ったAPIキーと署名を返す。
+// 別プロセスで署名する場合はこれを実装する
+type Signer interface {
+	Sign(ctx context.Context, message string) (apiKey, signature string, err error)
+}
+
+// ** HMAC-SHA256
+type HMACSigner struct {
+	Credentials CredentialsProvider
+}
+
+func (s *HMACSigner) Sign(ctx context.Context, message string) (string, string, error) {
+	cr, err := s.Credentials.Credentials(ctx)
+	if err != nil {
+		return "", "", err
+	}
+	if cr.APIKey == "" || cr.APISecret == "" {
+		return "", "", ErrNoCredentials
+	}
+
+	return cr.APIKey, createHMAC(message, cr.APISecret), nil
+}
+
+func createHMAC(msg, key string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(msg))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (c *Client) signer() Signer {
+	if c.Signer != nil {
+		return c.Signer
+	}
+	if c.Credentials != nil {
+		return &HMACSigner{Credentials: c.Credentials}
+	}
+	return &HMACSigner{Credentials: StaticCredentials{APIKey: c.APIKey, APISecret: c.APISecret}}
+}
+
+func (c *Client) hasCredentials() bool {
+	return c.Signer != nil || c.Credentials != nil || c.APIKey != ""
+}
+
+// ** 固定のキー
+type StaticCredentials Credentials
+
+func (s StaticCredentials) Credentials(ctx context.Context) (Credentials, error) {
+	return Credentials(s), nil
+}
+
+// ** 環境変数
+type EnvCredentials struct {
+	// 空ならBITFLYER_API_KEY, BITFLYER_API_SECRET
+	KeyVar    string
+	SecretVar string
+}
+
+func (e EnvCredentials) Credentials(ctx context.Context) (Credentials, error) {
+	keyVar, secretVar := e.KeyVar, e.SecretVar
+	if keyVar == "" {
+		keyVar = "BITFLYER_API_KEY"
+	}
+	if secretVar == "" {
+		secretVar = "BITFLYER_API_SECRET"
+	}
+
+	cr := Credentials{APIKey: os.Getenv(keyVar), APISecret: os.Getenv(secretVar)}
+	if cr.APIKey == "" || cr.APISecret == "" {
+		return Credentials{}, fmt.Errorf("%w: %s or %s is not set", ErrNoCredentials, keyVar, secretVar)
+	}
+
+	return cr, nil
+}
+
+// ** ファイル
+// {"api_key": "...", "api_secret": "..."} の形のJSONファイル。
+// 所有者以外が読み書きできるパーミッションなら読まない。更新されたら読み直す
+type FileCredentials struct {
+	Path string
+
+	mu      sync.Mutex
+	modTime time.Time
+	cached  Credentials
+}
+
+func NewFileCredentials(path string) *FileCredentials {
+	return &FileCredentials{Path: path}
+}
+
+func (f *FileCredentials) Credentials(ctx context.Context) (Credentials, error) {
+	info, err := os.Stat(f.Path)
+	if err != nil {
+		return Credentials{}, err
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return Credentials{}, fmt.Errorf("bitflyer: permissions %o for %s are too open", info.Mode().Perm(), f.Path)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if info.ModTime().Equal(f.modTime) {
+		return f.cached, nil
+	}
+	b, err := os.ReadFile(f.Path)
+	if err != nil {
+		return Credentials{}, err
+	}
+	var cr Credentials
+	if err := json.Unmarshal(b, &cr); err != nil {
+		return Credentials{}, fmt.Errorf("bitflyer: %s: %v", f.Path, err)
+	}
+	f.cached, f.modTime = cr, info.ModTime()
+
+	return cr, nil
+}
+
+// ** 差し替え可能なキー
+// Rotateで新しいキーに差し替えると、以降のリクエストからそのキーで署名する
+type RotatingCredentials struct {
+	mu      sync.RWMutex
+	current Credentials
+}
+
+func NewRotatingCredentials(initial Credentials) *RotatingCredentials {
+	return &RotatingCredentials{current: initial}
+}
+
+func (r *RotatingCredentials) Credentials(ctx context.Context) (Credentials, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.current, nil
+}
+
+func (r *RotatingCredentials) Rotate(cr Credentials) {
+	r.mu.Lock()
+	r.current = cr
+	r.mu.Unlock()
+}
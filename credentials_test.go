@@ -0,0 +1,130 @@
+package bitflyer_test
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackpopper/bitflyer"
+)
+
+func TestHMACSigner(t *testing.T) {
+	s := &bitflyer.HMACSigner{Credentials: bitflyer.StaticCredentials{APIKey: "key", APISecret: "secret"}}
+	key, sign, err := s.Sign(context.Background(), "1700000000000GET/v1/me/getbalance")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != "key" || sign != "da06260b464f88a4dad2088d9346efa6b26c31f183af682c4fc3cfe1ec76463f" {
+		t.Errorf("Sign = %s, %s", key, sign)
+	}
+
+	s.Credentials = bitflyer.StaticCredentials{APIKey: "key"}
+	if _, _, err := s.Sign(context.Background(), ""); !errors.Is(err, bitflyer.ErrNoCredentials) {
+		t.Errorf("err = %v, want %v", err, bitflyer.ErrNoCredentials)
+	}
+}
+
+func TestEnvCredentials(t *testing.T) {
+	e := bitflyer.EnvCredentials{KeyVar: "TEST_BITFLYER_KEY", SecretVar: "TEST_BITFLYER_SECRET"}
+	t.Setenv("TEST_BITFLYER_KEY", "key")
+	t.Setenv("TEST_BITFLYER_SECRET", "")
+	_, err := e.Credentials(context.Background())
+	if !errors.Is(err, bitflyer.ErrNoCredentials) || !strings.Contains(err.Error(), "TEST_BITFLYER_SECRET") {
+		t.Errorf("err = %v", err)
+	}
+
+	t.Setenv("TEST_BITFLYER_SECRET", "secret")
+	cr, err := e.Credentials(context.Background())
+	if err != nil || cr != (bitflyer.Credentials{APIKey: "key", APISecret: "secret"}) {
+		t.Errorf("Credentials = %+v, %v", cr, err)
+	}
+}
+
+func TestFileCredentials(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "credentials.json")
+	write := func(key string, modTime time.Time) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(`{"api_key":"`+key+`","api_secret":"secret"}`), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f := bitflyer.NewFileCredentials(path)
+	ctx := context.Background()
+
+	write("key1", time.Now().Add(-time.Hour))
+	if cr, err := f.Credentials(ctx); err != nil || cr.APIKey != "key1" {
+		t.Fatalf("Credentials = %+v, %v", cr, err)
+	}
+
+	// 更新されたら読み直す
+	write("key2", time.Now())
+	if cr, err := f.Credentials(ctx); err != nil || cr.APIKey != "key2" {
+		t.Errorf("Credentials = %+v, %v", cr, err)
+	}
+
+	// 所有者以外が読めるなら読まない
+	for _, perm := range []os.FileMode{0640, 0604, 0660} {
+		if err := os.Chmod(path, perm); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Credentials(ctx); err == nil || !strings.Contains(err.Error(), "too open") {
+			t.Errorf("%o: err = %v", perm, err)
+		}
+	}
+}
+
+func TestRotatingCredentials(t *testing.T) {
+	var mu sync.Mutex
+	var keys []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		keys = append(keys, r.Header.Get("ACCESS-KEY"))
+		mu.Unlock()
+
+		// 署名はタイムスタンプ、メソッド、パス、ボディをその時のキーで
+		secret := "secret-" + r.Header.Get("ACCESS-KEY")
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(r.Header.Get("ACCESS-TIMESTAMP") + r.Method + r.URL.RequestURI()))
+		if hex.EncodeToString(mac.Sum(nil)) != r.Header.Get("ACCESS-SIGN") {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"status":-500,"error_message":"Invalid signature"}`))
+			return
+		}
+		w.Write([]byte(`[]`))
+	}))
+	defer ts.Close()
+
+	rc := bitflyer.NewRotatingCredentials(bitflyer.Credentials{APIKey: "old", APISecret: "secret-old"})
+	c := bitflyer.NewClient("", "")
+	c.URL, _ = url.Parse(ts.URL + "/v1")
+	c.Credentials = rc
+	ctx := context.Background()
+
+	if _, err := c.GetMyBalance(ctx); err != nil {
+		t.Fatal(err)
+	}
+	rc.Rotate(bitflyer.Credentials{APIKey: "new", APISecret: "secret-new"})
+	if _, err := c.GetMyBalance(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(keys) != 2 || keys[0] != "old" || keys[1] != "new" {
+		t.Errorf("keys = %v", keys)
+	}
+}
@@ -0,0 +1,302 @@
+package bitflyer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// * 10進数
+// 価格・数量・金額をJSONから誤差なく読み書きするための型。値は coef * 10^exp。
+// ゼロ値は0として使え、演算は常に新しい値を返す
+
+type Decimal struct {
+	coef *big.Int
+	exp  int32
+}
+
+var bigTen = big.NewInt(10)
+
+func NewDecimal(coef int64, exp int32) Decimal {
+	return Decimal{coef: big.NewInt(coef), exp: exp}
+}
+
+func NewDecimalFromInt(v int64) Decimal {
+	return NewDecimal(v, 0)
+}
+
+// NewDecimalFromFloat はfを表す最短の10進表記から作る
+func NewDecimalFromFloat(f float64) Decimal {
+	d, _ := ParseDecimal(strconv.FormatFloat(f, 'f', -1, 64))
+	return d
+}
+
+func ParseDecimal(s string) (Decimal, error) {
+	orig := s
+	var exp int64
+	if i := strings.IndexAny(s, "eE"); i >= 0 {
+		e, err := strconv.ParseInt(s[i+1:], 10, 32)
+		if err != nil {
+			return Decimal{}, fmt.Errorf("bitflyer: invalid decimal %q", orig)
+		}
+		exp = e
+		s = s[:i]
+	}
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		exp -= int64(len(s) - i - 1)
+		s = s[:i] + s[i+1:]
+	}
+	if s == "" || s == "-" || s == "+" || strings.ContainsAny(s[1:], "+-") {
+		return Decimal{}, fmt.Errorf("bitflyer: invalid decimal %q", orig)
+	}
+	coef, ok := new(big.Int).SetString(s, 10)
+	if !ok {
+		return Decimal{}, fmt.Errorf("bitflyer: invalid decimal %q", orig)
+	}
+
+	return Decimal{coef: coef, exp: int32(exp)}, nil
+}
+
+func MustDecimal(s string) Decimal {
+	d, err := ParseDecimal(s)
+	if err != nil {
+		panic(err)
+	}
+	return d
+}
+
+func (d Decimal) coefficient() *big.Int {
+	if d.coef == nil {
+		return new(big.Int)
+	}
+	return d.coef
+}
+
+// rescale は指数をexp(<=d.exp)に合わせた係数を返す
+func (d Decimal) rescale(exp int32) *big.Int {
+	c := new(big.Int).Set(d.coefficient())
+	if exp < d.exp {
+		m := new(big.Int).Exp(bigTen, big.NewInt(int64(d.exp-exp)), nil)
+		c.Mul(c, m)
+	}
+	return c
+}
+
+func align(a, b Decimal) (*big.Int, *big.Int, int32) {
+	exp := a.exp
+	if b.exp < exp {
+		exp = b.exp
+	}
+	return a.rescale(exp), b.rescale(exp), exp
+}
+
+func (d Decimal) Add(d2 Decimal) Decimal {
+	a, b, exp := align(d, d2)
+	return Decimal{coef: a.Add(a, b), exp: exp}
+}
+
+func (d Decimal) Sub(d2 Decimal) Decimal {
+	a, b, exp := align(d, d2)
+	return Decimal{coef: a.Sub(a, b), exp: exp}
+}
+
+func (d Decimal) Mul(d2 Decimal) Decimal {
+	c := new(big.Int).Mul(d.coefficient(), d2.coefficient())
+	return Decimal{coef: c, exp: d.exp + d2.exp}
+}
+
+// Div はd/d2を小数点以下places桁に四捨五入する。d2が0ならpanicする
+func (d Decimal) Div(d2 Decimal, places int32) Decimal {
+	if d2.Sign() == 0 {
+		panic("bitflyer: decimal division by zero")
+	}
+
+	// d/d2 * 10^places = d.coef * 10^(d.exp - d2.exp + places) / d2.coef
+	num := new(big.Int).Set(d.coefficient())
+	den := new(big.Int).Set(d2.coefficient())
+	shift := int64(d.exp) - int64(d2.exp) + int64(places)
+	m := new(big.Int).Exp(bigTen, big.NewInt(abs64(shift)), nil)
+	if shift >= 0 {
+		num.Mul(num, m)
+	} else {
+		den.Mul(den, m)
+	}
+
+	return Decimal{coef: quoRound(num, den), exp: -places}
+}
+
+// quoRound はnum/denを四捨五入(0から遠い方へ)した整数
+func quoRound(num, den *big.Int) *big.Int {
+	q, r := new(big.Int).QuoRem(num, den, new(big.Int))
+	r.Abs(r).Lsh(r, 1)
+	if r.CmpAbs(den) >= 0 {
+		if num.Sign()*den.Sign() < 0 {
+			q.Sub(q, big.NewInt(1))
+		} else {
+			q.Add(q, big.NewInt(1))
+		}
+	}
+	return q
+}
+
+func abs64(v int64) int64 {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+func (d Decimal) Neg() Decimal {
+	return Decimal{coef: new(big.Int).Neg(d.coefficient()), exp: d.exp}
+}
+
+func (d Decimal) Abs() Decimal {
+	return Decimal{coef: new(big.Int).Abs(d.coefficient()), exp: d.exp}
+}
+
+func (d Decimal) Sign() int {
+	return d.coefficient().Sign()
+}
+
+func (d Decimal) IsZero() bool {
+	return d.Sign() == 0
+}
+
+func (d Decimal) Cmp(d2 Decimal) int {
+	a, b, _ := align(d, d2)
+	return a.Cmp(b)
+}
+
+// Equal は表記の桁数によらず値が等しいか
+func (d Decimal) Equal(d2 Decimal) bool {
+	return d.Cmp(d2) == 0
+}
+
+// Round は小数点以下places桁に四捨五入する
+func (d Decimal) Round(places int32) Decimal {
+	return d.RoundStep(NewDecimal(1, -places))
+}
+
+// FloorStep はstepの倍数に切り捨てる。stepが0以下ならdをそのまま返す
+func (d Decimal) FloorStep(step Decimal) Decimal {
+	if step.Sign() <= 0 {
+		return d
+	}
+	a, b, _ := align(d, step)
+	q := new(big.Int).Div(a, b) // bが正ならユークリッド除算は切り捨て
+	return Decimal{coef: q.Mul(q, step.coefficient()), exp: step.exp}
+}
+
+// CeilStep はstepの倍数に切り上げる。stepが0以下ならdをそのまま返す
+func (d Decimal) CeilStep(step Decimal) Decimal {
+	return d.Neg().FloorStep(step).Neg()
+}
+
+// RoundStep はstepの倍数に四捨五入する。stepが0以下ならdをそのまま返す
+func (d Decimal) RoundStep(step Decimal) Decimal {
+	if step.Sign() <= 0 {
+		return d
+	}
+	a, b, _ := align(d, step)
+	q := quoRound(a, b)
+	return Decimal{coef: q.Mul(q, step.coefficient()), exp: step.exp}
+}
+
+func (d Decimal) Float64() float64 {
+	f, _ := strconv.ParseFloat(d.String(), 64)
+	return f
+}
+
+func (d Decimal) String() string {
+	s := d.coefficient().String()
+	if d.exp >= 0 {
+		if d.Sign() == 0 {
+			return "0"
+		}
+		return s + strings.Repeat("0", int(d.exp))
+	}
+
+	neg := strings.HasPrefix(s, "-")
+	s = strings.TrimPrefix(s, "-")
+	n := int(-d.exp)
+	if len(s) <= n {
+		s = strings.Repeat("0", n-len(s)+1) + s
+	}
+	s = s[:len(s)-n] + "." + s[len(s)-n:]
+	if neg {
+		s = "-" + s
+	}
+	return s
+}
+
+func (d Decimal) MarshalJSON() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+// UnmarshalJSON は数値と文字列のどちらも受け付ける
+func (d *Decimal) UnmarshalJSON(b []byte) error {
+	s := string(b)
+	if s == "null" {
+		*d = Decimal{}
+		return nil
+	}
+	if strings.HasPrefix(s, `"`) {
+		if err := json.Unmarshal(b, &s); err != nil {
+			return err
+		}
+	}
+
+	v, err := ParseDecimal(s)
+	if err != nil {
+		return err
+	}
+	*d = v
+
+	return nil
+}
+
+// * 銘柄ごとの呼値と最小注文数量
+
+var ErrBelowMinimumSize = errors.New("bitflyer: size is below the minimum order size")
+
+type ProductSpec struct {
+	// 価格の刻み
+	TickSize Decimal
+	// 最小注文数量
+	MinSize Decimal
+	// 数量の刻み
+	SizeStep Decimal
+}
+
+var ProductSpecs = map[string]ProductSpec{
+	"BTC_JPY":    {TickSize: MustDecimal("1"), MinSize: MustDecimal("0.001"), SizeStep: MustDecimal("0.00000001")},
+	"FX_BTC_JPY": {TickSize: MustDecimal("1"), MinSize: MustDecimal("0.01"), SizeStep: MustDecimal("0.00000001")},
+	"ETH_JPY":    {TickSize: MustDecimal("1"), MinSize: MustDecimal("0.01"), SizeStep: MustDecimal("0.00000001")},
+	"ETH_BTC":    {TickSize: MustDecimal("0.00001"), MinSize: MustDecimal("0.01"), SizeStep: MustDecimal("0.00000001")},
+	"BCH_BTC":    {TickSize: MustDecimal("0.00001"), MinSize: MustDecimal("0.01"), SizeStep: MustDecimal("0.00000001")},
+}
+
+func LookupProductSpec(productCode string) (ProductSpec, bool) {
+	s, ok := ProductSpecs[productCode]
+	return s, ok
+}
+
+// RoundPrice は呼値に合わせる。買いは切り捨て、売りは切り上げで不利にならない方へ寄せる
+func (s ProductSpec) RoundPrice(price Decimal, side Side) Decimal {
+	if side == SideSell {
+		return price.CeilStep(s.TickSize)
+	}
+	return price.FloorStep(s.TickSize)
+}
+
+// RoundSize は数量の刻みに切り捨てる。最小注文数量に満たなければErrBelowMinimumSize
+func (s ProductSpec) RoundSize(size Decimal) (Decimal, error) {
+	size = size.FloorStep(s.SizeStep)
+	if size.Cmp(s.MinSize) < 0 {
+		return size, ErrBelowMinimumSize
+	}
+	return size, nil
+}
@@ -0,0 +1,212 @@
+package bitflyer_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/jackpopper/bitflyer"
+)
+
+func TestParseDecimal(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"0", "0"},
+		{"123", "123"},
+		{"-0.5", "-0.5"},
+		{"+2", "2"},
+		{"0.10000001", "0.10000001"},
+		{"1e-8", "0.00000001"},
+		{"-1.5E3", "-1500"},
+		{"12e2", "1200"},
+	}
+	for _, tt := range tests {
+		d, err := bitflyer.ParseDecimal(tt.in)
+		if err != nil {
+			t.Errorf("ParseDecimal(%q): %v", tt.in, err)
+			continue
+		}
+		if d.String() != tt.want {
+			t.Errorf("ParseDecimal(%q) = %s, want %s", tt.in, d, tt.want)
+		}
+	}
+
+	for _, in := range []string{"", "-", "+", "abc", "1.2.3", "1e", "1e-", "--1", "1-2"} {
+		if _, err := bitflyer.ParseDecimal(in); err == nil {
+			t.Errorf("ParseDecimal(%q) succeeded", in)
+		}
+	}
+}
+
+func TestDecimalJSON(t *testing.T) {
+	var v struct {
+		Number bitflyer.Decimal `json:"number"`
+		String bitflyer.Decimal `json:"string"`
+		Null   bitflyer.Decimal `json:"null"`
+		Exp    bitflyer.Decimal `json:"exp"`
+	}
+	if err := json.Unmarshal([]byte(`{"number":0.10000001,"string":"-0.00000001","null":null,"exp":1e-8}`), &v); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		got  bitflyer.Decimal
+		want string
+	}{
+		{v.Number, "0.10000001"},
+		{v.String, "-0.00000001"},
+		{v.Null, "0"},
+		{v.Exp, "0.00000001"},
+	} {
+		if tt.got.String() != tt.want {
+			t.Errorf("got %s, want %s", tt.got, tt.want)
+		}
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"number":0.10000001,"string":-0.00000001,"null":0,"exp":0.00000001}`; string(b) != want {
+		t.Errorf("Marshal = %s, want %s", b, want)
+	}
+
+	var d bitflyer.Decimal
+	for _, in := range []string{`"abc"`, `true`, `"1"x`} {
+		if err := json.Unmarshal([]byte(in), &d); err == nil {
+			t.Errorf("Unmarshal(%s) succeeded", in)
+		}
+	}
+}
+
+func TestDecimalArithmetic(t *testing.T) {
+	d := bitflyer.MustDecimal
+	tests := []struct {
+		name string
+		got  bitflyer.Decimal
+		want string
+	}{
+		{"add", d("0.1").Add(d("0.2")), "0.3"},
+		{"add negative", d("0.1").Add(d("-0.25")), "-0.15"},
+		{"sub", d("1").Sub(d("0.00000001")), "0.99999999"},
+		{"sub below zero", d("-1.5").Sub(d("2")), "-3.5"},
+		{"mul", d("0.01").Mul(d("5000000")), "50000"},
+		{"mul negative", d("-0.3").Mul(d("0.3")), "-0.09"},
+		{"div", d("1").Div(d("3"), 4), "0.3333"},
+		{"div round half up", d("1").Div(d("8"), 2), "0.13"},
+		{"div negative", d("-2").Div(d("3"), 2), "-0.67"},
+		{"div negative divisor", d("2").Div(d("-3"), 2), "-0.67"},
+		{"div negative round half", d("-1").Div(d("8"), 2), "-0.13"},
+		{"neg", d("1.5").Neg(), "-1.5"},
+		{"abs", d("-1.5").Abs(), "1.5"},
+		{"round", d("2.345").Round(2), "2.35"},
+		{"round negative", d("-2.345").Round(2), "-2.35"},
+		{"zero value", bitflyer.Decimal{}.Add(d("1")), "1"},
+	}
+	for _, tt := range tests {
+		if !tt.got.Equal(d(tt.want)) {
+			t.Errorf("%s = %s, want %s", tt.name, tt.got, tt.want)
+		}
+	}
+
+	if c := d("0.1").Cmp(d("0.10")); c != 0 {
+		t.Errorf("Cmp(0.1, 0.10) = %d", c)
+	}
+	if c := d("-2").Cmp(d("-1")); c != -1 {
+		t.Errorf("Cmp(-2, -1) = %d", c)
+	}
+	if s := d("-0.00000001").Sign(); s != -1 {
+		t.Errorf("Sign = %d", s)
+	}
+	if !(bitflyer.Decimal{}).IsZero() || !d("0.000").IsZero() {
+		t.Error("IsZero = false")
+	}
+	if f := d("-0.125").Float64(); f != -0.125 {
+		t.Errorf("Float64 = %v", f)
+	}
+	if s := bitflyer.NewDecimalFromFloat(0.1).String(); s != "0.1" {
+		t.Errorf("NewDecimalFromFloat(0.1) = %s", s)
+	}
+}
+
+func TestDecimalStep(t *testing.T) {
+	d := bitflyer.MustDecimal
+	tests := []struct {
+		in, step           string
+		floor, ceil, round string
+	}{
+		{"1.5", "1", "1", "2", "2"},
+		{"-1.5", "1", "-2", "-1", "-2"},
+		{"-1.4", "1", "-2", "-1", "-1"},
+		{"2", "1", "2", "2", "2"},
+		{"-2", "1", "-2", "-2", "-2"},
+		{"0.123", "0.01", "0.12", "0.13", "0.12"},
+		{"-0.123", "0.01", "-0.13", "-0.12", "-0.12"},
+		{"0.0012345678912", "0.00000001", "0.00123456", "0.00123457", "0.00123457"},
+		{"-0.0000000149", "0.00000001", "-0.00000002", "-0.00000001", "-0.00000001"},
+		{"1234567", "5", "1234565", "1234570", "1234565"},
+		{"-7.5", "5", "-10", "-5", "-10"},
+		// 刻みがなければそのまま
+		{"1.23", "0", "1.23", "1.23", "1.23"},
+		{"-1.23", "0", "-1.23", "-1.23", "-1.23"},
+		{"1.23", "-0.1", "1.23", "1.23", "1.23"},
+	}
+	for _, tt := range tests {
+		v, step := d(tt.in), d(tt.step)
+		if got := v.FloorStep(step); !got.Equal(d(tt.floor)) {
+			t.Errorf("%s.FloorStep(%s) = %s, want %s", tt.in, tt.step, got, tt.floor)
+		}
+		if got := v.CeilStep(step); !got.Equal(d(tt.ceil)) {
+			t.Errorf("%s.CeilStep(%s) = %s, want %s", tt.in, tt.step, got, tt.ceil)
+		}
+		if got := v.RoundStep(step); !got.Equal(d(tt.round)) {
+			t.Errorf("%s.RoundStep(%s) = %s, want %s", tt.in, tt.step, got, tt.round)
+		}
+	}
+}
+
+func TestProductSpec(t *testing.T) {
+	d := bitflyer.MustDecimal
+	spec, ok := bitflyer.LookupProductSpec("BTC_JPY")
+	if !ok {
+		t.Fatal("BTC_JPY not found")
+	}
+	if p := spec.RoundPrice(d("1234567.89"), bitflyer.SideBuy); !p.Equal(d("1234567")) {
+		t.Errorf("buy price = %s", p)
+	}
+	if p := spec.RoundPrice(d("1234567.89"), bitflyer.SideSell); !p.Equal(d("1234568")) {
+		t.Errorf("sell price = %s", p)
+	}
+	if s, err := spec.RoundSize(d("0.0012345678912")); err != nil || !s.Equal(d("0.00123456")) {
+		t.Errorf("RoundSize = %s, %v", s, err)
+	}
+	if _, err := spec.RoundSize(d("0.0009")); err != bitflyer.ErrBelowMinimumSize {
+		t.Errorf("RoundSize = %v, want %v", err, bitflyer.ErrBelowMinimumSize)
+	}
+}
+
+// 板・Ticker・約定の価格と数量は受け取った10進表記のまま保つ
+func TestMarketDataDecimal(t *testing.T) {
+	var tk bitflyer.Ticker
+	if err := json.Unmarshal([]byte(`{"best_bid":0.1,"best_ask":"0.3","volume":12345.67890123}`), &tk); err != nil {
+		t.Fatal(err)
+	}
+	if spread := tk.BestAsk.Sub(tk.BestBid); !spread.Equal(bitflyer.MustDecimal("0.2")) {
+		t.Errorf("spread = %s", spread)
+	}
+	if tk.Volume.String() != "12345.67890123" {
+		t.Errorf("volume = %s", tk.Volume)
+	}
+
+	ob := bitflyer.NewOrderBook("BTC_JPY")
+	ob.Reset(&bitflyer.Board{
+		Bids: []bitflyer.PriceLevel{{Price: bitflyer.MustDecimal("100"), Size: bitflyer.MustDecimal("0.1")}, {Price: bitflyer.MustDecimal("99"), Size: bitflyer.MustDecimal("0.2")}},
+		Asks: []bitflyer.PriceLevel{{Price: bitflyer.MustDecimal("101"), Size: bitflyer.MustDecimal("0.3")}},
+	})
+	if mid := ob.MidPrice(); !mid.Equal(bitflyer.MustDecimal("100.5")) {
+		t.Errorf("mid = %s", mid)
+	}
+	if size := ob.CumulativeSize(bitflyer.SideBuy, bitflyer.MustDecimal("99")); !size.Equal(bitflyer.MustDecimal("0.3")) {
+		t.Errorf("cumulative size = %s", size)
+	}
+}
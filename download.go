@@ -0,0 +1,324 @@
+package bitflyer
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// * 約定履歴のダウンロード
+// GetExecutionsを新しい方から古い方へ辿り、約定をChunkSize件ずつgzip圧縮したJSONLファイルに書く。
+// チャンクを書くたびにチェックポイントを保存するので、中断しても続きから再開できる
+
+const (
+	checkpointFile   = "checkpoint.json"
+	defaultChunkSize = 10000
+)
+
+type Downloader struct {
+	Client      *Client
+	ProductCode string
+	// チャンクとチェックポイントを書くディレクトリ
+	Dir string
+	// 1ファイルあたりの約定数。0なら10000
+	ChunkSize int
+	// 1回のリクエストで取得する件数。0なら500
+	Count int
+	// 取得するIDの範囲(両端を含む)。0なら制限しない
+	StartID int
+	EndID   int
+	// 取得する期間。ゼロ値なら制限しない
+	Since time.Time
+	Until time.Time
+}
+
+type Checkpoint struct {
+	ProductCode string `json:"product_code"`
+	// ダウンロードを始めたときの範囲。違う範囲では再開しない
+	StartID int       `json:"start_id"`
+	EndID   int       `json:"end_id"`
+	Since   time.Time `json:"since"`
+	Until   time.Time `json:"until"`
+	// 書き終えた最も古い約定のID。再開時はこれより前を取得する
+	Cursor int         `json:"cursor"`
+	Done   bool        `json:"done"`
+	Chunks []ChunkInfo `json:"chunks"`
+	Update time.Time   `json:"update"`
+}
+
+// ChunkInfo はチャンクファイル1つ分。Chunksは新しいものから順に並ぶ
+type ChunkInfo struct {
+	File    string `json:"file"`
+	FirstID int    `json:"first_id"`
+	LastID  int    `json:"last_id"`
+	Count   int    `json:"count"`
+	// 取得時にこのチャンクの直前に受け取った(新しい側の)約定のID。最初のチャンクでは0。
+	// Verifyで新しい側のチャンクの実際の先頭と突き合わせ、抜けがないことを確かめる
+	NextID int `json:"next_id"`
+}
+
+func (c *Client) NewDownloader(productCode, dir string) *Downloader {
+	return &Downloader{Client: c, ProductCode: productCode, Dir: dir}
+}
+
+// Run はダウンロードを実行する。チェックポイントがあれば続きから再開し、完了後にVerifyする
+func (d *Downloader) Run(ctx context.Context) error {
+	if err := os.MkdirAll(d.Dir, 0755); err != nil {
+		return err
+	}
+	cp, err := d.LoadCheckpoint()
+	if err != nil {
+		return err
+	}
+	if cp.Done {
+		return d.Verify()
+	}
+
+	from, next := cp.Cursor, cp.Cursor
+	if from == 0 && d.EndID > 0 {
+		from = d.EndID + 1
+	}
+	it := d.Client.IterExecutions(ctx, IterFilter{
+		ProductCode: d.ProductCode,
+		Count:       d.Count,
+		FromID:      from,
+		ToID:        d.StartID,
+		Since:       d.Since,
+		Until:       d.Until,
+	})
+
+	chunkSize := d.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = defaultChunkSize
+	}
+	buf := make([]Execution, 0, chunkSize)
+	for it.Next() {
+		buf = append(buf, it.Value())
+		if len(buf) >= chunkSize {
+			if err := d.writeChunk(cp, buf, next); err != nil {
+				return err
+			}
+			next = buf[len(buf)-1].ID
+			buf = buf[:0]
+		}
+	}
+	// 途中で失敗した場合、書きかけのチャンクは捨てて次回Cursorから取り直す
+	if err := it.Err(); err != nil {
+		return err
+	}
+	if len(buf) > 0 {
+		if err := d.writeChunk(cp, buf, next); err != nil {
+			return err
+		}
+	}
+
+	cp.Done = true
+	if err := d.saveCheckpoint(cp); err != nil {
+		return err
+	}
+
+	return d.Verify()
+}
+
+// LoadCheckpoint はチェックポイントを読む。銘柄や範囲がDownloaderと違えばエラー
+func (d *Downloader) LoadCheckpoint() (*Checkpoint, error) {
+	cp, err := readCheckpoint(d.Dir)
+	if os.IsNotExist(err) {
+		return &Checkpoint{ProductCode: d.ProductCode, StartID: d.StartID, EndID: d.EndID, Since: d.Since, Until: d.Until}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if cp.ProductCode != d.ProductCode {
+		return nil, fmt.Errorf("bitflyer: checkpoint is for %s, not %s", cp.ProductCode, d.ProductCode)
+	}
+	if cp.StartID != d.StartID || cp.EndID != d.EndID || !cp.Since.Equal(d.Since) || !cp.Until.Equal(d.Until) {
+		return nil, fmt.Errorf("bitflyer: checkpoint range (id %d-%d, %s - %s) does not match the downloader",
+			cp.StartID, cp.EndID, cp.Since.Format(time.RFC3339), cp.Until.Format(time.RFC3339))
+	}
+
+	return cp, nil
+}
+
+func readCheckpoint(dir string) (*Checkpoint, error) {
+	b, err := os.ReadFile(filepath.Join(dir, checkpointFile))
+	if err != nil {
+		return nil, err
+	}
+
+	var cp Checkpoint
+	if err := json.Unmarshal(b, &cp); err != nil {
+		return nil, fmt.Errorf("bitflyer: %s: %v", checkpointFile, err)
+	}
+
+	return &cp, nil
+}
+
+func (d *Downloader) saveCheckpoint(cp *Checkpoint) error {
+	cp.Update = time.Now().UTC()
+	b, err := json.MarshalIndent(cp, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(filepath.Join(d.Dir, checkpointFile), func(f *os.File) error {
+		_, err := f.Write(b)
+		return err
+	})
+}
+
+// writeChunk は新しい方から並んだbufを古い順に書き、チェックポイントを進める。
+// nextはbufの直前に受け取った約定のID
+func (d *Downloader) writeChunk(cp *Checkpoint, buf []Execution, next int) error {
+	data := make([]Execution, len(buf))
+	copy(data, buf)
+	sort.Slice(data, func(i, j int) bool { return data[i].ID < data[j].ID })
+
+	info := ChunkInfo{
+		File:    fmt.Sprintf("%s_%d_%d.jsonl.gz", d.ProductCode, data[0].ID, data[len(data)-1].ID),
+		FirstID: data[0].ID,
+		LastID:  data[len(data)-1].ID,
+		Count:   len(data),
+		NextID:  next,
+	}
+
+	err := writeFileAtomic(filepath.Join(d.Dir, info.File), func(f *os.File) error {
+		zw := gzip.NewWriter(f)
+		enc := json.NewEncoder(zw)
+		for i := range data {
+			if err := enc.Encode(&data[i]); err != nil {
+				return err
+			}
+		}
+		return zw.Close()
+	})
+	if err != nil {
+		return err
+	}
+
+	cp.Chunks = append(cp.Chunks, info)
+	cp.Cursor = info.FirstID
+
+	return d.saveCheckpoint(cp)
+}
+
+// Verify は書いたチャンクを読み直し、件数と並び順、チャンク間に抜けや重なりがないことを確かめる。
+// 隣り合うチャンクはファイルから読んだ実際の先頭と末尾のIDで比べる
+func (d *Downloader) Verify() error {
+	cp, err := d.LoadCheckpoint()
+	if err != nil {
+		return err
+	}
+
+	var newer *ChunkInfo
+	for i := range cp.Chunks {
+		info := &cp.Chunks[i]
+		var n, first, last int
+		err := readChunk(filepath.Join(d.Dir, info.File), func(e *Execution) error {
+			if n > 0 && e.ID <= last {
+				return fmt.Errorf("bitflyer: %s: id %d after %d", info.File, e.ID, last)
+			}
+			if n == 0 {
+				first = e.ID
+			}
+			last = e.ID
+			n++
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if n != info.Count {
+			return fmt.Errorf("bitflyer: %s: %d executions, want %d", info.File, n, info.Count)
+		}
+		if first != info.FirstID || last != info.LastID {
+			return fmt.Errorf("bitflyer: %s: ids %d-%d, want %d-%d", info.File, first, last, info.FirstID, info.LastID)
+		}
+		if newer != nil {
+			if last >= newer.FirstID {
+				return fmt.Errorf("bitflyer: %s overlaps %s", info.File, newer.File)
+			}
+			if info.NextID != newer.FirstID {
+				return fmt.Errorf("bitflyer: gap between %s and %s", info.File, newer.File)
+			}
+		} else if info.NextID != 0 {
+			return fmt.Errorf("bitflyer: %s: missing newer chunk before id %d", info.File, info.NextID)
+		}
+		newer = info
+	}
+
+	return nil
+}
+
+// ReadExecutionChunks はDownloaderが書いた約定を古い順にfnへ渡す。
+// 読むチャンクはチェックポイントに記録されたものだけ
+func ReadExecutionChunks(dir string, fn func(e *Execution) error) error {
+	cp, err := readCheckpoint(dir)
+	if err != nil {
+		return err
+	}
+
+	for i := len(cp.Chunks) - 1; i >= 0; i-- {
+		if err := readChunk(filepath.Join(dir, cp.Chunks[i].File), fn); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func readChunk(file string, fn func(e *Execution) error) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	zr, err := gzip.NewReader(bufio.NewReader(f))
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	dec := json.NewDecoder(zr)
+	for dec.More() {
+		var e Execution
+		if err := dec.Decode(&e); err != nil {
+			return fmt.Errorf("bitflyer: %s: %v", file, err)
+		}
+		if err := fn(&e); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writeFileAtomic は一時ファイルに書いてからrenameする
+func writeFileAtomic(name string, write func(f *os.File) error) error {
+	f, err := os.CreateTemp(filepath.Dir(name), "."+filepath.Base(name)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if err := write(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), name)
+}
@@ -0,0 +1,236 @@
+package bitflyer_test
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackpopper/bitflyer"
+	"github.com/jackpopper/bitflyer/bitflyertest"
+)
+
+func newDownloader(s *bitflyertest.Server, dir string) *bitflyer.Downloader {
+	c := s.Client()
+	c.RetryPolicy = nil
+	d := c.NewDownloader("BTC_JPY", dir)
+	d.ChunkSize = 30
+	d.Count = 10
+	return d
+}
+
+func readIDs(t *testing.T, dir string) []int {
+	t.Helper()
+	var got []int
+	err := bitflyer.ReadExecutionChunks(dir, func(e *bitflyer.Execution) error {
+		got = append(got, e.ID)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+func TestDownloader(t *testing.T) {
+	s := newIterServer(t)
+	dir := t.TempDir()
+	d := newDownloader(s, dir)
+	if err := d.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	cp, err := d.LoadCheckpoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cp.Done || len(cp.Chunks) != 4 || cp.Cursor != 1 {
+		t.Errorf("checkpoint = %+v", cp)
+	}
+	// チェックポイントにないファイルは読まない
+	if err := os.WriteFile(filepath.Join(dir, "BTC_JPY_1000_2000.jsonl.gz"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got := readIDs(t, dir); !reflect.DeepEqual(got, ids(1, 100)) {
+		t.Errorf("ids = %v", got)
+	}
+}
+
+func TestDownloaderRange(t *testing.T) {
+	s := newIterServer(t)
+	d := newDownloader(s, t.TempDir())
+	d.StartID, d.EndID = 21, 80
+	if err := d.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := readIDs(t, d.Dir); !reflect.DeepEqual(got, ids(21, 80)) {
+		t.Errorf("ids = %v", got)
+	}
+
+	d = newDownloader(s, t.TempDir())
+	d.Since, d.Until = iterBase.Add(50*time.Minute), iterBase.Add(59*time.Minute)
+	if err := d.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := readIDs(t, d.Dir); !reflect.DeepEqual(got, ids(50, 59)) {
+		t.Errorf("ids = %v", got)
+	}
+}
+
+func TestDownloaderResume(t *testing.T) {
+	s := newIterServer(t)
+	dir := t.TempDir()
+	// 5回目の取得で失敗させる。1チャンク(30件)を書いた後、2チャンク目の途中
+	for i := 0; i < 4; i++ {
+		s.InjectFault("executions", bitflyertest.Fault{})
+	}
+	s.InjectFault("executions", bitflyertest.Fault{HTTPStatus: 500, Message: "Internal Server Error"})
+
+	d := newDownloader(s, dir)
+	if err := d.Run(context.Background()); err == nil {
+		t.Fatal("Run succeeded")
+	}
+	cp, err := d.LoadCheckpoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cp.Done || len(cp.Chunks) != 1 || cp.Cursor != 71 {
+		t.Fatalf("checkpoint = %+v", cp)
+	}
+
+	if err := newDownloader(s, dir).Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := readIDs(t, dir); !reflect.DeepEqual(got, ids(1, 100)) {
+		t.Errorf("ids = %v", got)
+	}
+}
+
+func TestDownloaderRangeMismatch(t *testing.T) {
+	s := newIterServer(t)
+	dir := t.TempDir()
+	d := newDownloader(s, dir)
+	d.StartID = 11
+	if err := d.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, mod := range []func(d *bitflyer.Downloader){
+		func(d *bitflyer.Downloader) { d.StartID = 21 },
+		func(d *bitflyer.Downloader) { d.StartID, d.EndID = 11, 90 },
+		func(d *bitflyer.Downloader) { d.StartID, d.Since = 11, iterBase },
+		func(d *bitflyer.Downloader) { d.StartID, d.Until = 11, iterBase.Add(time.Hour) },
+	} {
+		d := newDownloader(s, dir)
+		mod(d)
+		if err := d.Run(context.Background()); err == nil || !strings.Contains(err.Error(), "does not match") {
+			t.Errorf("Run = %v", err)
+		}
+	}
+
+	d = newDownloader(s, dir)
+	d.StartID = 11
+	if err := d.Run(context.Background()); err != nil {
+		t.Errorf("Run with the same range = %v", err)
+	}
+}
+
+func TestDownloaderVerify(t *testing.T) {
+	tests := []struct {
+		name   string
+		tamper func(t *testing.T, dir string, cp *bitflyer.Checkpoint)
+		want   string
+	}{
+		{"middle chunk dropped", func(t *testing.T, dir string, cp *bitflyer.Checkpoint) {
+			cp.Chunks = append(cp.Chunks[:1], cp.Chunks[2:]...)
+		}, "gap"},
+		{"newest chunk dropped", func(t *testing.T, dir string, cp *bitflyer.Checkpoint) {
+			cp.Chunks = cp.Chunks[1:]
+		}, "missing newer chunk"},
+		{"first execution lost", func(t *testing.T, dir string, cp *bitflyer.Checkpoint) {
+			info := &cp.Chunks[1]
+			rewriteChunk(t, filepath.Join(dir, info.File), func(execs []bitflyer.Execution) []bitflyer.Execution { return execs[1:] })
+			info.Count--
+		}, "ids"},
+		{"overlap", func(t *testing.T, dir string, cp *bitflyer.Checkpoint) {
+			info := &cp.Chunks[1]
+			rewriteChunk(t, filepath.Join(dir, info.File), func(execs []bitflyer.Execution) []bitflyer.Execution {
+				e := execs[len(execs)-1]
+				e.ID = cp.Chunks[0].FirstID
+				return append(execs, e)
+			})
+			info.Count++
+			info.LastID = cp.Chunks[0].FirstID
+		}, "overlaps"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newIterServer(t)
+			dir := t.TempDir()
+			d := newDownloader(s, dir)
+			if err := d.Run(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+
+			cp, err := d.LoadCheckpoint()
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.tamper(t, dir, cp)
+			b, err := json.Marshal(cp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(dir, "checkpoint.json"), b, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := d.Verify(); err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Verify = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func rewriteChunk(t *testing.T, file string, edit func([]bitflyer.Execution) []bitflyer.Execution) {
+	t.Helper()
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var execs []bitflyer.Execution
+	dec := json.NewDecoder(zr)
+	for dec.More() {
+		var e bitflyer.Execution
+		if err := dec.Decode(&e); err != nil {
+			t.Fatal(err)
+		}
+		execs = append(execs, e)
+	}
+	f.Close()
+
+	w, err := os.Create(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	zw := gzip.NewWriter(w)
+	enc := json.NewEncoder(zw)
+	for _, e := range edit(execs) {
+		if err := enc.Encode(&e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
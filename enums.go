@@ -0,0 +1,300 @@
+package bitflyer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// * 列挙型
+// JSONへの変換時に未知の値をエラーにする。空文字列は省略として通す。
+// 取引所が値を増やしても応答を読めるように、JSONからの変換では未知の値も受け付ける
+
+type Side string
+
+const (
+	SideBuy  Side = "BUY"
+	SideSell Side = "SELL"
+)
+
+func (s Side) Valid() bool {
+	return s == SideBuy || s == SideSell
+}
+
+func (s Side) MarshalJSON() ([]byte, error) {
+	return marshalEnum("side", string(s), s.Valid())
+}
+
+func (s *Side) UnmarshalJSON(b []byte) error {
+	v, err := unmarshalEnum(b)
+	*s = Side(v)
+	return err
+}
+
+// ** 注文の執行条件
+type OrderType string
+
+const (
+	OrderTypeLimit  OrderType = "LIMIT"
+	OrderTypeMarket OrderType = "MARKET"
+)
+
+func (t OrderType) Valid() bool {
+	return t == OrderTypeLimit || t == OrderTypeMarket
+}
+
+func (t OrderType) MarshalJSON() ([]byte, error) {
+	return marshalEnum("order type", string(t), t.Valid())
+}
+
+func (t *OrderType) UnmarshalJSON(b []byte) error {
+	v, err := unmarshalEnum(b)
+	*t = OrderType(v)
+	return err
+}
+
+// ** 執行数量条件
+type TimeInForce string
+
+const (
+	TIFGTC TimeInForce = "GTC"
+	TIFIOC TimeInForce = "IOC"
+	TIFFOK TimeInForce = "FOK"
+)
+
+func (t TimeInForce) Valid() bool {
+	return t == TIFGTC || t == TIFIOC || t == TIFFOK
+}
+
+func (t TimeInForce) MarshalJSON() ([]byte, error) {
+	return marshalEnum("time in force", string(t), t.Valid())
+}
+
+func (t *TimeInForce) UnmarshalJSON(b []byte) error {
+	v, err := unmarshalEnum(b)
+	*t = TimeInForce(v)
+	return err
+}
+
+// ** 注文の状態
+type OrderState string
+
+const (
+	StateActive    OrderState = "ACTIVE"
+	StateCompleted OrderState = "COMPLETED"
+	StateCanceled  OrderState = "CANCELED"
+	StateExpired   OrderState = "EXPIRED"
+	StateRejected  OrderState = "REJECTED"
+)
+
+func (s OrderState) Valid() bool {
+	switch s {
+	case StateActive, StateCompleted, StateCanceled, StateExpired, StateRejected:
+		return true
+	}
+	return false
+}
+
+func (s OrderState) MarshalJSON() ([]byte, error) {
+	return marshalEnum("order state", string(s), s.Valid())
+}
+
+func (s *OrderState) UnmarshalJSON(b []byte) error {
+	v, err := unmarshalEnum(b)
+	*s = OrderState(v)
+	return err
+}
+
+// ** 親注文の注文方法
+type OrderMethod string
+
+const (
+	MethodSimple OrderMethod = "SIMPLE"
+	MethodIFD    OrderMethod = "IFD"
+	MethodOCO    OrderMethod = "OCO"
+	MethodIFDOCO OrderMethod = "IFDOCO"
+)
+
+func (m OrderMethod) Valid() bool {
+	switch m {
+	case MethodSimple, MethodIFD, MethodOCO, MethodIFDOCO:
+		return true
+	}
+	return false
+}
+
+// parameters は注文方法ごとに必要なParametersの数
+func (m OrderMethod) parameters() int {
+	switch m {
+	case MethodSimple:
+		return 1
+	case MethodIFD, MethodOCO:
+		return 2
+	case MethodIFDOCO:
+		return 3
+	}
+	return 0
+}
+
+func (m OrderMethod) MarshalJSON() ([]byte, error) {
+	return marshalEnum("order method", string(m), m.Valid())
+}
+
+func (m *OrderMethod) UnmarshalJSON(b []byte) error {
+	v, err := unmarshalEnum(b)
+	*m = OrderMethod(v)
+	return err
+}
+
+// ** 親注文の執行条件
+type ConditionType string
+
+const (
+	ConditionLimit     ConditionType = "LIMIT"
+	ConditionMarket    ConditionType = "MARKET"
+	ConditionStop      ConditionType = "STOP"
+	ConditionStopLimit ConditionType = "STOP_LIMIT"
+	ConditionTrail     ConditionType = "TRAIL"
+)
+
+func (t ConditionType) Valid() bool {
+	switch t {
+	case ConditionLimit, ConditionMarket, ConditionStop, ConditionStopLimit, ConditionTrail:
+		return true
+	}
+	return false
+}
+
+func (t ConditionType) MarshalJSON() ([]byte, error) {
+	return marshalEnum("condition type", string(t), t.Valid())
+}
+
+func (t *ConditionType) UnmarshalJSON(b []byte) error {
+	v, err := unmarshalEnum(b)
+	*t = ConditionType(v)
+	return err
+}
+
+func marshalEnum(kind, v string, valid bool) ([]byte, error) {
+	if v != "" && !valid {
+		return nil, fmt.Errorf("bitflyer: invalid %s %q", kind, v)
+	}
+	return json.Marshal(v)
+}
+
+// unmarshalEnum は値を検証しない。送る前にMarshalJSONかValidateで弾く
+func unmarshalEnum(b []byte) (string, error) {
+	var v string
+	if err := json.Unmarshal(b, &v); err != nil {
+		return "", err
+	}
+	return v, nil
+}
+
+// * 注文の検証
+
+var ErrInvalidOrder = errors.New("bitflyer: invalid order")
+
+func invalidOrder(format string, a ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrInvalidOrder, fmt.Sprintf(format, a...))
+}
+
+// Validate は取引所に送る前に矛盾した注文を弾く
+func (ch *Childorder) Validate() error {
+	if ch.ProductCode == "" {
+		return invalidOrder("product_code is required")
+	}
+	if !ch.Side.Valid() {
+		return invalidOrder("side %q", ch.Side)
+	}
+	if ch.Size.Sign() <= 0 {
+		return invalidOrder("size must be positive")
+	}
+	switch ch.ChildOrderType {
+	case OrderTypeLimit:
+		if ch.Price.Sign() <= 0 {
+			return invalidOrder("LIMIT order requires price")
+		}
+	case OrderTypeMarket:
+		if !ch.Price.IsZero() {
+			return invalidOrder("MARKET order must not have price")
+		}
+	default:
+		return invalidOrder("child_order_type %q", ch.ChildOrderType)
+	}
+	if ch.TimeInForce != "" && !ch.TimeInForce.Valid() {
+		return invalidOrder("time_in_force %q", ch.TimeInForce)
+	}
+	if ch.MinuteToExpire < 0 || ch.MinuteToExpire > 43200 {
+		return invalidOrder("minute_to_expire %d", ch.MinuteToExpire)
+	}
+
+	return nil
+}
+
+func (pa *Parentorder) Validate() error {
+	if !pa.OrderMethod.Valid() {
+		return invalidOrder("order_method %q", pa.OrderMethod)
+	}
+	if n := pa.OrderMethod.parameters(); len(pa.Parameters) != n {
+		return invalidOrder("%s order requires %d parameters, got %d", pa.OrderMethod, n, len(pa.Parameters))
+	}
+	if pa.TimeInForce != "" && !pa.TimeInForce.Valid() {
+		return invalidOrder("time_in_force %q", pa.TimeInForce)
+	}
+	if pa.MinuteToExpire < 0 || pa.MinuteToExpire > 43200 {
+		return invalidOrder("minute_to_expire %d", pa.MinuteToExpire)
+	}
+	for i := range pa.Parameters {
+		if err := pa.Parameters[i].validate(); err != nil {
+			return fmt.Errorf("%w (parameters[%d])", err, i)
+		}
+	}
+	if pa.OrderMethod == MethodOCO || pa.OrderMethod == MethodIFDOCO {
+		// OCOの2つの注文は同じ銘柄でなければならない
+		n := len(pa.Parameters)
+		if pa.Parameters[n-2].ProductCode != pa.Parameters[n-1].ProductCode {
+			return invalidOrder("OCO orders must have the same product_code")
+		}
+	}
+
+	return nil
+}
+
+func (p *ParentorderParameter) validate() error {
+	if p.ProductCode == "" {
+		return invalidOrder("product_code is required")
+	}
+	if !p.Side.Valid() {
+		return invalidOrder("side %q", p.Side)
+	}
+	if p.Size.Sign() <= 0 {
+		return invalidOrder("size must be positive")
+	}
+	switch p.ConditionType {
+	case ConditionLimit:
+		if p.Price.Sign() <= 0 {
+			return invalidOrder("LIMIT condition requires price")
+		}
+	case ConditionMarket:
+		if !p.Price.IsZero() {
+			return invalidOrder("MARKET condition must not have price")
+		}
+	case ConditionStop:
+		if p.TriggerPrice.Sign() <= 0 {
+			return invalidOrder("STOP condition requires trigger_price")
+		}
+	case ConditionStopLimit:
+		if p.Price.Sign() <= 0 || p.TriggerPrice.Sign() <= 0 {
+			return invalidOrder("STOP_LIMIT condition requires price and trigger_price")
+		}
+	case ConditionTrail:
+		if p.Offset <= 0 {
+			return invalidOrder("TRAIL condition requires offset")
+		}
+	default:
+		return invalidOrder("condition_type %q", p.ConditionType)
+	}
+
+	return nil
+}
@@ -0,0 +1,160 @@
+package bitflyer_test
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/jackpopper/bitflyer"
+)
+
+func TestEnumJSON(t *testing.T) {
+	b, err := json.Marshal(bitflyer.ParentorderParameter{ConditionType: bitflyer.ConditionStopLimit, Side: bitflyer.SideBuy})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var p bitflyer.ParentorderParameter
+	if err := json.Unmarshal(b, &p); err != nil {
+		t.Fatal(err)
+	}
+	if p.ConditionType != bitflyer.ConditionStopLimit || p.Side != bitflyer.SideBuy {
+		t.Errorf("round trip = %+v", p)
+	}
+
+	// 未知の値は送らない
+	for _, v := range []interface{}{
+		bitflyer.Side("HOLD"),
+		bitflyer.OrderType("ICEBERG"),
+		bitflyer.TimeInForce("GTD"),
+		bitflyer.OrderState("PENDING"),
+		bitflyer.OrderMethod("OTO"),
+		bitflyer.ConditionType("TRAILING_LIMIT"),
+	} {
+		if _, err := json.Marshal(v); err == nil {
+			t.Errorf("Marshal(%q) succeeded", v)
+		}
+	}
+	// 空は省略として通す
+	if b, err := json.Marshal(bitflyer.Side("")); err != nil || string(b) != `""` {
+		t.Errorf("Marshal(\"\") = %s, %v", b, err)
+	}
+
+	// 取引所が増やした値は読める
+	var info bitflyer.ChildorderInfo
+	err = json.Unmarshal([]byte(`{"side":"BUY","child_order_type":"ICEBERG","child_order_state":"PENDING"}`), &info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.ChildOrderType != "ICEBERG" || info.ChildOrderState != "PENDING" || info.ChildOrderState.Valid() {
+		t.Errorf("info = %+v", info)
+	}
+	// 文字列でなければエラー
+	if err := json.Unmarshal([]byte(`{"side":1}`), &info); err == nil {
+		t.Error("Unmarshal(side: 1) succeeded")
+	}
+}
+
+func TestChildorderValidate(t *testing.T) {
+	valid := func() *bitflyer.Childorder {
+		return &bitflyer.Childorder{
+			ProductCode:    "BTC_JPY",
+			ChildOrderType: bitflyer.OrderTypeLimit,
+			Side:           bitflyer.SideBuy,
+			Price:          bitflyer.MustDecimal("100"),
+			Size:           bitflyer.MustDecimal("0.01"),
+		}
+	}
+	tests := []struct {
+		name   string
+		modify func(ch *bitflyer.Childorder)
+		ok     bool
+	}{
+		{"valid", func(ch *bitflyer.Childorder) {}, true},
+		{"market", func(ch *bitflyer.Childorder) {
+			ch.ChildOrderType, ch.Price = bitflyer.OrderTypeMarket, bitflyer.Decimal{}
+		}, true},
+		{"no product", func(ch *bitflyer.Childorder) { ch.ProductCode = "" }, false},
+		{"unknown side", func(ch *bitflyer.Childorder) { ch.Side = "HOLD" }, false},
+		{"zero size", func(ch *bitflyer.Childorder) { ch.Size = bitflyer.Decimal{} }, false},
+		{"limit without price", func(ch *bitflyer.Childorder) { ch.Price = bitflyer.Decimal{} }, false},
+		{"market with price", func(ch *bitflyer.Childorder) { ch.ChildOrderType = bitflyer.OrderTypeMarket }, false},
+		{"unknown type", func(ch *bitflyer.Childorder) { ch.ChildOrderType = "ICEBERG" }, false},
+		{"unknown time in force", func(ch *bitflyer.Childorder) { ch.TimeInForce = "GTD" }, false},
+		{"expire too long", func(ch *bitflyer.Childorder) { ch.MinuteToExpire = 43201 }, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ch := valid()
+			tt.modify(ch)
+			err := ch.Validate()
+			if tt.ok && err != nil {
+				t.Errorf("Validate = %v", err)
+			}
+			if !tt.ok && !errors.Is(err, bitflyer.ErrInvalidOrder) {
+				t.Errorf("Validate = %v, want %v", err, bitflyer.ErrInvalidOrder)
+			}
+		})
+	}
+}
+
+func TestParentorderValidate(t *testing.T) {
+	param := func(c bitflyer.ConditionType, side bitflyer.Side) bitflyer.ParentorderParameter {
+		p := bitflyer.ParentorderParameter{ProductCode: "BTC_JPY", ConditionType: c, Side: side, Size: bitflyer.MustDecimal("0.01")}
+		switch c {
+		case bitflyer.ConditionLimit:
+			p.Price = bitflyer.MustDecimal("100")
+		case bitflyer.ConditionStop:
+			p.TriggerPrice = bitflyer.MustDecimal("90")
+		case bitflyer.ConditionStopLimit:
+			p.Price, p.TriggerPrice = bitflyer.MustDecimal("89"), bitflyer.MustDecimal("90")
+		case bitflyer.ConditionTrail:
+			p.Offset = 5
+		}
+		return p
+	}
+	ifdoco := func() *bitflyer.Parentorder {
+		return &bitflyer.Parentorder{
+			OrderMethod: bitflyer.MethodIFDOCO,
+			Parameters: []bitflyer.ParentorderParameter{
+				param(bitflyer.ConditionLimit, bitflyer.SideBuy),
+				param(bitflyer.ConditionLimit, bitflyer.SideSell),
+				param(bitflyer.ConditionStopLimit, bitflyer.SideSell),
+			},
+		}
+	}
+	tests := []struct {
+		name   string
+		modify func(pa *bitflyer.Parentorder)
+		ok     bool
+	}{
+		{"valid", func(pa *bitflyer.Parentorder) {}, true},
+		{"simple trail", func(pa *bitflyer.Parentorder) {
+			pa.OrderMethod, pa.Parameters = bitflyer.MethodSimple, pa.Parameters[:1]
+			pa.Parameters[0] = param(bitflyer.ConditionTrail, bitflyer.SideSell)
+		}, true},
+		{"unknown method", func(pa *bitflyer.Parentorder) { pa.OrderMethod = "OTO" }, false},
+		{"wrong parameter count", func(pa *bitflyer.Parentorder) { pa.OrderMethod = bitflyer.MethodOCO }, false},
+		{"unknown time in force", func(pa *bitflyer.Parentorder) { pa.TimeInForce = "GTD" }, false},
+		{"negative expire", func(pa *bitflyer.Parentorder) { pa.MinuteToExpire = -1 }, false},
+		{"unknown condition", func(pa *bitflyer.Parentorder) { pa.Parameters[1].ConditionType = "TRAILING_LIMIT" }, false},
+		{"stop without trigger", func(pa *bitflyer.Parentorder) { pa.Parameters[2].TriggerPrice = bitflyer.Decimal{} }, false},
+		{"trail without offset", func(pa *bitflyer.Parentorder) {
+			pa.Parameters[2] = param(bitflyer.ConditionTrail, bitflyer.SideSell)
+			pa.Parameters[2].Offset = 0
+		}, false},
+		{"OCO products differ", func(pa *bitflyer.Parentorder) { pa.Parameters[2].ProductCode = "FX_BTC_JPY" }, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pa := ifdoco()
+			tt.modify(pa)
+			err := pa.Validate()
+			if tt.ok && err != nil {
+				t.Errorf("Validate = %v", err)
+			}
+			if !tt.ok && !errors.Is(err, bitflyer.ErrInvalidOrder) {
+				t.Errorf("Validate = %v, want %v", err, bitflyer.ErrInvalidOrder)
+			}
+		})
+	}
+}
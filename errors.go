@@ -0,0 +1,106 @@
+package bitflyer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// * エラー
+
+// bitFlyerがエラー時に返すstatusコード
+const (
+	StatusOverAPILimit       = -1
+	StatusMarketClosed       = -2
+	StatusOrderNotFound      = -111
+	StatusInsufficientFunds  = -200
+	StatusInsufficientMargin = -205
+	// 注文が受け付けられなかった。メンテナンスではないので再送しても通らない
+	StatusOrderNotAccepted = -208
+)
+
+// APIError は200以外のレスポンス。bitFlyerのエラーボディ
+// ({"status": -200, "error_message": "...", "data": null})を読めた場合はその内容も持つ
+type APIError struct {
+	HTTPStatus int
+	Status     int             `json:"status"`
+	Message    string          `json:"error_message"`
+	Data       json.RawMessage `json:"data"`
+	Body       []byte          `json:"-"`
+	// Retry-Afterヘッダーで指定された待ち時間。なければ0
+	RetryAfter time.Duration `json:"-"`
+}
+
+func newAPIError(res *http.Response) *APIError {
+	e := &APIError{HTTPStatus: res.StatusCode, RetryAfter: parseRetryAfter(res.Header.Get("Retry-After"))}
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return e
+	}
+	e.Body = body
+	json.Unmarshal(body, e)
+
+	return e
+}
+
+// parseRetryAfter は秒数かHTTPの日付のRetry-Afterを待ち時間にする
+func parseRetryAfter(v string) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if sec, err := strconv.Atoi(v); err == nil {
+		if sec < 0 {
+			return 0
+		}
+		return time.Duration(sec) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+func (e *APIError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("status code: %d", e.HTTPStatus)
+	}
+	return fmt.Sprintf("status code: %d, %d: %s", e.HTTPStatus, e.Status, e.Message)
+}
+
+func asAPIError(err error) (*APIError, bool) {
+	var e *APIError
+	if errors.As(err, &e) {
+		return e, true
+	}
+	return nil, false
+}
+
+// IsInsufficientFunds は残高または証拠金の不足による失敗か
+func IsInsufficientFunds(err error) bool {
+	e, ok := asAPIError(err)
+	return ok && (e.Status == StatusInsufficientFunds || e.Status == StatusInsufficientMargin)
+}
+
+// IsRateLimited はAPIの呼び出し回数制限による失敗か
+func IsRateLimited(err error) bool {
+	e, ok := asAPIError(err)
+	return ok && (e.HTTPStatus == http.StatusTooManyRequests || e.Status == StatusOverAPILimit)
+}
+
+// IsOrderNotFound は指定した注文が存在しないことによる失敗か
+func IsOrderNotFound(err error) bool {
+	e, ok := asAPIError(err)
+	return ok && (e.HTTPStatus == http.StatusNotFound || e.Status == StatusOrderNotFound)
+}
+
+// IsMaintenance はメンテナンスや取引停止中、混雑で受け付けられなかったか
+func IsMaintenance(err error) bool {
+	e, ok := asAPIError(err)
+	return ok && (e.HTTPStatus == http.StatusServiceUnavailable || e.Status == StatusMarketClosed)
+}
@@ -0,0 +1,82 @@
+package bitflyer_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/jackpopper/bitflyer"
+	"github.com/jackpopper/bitflyer/bitflyertest"
+)
+
+func TestAPIError(t *testing.T) {
+	s := bitflyertest.NewServer()
+	defer s.Close()
+	c := s.Client()
+	c.RetryPolicy = nil
+
+	s.InjectFault("me/getbalance", bitflyertest.Fault{Status: bitflyer.StatusInsufficientFunds, Message: "Insufficient funds"})
+	_, err := c.GetMyBalance(context.Background())
+
+	var e *bitflyer.APIError
+	if !errors.As(err, &e) {
+		t.Fatalf("err = %#v, want *APIError", err)
+	}
+	if e.HTTPStatus != http.StatusBadRequest || e.Status != bitflyer.StatusInsufficientFunds || e.Message != "Insufficient funds" {
+		t.Errorf("APIError = %+v", e)
+	}
+	if len(e.Body) == 0 {
+		t.Error("Body is empty")
+	}
+}
+
+func TestErrorClassification(t *testing.T) {
+	tests := []struct {
+		name  string
+		fault bitflyertest.Fault
+
+		insufficient, rateLimited, notFound, maintenance bool
+	}{
+		{name: "insufficient funds", fault: bitflyertest.Fault{Status: bitflyer.StatusInsufficientFunds}, insufficient: true},
+		{name: "insufficient margin", fault: bitflyertest.Fault{Status: bitflyer.StatusInsufficientMargin}, insufficient: true},
+		{name: "over api limit", fault: bitflyertest.Fault{Status: bitflyer.StatusOverAPILimit}, rateLimited: true},
+		{name: "too many requests", fault: bitflyertest.Fault{HTTPStatus: http.StatusTooManyRequests}, rateLimited: true},
+		{name: "order not found", fault: bitflyertest.Fault{Status: bitflyer.StatusOrderNotFound}, notFound: true},
+		{name: "market closed", fault: bitflyertest.Fault{Status: bitflyer.StatusMarketClosed}, maintenance: true},
+		{name: "service unavailable", fault: bitflyertest.Fault{HTTPStatus: http.StatusServiceUnavailable}, maintenance: true},
+		{name: "order not accepted", fault: bitflyertest.Fault{Status: bitflyer.StatusOrderNotAccepted}},
+		{name: "invalid", fault: bitflyertest.Fault{Status: -100}},
+	}
+
+	s := bitflyertest.NewServer()
+	defer s.Close()
+	c := s.Client()
+	c.RetryPolicy = nil
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s.InjectFault("me/getbalance", tt.fault)
+			_, err := c.GetMyBalance(context.Background())
+			if err == nil {
+				t.Fatal("no error")
+			}
+			if got := bitflyer.IsInsufficientFunds(err); got != tt.insufficient {
+				t.Errorf("IsInsufficientFunds = %v", got)
+			}
+			if got := bitflyer.IsRateLimited(err); got != tt.rateLimited {
+				t.Errorf("IsRateLimited = %v", got)
+			}
+			if got := bitflyer.IsOrderNotFound(err); got != tt.notFound {
+				t.Errorf("IsOrderNotFound = %v", got)
+			}
+			if got := bitflyer.IsMaintenance(err); got != tt.maintenance {
+				t.Errorf("IsMaintenance = %v", got)
+			}
+		})
+	}
+
+	if bitflyer.IsMaintenance(errors.New("other")) || bitflyer.IsOrderNotFound(nil) {
+		t.Error("non-API error classified")
+	}
+}
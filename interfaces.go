@@ -0,0 +1,71 @@
+package bitflyer
+
+import "context"
+
+// * インターフェース
+// 戦略のコードは*Clientではなくこれらに依存させると、実取引、PaperClient、バックテストやモックを差し替えられる
+
+// MarketData は公開APIの相場情報
+type MarketData interface {
+	GetMarkets(ctx context.Context) (*Markets, error)
+	GetBoard(ctx context.Context, productCode string) (*Board, error)
+	GetTicker(ctx context.Context, productCode string) (*Ticker, error)
+	GetExecutions(ctx context.Context, productCode string, page *Page) (*Executions, error)
+	GetHealth(ctx context.Context) (*Status, error)
+	GetChats(ctx context.Context, fromDate string) (*Chats, error)
+}
+
+// Trader は子注文の発注、取消と照会
+type Trader interface {
+	SendChildorder(ctx context.Context, ch *Childorder) (*ChildOrderAcceptanceID, error)
+	CancelChildorder(ctx context.Context, ch *Childorder) error
+	CancelAllChildorder(ctx context.Context, productCode string) error
+	GetMyChildorders(ctx context.Context, productCode string, page *Page, childOrderState OrderState, parentOrderID string) (*Childorders, error)
+	GetMyChildorder(ctx context.Context, productCode, childOrderID, childOrderAcceptanceID string) (*Childorders, error)
+	GetMyExecutions(ctx context.Context, productCode string, page *Page, childOrderID, childOrderAcceptanceID string) (*Executions, error)
+}
+
+// ParentTrader は特殊注文の発注、取消と照会
+type ParentTrader interface {
+	SendParentrder(ctx context.Context, pa *Parentorder) (*ParentOrderAcceptanceID, error)
+	CancelParentorder(ctx context.Context, pa *Parentorder) error
+	GetMyParentorders(ctx context.Context, productCode string, page *Page, parentOrderState OrderState) (*Parentorders, error)
+	GetMyParentorder(ctx context.Context, parentOrderID, parentOrderAcceptanceID string) (*Parentorders, error)
+}
+
+// AccountReader は残高、証拠金、建玉と手数料の照会
+type AccountReader interface {
+	GetMyBalance(ctx context.Context) (*Balance, error)
+	GetMyCollateral(ctx context.Context) (*Collateral, error)
+	GetMyPositions(ctx context.Context, productCode string) (*Positions, error)
+	GetMyTradingCommission(ctx context.Context, productCode string) (*TradingCommission, error)
+}
+
+// Funds は入出金
+type Funds interface {
+	GetMyAddress(ctx context.Context) (*Address, error)
+	GetMyCoinins(ctx context.Context, page *Page) (*Coinins, error)
+	GetMyCoinouts(ctx context.Context, page *Page, messageID string) (*Coinouts, error)
+	GetMyBankAccounts(ctx context.Context) (*BankAccounts, error)
+	GetMyDeposits(ctx context.Context, page *Page) (*Deposits, error)
+	Withdraw(ctx context.Context, wd *Withdraw) (*WithdrawResponse, error)
+	GetMyWithdrawals(ctx context.Context, page *Page, messageID string) (*Withdrawals, error)
+}
+
+// Exchange はClientのすべてのAPI
+type Exchange interface {
+	MarketData
+	Trader
+	ParentTrader
+	AccountReader
+	Funds
+	GetMyPermissions(ctx context.Context) (*Permissions, error)
+}
+
+var (
+	_ Exchange = (*Client)(nil)
+
+	_ MarketData    = (*PaperClient)(nil)
+	_ Trader        = (*PaperClient)(nil)
+	_ AccountReader = (*PaperClient)(nil)
+)
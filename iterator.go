@@ -0,0 +1,336 @@
+package bitflyer
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+)
+
+// * 履歴のページ送り
+// Page.Before / Page.After を使って履歴をIDの順に辿る。
+// リクエストはClientのメソッドを通すので、RateLimiterやRetryPolicyもそのまま効く
+
+const defaultIterCount = 500
+
+type IterFilter struct {
+	ProductCode string
+	// IterMyChildorders, IterMyParentorders で絞り込む状態
+	State OrderState
+	// 1回のリクエストで取得する件数。0なら500
+	Count int
+	// falseなら新しい方から古い方へ、trueなら古い方から新しい方へ辿る
+	Forward bool
+	// 辿り始めるID(含まない)。新しい方へ辿るときは必須で、古い方へ辿るときに0なら最新から
+	FromID int
+	// このIDまで辿ったら止める(含む)。0なら制限しない
+	ToID int
+	// この期間の外に出たら止める。ゼロ値なら制限しない
+	Since time.Time
+	Until time.Time
+}
+
+type Iterator[T any] struct {
+	ctx    context.Context
+	filter IterFilter
+	fetch  func(ctx context.Context, page *Page) ([]T, error)
+	id     func(T) int
+	date   func(T) time.Time
+
+	cursor int
+	buf    []T
+	cur    T
+	done   bool
+	err    error
+
+	// 新しい方へ辿るとき、まだ読んでいないページの上端(含まない)。古いページが末尾
+	windows []int
+	scanned bool
+}
+
+func newIterator[T any](ctx context.Context, f IterFilter, fetch func(context.Context, *Page) ([]T, error), id func(T) int, date func(T) time.Time) *Iterator[T] {
+	if f.Count <= 0 {
+		f.Count = defaultIterCount
+	}
+	it := &Iterator[T]{ctx: ctx, filter: f, fetch: fetch, id: id, date: date, cursor: f.FromID}
+	if f.Forward && f.FromID <= 0 {
+		it.err = errors.New("bitflyer: forward iteration requires FromID")
+	}
+
+	return it
+}
+
+// Next は次の要素に進む。終わりに達したかエラーならfalse
+func (it *Iterator[T]) Next() bool {
+	for it.err == nil {
+		if len(it.buf) == 0 {
+			if it.done {
+				return false
+			}
+			if err := it.ctx.Err(); err != nil {
+				it.err = err
+				return false
+			}
+			if it.filter.Forward {
+				it.err = it.fillForward()
+			} else {
+				it.err = it.fillBackward()
+			}
+			continue
+		}
+
+		v := it.buf[0]
+		it.buf = it.buf[1:]
+		switch it.bound(v) {
+		case 0:
+			it.cur = v
+			return true
+		case 1:
+			it.done = true
+			it.buf = nil
+		}
+	}
+
+	return false
+}
+
+// bound は範囲内なら0、まだ範囲に入っていなければ-1、範囲を出たら1
+func (it *Iterator[T]) bound(v T) int {
+	f := &it.filter
+	id, date := it.id(v), it.date(v)
+	if f.Forward {
+		if (f.ToID > 0 && id > f.ToID) || (!f.Until.IsZero() && date.After(f.Until)) {
+			return 1
+		}
+		if !f.Since.IsZero() && date.Before(f.Since) {
+			return -1
+		}
+	} else {
+		if (f.ToID > 0 && id < f.ToID) || (!f.Since.IsZero() && date.Before(f.Since)) {
+			return 1
+		}
+		if !f.Until.IsZero() && date.After(f.Until) {
+			return -1
+		}
+	}
+	return 0
+}
+
+func (it *Iterator[T]) Value() T {
+	return it.cur
+}
+
+func (it *Iterator[T]) Err() error {
+	return it.err
+}
+
+// fillBackward はcursorより古いページを1つ読む
+func (it *Iterator[T]) fillBackward() error {
+	items, err := it.fetch(it.ctx, &Page{Count: it.filter.Count, Before: it.cursor})
+	if err != nil {
+		return err
+	}
+
+	// ページが重なっても同じ要素を2度返さない
+	page := items[:0]
+	for _, v := range items {
+		if it.cursor == 0 || it.id(v) < it.cursor {
+			page = append(page, v)
+		}
+	}
+	if len(page) == 0 {
+		it.done = true
+		return nil
+	}
+	sort.Slice(page, func(i, j int) bool { return it.id(page[i]) > it.id(page[j]) })
+	it.cursor = it.id(page[len(page)-1])
+	it.buf = page
+
+	return nil
+}
+
+// fillForward はcursorより新しいページを古い順に1つずつ読む。
+// afterを指定しても新しい方から返ってくるので、初めにToIDの次(なければ最新)からcursorに届くまで
+// 古い方へ辿ってページの境目だけを覚え、いちばん古いページを返す。残りのページは境目をbeforeにして読み直す
+func (it *Iterator[T]) fillForward() error {
+	f := &it.filter
+	if n := len(it.windows); n > 0 {
+		before := it.windows[n-1]
+		it.windows = it.windows[:n-1]
+		items, err := it.fetch(it.ctx, &Page{Count: f.Count, After: it.cursor, Before: before})
+		if err != nil {
+			return err
+		}
+		it.setForward(it.between(items, before))
+		return nil
+	}
+	// ToIDまで読み終えたので、次は読みに行かない
+	if it.scanned && f.ToID > 0 {
+		it.done = true
+		return nil
+	}
+
+	upper := 0
+	if f.ToID > 0 {
+		upper = f.ToID + 1
+	}
+	var windows []int
+	var page []T
+	for {
+		items, err := it.fetch(it.ctx, &Page{Count: f.Count, After: it.cursor, Before: upper})
+		if err != nil {
+			return err
+		}
+
+		next := it.between(items, upper)
+		if len(next) == 0 {
+			break
+		}
+		if upper == 0 {
+			// 辿るあいだに増えた分が最新のページに混ざらないようにする
+			for _, v := range next {
+				if id := it.id(v); id >= upper {
+					upper = id + 1
+				}
+			}
+		}
+		windows = append(windows, upper)
+		page = next
+		for _, v := range page {
+			if id := it.id(v); id < upper {
+				upper = id
+			}
+		}
+		if len(items) < f.Count {
+			break
+		}
+		if err := it.ctx.Err(); err != nil {
+			return err
+		}
+	}
+	it.scanned = true
+	if len(page) == 0 {
+		it.done = true
+		return nil
+	}
+	it.windows = windows[:len(windows)-1]
+	it.setForward(page)
+
+	return nil
+}
+
+// between はcursorより新しくbeforeより古い要素を選ぶ。beforeが0なら上限なし
+func (it *Iterator[T]) between(items []T, before int) []T {
+	page := items[:0]
+	for _, v := range items {
+		if id := it.id(v); id > it.cursor && (before == 0 || id < before) {
+			page = append(page, v)
+		}
+	}
+	return page
+}
+
+func (it *Iterator[T]) setForward(page []T) {
+	if len(page) == 0 {
+		return
+	}
+	sort.Slice(page, func(i, j int) bool { return it.id(page[i]) < it.id(page[j]) })
+	it.cursor = it.id(page[len(page)-1])
+	it.buf = page
+}
+
+// ** 各履歴のイテレータ
+func (c *Client) IterExecutions(ctx context.Context, f IterFilter) *Iterator[Execution] {
+	return newIterator(ctx, f, func(ctx context.Context, page *Page) ([]Execution, error) {
+		data, err := c.GetExecutions(ctx, f.ProductCode, page)
+		if err != nil {
+			return nil, err
+		}
+		return *data, nil
+	}, executionID, executionDate)
+}
+
+func (c *Client) IterMyExecutions(ctx context.Context, f IterFilter) *Iterator[Execution] {
+	return newIterator(ctx, f, func(ctx context.Context, page *Page) ([]Execution, error) {
+		data, err := c.GetMyExecutions(ctx, f.ProductCode, page, "", "")
+		if err != nil {
+			return nil, err
+		}
+		return *data, nil
+	}, executionID, executionDate)
+}
+
+func executionID(v Execution) int         { return v.ID }
+func executionDate(v Execution) time.Time { return v.ExecDate.Time }
+
+func (c *Client) IterMyChildorders(ctx context.Context, f IterFilter) *Iterator[ChildorderInfo] {
+	return newIterator(ctx, f, func(ctx context.Context, page *Page) ([]ChildorderInfo, error) {
+		data, err := c.GetMyChildorders(ctx, f.ProductCode, page, f.State, "")
+		if err != nil {
+			return nil, err
+		}
+		return *data, nil
+	},
+		func(v ChildorderInfo) int { return v.ID },
+		func(v ChildorderInfo) time.Time { return v.ChildOrderDate.Time })
+}
+
+func (c *Client) IterMyParentorders(ctx context.Context, f IterFilter) *Iterator[ParentorderInfo] {
+	return newIterator(ctx, f, func(ctx context.Context, page *Page) ([]ParentorderInfo, error) {
+		data, err := c.GetMyParentorders(ctx, f.ProductCode, page, f.State)
+		if err != nil {
+			return nil, err
+		}
+		return *data, nil
+	},
+		func(v ParentorderInfo) int { return v.ID },
+		func(v ParentorderInfo) time.Time { return v.ParentOrderDate.Time })
+}
+
+func (c *Client) IterMyCoinins(ctx context.Context, f IterFilter) *Iterator[Coinin] {
+	return newIterator(ctx, f, func(ctx context.Context, page *Page) ([]Coinin, error) {
+		data, err := c.GetMyCoinins(ctx, page)
+		if err != nil {
+			return nil, err
+		}
+		return *data, nil
+	},
+		func(v Coinin) int { return v.ID },
+		func(v Coinin) time.Time { return v.EventDate.Time })
+}
+
+func (c *Client) IterMyCoinouts(ctx context.Context, f IterFilter) *Iterator[Coinout] {
+	return newIterator(ctx, f, func(ctx context.Context, page *Page) ([]Coinout, error) {
+		data, err := c.GetMyCoinouts(ctx, page, "")
+		if err != nil {
+			return nil, err
+		}
+		return *data, nil
+	},
+		func(v Coinout) int { return v.ID },
+		func(v Coinout) time.Time { return v.EventDate.Time })
+}
+
+func (c *Client) IterMyDeposits(ctx context.Context, f IterFilter) *Iterator[Deposit] {
+	return newIterator(ctx, f, func(ctx context.Context, page *Page) ([]Deposit, error) {
+		data, err := c.GetMyDeposits(ctx, page)
+		if err != nil {
+			return nil, err
+		}
+		return *data, nil
+	},
+		func(v Deposit) int { return v.ID },
+		func(v Deposit) time.Time { return v.EventDate.Time })
+}
+
+func (c *Client) IterMyWithdrawals(ctx context.Context, f IterFilter) *Iterator[Withdrawal] {
+	return newIterator(ctx, f, func(ctx context.Context, page *Page) ([]Withdrawal, error) {
+		data, err := c.GetMyWithdrawals(ctx, page, "")
+		if err != nil {
+			return nil, err
+		}
+		return *data, nil
+	},
+		func(v Withdrawal) int { return v.ID },
+		func(v Withdrawal) time.Time { return v.EventDate.Time })
+}
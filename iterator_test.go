@@ -0,0 +1,125 @@
+package bitflyer_test
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jackpopper/bitflyer"
+	"github.com/jackpopper/bitflyer/bitflyertest"
+)
+
+var iterBase = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// newIterServer はIDが1から100まで、1分ごとの約定を持つ偽サーバー
+func newIterServer(t *testing.T) *bitflyertest.Server {
+	t.Helper()
+	s := bitflyertest.NewServer()
+	t.Cleanup(s.Close)
+	for id := 1; id <= 100; id++ {
+		s.AddExecutions("BTC_JPY", bitflyer.Execution{
+			ID:       id,
+			Side:     bitflyer.SideBuy,
+			Price:    bitflyer.NewDecimalFromInt(10000000),
+			Size:     bitflyer.MustDecimal("0.01"),
+			ExecDate: bitflyer.Time{Time: iterBase.Add(time.Duration(id) * time.Minute)},
+		})
+	}
+	return s
+}
+
+func ids(from, to int) []int {
+	var s []int
+	if from <= to {
+		for id := from; id <= to; id++ {
+			s = append(s, id)
+		}
+	} else {
+		for id := from; id >= to; id-- {
+			s = append(s, id)
+		}
+	}
+	return s
+}
+
+func TestIterExecutions(t *testing.T) {
+	tests := []struct {
+		name string
+		f    bitflyer.IterFilter
+		want []int
+		// 0なら数えない
+		requests int
+	}{
+		{"backward all", bitflyer.IterFilter{Count: 7}, ids(100, 1), 0},
+		{"backward from", bitflyer.IterFilter{Count: 7, FromID: 50}, ids(49, 1), 0},
+		{"backward to", bitflyer.IterFilter{Count: 5, FromID: 50, ToID: 41}, ids(49, 41), 2},
+		{"backward to page edge", bitflyer.IterFilter{Count: 5, ToID: 96}, ids(100, 96), 2},
+		{"backward since until", bitflyer.IterFilter{Count: 7, Since: iterBase.Add(20 * time.Minute), Until: iterBase.Add(30 * time.Minute)}, ids(30, 20), 0},
+		{"forward to", bitflyer.IterFilter{Count: 5, Forward: true, FromID: 10, ToID: 20}, ids(11, 20), 4},
+		{"forward to short page", bitflyer.IterFilter{Count: 7, Forward: true, FromID: 10, ToID: 20}, ids(11, 20), 3},
+		{"forward to equals from", bitflyer.IterFilter{Count: 5, Forward: true, FromID: 10, ToID: 10}, nil, 1},
+		{"forward to newest", bitflyer.IterFilter{Count: 5, Forward: true, FromID: 95}, ids(96, 100), 0},
+		{"forward from newest", bitflyer.IterFilter{Count: 5, Forward: true, FromID: 100}, nil, 1},
+		{"forward to beyond newest", bitflyer.IterFilter{Count: 5, Forward: true, FromID: 97, ToID: 1000}, ids(98, 100), 1},
+		{"forward since until", bitflyer.IterFilter{Count: 7, Forward: true, FromID: 1, Since: iterBase.Add(20 * time.Minute), Until: iterBase.Add(30 * time.Minute)}, ids(20, 30), 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newIterServer(t)
+			tt.f.ProductCode = "BTC_JPY"
+			it := s.Client().IterExecutions(context.Background(), tt.f)
+
+			var got []int
+			for it.Next() {
+				got = append(got, it.Value().ID)
+			}
+			if err := it.Err(); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ids = %v, want %v", got, tt.want)
+			}
+			if n := s.Requests("executions"); tt.requests > 0 && n != tt.requests {
+				t.Errorf("requests = %d, want %d", n, tt.requests)
+			}
+		})
+	}
+}
+
+func TestIterForwardPages(t *testing.T) {
+	s := newIterServer(t)
+	it := s.Client().IterExecutions(context.Background(), bitflyer.IterFilter{ProductCode: "BTC_JPY", Count: 10, Forward: true, FromID: 1})
+
+	// 境目を探して10ページ読み、最後に読んだいちばん古いページ(2から10)はそのまま返す
+	const scan = 10
+	var got []int
+	for it.Next() {
+		got = append(got, it.Value().ID)
+		// 1ページ返すごとに次のページを1回だけ読む
+		page := (it.Value().ID - 1) / 10
+		if n := s.Requests("executions"); n != scan+page {
+			t.Fatalf("id %d: requests = %d, want %d", it.Value().ID, n, scan+page)
+		}
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, ids(2, 100)) {
+		t.Errorf("ids = %v", got)
+	}
+}
+
+func TestIterForwardRequiresFromID(t *testing.T) {
+	s := newIterServer(t)
+	it := s.Client().IterExecutions(context.Background(), bitflyer.IterFilter{ProductCode: "BTC_JPY", Forward: true})
+	if it.Next() {
+		t.Error("Next = true")
+	}
+	if it.Err() == nil {
+		t.Error("Err = nil")
+	}
+	if n := s.Requests("executions"); n != 0 {
+		t.Errorf("requests = %d, want 0", n)
+	}
+}
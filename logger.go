@@ -0,0 +1,105 @@
+package bitflyer
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// * ログ
+// Client.Loggerを設定したときだけログを出す。*slog.Loggerをそのまま設定できる。
+// 認証ヘッダと出金の暗証コードは伏せて出力する
+
+type Logger interface {
+	Enabled(ctx context.Context, level slog.Level) bool
+	Log(ctx context.Context, level slog.Level, msg string, args ...interface{})
+}
+
+const redacted = "[REDACTED]"
+
+var (
+	redactedHeaders = []string{"ACCESS-KEY", "ACCESS-SIGN"}
+	// リクエストボディのうち伏せるフィールド
+	redactedFields = []string{"code"}
+)
+
+func (c *Client) log(ctx context.Context, level slog.Level, msg string, args ...interface{}) {
+	if c != nil && c.Logger != nil && c.Logger.Enabled(ctx, level) {
+		c.Logger.Log(ctx, level, msg, args...)
+	}
+}
+
+func logRequest(l Logger, req *http.Request, endpoint string) {
+	ctx := req.Context()
+	if !l.Enabled(ctx, slog.LevelDebug) {
+		return
+	}
+
+	args := []interface{}{
+		"method", req.Method,
+		"path", endpoint,
+		"query", req.URL.RawQuery,
+		"header", redactHeader(req.Header),
+	}
+	if b, err := requestBody(req); err == nil && len(b) > 0 {
+		args = append(args, "body", redactBody(b))
+	}
+	l.Log(ctx, slog.LevelDebug, "bitflyer: request", args...)
+}
+
+// logResponse は成功ならDebug、それ以外はWarnで出す
+func logResponse(l Logger, req *http.Request, endpoint string, res *http.Response, latency time.Duration) {
+	level := slog.LevelDebug
+	if res.StatusCode != http.StatusOK {
+		level = slog.LevelWarn
+	}
+	ctx := req.Context()
+	if !l.Enabled(ctx, level) {
+		return
+	}
+
+	l.Log(ctx, level, "bitflyer: response",
+		"method", req.Method,
+		"path", endpoint,
+		"status", res.StatusCode,
+		"latency", latency,
+		"ratelimit_remaining", res.Header.Get("X-RateLimit-Remaining"),
+		"ratelimit_reset", res.Header.Get("X-RateLimit-Reset"),
+		"ratelimit_period", res.Header.Get("X-RateLimit-Period"),
+	)
+}
+
+func redactHeader(h http.Header) http.Header {
+	h = h.Clone()
+	for _, k := range redactedHeaders {
+		if h.Get(k) != "" {
+			h.Set(k, redacted)
+		}
+	}
+	return h
+}
+
+// redactBody はJSONオブジェクトのredactedFieldsを伏せる。JSONでなければ中身を出さない
+func redactBody(b []byte) string {
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(b, &m); err != nil {
+		return redacted
+	}
+	found := false
+	for _, k := range redactedFields {
+		if _, ok := m[k]; ok {
+			m[k] = json.RawMessage(`"` + redacted + `"`)
+			found = true
+		}
+	}
+	if !found {
+		return string(b)
+	}
+	out, err := json.Marshal(m)
+	if err != nil {
+		return redacted
+	}
+	return string(out)
+}
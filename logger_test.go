@@ -0,0 +1,48 @@
+package bitflyer_test
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/jackpopper/bitflyer"
+	"github.com/jackpopper/bitflyer/bitflyertest"
+)
+
+func TestLoggerRedaction(t *testing.T) {
+	s := bitflyertest.NewServer()
+	defer s.Close()
+	s.SetBalance("JPY", bitflyer.MustDecimal("100000"))
+
+	var buf bytes.Buffer
+	c := s.Client()
+	c.Logger = slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	_, err := c.Withdraw(context.Background(), &bitflyer.Withdraw{CurrencyCode: "JPY", BankAccountID: 1, Amount: bitflyer.MustDecimal("1000"), Code: "012345"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := buf.String()
+	if !strings.Contains(out, "bitflyer: request") || !strings.Contains(out, "me/withdraw") {
+		t.Fatalf("no request log:\n%s", out)
+	}
+	for _, secret := range []string{s.APIKey, s.APISecret, "012345"} {
+		if strings.Contains(out, secret) {
+			t.Errorf("log contains %q:\n%s", secret, out)
+		}
+	}
+	// HMAC-SHA256の署名
+	if sign := regexp.MustCompile(`[0-9a-f]{64}`).FindString(out); sign != "" {
+		t.Errorf("log contains signature %s:\n%s", sign, out)
+	}
+	// 伏せたことは分かるように残す
+	for _, want := range []string{"Access-Key:[[REDACTED]]", "Access-Sign:[[REDACTED]]", `\"code\":\"[REDACTED]\"`, `\"amount\":`} {
+		if !strings.Contains(out, want) {
+			t.Errorf("log does not contain %s:\n%s", want, out)
+		}
+	}
+}
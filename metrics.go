@@ -0,0 +1,191 @@
+package bitflyer
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// * メトリクス
+// Client.Metricsを設定すると、エンドポイント ("board", "me/sendchildorder" など) ごとに
+// 呼び出し回数、エラーの種類ごとの回数、レイテンシの分布、残りの呼び出し回数を集計する。
+// 値はexpvar.Mapとして読め、名前をつけて作ればexpvarに公開される (/debug/vars)
+
+// DefaultLatencyBuckets はレイテンシのヒストグラムの上限(秒)
+var DefaultLatencyBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type Metrics struct {
+	mu   sync.Mutex
+	vars *expvar.Map
+	// エンドポイント別の各値
+	requests   *expvar.Map
+	errors     *expvar.Map
+	latency    *expvar.Map
+	remaining  *expvar.Map
+	reconnects *expvar.Int
+}
+
+// NewMetrics はメトリクスを作る。nameが空でなければその名前でexpvarに公開する。
+// expvarは同じ名前を2度公開するとpanicするので、nameはプロセス内で一意にする
+func NewMetrics(name string) *Metrics {
+	m := &Metrics{
+		vars:       new(expvar.Map),
+		requests:   new(expvar.Map),
+		errors:     new(expvar.Map),
+		latency:    new(expvar.Map),
+		remaining:  new(expvar.Map),
+		reconnects: new(expvar.Int),
+	}
+	m.vars.Set("requests", m.requests)
+	m.vars.Set("errors", m.errors)
+	m.vars.Set("latency_seconds", m.latency)
+	m.vars.Set("ratelimit_remaining", m.remaining)
+	m.vars.Set("websocket_reconnects", m.reconnects)
+	if name != "" {
+		expvar.Publish(name, m.vars)
+	}
+
+	return m
+}
+
+// Var はすべての値をまとめたexpvar.Map
+func (m *Metrics) Var() *expvar.Map {
+	return m.vars
+}
+
+// Middleware は呼び出しを集計する段。Client.Metricsを設定すれば自動で組み込まれる。
+// レイテンシには回数制限の待ち時間も含む
+func (m *Metrics) Middleware() Middleware {
+	return func(next Handler) Handler {
+		return func(call *Call) (*http.Response, error) {
+			start := time.Now()
+			res, err := next(call)
+			m.observe(call.Endpoint, res, err, time.Since(start))
+			return res, err
+		}
+	}
+}
+
+func (m *Metrics) observe(endpoint string, res *http.Response, err error, latency time.Duration) {
+	m.requests.Add(endpoint, 1)
+	m.histogram(endpoint).observe(latency.Seconds())
+	if err != nil {
+		m.submap(m.errors, endpoint).Add(errorCode(err), 1)
+	}
+	if res != nil {
+		if v, perr := strconv.ParseInt(res.Header.Get("X-RateLimit-Remaining"), 10, 64); perr == nil {
+			m.gauge(endpoint).Set(v)
+		}
+	}
+}
+
+func (m *Metrics) reconnect() {
+	if m != nil {
+		m.reconnects.Add(1)
+	}
+}
+
+func (m *Metrics) submap(parent *expvar.Map, key string) *expvar.Map {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	sub, _ := parent.Get(key).(*expvar.Map)
+	if sub == nil {
+		sub = new(expvar.Map)
+		parent.Set(key, sub)
+	}
+	return sub
+}
+
+func (m *Metrics) gauge(endpoint string) *expvar.Int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i, _ := m.remaining.Get(endpoint).(*expvar.Int)
+	if i == nil {
+		i = new(expvar.Int)
+		m.remaining.Set(endpoint, i)
+	}
+	return i
+}
+
+func (m *Metrics) histogram(endpoint string) *histogram {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	h, _ := m.latency.Get(endpoint).(*histogram)
+	if h == nil {
+		h = newHistogram(DefaultLatencyBuckets)
+		m.latency.Set(endpoint, h)
+	}
+	return h
+}
+
+// errorCode はエラーの集計キー。APIエラーはbitFlyerのステータス("-208"など)、
+// それがなければHTTPステータス("http_503"など)
+func errorCode(err error) string {
+	if e, ok := asAPIError(err); ok {
+		if e.Status != 0 {
+			return strconv.Itoa(e.Status)
+		}
+		return fmt.Sprintf("http_%d", e.HTTPStatus)
+	}
+	switch {
+	case errors.Is(err, ErrRateLimitExceeded):
+		return "rate_limited"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	}
+	return "transport"
+}
+
+// ** ヒストグラム
+// 各上限以下の件数を累積で持つ (Prometheusのhistogramと同じ形)
+type histogram struct {
+	mu     sync.Mutex
+	bounds []float64
+	counts []int64
+	count  int64
+	sum    float64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	b := append([]float64(nil), bounds...)
+	sort.Float64s(b)
+	return &histogram{bounds: b, counts: make([]int64, len(b))}
+}
+
+func (h *histogram) observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, b := range h.bounds {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+// String はexpvar.VarとしてのJSON
+func (h *histogram) String() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	buckets := make([]string, len(h.bounds))
+	for i, b := range h.bounds {
+		buckets[i] = fmt.Sprintf("%q: %d", strconv.FormatFloat(b, 'g', -1, 64), h.counts[i])
+	}
+	return fmt.Sprintf(`{"buckets": {%s}, "count": %d, "sum": %s}`,
+		strings.Join(buckets, ", "), h.count, strconv.FormatFloat(h.sum, 'g', -1, 64))
+}
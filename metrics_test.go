@@ -0,0 +1,84 @@
+package bitflyer_test
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/jackpopper/bitflyer"
+)
+
+func TestMetrics(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("product_code") {
+		case "SLOW":
+			time.Sleep(120 * time.Millisecond)
+		case "BAD":
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"status":-156,"error_message":"Invalid product"}`))
+			return
+		case "DOWN":
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("X-RateLimit-Remaining", "42")
+		w.Write([]byte(`{}`))
+	}))
+	defer ts.Close()
+
+	c := bitflyer.NewClient("", "")
+	c.URL, _ = url.Parse(ts.URL + "/v1")
+	c.RetryPolicy = nil
+	// 同じ名前を2度公開するとpanicするので、-countで繰り返しても重ならない名前にする
+	name := fmt.Sprintf("bitflyer_test_metrics_%d", time.Now().UnixNano())
+	c.Metrics = bitflyer.NewMetrics(name)
+	ctx := context.Background()
+	for _, product := range []string{"BTC_JPY", "SLOW", "BAD", "DOWN"} {
+		c.GetTicker(ctx, product)
+	}
+
+	if expvar.Get(name) != c.Metrics.Var() {
+		t.Error("metrics are not published")
+	}
+	var v struct {
+		Requests  map[string]int            `json:"requests"`
+		Errors    map[string]map[string]int `json:"errors"`
+		Remaining map[string]int            `json:"ratelimit_remaining"`
+		Latency   map[string]struct {
+			Buckets map[string]int `json:"buckets"`
+			Count   int            `json:"count"`
+			Sum     float64        `json:"sum"`
+		} `json:"latency_seconds"`
+	}
+	if err := json.Unmarshal([]byte(c.Metrics.Var().String()), &v); err != nil {
+		t.Fatalf("%v: %s", err, c.Metrics.Var())
+	}
+
+	if v.Requests["ticker"] != 4 {
+		t.Errorf("requests = %v", v.Requests)
+	}
+	if e := v.Errors["ticker"]; len(e) != 2 || e["-156"] != 1 || e["http_503"] != 1 {
+		t.Errorf("errors = %v", v.Errors)
+	}
+	if v.Remaining["ticker"] != 42 {
+		t.Errorf("remaining = %v", v.Remaining)
+	}
+
+	// 累積なので上限が大きいほど多い。遅い1件だけが0.1秒を超える
+	h := v.Latency["ticker"]
+	if h.Count != 4 || h.Sum < 0.12 {
+		t.Errorf("latency = %+v", h)
+	}
+	if h.Buckets["0.1"] != 3 || h.Buckets["0.25"] != 4 || h.Buckets["10"] != 4 {
+		t.Errorf("buckets = %v", h.Buckets)
+	}
+	if len(h.Buckets) != len(bitflyer.DefaultLatencyBuckets) {
+		t.Errorf("buckets = %d, want %d", len(h.Buckets), len(bitflyer.DefaultLatencyBuckets))
+	}
+}
@@ -0,0 +1,187 @@
+package bitflyer
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// * ミドルウェア
+// リクエストは外側から順に
+//   デコード → Client.Middleware → メトリクス → ステータス確認 → 回数制限 → 署名 → ログ → HTTPClient.Do
+// と通る。Client.Middlewareは署名前のリクエストを受け取るので、書き換えても署名はそれに合わせて作られる。
+// 200以外のレスポンスは*APIErrorとして受け取り、成功したレスポンスはBodyを読む前の状態で受け取る。
+// リトライはこの外側で行うので、各段は試行ごとに呼ばれる
+
+// Call は1回のAPI呼び出し。各段はRequestを書き換えてよい
+type Call struct {
+	Request *http.Request
+	// APIバージョン以下のパス ("board", "me/sendchildorder" など)
+	Endpoint string
+	// レスポンスのデコード先。nilなら読み捨てる
+	Result interface{}
+}
+
+// Handler はCallを処理してレスポンスを返す。エラーのときもレスポンスを返すことがある
+type Handler func(call *Call) (*http.Response, error)
+
+type Middleware func(next Handler) Handler
+
+// Chain はmwsを先頭が外側になるようにhに被せる
+func Chain(h Handler, mws ...Middleware) Handler {
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
+
+func (c *Client) handler() Handler {
+	mws := make([]Middleware, 0, len(c.Middleware)+6)
+	mws = append(mws, DecodeMiddleware)
+	mws = append(mws, c.Middleware...)
+	if c.Metrics != nil {
+		mws = append(mws, c.Metrics.Middleware())
+	}
+	mws = append(mws, StatusMiddleware)
+	if c.RateLimiter != nil {
+		mws = append(mws, RateLimitMiddleware(c.RateLimiter))
+	}
+	mws = append(mws, SignMiddleware(c.signer()))
+	if c.Logger != nil {
+		mws = append(mws, LogMiddleware(c.Logger))
+	}
+
+	return Chain(c.send, mws...)
+}
+
+func (c *Client) send(call *Call) (*http.Response, error) {
+	return c.HTTPClient.Do(call.Request)
+}
+
+// ** 各段
+// DecodeMiddleware は成功したレスポンスをCall.ResultへJSONとしてデコードし、Bodyを閉じる
+func DecodeMiddleware(next Handler) Handler {
+	return func(call *Call) (*http.Response, error) {
+		res, err := next(call)
+		if err != nil {
+			return res, err
+		}
+		defer res.Body.Close()
+
+		if call.Result != nil {
+			if err := json.NewDecoder(res.Body).Decode(call.Result); err != nil {
+				return res, err
+			}
+		}
+		return res, nil
+	}
+}
+
+// StatusMiddleware は200以外のレスポンスを*APIErrorにする
+func StatusMiddleware(next Handler) Handler {
+	return func(call *Call) (*http.Response, error) {
+		res, err := next(call)
+		if err != nil {
+			return res, err
+		}
+		if res.StatusCode != http.StatusOK {
+			defer res.Body.Close()
+			return res, newAPIError(res)
+		}
+		return res, nil
+	}
+}
+
+func RateLimitMiddleware(l *RateLimiter) Middleware {
+	return func(next Handler) Handler {
+		return func(call *Call) (*http.Response, error) {
+			if err := l.Wait(call.Request.Context(), call.Endpoint); err != nil {
+				return nil, err
+			}
+			res, err := next(call)
+			if err == nil {
+				l.Update(call.Endpoint, res)
+			}
+			return res, err
+		}
+	}
+}
+
+// SignMiddleware はPrivate APIのリクエストに認証ヘッダをつける。
+// 送る直前に署名するので、リトライしてもタイムスタンプが古くならない
+func SignMiddleware(s Signer) Middleware {
+	return func(next Handler) Handler {
+		return func(call *Call) (*http.Response, error) {
+			if !isPrivateEndpoint(call.Endpoint) {
+				return next(call)
+			}
+
+			req := call.Request
+			body, err := requestBody(req)
+			if err != nil {
+				return nil, err
+			}
+			timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+			key, sign, err := s.Sign(req.Context(), timestamp+req.Method+req.URL.RequestURI()+string(body))
+			if err != nil {
+				return nil, err
+			}
+			req.Header.Set("ACCESS-KEY", key)
+			req.Header.Set("ACCESS-TIMESTAMP", timestamp)
+			req.Header.Set("ACCESS-SIGN", sign)
+
+			return next(call)
+		}
+	}
+}
+
+// LogMiddleware はリクエストとレスポンスをlに出す。認証ヘッダと出金の暗証コードは伏せる
+func LogMiddleware(l Logger) Middleware {
+	return func(next Handler) Handler {
+		return func(call *Call) (*http.Response, error) {
+			req := call.Request
+			logRequest(l, req, call.Endpoint)
+			start := time.Now()
+			res, err := next(call)
+			if err != nil {
+				if ctx := req.Context(); l.Enabled(ctx, slog.LevelWarn) {
+					l.Log(ctx, slog.LevelWarn, "bitflyer: request failed",
+						"method", req.Method, "path", call.Endpoint, "latency", time.Since(start), "error", err)
+				}
+				return res, err
+			}
+			logResponse(l, req, call.Endpoint, res, time.Since(start))
+			return res, nil
+		}
+	}
+}
+
+// requestBody はBodyを消費せずに読む
+func requestBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, nil
+	}
+	if req.GetBody != nil {
+		rc, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+		return io.ReadAll(rc)
+	}
+
+	b, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	req.Body = io.NopCloser(bytes.NewReader(b))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(b)), nil
+	}
+	return b, nil
+}
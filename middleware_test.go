@@ -0,0 +1,129 @@
+package bitflyer_test
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackpopper/bitflyer"
+)
+
+// trace は各段が呼ばれた順を記録する
+type trace struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (tr *trace) add(event string) {
+	tr.mu.Lock()
+	tr.events = append(tr.events, event)
+	tr.mu.Unlock()
+}
+
+func (tr *trace) take() []string {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	events := tr.events
+	tr.events = nil
+	return events
+}
+
+func (tr *trace) Sign(ctx context.Context, message string) (string, string, error) {
+	tr.add("sign")
+	return "key", "signature", nil
+}
+
+func (tr *trace) Enabled(ctx context.Context, level slog.Level) bool { return true }
+
+func (tr *trace) Log(ctx context.Context, level slog.Level, msg string, args ...interface{}) {
+	tr.add(strings.TrimPrefix(msg, "bitflyer: "))
+}
+
+func TestMiddlewareOrder(t *testing.T) {
+	tr := &trace{}
+	status := http.StatusOK
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tr.add("server " + r.Header.Get("ACCESS-SIGN"))
+		w.WriteHeader(status)
+		if status == http.StatusOK {
+			w.Write([]byte(`[{"currency_code":"JPY","amount":100,"available":100}]`))
+		} else {
+			w.Write([]byte(`{"status":-208,"error_message":"Order is not accepted"}`))
+		}
+	}))
+	defer ts.Close()
+
+	c := bitflyer.NewClient("", "")
+	c.URL, _ = url.Parse(ts.URL + "/v1")
+	c.RetryPolicy = nil
+	c.Signer = tr
+	c.Logger = tr
+	c.Metrics = bitflyer.NewMetrics("")
+	c.RateLimiter = &bitflyer.RateLimiter{FailFast: true, Private: bitflyer.NewRateBucket(2, time.Hour)}
+
+	var requests int64
+	var resErr error
+	var result interface{}
+	c.Middleware = []bitflyer.Middleware{func(next bitflyer.Handler) bitflyer.Handler {
+		return func(call *bitflyer.Call) (*http.Response, error) {
+			// 署名の前に受け取る
+			tr.add("user " + call.Request.Header.Get("ACCESS-SIGN"))
+			res, err := next(call)
+			tr.add("user done")
+			// メトリクスとステータス確認は内側、デコードは外側
+			requests = c.Metrics.Var().Get("requests").(*expvar.Map).Get("me/getbalance").(*expvar.Int).Value()
+			resErr = err
+			result = reflect.ValueOf(call.Result).Elem().Interface()
+			return res, err
+		}
+	}}
+
+	ctx := context.Background()
+	bal, err := c.GetMyBalance(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"user ", "sign", "request", "server signature", "response", "user done"}
+	if got := tr.take(); !reflect.DeepEqual(got, want) {
+		t.Errorf("events = %q, want %q", got, want)
+	}
+	if requests != 1 || resErr != nil {
+		t.Errorf("requests = %d, err = %v", requests, resErr)
+	}
+	if b, ok := result.(bitflyer.Balance); !ok || len(b) != 0 || len(*bal) != 1 {
+		t.Errorf("result = %#v, balance = %+v", result, bal)
+	}
+
+	status = http.StatusBadRequest
+	if _, err := c.GetMyBalance(ctx); err == nil {
+		t.Fatal("GetMyBalance succeeded")
+	}
+	if got := tr.take(); !reflect.DeepEqual(got, want) {
+		t.Errorf("events = %q, want %q", got, want)
+	}
+	var e *bitflyer.APIError
+	if !errors.As(resErr, &e) || e.Status != -208 || requests != 2 {
+		t.Errorf("requests = %d, err = %v", requests, resErr)
+	}
+
+	// 回数制限は署名とログより外側、メトリクスより内側
+	if _, err := c.GetMyBalance(ctx); !errors.Is(err, bitflyer.ErrRateLimitExceeded) {
+		t.Fatalf("err = %v", err)
+	}
+	want = []string{"user ", "user done"}
+	if got := tr.take(); !reflect.DeepEqual(got, want) {
+		t.Errorf("events = %q, want %q", got, want)
+	}
+	if requests != 3 {
+		t.Errorf("requests = %d, want 3", requests)
+	}
+}
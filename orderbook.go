@@ -0,0 +1,194 @@
+package bitflyer
+
+import (
+	"context"
+	"sort"
+	"sync"
+)
+
+// * 板の管理
+// スナップショット(GetBoard または lightning_board_snapshot_*)で初期化し、
+// 差分(lightning_board_*)を適用して板を保持する
+
+type OrderBook struct {
+	ProductCode string
+
+	mu   sync.RWMutex
+	bids []PriceLevel // 価格の降順
+	asks []PriceLevel // 価格の昇順
+}
+
+func NewOrderBook(productCode string) *OrderBook {
+	return &OrderBook{ProductCode: productCode}
+}
+
+// Load はGetBoardで板を取得して初期化する
+func (ob *OrderBook) Load(ctx context.Context, c *Client) error {
+	b, err := c.GetBoard(ctx, ob.ProductCode)
+	if err != nil {
+		return err
+	}
+	ob.Reset(b)
+
+	return nil
+}
+
+// Reset はスナップショットで板を置き換える
+func (ob *OrderBook) Reset(b *Board) {
+	bids := make([]PriceLevel, 0, len(b.Bids))
+	for _, l := range b.Bids {
+		if l.Size.Sign() > 0 {
+			bids = append(bids, l)
+		}
+	}
+	asks := make([]PriceLevel, 0, len(b.Asks))
+	for _, l := range b.Asks {
+		if l.Size.Sign() > 0 {
+			asks = append(asks, l)
+		}
+	}
+	sort.Slice(bids, func(i, j int) bool { return bids[i].Price.Cmp(bids[j].Price) > 0 })
+	sort.Slice(asks, func(i, j int) bool { return asks[i].Price.Cmp(asks[j].Price) < 0 })
+
+	ob.mu.Lock()
+	ob.bids = bids
+	ob.asks = asks
+	ob.mu.Unlock()
+}
+
+// Apply は差分を適用する。サイズ0の気配は削除する。
+// 差分は削除が届かないことがあるため、新しい気配と交差する反対側の気配も取り除く
+func (ob *OrderBook) Apply(b *Board) {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	for _, l := range b.Bids {
+		ob.bids = updateLevel(ob.bids, l, true)
+		if l.Size.Sign() > 0 {
+			i := sort.Search(len(ob.asks), func(i int) bool { return ob.asks[i].Price.Cmp(l.Price) > 0 })
+			ob.asks = ob.asks[i:]
+		}
+	}
+	for _, l := range b.Asks {
+		ob.asks = updateLevel(ob.asks, l, false)
+		if l.Size.Sign() > 0 {
+			i := sort.Search(len(ob.bids), func(i int) bool { return ob.bids[i].Price.Cmp(l.Price) < 0 })
+			ob.bids = ob.bids[i:]
+		}
+	}
+}
+
+func updateLevel(levels []PriceLevel, l PriceLevel, desc bool) []PriceLevel {
+	i := sort.Search(len(levels), func(i int) bool {
+		if desc {
+			return levels[i].Price.Cmp(l.Price) <= 0
+		}
+		return levels[i].Price.Cmp(l.Price) >= 0
+	})
+	found := i < len(levels) && levels[i].Price.Equal(l.Price)
+
+	switch {
+	case l.Size.Sign() <= 0 && found:
+		return append(levels[:i], levels[i+1:]...)
+	case l.Size.Sign() <= 0:
+		return levels
+	case found:
+		levels[i].Size = l.Size
+		return levels
+	default:
+		levels = append(levels, PriceLevel{})
+		copy(levels[i+1:], levels[i:])
+		levels[i] = l
+		return levels
+	}
+}
+
+func (ob *OrderBook) BestBid() (PriceLevel, bool) {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	if len(ob.bids) == 0 {
+		return PriceLevel{}, false
+	}
+	return ob.bids[0], true
+}
+
+func (ob *OrderBook) BestAsk() (PriceLevel, bool) {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	if len(ob.asks) == 0 {
+		return PriceLevel{}, false
+	}
+	return ob.asks[0], true
+}
+
+// MidPrice は最良気配の仲値。どちらかが空なら0
+func (ob *OrderBook) MidPrice() Decimal {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	if len(ob.bids) == 0 || len(ob.asks) == 0 {
+		return Decimal{}
+	}
+	return midPrice(ob.bids[0].Price, ob.asks[0].Price)
+}
+
+func midPrice(bid, ask Decimal) Decimal {
+	return bid.Add(ask).Mul(NewDecimal(5, -1))
+}
+
+// Depth は上位n本の気配のコピーを返す。n<=0なら全部
+func (ob *OrderBook) Depth(n int) (bids, asks []PriceLevel) {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	return copyLevels(ob.bids, n), copyLevels(ob.asks, n)
+}
+
+func copyLevels(levels []PriceLevel, n int) []PriceLevel {
+	if n <= 0 || n > len(levels) {
+		n = len(levels)
+	}
+	c := make([]PriceLevel, n)
+	copy(c, levels[:n])
+	return c
+}
+
+// CumulativeSize は最良気配からpriceまでの累積サイズ。
+// side がSideBuyなら買い板(price以上)、SideSellなら売り板(price以下)
+func (ob *OrderBook) CumulativeSize(side Side, price Decimal) Decimal {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	var size Decimal
+	switch side {
+	case SideBuy:
+		for _, l := range ob.bids {
+			if l.Price.Cmp(price) < 0 {
+				break
+			}
+			size = size.Add(l.Size)
+		}
+	case SideSell:
+		for _, l := range ob.asks {
+			if l.Price.Cmp(price) > 0 {
+				break
+			}
+			size = size.Add(l.Size)
+		}
+	}
+
+	return size
+}
+
+// Board は現在の板をBoardとして返す
+func (ob *OrderBook) Board() *Board {
+	bids, asks := ob.Depth(0)
+	b := &Board{Bids: bids, Asks: asks}
+	if len(bids) > 0 && len(asks) > 0 {
+		b.MidPrice = midPrice(bids[0].Price, asks[0].Price)
+	}
+
+	return b
+}
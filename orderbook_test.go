@@ -0,0 +1,162 @@
+package bitflyer_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/jackpopper/bitflyer"
+)
+
+// levels は "価格:数量" の並びを気配にする
+func levels(s string) []bitflyer.PriceLevel {
+	var ls []bitflyer.PriceLevel
+	for _, f := range strings.Fields(s) {
+		price, size, _ := strings.Cut(f, ":")
+		ls = append(ls, bitflyer.PriceLevel{Price: bitflyer.MustDecimal(price), Size: bitflyer.MustDecimal(size)})
+	}
+	return ls
+}
+
+func formatLevels(ls []bitflyer.PriceLevel) string {
+	var fs []string
+	for _, l := range ls {
+		fs = append(fs, fmt.Sprintf("%s:%s", l.Price, l.Size))
+	}
+	return strings.Join(fs, " ")
+}
+
+func board(bids, asks string) *bitflyer.Board {
+	return &bitflyer.Board{Bids: levels(bids), Asks: levels(asks)}
+}
+
+func TestOrderBook(t *testing.T) {
+	tests := []struct {
+		name       string
+		snapshot   *bitflyer.Board
+		diffs      []*bitflyer.Board
+		bids, asks string
+	}{
+		{
+			name:     "snapshot is sorted and drops empty levels",
+			snapshot: board("98:1 100:2 99:0", "103:1 101:0.5 102:0"),
+			bids:     "100:2 98:1",
+			asks:     "101:0.5 103:1",
+		},
+		{
+			name:     "insert and update",
+			snapshot: board("100:2 98:1", "101:0.5 103:1"),
+			diffs:    []*bitflyer.Board{board("99:3 100:1", "102:4")},
+			bids:     "100:1 99:3 98:1",
+			asks:     "101:0.5 102:4 103:1",
+		},
+		{
+			name:     "zero size deletes",
+			snapshot: board("100:2 98:1", "101:0.5 103:1"),
+			diffs:    []*bitflyer.Board{board("100:0 97:0", "103:0")},
+			bids:     "98:1",
+			asks:     "101:0.5",
+		},
+		{
+			name:     "new bid removes crossed asks",
+			snapshot: board("100:2 98:1", "101:0.5 102:1 103:1"),
+			diffs:    []*bitflyer.Board{board("102:1", "")},
+			bids:     "102:1 100:2 98:1",
+			asks:     "103:1",
+		},
+		{
+			name:     "new ask removes crossed bids",
+			snapshot: board("100:2 99:1 98:1", "101:0.5"),
+			diffs:    []*bitflyer.Board{board("", "99:2")},
+			bids:     "98:1",
+			asks:     "99:2 101:0.5",
+		},
+		{
+			name:     "deleting a level does not prune the other side",
+			snapshot: board("100:2", "101:1"),
+			diffs:    []*bitflyer.Board{board("105:0", "95:0")},
+			bids:     "100:2",
+			asks:     "101:1",
+		},
+		{
+			name:     "diffs in order",
+			snapshot: board("", ""),
+			diffs:    []*bitflyer.Board{board("100:1", "101:1"), board("100:0 99:2", ""), board("", "100:1")},
+			bids:     "99:2",
+			asks:     "100:1 101:1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ob := bitflyer.NewOrderBook("BTC_JPY")
+			ob.Reset(tt.snapshot)
+			for _, d := range tt.diffs {
+				ob.Apply(d)
+			}
+			bids, asks := ob.Depth(0)
+			if got := formatLevels(bids); got != tt.bids {
+				t.Errorf("bids = %q, want %q", got, tt.bids)
+			}
+			if got := formatLevels(asks); got != tt.asks {
+				t.Errorf("asks = %q, want %q", got, tt.asks)
+			}
+		})
+	}
+}
+
+func TestOrderBookQueries(t *testing.T) {
+	ob := bitflyer.NewOrderBook("BTC_JPY")
+	if _, ok := ob.BestBid(); ok {
+		t.Error("empty book has a best bid")
+	}
+	if _, ok := ob.BestAsk(); ok {
+		t.Error("empty book has a best ask")
+	}
+	if !ob.MidPrice().IsZero() {
+		t.Errorf("mid = %s", ob.MidPrice())
+	}
+
+	ob.Reset(board("100:1 99:2 98:3", "101:0.5 102:1.5 103:2"))
+	if l, ok := ob.BestBid(); !ok || !l.Price.Equal(bitflyer.MustDecimal("100")) {
+		t.Errorf("best bid = %+v", l)
+	}
+	if l, ok := ob.BestAsk(); !ok || !l.Price.Equal(bitflyer.MustDecimal("101")) {
+		t.Errorf("best ask = %+v", l)
+	}
+	if !ob.MidPrice().Equal(bitflyer.MustDecimal("100.5")) {
+		t.Errorf("mid = %s", ob.MidPrice())
+	}
+
+	bids, asks := ob.Depth(2)
+	if formatLevels(bids) != "100:1 99:2" || formatLevels(asks) != "101:0.5 102:1.5" {
+		t.Errorf("depth = %v %v", bids, asks)
+	}
+	// Depthは写しを返す
+	bids[0].Size = bitflyer.MustDecimal("9")
+	if l, _ := ob.BestBid(); !l.Size.Equal(bitflyer.MustDecimal("1")) {
+		t.Errorf("Depth shares the book: %+v", l)
+	}
+
+	for _, tt := range []struct {
+		side  bitflyer.Side
+		price string
+		want  string
+	}{
+		{bitflyer.SideBuy, "99", "3"},
+		{bitflyer.SideBuy, "99.5", "1"},
+		{bitflyer.SideBuy, "100.5", "0"},
+		{bitflyer.SideBuy, "0", "6"},
+		{bitflyer.SideSell, "102", "2"},
+		{bitflyer.SideSell, "100", "0"},
+		{bitflyer.SideSell, "1000", "4"},
+	} {
+		if got := ob.CumulativeSize(tt.side, bitflyer.MustDecimal(tt.price)); !got.Equal(bitflyer.MustDecimal(tt.want)) {
+			t.Errorf("CumulativeSize(%s, %s) = %s, want %s", tt.side, tt.price, got, tt.want)
+		}
+	}
+
+	b := ob.Board()
+	if !b.MidPrice.Equal(bitflyer.MustDecimal("100.5")) || len(b.Bids) != 3 || len(b.Asks) != 3 {
+		t.Errorf("board = %+v", b)
+	}
+}
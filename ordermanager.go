@@ -0,0 +1,834 @@
+package bitflyer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// * 特殊注文のエミュレーション
+// 親注文 (IFD, OCO, IFDOCO と STOP, STOP_LIMIT, TRAIL) を取引所に送らず、
+// 価格を見て手元で執行条件を判定し、普通の子注文 (SendChildorder, CancelChildorder) で執行する。
+// IFDは1つ目が約定し終えたら2つ目を、OCOはどちらかが約定したらもう一方を取り消す。
+// 状態はStateFileに保存し、再起動後にNewOrderManagerで読み込んでSyncすれば続きから動く。
+// 発注と取消はmuを持ったまま決めてrequestsにためておき、muを離してから送る
+
+// LegState は親注文の中の注文ひとつの状態
+type LegState string
+
+const (
+	// 前の注文が約定し終えるのを待っている
+	LegWaiting LegState = "WAITING"
+	// 執行条件を監視している
+	LegArmed LegState = "ARMED"
+	// 子注文を出した
+	LegPlaced LegState = "PLACED"
+	// 約定し終えたか取り消された
+	LegDone LegState = "DONE"
+)
+
+// EmulatedOrder はOrderManagerが執行する親注文
+type EmulatedOrder struct {
+	ParentOrderAcceptanceID string        `json:"parent_order_acceptance_id"`
+	OrderMethod             OrderMethod   `json:"order_method"`
+	TimeInForce             TimeInForce   `json:"time_in_force,omitempty"`
+	ParentOrderState        OrderState    `json:"parent_order_state"`
+	ParentOrderDate         time.Time     `json:"parent_order_date"`
+	ExpireDate              time.Time     `json:"expire_date"`
+	Legs                    []EmulatedLeg `json:"legs"`
+}
+
+type EmulatedLeg struct {
+	ParentorderParameter
+	State LegState `json:"state"`
+	// TRAILで追う高値 (売り) か安値 (買い)
+	Extreme                Decimal    `json:"extreme,omitzero"`
+	ChildOrderAcceptanceID string     `json:"child_order_acceptance_id,omitempty"`
+	ChildOrderState        OrderState `json:"child_order_state,omitempty"`
+	ExecutedSize           Decimal    `json:"executed_size,omitzero"`
+	// 反映した約定のID。イベントとSyncで同じ約定を二重に数えない
+	ExecIDs []int `json:"exec_ids,omitempty"`
+	// 子注文の取消を送ったか
+	CancelRequested bool `json:"cancel_requested,omitempty"`
+	// 子注文を出せなかった理由
+	Error string `json:"error,omitempty"`
+	// 受け付けられたか分からない子注文と送った時刻。注文一覧で確かめるまで出し直さない
+	Unconfirmed *Childorder `json:"unconfirmed,omitempty"`
+	SentAt      time.Time   `json:"sent_at,omitzero"`
+
+	// 子注文を送っている途中ならtrue
+	sending bool
+}
+
+type OrderManager struct {
+	Trader Trader
+	// 状態を保存するファイル。空なら保存しない
+	StateFile string
+	Logger    Logger
+	// Runで取引所の注文と突き合わせる間隔
+	SyncInterval time.Duration
+	// TRAILの高値と安値の更新を保存する間隔。ほかの変更はすぐに保存する
+	SaveInterval time.Duration
+
+	mu     sync.Mutex
+	orders []*EmulatedOrder
+	nextID int
+	// 最後に見た銘柄ごとの価格
+	prices map[string]Decimal
+	// 保存していない変更があればtrue。lazyはSaveIntervalごとに保存すればよい変更
+	dirty   bool
+	lazy    bool
+	savedAt time.Time
+	// まだ送っていない発注と取消
+	requests []request
+	// 送っている途中の子注文の数と、その間に届いた受付IDの分からないイベント
+	sending int
+	early   []*ChildOrderEvent
+}
+
+// request は子注文の発注か取消
+type request struct {
+	o      *EmulatedOrder
+	i      int
+	ch     *Childorder
+	cancel bool
+
+	// 発注を送った時刻と、受け付けられたか分からないときに取った注文一覧
+	sent   time.Time
+	orders *Childorders
+}
+
+type orderManagerState struct {
+	NextID int              `json:"next_id"`
+	Orders []*EmulatedOrder `json:"orders"`
+}
+
+// NewOrderManager はstateFileがあれば執行中の注文を読み込む
+func NewOrderManager(t Trader, stateFile string) (*OrderManager, error) {
+	m := &OrderManager{
+		Trader:       t,
+		StateFile:    stateFile,
+		SyncInterval: 30 * time.Second,
+		SaveInterval: 5 * time.Second,
+		prices:       map[string]Decimal{},
+	}
+	if stateFile == "" {
+		return m, nil
+	}
+
+	b, err := os.ReadFile(stateFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var st orderManagerState
+	if err := json.Unmarshal(b, &st); err != nil {
+		return nil, fmt.Errorf("bitflyer: %s: %v", stateFile, err)
+	}
+	m.orders, m.nextID = st.Orders, st.NextID
+
+	return m, nil
+}
+
+func (m *OrderManager) log(ctx context.Context, level slog.Level, msg string, args ...interface{}) {
+	if m.Logger != nil && m.Logger.Enabled(ctx, level) {
+		m.Logger.Log(ctx, level, msg, args...)
+	}
+}
+
+// Save は執行中の注文をStateFileに書く。終わった注文は、出した子注文が残っていなければ書かない
+func (m *OrderManager) Save() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.save()
+}
+
+func (m *OrderManager) save() error {
+	if m.StateFile == "" {
+		m.dirty, m.lazy = false, false
+		return nil
+	}
+	st := orderManagerState{NextID: m.nextID, Orders: []*EmulatedOrder{}}
+	for _, o := range m.orders {
+		if !o.settled() {
+			st.Orders = append(st.Orders, o)
+		}
+	}
+	err := writeFileAtomic(m.StateFile, func(f *os.File) error {
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		return enc.Encode(&st)
+	})
+	if err == nil {
+		m.dirty, m.lazy = false, false
+		m.savedAt = time.Now()
+	}
+	return err
+}
+
+// persist は状態が変わっていれば保存する。lazyな変更だけなら前の保存からSaveIntervalたってから
+func (m *OrderManager) persist(ctx context.Context) {
+	if !m.dirty && !(m.lazy && time.Since(m.savedAt) >= m.SaveInterval) {
+		return
+	}
+	if err := m.save(); err != nil {
+		m.log(ctx, slog.LevelError, "bitflyer: order manager save failed", "error", err)
+	}
+}
+
+// ** 注文
+// Send は親注文を受け付け、LIMITかMARKETで始まる注文はすぐに子注文を出す
+func (m *OrderManager) Send(ctx context.Context, pa *Parentorder) (*ParentOrderAcceptanceID, error) {
+	if err := pa.Validate(); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	expire := pa.MinuteToExpire
+	if expire == 0 {
+		expire = 43200
+	}
+	now := time.Now().UTC()
+	m.nextID++
+	o := &EmulatedOrder{
+		ParentOrderAcceptanceID: fmt.Sprintf("LOCAL-JRP-%06d", m.nextID),
+		OrderMethod:             pa.OrderMethod,
+		TimeInForce:             pa.TimeInForce,
+		ParentOrderState:        StateActive,
+		ParentOrderDate:         now,
+		ExpireDate:              now.Add(time.Duration(expire) * time.Minute),
+	}
+	for _, p := range pa.Parameters {
+		o.Legs = append(o.Legs, EmulatedLeg{ParentorderParameter: p, State: LegWaiting})
+	}
+	m.orders = append(m.orders, o)
+	m.dirty = true
+
+	m.arm(ctx, o, 0)
+	if o.OrderMethod == MethodOCO {
+		m.arm(ctx, o, 1)
+	}
+	m.flush(ctx)
+	// 最初の注文を出せなければ受け付けない
+	if first := &o.Legs[0]; first.Error != "" {
+		o.ParentOrderState = StateRejected
+		m.persist(ctx)
+		return nil, errors.New(first.Error)
+	}
+	m.persist(ctx)
+
+	return &ParentOrderAcceptanceID{ParentOrderAcceptanceID: o.ParentOrderAcceptanceID}, nil
+}
+
+// Cancel は親注文を取り消し、出している子注文も取り消す
+func (m *OrderManager) Cancel(ctx context.Context, parentOrderAcceptanceID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	o := m.find(parentOrderAcceptanceID)
+	if o == nil || o.ParentOrderState != StateActive {
+		return &APIError{HTTPStatus: http.StatusBadRequest, Status: StatusOrderNotFound, Message: "Order not found"}
+	}
+	m.cancelOrder(ctx, o, StateCanceled)
+	m.flush(ctx)
+	m.persist(ctx)
+
+	return nil
+}
+
+// Orders はすべての注文の写し。終わった注文は再起動すると消える
+func (m *OrderManager) Orders() []EmulatedOrder {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	orders := make([]EmulatedOrder, len(m.orders))
+	for i, o := range m.orders {
+		orders[i] = *o
+		orders[i].Legs = append([]EmulatedLeg(nil), o.Legs...)
+		for j := range orders[i].Legs {
+			l := &orders[i].Legs[j]
+			l.ExecIDs = append([]int(nil), l.ExecIDs...)
+			if l.Unconfirmed != nil {
+				ch := *l.Unconfirmed
+				l.Unconfirmed = &ch
+			}
+		}
+	}
+	return orders
+}
+
+func (m *OrderManager) find(parentOrderAcceptanceID string) *EmulatedOrder {
+	for _, o := range m.orders {
+		if o.ParentOrderAcceptanceID == parentOrderAcceptanceID {
+			return o
+		}
+	}
+	return nil
+}
+
+// findChild は子注文の受付IDから注文を引く。親注文が終わった後に届いた約定も反映するので、終わった注文からも引く
+func (m *OrderManager) findChild(childOrderAcceptanceID string) (*EmulatedOrder, int) {
+	for _, o := range m.orders {
+		for i := range o.Legs {
+			if o.Legs[i].ChildOrderAcceptanceID == childOrderAcceptanceID {
+				return o, i
+			}
+		}
+	}
+	return nil, -1
+}
+
+// settled は親注文が終わり、取引所に残っているかもしれない子注文もないか
+func (o *EmulatedOrder) settled() bool {
+	if o.ParentOrderState == StateActive {
+		return false
+	}
+	for _, l := range o.Legs {
+		if l.State == LegPlaced || l.Unconfirmed != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// ** 価格と約定
+// OnPrice は価格でSTOP, STOP_LIMIT, TRAILの執行条件を確かめる。期限切れの注文もここで失効させる
+func (m *OrderManager) OnPrice(ctx context.Context, productCode string, price Decimal) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.prices[productCode] = price
+	now := time.Now()
+	for _, o := range m.orders {
+		if o.ParentOrderState != StateActive {
+			continue
+		}
+		if now.After(o.ExpireDate) {
+			m.cancelOrder(ctx, o, StateExpired)
+			continue
+		}
+		for i := range o.Legs {
+			if l := &o.Legs[i]; l.State == LegArmed && l.ProductCode == productCode {
+				m.check(ctx, o, i, price)
+			}
+		}
+	}
+	m.flush(ctx)
+	m.persist(ctx)
+}
+
+func (m *OrderManager) OnTicker(ctx context.Context, t *Ticker) {
+	m.OnPrice(ctx, t.ProductCode, t.Ltp)
+}
+
+// OnExecutions は市場の約定をひとつずつOnPriceに渡す
+func (m *OrderManager) OnExecutions(ctx context.Context, productCode string, execs *Executions) {
+	for _, e := range *execs {
+		m.OnPrice(ctx, productCode, e.Price)
+	}
+}
+
+// OnChildOrderEvent は子注文の約定、取消、失効を反映する
+func (m *OrderManager) OnChildOrderEvent(ctx context.Context, ev *ChildOrderEvent) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	o, i := m.findChild(ev.ChildOrderAcceptanceID)
+	if o == nil {
+		// 送っている途中の子注文のイベントなら、受付IDが分かってから反映する
+		if m.sending > 0 {
+			m.early = append(m.early, ev)
+		}
+		return
+	}
+	m.childEvent(ctx, o, i, ev)
+	m.flush(ctx)
+	m.persist(ctx)
+}
+
+func (m *OrderManager) childEvent(ctx context.Context, o *EmulatedOrder, i int, ev *ChildOrderEvent) {
+	switch ev.EventType {
+	case EventExecution:
+		m.execution(ctx, o, i, ev.ExecID, ev.Size)
+	case EventCancel:
+		m.childDone(ctx, o, i, StateCanceled)
+	case EventExpire:
+		m.childDone(ctx, o, i, StateExpired)
+	case EventOrderFailed:
+		o.Legs[i].Error = ev.Reason
+		m.childDone(ctx, o, i, StateRejected)
+	}
+}
+
+// Sync は出している子注文を受付IDでひとつずつ取引所の注文と約定に突き合わせる。
+// 受け付けられたか分からない子注文は注文一覧から探す。
+// 再起動の後や、Realtime APIのイベントを取りこぼしたときに使う
+func (m *OrderManager) Sync(ctx context.Context) error {
+	type placed struct {
+		o *EmulatedOrder
+		i int
+		l EmulatedLeg
+	}
+	m.mu.Lock()
+	var legs []placed
+	for _, o := range m.orders {
+		for i, l := range o.Legs {
+			if l.State == LegPlaced || l.Unconfirmed != nil {
+				legs = append(legs, placed{o, i, l})
+			}
+		}
+	}
+	m.mu.Unlock()
+
+	for _, p := range legs {
+		if p.l.Unconfirmed != nil {
+			orders, err := m.Trader.GetMyChildorders(ctx, p.l.ProductCode, &Page{Count: 100}, "", "")
+			if err != nil {
+				return err
+			}
+
+			m.mu.Lock()
+			// 確かめている間に確かめ終わっていれば何もしない
+			if p.o.Legs[p.i].Unconfirmed == p.l.Unconfirmed {
+				m.confirm(ctx, p.o, p.i, orders)
+			}
+			m.flush(ctx)
+			m.mu.Unlock()
+			continue
+		}
+
+		children, err := m.Trader.GetMyChildorder(ctx, p.l.ProductCode, "", p.l.ChildOrderAcceptanceID)
+		if err != nil {
+			return err
+		}
+		execs, err := m.Trader.GetMyExecutions(ctx, p.l.ProductCode, &Page{Count: 500}, "", p.l.ChildOrderAcceptanceID)
+		if err != nil {
+			return err
+		}
+
+		m.mu.Lock()
+		m.synced(ctx, p.o, p.i, p.l.ChildOrderAcceptanceID, children, execs)
+		m.flush(ctx)
+		m.mu.Unlock()
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.dirty = true
+	m.persist(ctx)
+
+	return nil
+}
+
+// synced はSyncで取得した子注文と約定を反映する
+func (m *OrderManager) synced(ctx context.Context, o *EmulatedOrder, i int, acceptanceID string, children *Childorders, execs *Executions) {
+	l := &o.Legs[i]
+	// 取得している間にイベントで終わっていれば何もしない
+	if l.State != LegPlaced || l.ChildOrderAcceptanceID != acceptanceID {
+		return
+	}
+	for k := len(*execs) - 1; k >= 0 && l.State == LegPlaced; k-- {
+		e := (*execs)[k]
+		m.execution(ctx, o, i, e.ID, e.Size)
+	}
+	for _, ch := range *children {
+		if ch.ChildOrderAcceptanceID != acceptanceID || l.State != LegPlaced {
+			continue
+		}
+		// 約定の一覧に載っていない約定があれば、取引所の約定数量に合わせる
+		if ch.ExecutedSize.Cmp(l.ExecutedSize) > 0 {
+			m.executed(ctx, o, i, ch.ExecutedSize)
+		}
+		if ch.ChildOrderState != StateActive && l.State == LegPlaced {
+			m.childDone(ctx, o, i, ch.ChildOrderState)
+		}
+	}
+}
+
+// Run はRealtime APIでproductCodesの約定と子注文のイベントを購読して注文を執行する。
+// Realtime.Runは別に呼ぶ。始めにSyncし、その後もSyncIntervalごとにSyncする
+func (m *OrderManager) Run(ctx context.Context, rt *Realtime, productCodes ...string) error {
+	// 戻った後に配信が詰まらないよう、購読をやめる
+	events := rt.SubscribeChildOrderEvents()
+	defer rt.Unsubscribe(events)
+	type batch struct {
+		productCode string
+		execs       *Executions
+	}
+	execs := make(chan batch)
+	for _, code := range productCodes {
+		in := rt.SubscribeExecutions(code)
+		defer rt.Unsubscribe(in)
+		go func() {
+			for e := range in {
+				select {
+				case execs <- batch{code, e}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+
+	if err := m.Sync(ctx); err != nil {
+		m.log(ctx, slog.LevelWarn, "bitflyer: order manager sync failed", "error", err)
+	}
+	tick := time.NewTicker(m.SyncInterval)
+	defer tick.Stop()
+
+	for {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+			m.OnChildOrderEvent(ctx, ev)
+		case b := <-execs:
+			m.OnExecutions(ctx, b.productCode, b.execs)
+		case <-tick.C:
+			if err := m.Sync(ctx); err != nil {
+				m.log(ctx, slog.LevelWarn, "bitflyer: order manager sync failed", "error", err)
+			}
+		case <-ctx.Done():
+			if err := m.Save(); err != nil {
+				return err
+			}
+			return ctx.Err()
+		}
+	}
+}
+
+// ** 執行
+// arm は執行条件の監視を始める。LIMITとMARKETはすぐに子注文を出す
+func (m *OrderManager) arm(ctx context.Context, o *EmulatedOrder, i int) {
+	l := &o.Legs[i]
+	if o.ParentOrderState != StateActive || l.State != LegWaiting {
+		return
+	}
+	l.State = LegArmed
+	m.dirty = true
+
+	price, ok := m.prices[l.ProductCode]
+	switch {
+	case l.ConditionType == ConditionLimit || l.ConditionType == ConditionMarket:
+		m.check(ctx, o, i, price)
+	case ok:
+		l.Extreme = price
+		m.check(ctx, o, i, price)
+	}
+}
+
+func (m *OrderManager) check(ctx context.Context, o *EmulatedOrder, i int, price Decimal) {
+	l := &o.Legs[i]
+	buy := l.Side == SideBuy
+	switch l.ConditionType {
+	case ConditionLimit:
+		m.place(ctx, o, i, OrderTypeLimit, l.Price)
+	case ConditionMarket:
+		m.place(ctx, o, i, OrderTypeMarket, Decimal{})
+	case ConditionStop, ConditionStopLimit:
+		if c := price.Cmp(l.TriggerPrice); (buy && c < 0) || (!buy && c > 0) {
+			return
+		}
+		if l.ConditionType == ConditionStop {
+			m.place(ctx, o, i, OrderTypeMarket, Decimal{})
+		} else {
+			m.place(ctx, o, i, OrderTypeLimit, l.Price)
+		}
+	case ConditionTrail:
+		offset := NewDecimalFromInt(int64(l.Offset))
+		if l.Extreme.IsZero() || (buy && price.Cmp(l.Extreme) < 0) || (!buy && price.Cmp(l.Extreme) > 0) {
+			// 価格のたびに書かないよう、高値と安値の更新はSaveIntervalごとに保存する
+			l.Extreme = price
+			m.lazy = true
+			return
+		}
+		if (buy && price.Cmp(l.Extreme.Add(offset)) >= 0) || (!buy && price.Cmp(l.Extreme.Sub(offset)) <= 0) {
+			m.place(ctx, o, i, OrderTypeMarket, Decimal{})
+		}
+	}
+}
+
+// place は子注文の発注をrequestsに加える
+func (m *OrderManager) place(ctx context.Context, o *EmulatedOrder, i int, typ OrderType, price Decimal) {
+	l := &o.Legs[i]
+	if l.sending || l.Unconfirmed != nil {
+		return
+	}
+	minutes := int(time.Until(o.ExpireDate)/time.Minute) + 1
+	if minutes > 43200 {
+		minutes = 43200
+	}
+	l.sending = true
+	m.sending++
+	m.requests = append(m.requests, request{o: o, i: i, ch: &Childorder{
+		ProductCode:    l.ProductCode,
+		ChildOrderType: typ,
+		Side:           l.Side,
+		Price:          price,
+		Size:           l.Size,
+		MinuteToExpire: minutes,
+		TimeInForce:    o.TimeInForce,
+	}})
+}
+
+// flush はrequestsを、muを離して順に送り、結果を反映する。呼ぶときはmuを持つ。
+// 送る間に他の呼び出しが加えたものは、その呼び出しが送る
+func (m *OrderManager) flush(ctx context.Context) {
+	for len(m.requests) > 0 {
+		reqs := m.requests
+		m.requests = nil
+		for _, req := range reqs {
+			m.mu.Unlock()
+			var acc *ChildOrderAcceptanceID
+			var err error
+			if req.cancel {
+				err = m.Trader.CancelChildorder(ctx, req.ch)
+			} else {
+				req.sent = time.Now()
+				acc, err = m.Trader.SendChildorder(ctx, req.ch)
+				if err != nil && isAmbiguousError(err) {
+					req.orders = m.lookup(ctx, req.ch.ProductCode)
+				}
+			}
+			m.mu.Lock()
+
+			if req.cancel {
+				m.canceled(ctx, req.o, req.i, err)
+			} else {
+				m.placed(ctx, req, acc, err)
+			}
+		}
+	}
+}
+
+// lookup は受け付けられたか分からない子注文を探すために注文一覧を取る。取れなければnilで、次のSyncで探す
+func (m *OrderManager) lookup(ctx context.Context, productCode string) *Childorders {
+	// 呼び出し元のctxが切れていても確かめる
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), safeSendCheckTimeout)
+	defer cancel()
+
+	orders, err := m.Trader.GetMyChildorders(ctx, productCode, &Page{Count: 100}, "", "")
+	if err != nil {
+		m.log(ctx, slog.LevelWarn, "bitflyer: order manager lookup failed", "product_code", productCode, "error", err)
+		return nil
+	}
+	return orders
+}
+
+// placed は発注の結果を反映する。回数制限で失敗したら次の価格で出し直し、
+// 注文が受け付けられなければその注文を終わりにする。
+// 時間切れなどで受け付けられたか分からなければ、注文一覧で確かめるまで出し直さない
+func (m *OrderManager) placed(ctx context.Context, req request, acc *ChildOrderAcceptanceID, err error) {
+	o, i := req.o, req.i
+	l := &o.Legs[i]
+	l.sending = false
+	m.sending--
+	m.dirty = true
+	defer func() {
+		if m.sending == 0 {
+			m.early = nil
+		}
+	}()
+
+	if err != nil {
+		m.log(ctx, slog.LevelWarn, "bitflyer: order manager send failed", "parent_order_acceptance_id", o.ParentOrderAcceptanceID, "error", err)
+		switch _, ok := asAPIError(err); {
+		case isAmbiguousError(err):
+			l.Unconfirmed, l.SentAt = req.ch, req.sent
+			if req.orders != nil {
+				m.confirm(ctx, o, i, req.orders)
+			}
+		case (ok && !IsRateLimited(err) && !IsMaintenance(err)) || errors.Is(err, ErrInvalidOrder):
+			l.Error = err.Error()
+			m.childDone(ctx, o, i, StateRejected)
+		}
+		return
+	}
+	m.accepted(ctx, o, i, acc.ChildOrderAcceptanceID)
+}
+
+// confirm は受け付けられたか分からない子注文をordersから探す。
+// 見つかれば出した子注文として扱い、なければ次の価格で出し直せるようにする
+func (m *OrderManager) confirm(ctx context.Context, o *EmulatedOrder, i int, orders *Childorders) {
+	l := &o.Legs[i]
+	// 他の注文が出した子注文とは取り違えない
+	known := map[string]bool{}
+	for _, o := range m.orders {
+		for _, l := range o.Legs {
+			if l.ChildOrderAcceptanceID != "" {
+				known[l.ChildOrderAcceptanceID] = true
+			}
+		}
+	}
+	id := matchChildorder(*orders, l.Unconfirmed, l.SentAt.Add(-safeSendClockSkew), known)
+	l.Unconfirmed, l.SentAt = nil, time.Time{}
+	m.dirty = true
+	if id != "" {
+		m.accepted(ctx, o, i, id)
+	}
+}
+
+// accepted は子注文が受け付けられたことを反映する
+func (m *OrderManager) accepted(ctx context.Context, o *EmulatedOrder, i int, acceptanceID string) {
+	l := &o.Legs[i]
+	// 送っている間に取り消されていれば、出した子注文も取り消す
+	canceled := l.State == LegDone
+	l.State = LegPlaced
+	l.ChildOrderAcceptanceID = acceptanceID
+	l.ChildOrderState = StateActive
+	m.dirty = true
+	if canceled {
+		m.cancelLeg(ctx, o, i)
+	}
+
+	early := m.early[:0]
+	for _, ev := range m.early {
+		if ev.ChildOrderAcceptanceID != acceptanceID {
+			early = append(early, ev)
+		} else {
+			m.childEvent(ctx, o, i, ev)
+		}
+	}
+	m.early = early
+}
+
+// execution は約定1件を反映する。同じIDの約定は一度だけ数え、注文の数量を超えては数えない
+func (m *OrderManager) execution(ctx context.Context, o *EmulatedOrder, i int, execID int, size Decimal) {
+	l := &o.Legs[i]
+	if execID != 0 {
+		for _, id := range l.ExecIDs {
+			if id == execID {
+				return
+			}
+		}
+		l.ExecIDs = append(l.ExecIDs, execID)
+	}
+	total := l.ExecutedSize.Add(size)
+	if total.Cmp(l.Size) > 0 {
+		total = l.Size
+	}
+	m.executed(ctx, o, i, total)
+}
+
+// executed は子注文の約定数量を更新する。OCOは一方が約定したらもう一方を取り消す
+func (m *OrderManager) executed(ctx context.Context, o *EmulatedOrder, i int, size Decimal) {
+	l := &o.Legs[i]
+	l.ExecutedSize = size
+	m.dirty = true
+
+	if j := ocoSibling(o.OrderMethod, i); j >= 0 && o.Legs[j].State != LegDone {
+		m.cancelLeg(ctx, o, j)
+	}
+	if l.ExecutedSize.Cmp(l.Size) >= 0 {
+		m.childDone(ctx, o, i, StateCompleted)
+	}
+}
+
+// ocoSibling はOCOの組になっているもう一方の注文の番号。なければ-1
+func ocoSibling(method OrderMethod, i int) int {
+	first := -1
+	switch method {
+	case MethodOCO:
+		first = 0
+	case MethodIFDOCO:
+		first = 1
+	}
+	switch {
+	case first < 0:
+		return -1
+	case i == first:
+		return first + 1
+	case i == first+1:
+		return first
+	}
+	return -1
+}
+
+// childDone は子注文が終わった注文を終わりにし、IFDなら次の注文の監視を始める
+func (m *OrderManager) childDone(ctx context.Context, o *EmulatedOrder, i int, state OrderState) {
+	l := &o.Legs[i]
+	if l.State == LegDone {
+		return
+	}
+	l.State = LegDone
+	l.ChildOrderState = state
+	m.dirty = true
+
+	if i == 0 && (o.OrderMethod == MethodIFD || o.OrderMethod == MethodIFDOCO) {
+		if state != StateCompleted {
+			// 1つ目が約定しなければ残りは出さない
+			for j := 1; j < len(o.Legs); j++ {
+				o.Legs[j].State = LegDone
+			}
+			if o.ParentOrderState == StateActive {
+				o.ParentOrderState = state
+			}
+			return
+		}
+		for j := 1; j < len(o.Legs); j++ {
+			m.arm(ctx, o, j)
+		}
+	}
+
+	if o.ParentOrderState != StateActive {
+		return
+	}
+	for _, l := range o.Legs {
+		if l.State != LegDone {
+			return
+		}
+	}
+	o.ParentOrderState = StateCompleted
+}
+
+// cancelLeg は出している子注文の取消をrequestsに加え、まだ出していなければ終わりにする。
+// 送っている途中の子注文は、受け付けられてから取り消す
+func (m *OrderManager) cancelLeg(ctx context.Context, o *EmulatedOrder, i int) {
+	l := &o.Legs[i]
+	m.dirty = true
+	if l.State != LegPlaced {
+		l.State = LegDone
+		return
+	}
+	if l.CancelRequested {
+		return
+	}
+
+	l.CancelRequested = true
+	m.requests = append(m.requests, request{o: o, i: i, cancel: true, ch: &Childorder{ProductCode: l.ProductCode, ChildOrderAcceptanceID: l.ChildOrderAcceptanceID}})
+}
+
+// canceled は取消の結果を反映する
+func (m *OrderManager) canceled(ctx context.Context, o *EmulatedOrder, i int, err error) {
+	if err == nil || IsOrderNotFound(err) {
+		return
+	}
+	// 次のSyncかイベントで終わりが分かる。取消は出し直さない
+	l := &o.Legs[i]
+	m.log(ctx, slog.LevelWarn, "bitflyer: order manager cancel failed", "child_order_acceptance_id", l.ChildOrderAcceptanceID, "error", err)
+	l.CancelRequested = false
+	m.dirty = true
+}
+
+func (m *OrderManager) cancelOrder(ctx context.Context, o *EmulatedOrder, state OrderState) {
+	o.ParentOrderState = state
+	m.dirty = true
+	for i := range o.Legs {
+		if o.Legs[i].State != LegDone {
+			m.cancelLeg(ctx, o, i)
+		}
+	}
+}
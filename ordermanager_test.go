@@ -0,0 +1,615 @@
+package bitflyer_test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackpopper/bitflyer"
+	"github.com/jackpopper/bitflyer/bitflyertest"
+)
+
+// fakeTrader は送った注文を覚えておくだけのTrader
+type fakeTrader struct {
+	mu       sync.Mutex
+	sent     []*bitflyer.Childorder
+	canceled []string
+	orders   map[string]*bitflyer.ChildorderInfo
+	execs    map[string]bitflyer.Executions
+	sendErr  error
+	// trueならsendErrを返しても注文は受け付けている (応答が届かなかった)
+	lost    bool
+	listErr error
+	// 発注と取消の応答を返す前に呼ぶ
+	onSend   func(acceptanceID string)
+	onCancel func(acceptanceID string)
+}
+
+func newFakeTrader() *fakeTrader {
+	return &fakeTrader{orders: map[string]*bitflyer.ChildorderInfo{}, execs: map[string]bitflyer.Executions{}}
+}
+
+func (f *fakeTrader) SendChildorder(ctx context.Context, ch *bitflyer.Childorder) (*bitflyer.ChildOrderAcceptanceID, error) {
+	f.mu.Lock()
+	if f.sendErr != nil && !f.lost {
+		f.mu.Unlock()
+		return nil, f.sendErr
+	}
+	f.sent = append(f.sent, ch)
+	id := fmt.Sprintf("JRF-%d", len(f.sent))
+	f.orders[id] = &bitflyer.ChildorderInfo{
+		ChildOrderAcceptanceID: id,
+		ProductCode:            ch.ProductCode,
+		Side:                   ch.Side,
+		ChildOrderType:         ch.ChildOrderType,
+		Price:                  ch.Price,
+		Size:                   ch.Size,
+		ChildOrderState:        bitflyer.StateActive,
+		ChildOrderDate:         bitflyer.Time{Time: time.Now().UTC()},
+	}
+	onSend, err := f.onSend, f.sendErr
+	f.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	if onSend != nil {
+		onSend(id)
+	}
+	return &bitflyer.ChildOrderAcceptanceID{ChildOrderAcceptanceID: id}, nil
+}
+
+func (f *fakeTrader) CancelChildorder(ctx context.Context, ch *bitflyer.Childorder) error {
+	f.mu.Lock()
+	f.canceled = append(f.canceled, ch.ChildOrderAcceptanceID)
+	onCancel := f.onCancel
+	f.mu.Unlock()
+
+	if onCancel != nil {
+		onCancel(ch.ChildOrderAcceptanceID)
+	}
+	return nil
+}
+
+func (f *fakeTrader) CancelAllChildorder(ctx context.Context, productCode string) error {
+	return nil
+}
+
+func (f *fakeTrader) GetMyChildorders(ctx context.Context, productCode string, page *bitflyer.Page, childOrderState bitflyer.OrderState, parentOrderID string) (*bitflyer.Childorders, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.listErr != nil {
+		return nil, f.listErr
+	}
+	// 新しい順
+	data := bitflyer.Childorders{}
+	for k := len(f.sent); k > 0 && len(data) < page.Limit(); k-- {
+		data = append(data, *f.orders[fmt.Sprintf("JRF-%d", k)])
+	}
+	return &data, nil
+}
+
+func (f *fakeTrader) GetMyChildorder(ctx context.Context, productCode, childOrderID, childOrderAcceptanceID string) (*bitflyer.Childorders, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	data := bitflyer.Childorders{}
+	if o, ok := f.orders[childOrderAcceptanceID]; ok {
+		data = append(data, *o)
+	}
+	return &data, nil
+}
+
+func (f *fakeTrader) GetMyExecutions(ctx context.Context, productCode string, page *bitflyer.Page, childOrderID, childOrderAcceptanceID string) (*bitflyer.Executions, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	data := append(bitflyer.Executions{}, f.execs[childOrderAcceptanceID]...)
+	return &data, nil
+}
+
+// fill は取引所で約定したことにし、Realtime APIのイベントを返す
+func (f *fakeTrader) fill(acceptanceID string, execID int, size string) *bitflyer.ChildOrderEvent {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	o := f.orders[acceptanceID]
+	o.ExecutedSize = o.ExecutedSize.Add(bitflyer.MustDecimal(size))
+	if o.ExecutedSize.Cmp(o.Size) >= 0 {
+		o.ChildOrderState = bitflyer.StateCompleted
+	}
+	// 新しい順
+	f.execs[acceptanceID] = append(bitflyer.Executions{{ID: execID, ChildOrderAcceptanceID: acceptanceID, Size: bitflyer.MustDecimal(size)}}, f.execs[acceptanceID]...)
+	return &bitflyer.ChildOrderEvent{ChildOrderAcceptanceID: acceptanceID, EventType: bitflyer.EventExecution, ExecID: execID, Size: bitflyer.MustDecimal(size)}
+}
+
+func (f *fakeTrader) sentCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.sent)
+}
+
+// timeoutError は応答を待ちきれなかったときのnet.Error
+type timeoutError struct{}
+
+var _ net.Error = timeoutError{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func limit(side bitflyer.Side, price string) bitflyer.ParentorderParameter {
+	return bitflyer.ParentorderParameter{ProductCode: "FX_BTC_JPY", ConditionType: bitflyer.ConditionLimit, Side: side, Price: bitflyer.MustDecimal(price), Size: bitflyer.MustDecimal("0.01")}
+}
+
+func legStates(m *bitflyer.OrderManager) []bitflyer.LegState {
+	var states []bitflyer.LegState
+	for _, o := range m.Orders() {
+		for _, l := range o.Legs {
+			states = append(states, l.State)
+		}
+	}
+	return states
+}
+
+func checkLegs(t *testing.T, m *bitflyer.OrderManager, want ...bitflyer.LegState) {
+	t.Helper()
+	got := legStates(m)
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("legs = %v, want %v", got, want)
+	}
+}
+
+func TestOrderManagerIFDOCO(t *testing.T) {
+	ctx := context.Background()
+	file := filepath.Join(t.TempDir(), "orders.json")
+	ft := newFakeTrader()
+	m, err := bitflyer.NewOrderManager(ft, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	acc, err := m.Send(ctx, &bitflyer.Parentorder{OrderMethod: bitflyer.MethodIFDOCO, Parameters: []bitflyer.ParentorderParameter{
+		limit(bitflyer.SideBuy, "100"),
+		limit(bitflyer.SideSell, "120"),
+		{ProductCode: "FX_BTC_JPY", ConditionType: bitflyer.ConditionTrail, Side: bitflyer.SideSell, Size: bitflyer.MustDecimal("0.01"), Offset: 5},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkLegs(t, m, bitflyer.LegPlaced, bitflyer.LegWaiting, bitflyer.LegWaiting)
+
+	// 1つ目が約定し終えたら2つ目と3つ目
+	m.OnChildOrderEvent(ctx, ft.fill("JRF-1", 1, "0.01"))
+	if len(ft.sent) != 2 || !ft.sent[1].Price.Equal(bitflyer.MustDecimal("120")) {
+		t.Fatalf("sent = %+v", ft.sent)
+	}
+	checkLegs(t, m, bitflyer.LegDone, bitflyer.LegPlaced, bitflyer.LegArmed)
+
+	// 状態ファイルから続きを動かす
+	m, err = bitflyer.NewOrderManager(ft, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkLegs(t, m, bitflyer.LegDone, bitflyer.LegPlaced, bitflyer.LegArmed)
+	for _, p := range []string{"110", "115", "112"} {
+		m.OnPrice(ctx, "FX_BTC_JPY", bitflyer.MustDecimal(p))
+	}
+	if len(ft.sent) != 2 {
+		t.Fatalf("sent = %d before the trail triggers", len(ft.sent))
+	}
+	m.OnPrice(ctx, "FX_BTC_JPY", bitflyer.MustDecimal("110"))
+	if len(ft.sent) != 3 || ft.sent[2].ChildOrderType != bitflyer.OrderTypeMarket {
+		t.Fatalf("sent = %+v", ft.sent)
+	}
+
+	// TRAILが約定したら指値を取り消す
+	m.OnChildOrderEvent(ctx, ft.fill("JRF-3", 2, "0.01"))
+	if len(ft.canceled) != 1 || ft.canceled[0] != "JRF-2" {
+		t.Fatalf("canceled = %v", ft.canceled)
+	}
+	m.OnChildOrderEvent(ctx, &bitflyer.ChildOrderEvent{ChildOrderAcceptanceID: "JRF-2", EventType: bitflyer.EventCancel})
+	orders := m.Orders()
+	if orders[0].ParentOrderAcceptanceID != acc.ParentOrderAcceptanceID || orders[0].ParentOrderState != bitflyer.StateCompleted {
+		t.Errorf("order = %+v", orders[0])
+	}
+}
+
+func TestOrderManagerOCO(t *testing.T) {
+	ctx := context.Background()
+	ft := newFakeTrader()
+	m, err := bitflyer.NewOrderManager(ft, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = m.Send(ctx, &bitflyer.Parentorder{OrderMethod: bitflyer.MethodOCO, Parameters: []bitflyer.ParentorderParameter{
+		limit(bitflyer.SideSell, "120"),
+		{ProductCode: "FX_BTC_JPY", ConditionType: bitflyer.ConditionStop, Side: bitflyer.SideSell, TriggerPrice: bitflyer.MustDecimal("90"), Size: bitflyer.MustDecimal("0.01")},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkLegs(t, m, bitflyer.LegPlaced, bitflyer.LegArmed)
+	m.OnPrice(ctx, "FX_BTC_JPY", bitflyer.MustDecimal("95"))
+	if len(ft.sent) != 1 {
+		t.Fatalf("sent = %d above the trigger", len(ft.sent))
+	}
+
+	// 指値が一部でも約定したらSTOPは出さない
+	m.OnChildOrderEvent(ctx, ft.fill("JRF-1", 1, "0.005"))
+	checkLegs(t, m, bitflyer.LegPlaced, bitflyer.LegDone)
+	m.OnPrice(ctx, "FX_BTC_JPY", bitflyer.MustDecimal("80"))
+	if len(ft.sent) != 1 {
+		t.Errorf("sent = %d after the sibling filled", len(ft.sent))
+	}
+	m.OnChildOrderEvent(ctx, ft.fill("JRF-1", 2, "0.005"))
+	if o := m.Orders()[0]; o.ParentOrderState != bitflyer.StateCompleted {
+		t.Errorf("state = %s", o.ParentOrderState)
+	}
+}
+
+func TestOrderManagerStop(t *testing.T) {
+	ctx := context.Background()
+	ft := newFakeTrader()
+	m, _ := bitflyer.NewOrderManager(ft, "")
+
+	_, err := m.Send(ctx, &bitflyer.Parentorder{OrderMethod: bitflyer.MethodSimple, Parameters: []bitflyer.ParentorderParameter{
+		{ProductCode: "FX_BTC_JPY", ConditionType: bitflyer.ConditionStopLimit, Side: bitflyer.SideBuy, Price: bitflyer.MustDecimal("111"), TriggerPrice: bitflyer.MustDecimal("110"), Size: bitflyer.MustDecimal("0.01")},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.OnPrice(ctx, "FX_BTC_JPY", bitflyer.MustDecimal("109"))
+	m.OnPrice(ctx, "BTC_JPY", bitflyer.MustDecimal("200"))
+	if len(ft.sent) != 0 {
+		t.Fatalf("sent = %d below the trigger", len(ft.sent))
+	}
+	m.OnPrice(ctx, "FX_BTC_JPY", bitflyer.MustDecimal("110"))
+	if len(ft.sent) != 1 || ft.sent[0].ChildOrderType != bitflyer.OrderTypeLimit || !ft.sent[0].Price.Equal(bitflyer.MustDecimal("111")) {
+		t.Fatalf("sent = %+v", ft.sent)
+	}
+
+	// 取引所で失効した
+	m.OnChildOrderEvent(ctx, &bitflyer.ChildOrderEvent{ChildOrderAcceptanceID: "JRF-1", EventType: bitflyer.EventExpire})
+	if o := m.Orders()[0]; o.ParentOrderState != bitflyer.StateCompleted || o.Legs[0].ChildOrderState != bitflyer.StateExpired {
+		t.Errorf("order = %+v", o)
+	}
+}
+
+func TestOrderManagerRejected(t *testing.T) {
+	ctx := context.Background()
+	ft := newFakeTrader()
+	ft.sendErr = &bitflyer.APIError{HTTPStatus: http.StatusBadRequest, Status: bitflyer.StatusInsufficientMargin, Message: "Insufficient margin"}
+	m, _ := bitflyer.NewOrderManager(ft, "")
+
+	_, err := m.Send(ctx, &bitflyer.Parentorder{OrderMethod: bitflyer.MethodIFD, Parameters: []bitflyer.ParentorderParameter{
+		limit(bitflyer.SideBuy, "100"),
+		limit(bitflyer.SideSell, "120"),
+	}})
+	if err == nil {
+		t.Fatal("Send succeeded")
+	}
+	if o := m.Orders()[0]; o.ParentOrderState != bitflyer.StateRejected || o.Legs[0].Error == "" {
+		t.Errorf("order = %+v", o)
+	}
+	checkLegs(t, m, bitflyer.LegDone, bitflyer.LegDone)
+
+	// 回数制限なら次の価格で出し直す
+	ft.sendErr = &bitflyer.APIError{HTTPStatus: http.StatusTooManyRequests, Status: bitflyer.StatusOverAPILimit}
+	if _, err := m.Send(ctx, &bitflyer.Parentorder{OrderMethod: bitflyer.MethodSimple, Parameters: []bitflyer.ParentorderParameter{limit(bitflyer.SideBuy, "100")}}); err != nil {
+		t.Fatal(err)
+	}
+	ft.sendErr = nil
+	m.OnPrice(ctx, "FX_BTC_JPY", bitflyer.MustDecimal("105"))
+	if len(ft.sent) != 1 {
+		t.Errorf("sent = %d", len(ft.sent))
+	}
+}
+
+// 受け付けられたか分からない発注は、出し直す前に注文一覧で確かめる
+func TestOrderManagerAmbiguousSend(t *testing.T) {
+	ctx := context.Background()
+	ft := newFakeTrader()
+	m, _ := bitflyer.NewOrderManager(ft, filepath.Join(t.TempDir(), "orders.json"))
+	send := func() {
+		t.Helper()
+		if _, err := m.Send(ctx, &bitflyer.Parentorder{OrderMethod: bitflyer.MethodSimple, Parameters: []bitflyer.ParentorderParameter{limit(bitflyer.SideBuy, "100")}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 応答は届かなかったが受け付けられていた
+	ft.sendErr, ft.lost = timeoutError{}, true
+	send()
+	ft.sendErr, ft.lost = nil, false
+	m.OnPrice(ctx, "FX_BTC_JPY", bitflyer.MustDecimal("105"))
+	if l := m.Orders()[0].Legs[0]; l.State != bitflyer.LegPlaced || l.ChildOrderAcceptanceID != "JRF-1" || l.Unconfirmed != nil {
+		t.Errorf("leg = %+v", l)
+	}
+	if ft.sentCount() != 1 {
+		t.Fatalf("sent = %d, want 1", ft.sentCount())
+	}
+
+	// 注文一覧になければ次の価格で出し直す
+	ft.sendErr = timeoutError{}
+	send()
+	ft.sendErr = nil
+	if l := m.Orders()[1].Legs[0]; l.State != bitflyer.LegArmed || l.Unconfirmed != nil {
+		t.Errorf("leg = %+v", l)
+	}
+	m.OnPrice(ctx, "FX_BTC_JPY", bitflyer.MustDecimal("105"))
+	if l := m.Orders()[1].Legs[0]; l.State != bitflyer.LegPlaced || l.ChildOrderAcceptanceID != "JRF-2" || ft.sentCount() != 2 {
+		t.Errorf("leg = %+v, sent = %d", l, ft.sentCount())
+	}
+
+	// 注文一覧も取れなければ、Syncで確かめるまで出し直さない
+	ft.sendErr, ft.lost = context.DeadlineExceeded, true
+	ft.listErr = fmt.Errorf("unavailable")
+	send()
+	ft.sendErr, ft.lost = nil, false
+	m.OnPrice(ctx, "FX_BTC_JPY", bitflyer.MustDecimal("105"))
+	if ft.sentCount() != 3 {
+		t.Fatalf("sent = %d before the order was confirmed", ft.sentCount())
+	}
+	if l := m.Orders()[2].Legs[0]; l.Unconfirmed == nil || l.State != bitflyer.LegArmed {
+		t.Fatalf("leg = %+v", l)
+	}
+	// 再起動しても確かめ直す
+	m, _ = bitflyer.NewOrderManager(ft, m.StateFile)
+	if err := m.Sync(ctx); err == nil {
+		t.Fatal("Sync succeeded")
+	}
+	ft.listErr = nil
+	if err := m.Sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if l := m.Orders()[2].Legs[0]; l.State != bitflyer.LegPlaced || l.ChildOrderAcceptanceID != "JRF-3" || l.Unconfirmed != nil {
+		t.Errorf("leg = %+v", l)
+	}
+}
+
+// TRAILの高値と安値の更新は、価格のたびではなくSaveIntervalごとに保存する
+func TestOrderManagerTrailSave(t *testing.T) {
+	ctx := context.Background()
+	file := filepath.Join(t.TempDir(), "orders.json")
+	ft := newFakeTrader()
+	m, _ := bitflyer.NewOrderManager(ft, file)
+	m.SaveInterval = 50 * time.Millisecond
+	_, err := m.Send(ctx, &bitflyer.Parentorder{OrderMethod: bitflyer.MethodSimple, Parameters: []bitflyer.ParentorderParameter{
+		{ProductCode: "FX_BTC_JPY", ConditionType: bitflyer.ConditionTrail, Side: bitflyer.SideSell, Offset: 10, Size: bitflyer.MustDecimal("0.01")},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	extreme := func() bitflyer.Decimal {
+		t.Helper()
+		saved, err := bitflyer.NewOrderManager(ft, file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return saved.Orders()[0].Legs[0].Extreme
+	}
+
+	m.OnPrice(ctx, "FX_BTC_JPY", bitflyer.MustDecimal("100"))
+	if e := extreme(); !e.IsZero() {
+		t.Errorf("extreme = %s, saved before SaveInterval", e)
+	}
+	time.Sleep(60 * time.Millisecond)
+	m.OnPrice(ctx, "FX_BTC_JPY", bitflyer.MustDecimal("95"))
+	if e := extreme(); !e.Equal(bitflyer.MustDecimal("100")) {
+		t.Errorf("extreme = %s, want 100", e)
+	}
+	if ft.sentCount() != 0 {
+		t.Errorf("sent = %d above the trail", ft.sentCount())
+	}
+}
+
+// 親注文を取り消した後に届いた約定も反映する
+func TestOrderManagerFillAfterCancel(t *testing.T) {
+	ctx := context.Background()
+	file := filepath.Join(t.TempDir(), "orders.json")
+	ft := newFakeTrader()
+	m, _ := bitflyer.NewOrderManager(ft, file)
+	acc, err := m.Send(ctx, &bitflyer.Parentorder{OrderMethod: bitflyer.MethodSimple, Parameters: []bitflyer.ParentorderParameter{
+		{ProductCode: "FX_BTC_JPY", ConditionType: bitflyer.ConditionLimit, Side: bitflyer.SideBuy, Price: bitflyer.MustDecimal("100"), Size: bitflyer.MustDecimal("0.03")},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Cancel(ctx, acc.ParentOrderAcceptanceID); err != nil {
+		t.Fatal(err)
+	}
+
+	// 取消が届く前に約定していた
+	m.OnChildOrderEvent(ctx, ft.fill("JRF-1", 1, "0.01"))
+	if l := m.Orders()[0].Legs[0]; !l.ExecutedSize.Equal(bitflyer.MustDecimal("0.01")) {
+		t.Errorf("executed = %s", l.ExecutedSize)
+	}
+	// 取りこぼした約定と取消は、再起動してからでもSyncで拾う
+	ft.fill("JRF-1", 2, "0.01")
+	ft.mu.Lock()
+	ft.orders["JRF-1"].ChildOrderState = bitflyer.StateCanceled
+	ft.mu.Unlock()
+	m, err = bitflyer.NewOrderManager(ft, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+	o := m.Orders()[0]
+	if l := o.Legs[0]; !l.ExecutedSize.Equal(bitflyer.MustDecimal("0.02")) || l.State != bitflyer.LegDone || l.ChildOrderState != bitflyer.StateCanceled {
+		t.Errorf("leg = %+v", l)
+	}
+	if o.ParentOrderState != bitflyer.StateCanceled {
+		t.Errorf("state = %s", o.ParentOrderState)
+	}
+}
+
+// Runが戻ったら購読をやめる
+func TestOrderManagerRunUnsubscribe(t *testing.T) {
+	s, rt, ctx, _ := startRealtime(t, bitflyer.NewClient(bitflyertest.DefaultAPIKey, bitflyertest.DefaultAPISecret))
+	run(ctx, rt)
+	m, _ := bitflyer.NewOrderManager(newFakeTrader(), "")
+
+	runCtx, stop := context.WithCancel(ctx)
+	done := make(chan error, 1)
+	go func() { done <- m.Run(runCtx, rt, "FX_BTC_JPY") }()
+	channels := []string{"child_order_events", "lightning_executions_FX_BTC_JPY"}
+	for _, ch := range channels {
+		if err := s.Wait(ctx, func() bool { return s.Subscribed(ch) }); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stop()
+	if err := <-done; err != context.Canceled {
+		t.Errorf("Run = %v", err)
+	}
+	for _, ch := range channels {
+		if err := s.Wait(ctx, func() bool { return !s.Subscribed(ch) }); err != nil {
+			t.Errorf("%s is still subscribed: %v", ch, err)
+		}
+	}
+}
+
+// 発注と取消を送る間はOrderManagerを止めない。応答より先に届いたイベントも反映する
+func TestOrderManagerUnlockedIO(t *testing.T) {
+	ctx := context.Background()
+	ft := newFakeTrader()
+	m, _ := bitflyer.NewOrderManager(ft, "")
+
+	locked := func() {
+		done := make(chan struct{})
+		go func() {
+			m.Orders()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Error("the order manager is locked while sending")
+		}
+	}
+	ft.onSend = func(id string) {
+		locked()
+		// 成行がすぐに約定し、応答より先にイベントが届く
+		if id == "JRF-2" {
+			m.OnChildOrderEvent(ctx, ft.fill(id, 1, "0.01"))
+		}
+	}
+	ft.onCancel = func(string) { locked() }
+
+	acc, err := m.Send(ctx, &bitflyer.Parentorder{OrderMethod: bitflyer.MethodOCO, Parameters: []bitflyer.ParentorderParameter{
+		limit(bitflyer.SideSell, "120"),
+		{ProductCode: "FX_BTC_JPY", ConditionType: bitflyer.ConditionMarket, Side: bitflyer.SideSell, Size: bitflyer.MustDecimal("0.01")},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := m.Orders()[0]
+	if !o.Legs[1].ExecutedSize.Equal(bitflyer.MustDecimal("0.01")) || o.Legs[1].State != bitflyer.LegDone {
+		t.Errorf("market leg = %+v", o.Legs[1])
+	}
+	if len(ft.canceled) != 1 || ft.canceled[0] != "JRF-1" {
+		t.Errorf("canceled = %v", ft.canceled)
+	}
+	if err := m.Cancel(ctx, acc.ParentOrderAcceptanceID); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOrderManagerSync(t *testing.T) {
+	ctx := context.Background()
+	file := filepath.Join(t.TempDir(), "orders.json")
+	ft := newFakeTrader()
+	m, _ := bitflyer.NewOrderManager(ft, file)
+
+	_, err := m.Send(ctx, &bitflyer.Parentorder{OrderMethod: bitflyer.MethodIFD, Parameters: []bitflyer.ParentorderParameter{
+		{ProductCode: "FX_BTC_JPY", ConditionType: bitflyer.ConditionLimit, Side: bitflyer.SideBuy, Price: bitflyer.MustDecimal("100"), Size: bitflyer.MustDecimal("0.03")},
+		limit(bitflyer.SideSell, "120"),
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// イベントを取りこぼした約定をSyncで拾う
+	m.OnChildOrderEvent(ctx, ft.fill("JRF-1", 1, "0.01"))
+	late := ft.fill("JRF-1", 2, "0.01")
+	if err := m.Sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if l := m.Orders()[0].Legs[0]; !l.ExecutedSize.Equal(bitflyer.MustDecimal("0.02")) || l.State != bitflyer.LegPlaced {
+		t.Fatalf("leg = %+v", l)
+	}
+
+	// Syncの後に届いたイベントは二重に数えない
+	m.OnChildOrderEvent(ctx, late)
+	m.OnChildOrderEvent(ctx, late)
+	if l := m.Orders()[0].Legs[0]; !l.ExecutedSize.Equal(bitflyer.MustDecimal("0.02")) {
+		t.Fatalf("executed = %s after a duplicate event", l.ExecutedSize)
+	}
+	if ft.sentCount() != 1 {
+		t.Fatalf("sent = %d before the first leg completed", ft.sentCount())
+	}
+
+	// 再起動してから、止まっている間の約定をSyncで拾う
+	ft.fill("JRF-1", 3, "0.01")
+	m, err = bitflyer.NewOrderManager(ft, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+	checkLegs(t, m, bitflyer.LegDone, bitflyer.LegPlaced)
+	if l := m.Orders()[0].Legs[0]; !l.ExecutedSize.Equal(bitflyer.MustDecimal("0.03")) || len(l.ExecIDs) != 3 {
+		t.Errorf("leg = %+v", l)
+	}
+}
+
+// Syncは注文の一覧の件数に関わらず、出した子注文を受付IDで引く
+func TestOrderManagerSyncServer(t *testing.T) {
+	ctx := context.Background()
+	s := bitflyertest.NewServer()
+	t.Cleanup(s.Close)
+	s.SetBalance("JPY", bitflyer.MustDecimal("100000000"))
+	s.SetBoard("BTC_JPY", &bitflyer.Board{
+		MidPrice: bitflyer.MustDecimal("10000"),
+		Bids:     []bitflyer.PriceLevel{{Price: bitflyer.MustDecimal("9900"), Size: bitflyer.MustDecimal("1")}},
+		Asks:     []bitflyer.PriceLevel{{Price: bitflyer.MustDecimal("10100"), Size: bitflyer.MustDecimal("1")}},
+	})
+	c := s.Client()
+	m, _ := bitflyer.NewOrderManager(c, "")
+
+	_, err := m.Send(ctx, &bitflyer.Parentorder{OrderMethod: bitflyer.MethodIFD, Parameters: []bitflyer.ParentorderParameter{
+		{ProductCode: "BTC_JPY", ConditionType: bitflyer.ConditionLimit, Side: bitflyer.SideBuy, Price: bitflyer.MustDecimal("9000"), Size: bitflyer.MustDecimal("0.01")},
+		{ProductCode: "BTC_JPY", ConditionType: bitflyer.ConditionLimit, Side: bitflyer.SideSell, Price: bitflyer.MustDecimal("20000"), Size: bitflyer.MustDecimal("0.01")},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 120; i++ {
+		_, err := c.SendChildorder(ctx, &bitflyer.Childorder{ProductCode: "BTC_JPY", ChildOrderType: bitflyer.OrderTypeLimit, Side: bitflyer.SideBuy, Price: bitflyer.MustDecimal("8000"), Size: bitflyer.MustDecimal("0.01")})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 板が下がって1つ目の指値が約定する
+	s.SetBoard("BTC_JPY", &bitflyer.Board{
+		MidPrice: bitflyer.MustDecimal("8950"),
+		Bids:     []bitflyer.PriceLevel{{Price: bitflyer.MustDecimal("8900"), Size: bitflyer.MustDecimal("1")}},
+		Asks:     []bitflyer.PriceLevel{{Price: bitflyer.MustDecimal("8990"), Size: bitflyer.MustDecimal("1")}},
+	})
+	if err := m.Sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+	checkLegs(t, m, bitflyer.LegDone, bitflyer.LegPlaced)
+	if l := m.Orders()[0].Legs[0]; !l.ExecutedSize.Equal(bitflyer.MustDecimal("0.01")) || len(l.ExecIDs) != 1 {
+		t.Errorf("leg = %+v", l)
+	}
+}
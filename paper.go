@@ -0,0 +1,328 @@
+package bitflyer
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// * ペーパートレード
+// Clientと同じ注文系のメソッドを持ち、注文を取引所に送らずに手元で約定させる。
+// 成行と板に届く指値は発注時の板(GetBoard)と突き合わせてその場で約定させ、
+// 板に残った指値はそれ以降の約定履歴(GetExecutions)で価格を越えた約定があれば指値で約定させる。
+// 現物は仮想の残高、FX_で始まる銘柄は仮想の証拠金と建玉で扱う。約定と口座の計算はPaperExchangeが行う
+
+type PaperClient struct {
+	// 板と約定履歴を取得するClient
+	Client *Client
+	// 銘柄ごとの手数料率。なければClient.GetMyTradingCommissionで取得し、APIキーがなければ0
+	CommissionRates map[string]Decimal
+
+	mu sync.Mutex
+	ex *PaperExchange
+	// 銘柄ごとに突き合わせ済みの約定ID
+	cursors map[string]int
+}
+
+func (c *Client) NewPaperClient() *PaperClient {
+	return &PaperClient{
+		Client:          c,
+		CommissionRates: map[string]Decimal{},
+		ex: &PaperExchange{
+			Account: NewPaperAccount(),
+			FormatID: func(kind string, id int) string {
+				return fmt.Sprintf("PAPER-%s-%06d", kind, id)
+			},
+		},
+		cursors: map[string]int{},
+	}
+}
+
+// SetBalance は通貨の仮想の残高を設定する。注文で拘束している分は利用可能額から除く
+func (p *PaperClient) SetBalance(currencyCode string, amount Decimal) {
+	p.mu.Lock()
+	p.ex.Account.SetBalance(currencyCode, amount)
+	p.mu.Unlock()
+}
+
+// SetCollateral はFXの仮想の証拠金を設定する
+func (p *PaperClient) SetCollateral(amount Decimal) {
+	p.mu.Lock()
+	p.ex.Account.SetCollateral(amount)
+	p.mu.Unlock()
+}
+
+func (p *PaperClient) commissionRate(ctx context.Context, productCode string) (Decimal, error) {
+	p.mu.Lock()
+	rate, ok := p.CommissionRates[productCode]
+	p.mu.Unlock()
+	if ok || !p.Client.hasCredentials() {
+		return rate, nil
+	}
+
+	tc, err := p.Client.GetMyTradingCommission(ctx, productCode)
+	if err != nil {
+		return Decimal{}, err
+	}
+	p.mu.Lock()
+	p.CommissionRates[productCode] = tc.CommissionRate
+	p.mu.Unlock()
+
+	return tc.CommissionRate, nil
+}
+
+// ** 注文
+func (p *PaperClient) SendChildorder(ctx context.Context, ch *Childorder) (*ChildOrderAcceptanceID, error) {
+	if err := ch.Validate(); err != nil {
+		return nil, err
+	}
+	rate, err := p.commissionRate(ctx, ch.ProductCode)
+	if err != nil {
+		return nil, err
+	}
+	board, err := p.Client.GetBoard(ctx, ch.ProductCode)
+	if err != nil {
+		return nil, err
+	}
+	// 板に残る注文はこれより後の約定とだけ突き合わせる
+	var cursor int
+	if execs, err := p.Client.GetExecutions(ctx, ch.ProductCode, &Page{Count: 1}); err != nil {
+		return nil, err
+	} else if len(*execs) > 0 {
+		cursor = (*execs)[0].ID
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.cursors[ch.ProductCode] < cursor {
+		p.cursors[ch.ProductCode] = cursor
+	}
+	o := p.ex.NewOrder(ch, rate)
+	if _, err := p.ex.Place(o, board); err != nil {
+		return nil, err
+	}
+
+	return &ChildOrderAcceptanceID{ChildOrderAcceptanceID: o.ChildOrderAcceptanceID}, nil
+}
+
+func (p *PaperClient) CancelChildorder(ctx context.Context, ch *Childorder) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	o := p.ex.ActiveOrder(ch.ProductCode, ch.ChildOrderID, ch.ChildOrderAcceptanceID)
+	if o == nil {
+		return paperError(StatusOrderNotFound, "Order not found")
+	}
+	p.ex.Cancel(o)
+	return nil
+}
+
+func (p *PaperClient) CancelAllChildorder(ctx context.Context, productCode string) error {
+	p.mu.Lock()
+	p.ex.CancelAll(productCode)
+	p.mu.Unlock()
+	return nil
+}
+
+// ** 板に残った注文の約定
+// Update は板に残っている注文の銘柄の約定履歴を取得して突き合わせ、期限切れの注文を失効させる。
+// GetMy*を呼ぶと先に呼ばれる
+func (p *PaperClient) Update(ctx context.Context) error {
+	p.mu.Lock()
+	cursors := map[string]int{}
+	for _, o := range p.ex.Orders() {
+		if o.ChildOrderState == StateActive {
+			cursors[o.ProductCode] = p.cursors[o.ProductCode]
+		}
+	}
+	p.mu.Unlock()
+
+	for code, cursor := range cursors {
+		// 発注時に約定履歴がなければ最新のページから突き合わせる
+		if cursor == 0 {
+			execs, err := p.Client.GetExecutions(ctx, code, nil)
+			if err != nil {
+				return err
+			}
+			p.Feed(code, *execs)
+			continue
+		}
+
+		it := p.Client.IterExecutions(ctx, IterFilter{ProductCode: code, Forward: true, FromID: cursor})
+		var execs []Execution
+		for it.Next() {
+			execs = append(execs, it.Value())
+		}
+		if err := it.Err(); err != nil {
+			return err
+		}
+		p.Feed(code, execs)
+	}
+
+	p.mu.Lock()
+	now := time.Now()
+	for _, o := range p.ex.Orders() {
+		if o.ChildOrderState == StateActive && now.After(o.ExpireDate.Time) {
+			p.ex.Expire(o)
+		}
+	}
+	p.mu.Unlock()
+
+	return nil
+}
+
+// Feed は約定を板に残っている注文と突き合わせる。Realtime APIの約定を渡してもよい。
+// 注文の価格を越えた約定だけを、古い注文から順に指値で約定させる
+func (p *PaperClient) Feed(productCode string, execs []Execution) {
+	sorted := append([]Execution(nil), execs...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].ID < sorted[j].ID })
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for i := range sorted {
+		if sorted[i].ID <= p.cursors[productCode] {
+			continue
+		}
+		p.cursors[productCode] = sorted[i].ID
+		p.ex.Feed(productCode, &sorted[i])
+	}
+}
+
+// ** 照会
+func (p *PaperClient) GetMyChildorders(ctx context.Context, productCode string, page *Page, childOrderState OrderState, parentOrderID string) (*Childorders, error) {
+	if err := p.Update(ctx); err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	data := p.ex.Childorders(page, func(o *PaperOrder) bool {
+		return (productCode == "" || o.ProductCode == productCode) &&
+			(childOrderState == "" || o.ChildOrderState == childOrderState) && parentOrderID == ""
+	})
+	return &data, nil
+}
+
+func (p *PaperClient) GetMyChildorder(ctx context.Context, productCode, childOrderID, childOrderAcceptanceID string) (*Childorders, error) {
+	if err := p.Update(ctx); err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	data := p.ex.Childorders(nil, func(o *PaperOrder) bool {
+		return o.ProductCode == productCode &&
+			(childOrderID == "" || o.ChildOrderID == childOrderID) &&
+			(childOrderAcceptanceID == "" || o.ChildOrderAcceptanceID == childOrderAcceptanceID)
+	})
+	return &data, nil
+}
+
+func (p *PaperClient) GetMyExecutions(ctx context.Context, productCode string, page *Page, childOrderID, childOrderAcceptanceID string) (*Executions, error) {
+	if err := p.Update(ctx); err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	data := p.ex.Executions(page, func(e *PaperExecution) bool {
+		return (productCode == "" || e.ProductCode == productCode) &&
+			(childOrderID == "" || e.ChildOrderID == childOrderID) &&
+			(childOrderAcceptanceID == "" || e.ChildOrderAcceptanceID == childOrderAcceptanceID)
+	})
+	return &data, nil
+}
+
+func (p *PaperClient) GetMyBalance(ctx context.Context) (*Balance, error) {
+	if err := p.Update(ctx); err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	data := p.ex.Account.Balances()
+	return &data, nil
+}
+
+// GetMyPositions はbitFlyerと同じくproductCodeを必須とする
+func (p *PaperClient) GetMyPositions(ctx context.Context, productCode string) (*Positions, error) {
+	if productCode == "" {
+		return nil, paperError(-100, "Invalid product_code")
+	}
+	if err := p.Update(ctx); err != nil {
+		return nil, err
+	}
+	board, err := p.Client.GetBoard(ctx, productCode)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	data := p.ex.Account.Positions(productCode, board.MidPrice)
+	return &data, nil
+}
+
+// GetMyCollateral は建玉の評価損益を各銘柄の板の仲値で計算する
+func (p *PaperClient) GetMyCollateral(ctx context.Context) (*Collateral, error) {
+	if err := p.Update(ctx); err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	codes := p.ex.Account.PositionProductCodes()
+	p.mu.Unlock()
+
+	mids := map[string]Decimal{}
+	for _, code := range codes {
+		board, err := p.Client.GetBoard(ctx, code)
+		if err != nil {
+			return nil, err
+		}
+		mids[code] = board.MidPrice
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	data := p.ex.Account.Collateral(mids)
+	return &data, nil
+}
+
+func (p *PaperClient) GetMyTradingCommission(ctx context.Context, productCode string) (*TradingCommission, error) {
+	rate, err := p.commissionRate(ctx, productCode)
+	if err != nil {
+		return nil, err
+	}
+	return &TradingCommission{CommissionRate: rate}, nil
+}
+
+// ** 相場情報
+// 相場情報はClientの公開APIをそのまま使う
+func (p *PaperClient) GetMarkets(ctx context.Context) (*Markets, error) {
+	return p.Client.GetMarkets(ctx)
+}
+
+func (p *PaperClient) GetBoard(ctx context.Context, productCode string) (*Board, error) {
+	return p.Client.GetBoard(ctx, productCode)
+}
+
+func (p *PaperClient) GetTicker(ctx context.Context, productCode string) (*Ticker, error) {
+	return p.Client.GetTicker(ctx, productCode)
+}
+
+func (p *PaperClient) GetExecutions(ctx context.Context, productCode string, page *Page) (*Executions, error) {
+	return p.Client.GetExecutions(ctx, productCode, page)
+}
+
+func (p *PaperClient) GetHealth(ctx context.Context) (*Status, error) {
+	return p.Client.GetHealth(ctx)
+}
+
+func (p *PaperClient) GetChats(ctx context.Context, fromDate string) (*Chats, error) {
+	return p.Client.GetChats(ctx, fromDate)
+}
@@ -0,0 +1,628 @@
+package bitflyer
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// * 手元の取引所
+// PaperExchange は子注文を板と市場の約定に突き合わせて約定させ、注文と約定の履歴を持つ。
+// 成行と板に届く指値は渡された板でその場で約定させ、板に残った指値は価格を越えた市場の約定があれば指値で約定させる。
+// Accountがあれば、現物は残高、FX_で始まる銘柄は証拠金と建玉で扱う。
+// PaperClient、bitflyertest、backtestが同じ規則で約定させるための部品で、ゴルーチンセーフではない
+
+// PaperLeverage はFXの証拠金倍率
+const PaperLeverage = 2
+
+type PaperExchange struct {
+	// 残高と建玉。nilなら資金の不足を確かめず、約定を口座に反映しない
+	Account *PaperAccount
+	// 現在時刻。nilならtime.Now
+	Now func() time.Time
+	// 注文IDを作る。kindは注文IDなら"JOR"、受付IDなら"JRF"。nilなら"JOR-000001"の形
+	FormatID func(kind string, id int) string
+	// 約定1件の手数料。nilなら現物は数量に注文の手数料率をかけた額 (基軸通貨建て)、FXは0
+	Commission func(o *PaperOrder, price, size Decimal, maker bool) Decimal
+	// 約定のたびに呼ぶ。注文は約定を反映した後の状態
+	OnFill func(o *PaperOrder, e *PaperExecution, maker bool)
+	// 取消と失効のたびに呼ぶ
+	OnCancel func(o *PaperOrder)
+
+	orders     []*PaperOrder     // 古い順
+	executions []*PaperExecution // 古い順
+	nextID     int
+}
+
+// PaperOrder はPaperExchangeの子注文
+type PaperOrder struct {
+	ChildorderInfo
+	TimeInForce TimeInForce
+	// 約定の手数料率
+	CommissionRate Decimal
+	// 現物の注文が拘束している残高
+	locked Decimal
+}
+
+// PaperExecution はPaperExchangeの自分の約定
+type PaperExecution struct {
+	Execution
+	ProductCode string
+}
+
+type paperFill struct {
+	price Decimal
+	size  Decimal
+}
+
+func paperError(status int, msg string) *APIError {
+	return &APIError{HTTPStatus: http.StatusBadRequest, Status: status, Message: msg}
+}
+
+func paperCurrencies(productCode string) (base, quote string) {
+	parts := strings.Split(productCode, "_")
+	return parts[0], parts[len(parts)-1]
+}
+
+func isFXProduct(productCode string) bool {
+	return strings.HasPrefix(productCode, "FX_")
+}
+
+func (x *PaperExchange) now() time.Time {
+	if x.Now != nil {
+		return x.Now()
+	}
+	return time.Now().UTC()
+}
+
+// NewID は注文と約定に振る通し番号。呼び出す側の親注文などにも使える
+func (x *PaperExchange) NewID() int {
+	x.nextID++
+	return x.nextID
+}
+
+func (x *PaperExchange) formatID(kind string, id int) string {
+	if x.FormatID != nil {
+		return x.FormatID(kind, id)
+	}
+	return fmt.Sprintf("%s-%06d", kind, id)
+}
+
+// ** 注文
+// NewOrder は子注文を作る。Placeで受け付けるまでは注文の一覧に載らない
+func (x *PaperExchange) NewOrder(ch *Childorder, rate Decimal) *PaperOrder {
+	now := x.now()
+	expire := ch.MinuteToExpire
+	if expire == 0 {
+		expire = 43200
+	}
+	id := x.NewID()
+	return &PaperOrder{
+		ChildorderInfo: ChildorderInfo{
+			ID:                     id,
+			ChildOrderID:           x.formatID("JOR", id),
+			ProductCode:            ch.ProductCode,
+			Side:                   ch.Side,
+			ChildOrderType:         ch.ChildOrderType,
+			Price:                  ch.Price,
+			Size:                   ch.Size,
+			ChildOrderState:        StateActive,
+			ExpireDate:             Time{now.Add(time.Duration(expire) * time.Minute)},
+			ChildOrderDate:         Time{now},
+			ChildOrderAcceptanceID: x.formatID("JRF", id),
+			OutstandingSize:        ch.Size,
+		},
+		TimeInForce:    ch.TimeInForce,
+		CommissionRate: rate,
+	}
+}
+
+// Place は注文を受け付けてboardと突き合わせる。成行とIOC・FOKの残りは取り消し、指値の残りは板に置く。
+// Accountがあり資金が足りなければ、受け付けずにエラーを返す
+func (x *PaperExchange) Place(o *PaperOrder, board *Board) ([]*PaperExecution, error) {
+	fills := o.takerFills(board)
+	var fillable, cost Decimal
+	for _, f := range fills {
+		fillable = fillable.Add(f.size)
+		cost = cost.Add(f.price.Mul(f.size))
+	}
+	if x.Account != nil {
+		if err := x.Account.reserve(o, fillable, cost, board.MidPrice); err != nil {
+			return nil, err
+		}
+	}
+	x.orders = append(x.orders, o)
+
+	if o.TimeInForce == TIFFOK && fillable.Cmp(o.OutstandingSize) < 0 {
+		x.cancel(o, StateCanceled)
+		return nil, nil
+	}
+	return x.take(o, fills), nil
+}
+
+// Match は板に残っている注文をboardと突き合わせる。板を差し替えたときに使う
+func (x *PaperExchange) Match(o *PaperOrder, board *Board) []*PaperExecution {
+	return x.take(o, o.takerFills(board))
+}
+
+func (x *PaperExchange) take(o *PaperOrder, fills []paperFill) []*PaperExecution {
+	var execs []*PaperExecution
+	for _, f := range fills {
+		if o.ChildOrderState != StateActive {
+			break
+		}
+		execs = append(execs, x.fill(o, f.price, f.size, false))
+	}
+	if o.ChildOrderState == StateActive && (o.ChildOrderType == OrderTypeMarket || o.TimeInForce == TIFIOC || o.TimeInForce == TIFFOK) {
+		x.cancel(o, StateCanceled)
+	}
+	return execs
+}
+
+// takerFills はboardの反対側と突き合わせて約定する価格と数量
+func (o *PaperOrder) takerFills(board *Board) []paperFill {
+	levels := board.Asks
+	if o.Side == SideSell {
+		levels = board.Bids
+	}
+
+	var fills []paperFill
+	rest := o.OutstandingSize
+	for _, l := range levels {
+		if rest.Sign() <= 0 || !o.crosses(l.Price) {
+			break
+		}
+		size := l.Size
+		if size.Cmp(rest) > 0 {
+			size = rest
+		}
+		fills = append(fills, paperFill{price: l.Price, size: size})
+		rest = rest.Sub(size)
+	}
+	return fills
+}
+
+func (o *PaperOrder) crosses(price Decimal) bool {
+	if o.ChildOrderType == OrderTypeMarket {
+		return true
+	}
+	if o.Side == SideBuy {
+		return price.Cmp(o.Price) <= 0
+	}
+	return price.Cmp(o.Price) >= 0
+}
+
+// Feed は市場の約定eを板に残っている注文と突き合わせる。
+// 注文の価格を越えた約定だけを、古い注文から順に指値で約定させる
+func (x *PaperExchange) Feed(productCode string, e *Execution) []*PaperExecution {
+	var execs []*PaperExecution
+	rest := e.Size
+	for _, o := range x.orders {
+		if rest.Sign() <= 0 {
+			break
+		}
+		if o.ChildOrderState != StateActive || o.ProductCode != productCode || o.ChildOrderType != OrderTypeLimit {
+			continue
+		}
+		if (o.Side == SideBuy && e.Price.Cmp(o.Price) >= 0) || (o.Side == SideSell && e.Price.Cmp(o.Price) <= 0) {
+			continue
+		}
+		size := o.OutstandingSize
+		if size.Cmp(rest) > 0 {
+			size = rest
+		}
+		execs = append(execs, x.fill(o, o.Price, size, true))
+		rest = rest.Sub(size)
+	}
+	return execs
+}
+
+func (x *PaperExchange) fill(o *PaperOrder, price, size Decimal, maker bool) *PaperExecution {
+	var commission Decimal
+	if x.Commission != nil {
+		commission = x.Commission(o, price, size, maker)
+	} else if !isFXProduct(o.ProductCode) {
+		commission = size.Mul(o.CommissionRate).Round(8)
+	}
+
+	executed := o.ExecutedSize.Add(size)
+	o.AveragePrice = o.AveragePrice.Mul(o.ExecutedSize).Add(price.Mul(size)).Div(executed, 8)
+	o.ExecutedSize = executed
+	o.OutstandingSize = o.OutstandingSize.Sub(size)
+	o.TotalCommission = o.TotalCommission.Add(commission)
+
+	now := x.now()
+	if x.Account != nil {
+		x.Account.fill(o, price, size, commission, now)
+	}
+	if o.OutstandingSize.Sign() <= 0 {
+		o.ChildOrderState = StateCompleted
+		x.release(o)
+	}
+
+	e := &PaperExecution{
+		Execution: Execution{
+			ID:                     x.NewID(),
+			ChildOrderID:           o.ChildOrderID,
+			Side:                   o.Side,
+			Price:                  price,
+			Size:                   size,
+			Commission:             commission,
+			ExecDate:               Time{now},
+			ChildOrderAcceptanceID: o.ChildOrderAcceptanceID,
+		},
+		ProductCode: o.ProductCode,
+	}
+	x.executions = append(x.executions, e)
+	if x.OnFill != nil {
+		x.OnFill(o, e, maker)
+	}
+	return e
+}
+
+// Cancel は注文の残りを取り消す
+func (x *PaperExchange) Cancel(o *PaperOrder) {
+	x.cancel(o, StateCanceled)
+}
+
+// Expire は注文の残りを失効させる
+func (x *PaperExchange) Expire(o *PaperOrder) {
+	x.cancel(o, StateExpired)
+}
+
+func (x *PaperExchange) cancel(o *PaperOrder, state OrderState) {
+	o.ChildOrderState = state
+	o.CancelSize = o.CancelSize.Add(o.OutstandingSize)
+	o.OutstandingSize = Decimal{}
+	x.release(o)
+	if x.OnCancel != nil {
+		x.OnCancel(o)
+	}
+}
+
+func (x *PaperExchange) release(o *PaperOrder) {
+	if x.Account != nil {
+		x.Account.release(o)
+	}
+}
+
+// CancelAll はproductCodeの板に残っている注文をすべて取り消す
+func (x *PaperExchange) CancelAll(productCode string) {
+	for _, o := range x.orders {
+		if o.ChildOrderState == StateActive && o.ProductCode == productCode {
+			x.cancel(o, StateCanceled)
+		}
+	}
+}
+
+// ** 照会
+// ActiveOrder は板に残っている注文を注文IDか受付IDで探す。なければnil
+func (x *PaperExchange) ActiveOrder(productCode, childOrderID, childOrderAcceptanceID string) *PaperOrder {
+	for _, o := range x.orders {
+		if o.ChildOrderState != StateActive || o.ProductCode != productCode {
+			continue
+		}
+		if (childOrderID != "" && o.ChildOrderID == childOrderID) ||
+			(childOrderAcceptanceID != "" && o.ChildOrderAcceptanceID == childOrderAcceptanceID) {
+			return o
+		}
+	}
+	return nil
+}
+
+// Orders は受け付けた注文を古い順に返す
+func (x *PaperExchange) Orders() []*PaperOrder {
+	return append([]*PaperOrder(nil), x.orders...)
+}
+
+// Childorders は注文を新しい順にpageの範囲で返す。matchがfalseを返す注文は除く
+func (x *PaperExchange) Childorders(page *Page, match func(o *PaperOrder) bool) Childorders {
+	data := Childorders{}
+	for i := len(x.orders) - 1; i >= 0 && len(data) < page.Limit(); i-- {
+		o := x.orders[i]
+		if page.Contains(o.ID) && (match == nil || match(o)) {
+			data = append(data, o.ChildorderInfo)
+		}
+	}
+	return data
+}
+
+// Executions は自分の約定を新しい順にpageの範囲で返す。matchがfalseを返す約定は除く
+func (x *PaperExchange) Executions(page *Page, match func(e *PaperExecution) bool) Executions {
+	data := Executions{}
+	for i := len(x.executions) - 1; i >= 0 && len(data) < page.Limit(); i-- {
+		e := x.executions[i]
+		if page.Contains(e.ID) && (match == nil || match(e)) {
+			data = append(data, e.Execution)
+		}
+	}
+	return data
+}
+
+// ** 口座
+// PaperAccount はPaperExchangeの現物の残高とFXの証拠金・建玉
+type PaperAccount struct {
+	balances   map[string]*paperBalance
+	collateral Decimal
+	positions  []*paperPosition
+}
+
+type paperBalance struct {
+	amount    Decimal
+	available Decimal
+}
+
+type paperPosition struct {
+	productCode       string
+	side              Side
+	price             Decimal
+	size              Decimal
+	requireCollateral Decimal
+	openDate          time.Time
+}
+
+func NewPaperAccount() *PaperAccount {
+	return &PaperAccount{balances: map[string]*paperBalance{}}
+}
+
+func (a *PaperAccount) balance(currencyCode string) *paperBalance {
+	b, ok := a.balances[currencyCode]
+	if !ok {
+		b = &paperBalance{}
+		a.balances[currencyCode] = b
+	}
+	return b
+}
+
+// SetBalance は通貨の残高を設定する。注文で拘束している分は利用可能額から除く
+func (a *PaperAccount) SetBalance(currencyCode string, amount Decimal) {
+	b := a.balance(currencyCode)
+	b.available = b.available.Add(amount.Sub(b.amount))
+	b.amount = amount
+}
+
+// Balance は通貨の残高と利用可能額
+func (a *PaperAccount) Balance(currencyCode string) (amount, available Decimal) {
+	if b, ok := a.balances[currencyCode]; ok {
+		return b.amount, b.available
+	}
+	return Decimal{}, Decimal{}
+}
+
+// Balances はすべての通貨の残高を通貨コード順に返す
+func (a *PaperAccount) Balances() Balance {
+	codes := make([]string, 0, len(a.balances))
+	for code := range a.balances {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+
+	data := make(Balance, len(codes))
+	for i, code := range codes {
+		data[i].CurrencyCode = code
+		data[i].Amount = a.balances[code].amount
+		data[i].Available = a.balances[code].available
+	}
+	return data
+}
+
+// SetCollateral はFXの証拠金を設定する
+func (a *PaperAccount) SetCollateral(amount Decimal) {
+	a.collateral = amount
+}
+
+// Positions はproductCodeの建玉。評価損益はmidで計算し、midがゼロなら0にする
+func (a *PaperAccount) Positions(productCode string, mid Decimal) Positions {
+	data := Positions{}
+	for _, pos := range a.positions {
+		if pos.productCode != productCode {
+			continue
+		}
+		data = append(data, Positions{{
+			ProductCode:       pos.productCode,
+			Side:              pos.side,
+			Price:             pos.price,
+			Size:              pos.size,
+			RequireCollateral: pos.requireCollateral,
+			OpenDate:          Time{pos.openDate},
+			Leverage:          PaperLeverage,
+			Pnl:               pos.pnl(mid),
+		}}...)
+	}
+	return data
+}
+
+// PositionProductCodes は建玉のある銘柄
+func (a *PaperAccount) PositionProductCodes() []string {
+	var codes []string
+	seen := map[string]bool{}
+	for _, pos := range a.positions {
+		if !seen[pos.productCode] {
+			seen[pos.productCode] = true
+			codes = append(codes, pos.productCode)
+		}
+	}
+	return codes
+}
+
+// Collateral は証拠金の状態。建玉の評価損益はmidsにある銘柄ごとの仲値で計算する
+func (a *PaperAccount) Collateral(mids map[string]Decimal) Collateral {
+	data := Collateral{Collateral: a.collateral}
+	for _, pos := range a.positions {
+		data.OpenPositionPnl = data.OpenPositionPnl.Add(pos.pnl(mids[pos.productCode]))
+		data.RequireCollateral = data.RequireCollateral.Add(pos.requireCollateral)
+	}
+	if data.RequireCollateral.Sign() > 0 {
+		data.KeepRate = data.Collateral.Add(data.OpenPositionPnl).Div(data.RequireCollateral, 8).Float64()
+	}
+	return data
+}
+
+// reserve は現物なら注文に必要な残高を拘束し、FXなら証拠金が足りるか確かめる。
+// FXは反対側の建玉を決済する分には証拠金を求めず、決済で空く証拠金を足して建玉を増やす分だけ確かめる。
+// 現物の売りは手数料も売る通貨で払うので、数量に手数料を足して拘束する
+func (a *PaperAccount) reserve(o *PaperOrder, fillable, cost, mid Decimal) error {
+	if isFXProduct(o.ProductCode) {
+		price := o.Price
+		if o.ChildOrderType == OrderTypeMarket {
+			price = mid
+			if fillable.Sign() > 0 {
+				price = cost.Div(fillable, 8)
+			}
+		}
+		open, freed := a.closing(o.ProductCode, o.Side, o.OutstandingSize)
+		if open.Sign() <= 0 {
+			return nil
+		}
+		need := price.Mul(open).Div(NewDecimalFromInt(PaperLeverage), 8)
+		if a.freeCollateral(o.ProductCode, mid).Add(freed).Cmp(need) < 0 {
+			return paperError(StatusInsufficientMargin, "Insufficient margin")
+		}
+		return nil
+	}
+
+	base, quote := paperCurrencies(o.ProductCode)
+	b, need := a.balance(base), o.OutstandingSize
+	if o.Side == SideBuy {
+		b, need = a.balance(quote), o.Price.Mul(o.OutstandingSize)
+		if o.ChildOrderType == OrderTypeMarket {
+			need = cost
+		}
+	} else {
+		if o.ChildOrderType == OrderTypeMarket {
+			need = fillable
+		}
+		need = need.Add(need.Mul(o.CommissionRate).Round(8))
+	}
+	if b.available.Cmp(need) < 0 {
+		return paperError(StatusInsufficientFunds, "Insufficient funds")
+	}
+	b.available = b.available.Sub(need)
+	o.locked = need
+
+	return nil
+}
+
+// closing はsideのsizeの注文で反対側の建玉を古いものから決済したときに、
+// 新しく建てる数量と決済で空く必要証拠金
+func (a *PaperAccount) closing(productCode string, side Side, size Decimal) (open, freed Decimal) {
+	for _, pos := range a.positions {
+		if size.Sign() <= 0 {
+			break
+		}
+		if pos.productCode != productCode || pos.side == side {
+			continue
+		}
+		closed := pos.size
+		if closed.Cmp(size) > 0 {
+			closed = size
+		}
+		freed = freed.Add(pos.requireCollateral.Mul(closed).Div(pos.size, 8))
+		size = size.Sub(closed)
+	}
+	return size, freed
+}
+
+// freeCollateral は建玉の評価損益を含めた証拠金から必要証拠金を引いた額。
+// 評価にはproductCodeの建玉だけmidを使う
+func (a *PaperAccount) freeCollateral(productCode string, mid Decimal) Decimal {
+	free := a.collateral
+	for _, pos := range a.positions {
+		if pos.productCode == productCode {
+			free = free.Add(pos.pnl(mid))
+		}
+		free = free.Sub(pos.requireCollateral)
+	}
+	return free
+}
+
+// pnl はpriceで評価した損益。priceがゼロなら0
+func (pos *paperPosition) pnl(price Decimal) Decimal {
+	if price.IsZero() {
+		return Decimal{}
+	}
+	pnl := price.Sub(pos.price).Mul(pos.size)
+	if pos.side == SideSell {
+		return pnl.Neg()
+	}
+	return pnl
+}
+
+// fill は約定を残高か建玉に反映する
+func (a *PaperAccount) fill(o *PaperOrder, price, size, commission Decimal, now time.Time) {
+	if isFXProduct(o.ProductCode) {
+		a.addPosition(o.ProductCode, o.Side, price, size, now)
+		return
+	}
+
+	// 手数料は現物の通貨で払う
+	cost := price.Mul(size)
+	base, quote := paperCurrencies(o.ProductCode)
+	bb, qb := a.balance(base), a.balance(quote)
+	if o.Side == SideBuy {
+		reserved := o.Price.Mul(size)
+		if o.ChildOrderType == OrderTypeMarket {
+			reserved = cost
+		}
+		qb.amount = qb.amount.Sub(cost)
+		qb.available = qb.available.Add(reserved.Sub(cost))
+		o.locked = o.locked.Sub(reserved)
+		bb.amount = bb.amount.Add(size).Sub(commission)
+		bb.available = bb.available.Add(size).Sub(commission)
+	} else {
+		// 手数料も拘束した分から払う
+		bb.amount = bb.amount.Sub(size).Sub(commission)
+		o.locked = o.locked.Sub(size).Sub(commission)
+		qb.amount = qb.amount.Add(cost)
+		qb.available = qb.available.Add(cost)
+	}
+}
+
+// addPosition はFXの建玉を増やす。反対側の建玉があれば古いものから決済し、損益を証拠金に入れる
+func (a *PaperAccount) addPosition(productCode string, side Side, price, size Decimal, now time.Time) {
+	positions := a.positions[:0]
+	for _, pos := range a.positions {
+		if size.Sign() > 0 && pos.productCode == productCode && pos.side != side {
+			closed := pos.size
+			if closed.Cmp(size) > 0 {
+				closed = size
+			}
+			a.collateral = a.collateral.Add(pos.pnl(price).Mul(closed).Div(pos.size, 8))
+			pos.requireCollateral = pos.requireCollateral.Mul(pos.size.Sub(closed)).Div(pos.size, 8)
+			pos.size = pos.size.Sub(closed)
+			size = size.Sub(closed)
+			if pos.size.Sign() <= 0 {
+				continue
+			}
+		}
+		positions = append(positions, pos)
+	}
+	a.positions = positions
+
+	if size.Sign() > 0 {
+		a.positions = append(a.positions, &paperPosition{
+			productCode:       productCode,
+			side:              side,
+			price:             price,
+			size:              size,
+			requireCollateral: price.Mul(size).Div(NewDecimalFromInt(PaperLeverage), 8),
+			openDate:          now,
+		})
+	}
+}
+
+// release は注文が拘束している残高を戻す
+func (a *PaperAccount) release(o *PaperOrder) {
+	if o.locked.Sign() == 0 {
+		return
+	}
+	base, quote := paperCurrencies(o.ProductCode)
+	b := a.balance(base)
+	if o.Side == SideBuy {
+		b = a.balance(quote)
+	}
+	b.available = b.available.Add(o.locked)
+	o.locked = Decimal{}
+}
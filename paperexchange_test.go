@@ -0,0 +1,370 @@
+package bitflyer_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/jackpopper/bitflyer"
+	"github.com/jackpopper/bitflyer/bitflyertest"
+)
+
+func paperBoard(mid string, bids, asks [][2]string) *bitflyer.Board {
+	b := &bitflyer.Board{MidPrice: bitflyer.MustDecimal(mid)}
+	for _, l := range bids {
+		b.Bids = append(b.Bids, bitflyer.PriceLevel{Price: bitflyer.MustDecimal(l[0]), Size: bitflyer.MustDecimal(l[1])})
+	}
+	for _, l := range asks {
+		b.Asks = append(b.Asks, bitflyer.PriceLevel{Price: bitflyer.MustDecimal(l[0]), Size: bitflyer.MustDecimal(l[1])})
+	}
+	return b
+}
+
+func newPaperExchange() *bitflyer.PaperExchange {
+	return &bitflyer.PaperExchange{Account: bitflyer.NewPaperAccount()}
+}
+
+func paperOrder(x *bitflyer.PaperExchange, code string, side bitflyer.Side, typ bitflyer.OrderType, tif bitflyer.TimeInForce, price, size string) *bitflyer.PaperOrder {
+	ch := &bitflyer.Childorder{ProductCode: code, ChildOrderType: typ, Side: side, Size: bitflyer.MustDecimal(size), TimeInForce: tif}
+	if price != "" {
+		ch.Price = bitflyer.MustDecimal(price)
+	}
+	return x.NewOrder(ch, bitflyer.MustDecimal("0.001"))
+}
+
+func checkPaperBalance(t *testing.T, a *bitflyer.PaperAccount, currency, amount, available string) {
+	t.Helper()
+	got, avail := a.Balance(currency)
+	if !got.Equal(bitflyer.MustDecimal(amount)) || !avail.Equal(bitflyer.MustDecimal(available)) {
+		t.Errorf("%s = %s (available %s), want %s (available %s)", currency, got, avail, amount, available)
+	}
+}
+
+func checkPaperOrder(t *testing.T, o *bitflyer.PaperOrder, state bitflyer.OrderState, executed, outstanding, canceled string) {
+	t.Helper()
+	if o.ChildOrderState != state || !o.ExecutedSize.Equal(bitflyer.MustDecimal(executed)) ||
+		!o.OutstandingSize.Equal(bitflyer.MustDecimal(outstanding)) || !o.CancelSize.Equal(bitflyer.MustDecimal(canceled)) {
+		t.Errorf("order = %s executed %s outstanding %s canceled %s, want %s %s %s %s",
+			o.ChildOrderState, o.ExecutedSize, o.OutstandingSize, o.CancelSize, state, executed, outstanding, canceled)
+	}
+}
+
+func TestPaperExchangeSpot(t *testing.T) {
+	x := newPaperExchange()
+	x.Account.SetBalance("JPY", bitflyer.MustDecimal("1000"))
+	board := paperBoard("99.5", [][2]string{{"99", "1"}}, [][2]string{{"100", "0.5"}, {"101", "1"}})
+
+	// 板の2段を取り、残りはない
+	o := paperOrder(x, "BTC_JPY", bitflyer.SideBuy, bitflyer.OrderTypeLimit, "", "101", "0.7")
+	execs, err := x.Place(o, board)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(execs) != 2 || !execs[0].Price.Equal(bitflyer.MustDecimal("100")) || !execs[1].Size.Equal(bitflyer.MustDecimal("0.2")) {
+		t.Errorf("executions = %+v", execs)
+	}
+	checkPaperOrder(t, o, bitflyer.StateCompleted, "0.7", "0", "0")
+	if !o.AveragePrice.Equal(bitflyer.MustDecimal("100.28571429")) || !o.TotalCommission.Equal(bitflyer.MustDecimal("0.0007")) {
+		t.Errorf("average = %s, commission = %s", o.AveragePrice, o.TotalCommission)
+	}
+	checkPaperBalance(t, x.Account, "JPY", "929.8", "929.8")
+	checkPaperBalance(t, x.Account, "BTC", "0.6993", "0.6993")
+
+	// 板に残る指値は価格を拘束し、越えた約定で指値で約定する
+	rest := paperOrder(x, "BTC_JPY", bitflyer.SideBuy, bitflyer.OrderTypeLimit, "", "98", "1")
+	if _, err := x.Place(rest, board); err != nil {
+		t.Fatal(err)
+	}
+	checkPaperBalance(t, x.Account, "JPY", "929.8", "831.8")
+	if execs := x.Feed("BTC_JPY", &bitflyer.Execution{Price: bitflyer.MustDecimal("98"), Size: bitflyer.MustDecimal("1")}); len(execs) != 0 {
+		t.Errorf("filled at the order price: %+v", execs)
+	}
+	execs = x.Feed("BTC_JPY", &bitflyer.Execution{Price: bitflyer.MustDecimal("97"), Size: bitflyer.MustDecimal("0.4")})
+	if len(execs) != 1 || !execs[0].Price.Equal(bitflyer.MustDecimal("98")) {
+		t.Errorf("executions = %+v", execs)
+	}
+	checkPaperOrder(t, rest, bitflyer.StateActive, "0.4", "0.6", "0")
+	checkPaperBalance(t, x.Account, "JPY", "890.6", "831.8")
+
+	x.Cancel(rest)
+	checkPaperOrder(t, rest, bitflyer.StateCanceled, "0.4", "0", "0.6")
+	checkPaperBalance(t, x.Account, "JPY", "890.6", "890.6")
+	checkPaperBalance(t, x.Account, "BTC", "1.0989", "1.0989")
+
+	// 売りは基軸通貨を拘束する
+	sell := paperOrder(x, "BTC_JPY", bitflyer.SideSell, bitflyer.OrderTypeLimit, "", "105", "2")
+	var apiErr *bitflyer.APIError
+	if _, err := x.Place(sell, board); !errors.As(err, &apiErr) || apiErr.Status != bitflyer.StatusInsufficientFunds {
+		t.Errorf("Place = %v, want insufficient funds", err)
+	}
+	if n := len(x.Orders()); n != 2 {
+		t.Errorf("orders = %d, want 2", n)
+	}
+}
+
+func TestPaperExchangeTimeInForce(t *testing.T) {
+	board := paperBoard("99.5", [][2]string{{"99", "1"}}, [][2]string{{"100", "0.5"}, {"101", "1"}})
+	tests := []struct {
+		name                            string
+		typ                             bitflyer.OrderType
+		tif                             bitflyer.TimeInForce
+		price, size                     string
+		state                           bitflyer.OrderState
+		executed, outstanding, canceled string
+		jpy                             string
+	}{
+		{"gtc rests", bitflyer.OrderTypeLimit, "", "100", "1", bitflyer.StateActive, "0.5", "0.5", "0", "900"},
+		{"ioc cancels the rest", bitflyer.OrderTypeLimit, bitflyer.TIFIOC, "100", "1", bitflyer.StateCanceled, "0.5", "0", "0.5", "950"},
+		{"fok needs the whole size", bitflyer.OrderTypeLimit, bitflyer.TIFFOK, "100", "1", bitflyer.StateCanceled, "0", "0", "1", "1000"},
+		{"fok fills", bitflyer.OrderTypeLimit, bitflyer.TIFFOK, "101", "1", bitflyer.StateCompleted, "1", "0", "0", "899.5"},
+		{"market cancels the rest", bitflyer.OrderTypeMarket, "", "", "2", bitflyer.StateCanceled, "1.5", "0", "0.5", "849"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			x := newPaperExchange()
+			x.Account.SetBalance("JPY", bitflyer.MustDecimal("1000"))
+			o := paperOrder(x, "BTC_JPY", bitflyer.SideBuy, tt.typ, tt.tif, tt.price, tt.size)
+			if _, err := x.Place(o, board); err != nil {
+				t.Fatal(err)
+			}
+			checkPaperOrder(t, o, tt.state, tt.executed, tt.outstanding, tt.canceled)
+			// 約定代金と板に残った分の拘束を除き、取り消した分は戻る
+			_, available := x.Account.Balance("JPY")
+			if !available.Equal(bitflyer.MustDecimal(tt.jpy)) {
+				t.Errorf("available = %s, want %s", available, tt.jpy)
+			}
+		})
+	}
+}
+
+func TestPaperExchangeFX(t *testing.T) {
+	x := newPaperExchange()
+	x.Account.SetCollateral(bitflyer.MustDecimal("10000"))
+	board := paperBoard("999.5", [][2]string{{"999", "10"}}, [][2]string{{"1000", "10"}})
+
+	buy := paperOrder(x, "FX_BTC_JPY", bitflyer.SideBuy, bitflyer.OrderTypeMarket, "", "", "5")
+	if _, err := x.Place(buy, board); err != nil {
+		t.Fatal(err)
+	}
+	if !buy.TotalCommission.IsZero() {
+		t.Errorf("commission = %s", buy.TotalCommission)
+	}
+	pos := x.Account.Positions("FX_BTC_JPY", board.MidPrice)
+	if len(pos) != 1 || !pos[0].RequireCollateral.Equal(bitflyer.MustDecimal("2500")) || !pos[0].Pnl.Equal(bitflyer.MustDecimal("-2.5")) {
+		t.Fatalf("positions = %+v", pos)
+	}
+
+	// 空き証拠金は 10000 - 2.5 - 2500 で、15枚の7500に足りない
+	more := paperOrder(x, "FX_BTC_JPY", bitflyer.SideBuy, bitflyer.OrderTypeMarket, "", "", "15")
+	var apiErr *bitflyer.APIError
+	if _, err := x.Place(more, board); !errors.As(err, &apiErr) || apiErr.Status != bitflyer.StatusInsufficientMargin {
+		t.Errorf("Place = %v, want insufficient margin", err)
+	}
+
+	// 売りで買い建玉を決済し、残りは売り建玉になる
+	sell := paperOrder(x, "FX_BTC_JPY", bitflyer.SideSell, bitflyer.OrderTypeMarket, "", "", "8")
+	if _, err := x.Place(sell, board); err != nil {
+		t.Fatal(err)
+	}
+	pos = x.Account.Positions("FX_BTC_JPY", board.MidPrice)
+	if len(pos) != 1 || pos[0].Side != bitflyer.SideSell || !pos[0].Size.Equal(bitflyer.MustDecimal("3")) || !pos[0].RequireCollateral.Equal(bitflyer.MustDecimal("1498.5")) {
+		t.Fatalf("positions = %+v", pos)
+	}
+	c := x.Account.Collateral(map[string]bitflyer.Decimal{"FX_BTC_JPY": board.MidPrice})
+	if !c.Collateral.Equal(bitflyer.MustDecimal("9995")) || !c.OpenPositionPnl.Equal(bitflyer.MustDecimal("-1.5")) || !c.RequireCollateral.Equal(bitflyer.MustDecimal("1498.5")) {
+		t.Errorf("collateral = %+v", c)
+	}
+	if codes := x.Account.PositionProductCodes(); len(codes) != 1 || codes[0] != "FX_BTC_JPY" {
+		t.Errorf("product codes = %v", codes)
+	}
+}
+
+func TestPaperExchangeFXClose(t *testing.T) {
+	x := newPaperExchange()
+	x.Account.SetCollateral(bitflyer.MustDecimal("3000"))
+	board := paperBoard("1000", [][2]string{{"1000", "10"}}, [][2]string{{"1000", "10"}})
+	place := func(side bitflyer.Side, size string) error {
+		_, err := x.Place(paperOrder(x, "FX_BTC_JPY", side, bitflyer.OrderTypeMarket, "", "", size), board)
+		return err
+	}
+
+	// 空き証拠金は 3000 - 2500 = 500
+	if err := place(bitflyer.SideBuy, "5"); err != nil {
+		t.Fatal(err)
+	}
+	// 決済する分には証拠金はいらない
+	if err := place(bitflyer.SideSell, "2"); err != nil {
+		t.Errorf("close: %v", err)
+	}
+	// 残りの3枚を決済し、2枚の売りを建てる。必要なのは2枚の1000だけで、空き証拠金は 3000 - 1500 = 1500
+	if err := place(bitflyer.SideSell, "5"); err != nil {
+		t.Errorf("close and open: %v", err)
+	}
+	pos := x.Account.Positions("FX_BTC_JPY", board.MidPrice)
+	if len(pos) != 1 || pos[0].Side != bitflyer.SideSell || !pos[0].Size.Equal(bitflyer.MustDecimal("2")) {
+		t.Fatalf("positions = %+v", pos)
+	}
+	// 建玉を増やす分は確かめる。空き証拠金 2000 から3枚の1500を使うと、2枚の1000には足りない
+	var apiErr *bitflyer.APIError
+	if err := place(bitflyer.SideSell, "3"); err != nil {
+		t.Errorf("open: %v", err)
+	}
+	if err := place(bitflyer.SideSell, "2"); !errors.As(err, &apiErr) || apiErr.Status != bitflyer.StatusInsufficientMargin {
+		t.Errorf("Place = %v, want insufficient margin", err)
+	}
+	// 5枚の決済で空く2500を足せば、2枚の買いを建てられる
+	if err := place(bitflyer.SideBuy, "7"); err != nil {
+		t.Errorf("close and open: %v", err)
+	}
+	pos = x.Account.Positions("FX_BTC_JPY", board.MidPrice)
+	if len(pos) != 1 || pos[0].Side != bitflyer.SideBuy || !pos[0].Size.Equal(bitflyer.MustDecimal("2")) {
+		t.Errorf("positions = %+v", pos)
+	}
+}
+
+func TestPaperExchangeSpotSellCommission(t *testing.T) {
+	x := newPaperExchange()
+	x.Account.SetBalance("BTC", bitflyer.MustDecimal("1"))
+	board := paperBoard("100", [][2]string{{"100", "10"}}, [][2]string{{"101", "10"}})
+
+	// 手数料の0.001を払えない
+	sell := paperOrder(x, "BTC_JPY", bitflyer.SideSell, bitflyer.OrderTypeLimit, "", "105", "1")
+	var apiErr *bitflyer.APIError
+	if _, err := x.Place(sell, board); !errors.As(err, &apiErr) || apiErr.Status != bitflyer.StatusInsufficientFunds {
+		t.Errorf("Place = %v, want insufficient funds", err)
+	}
+	if _, err := x.Place(paperOrder(x, "BTC_JPY", bitflyer.SideSell, bitflyer.OrderTypeMarket, "", "", "1"), board); err == nil {
+		t.Error("market: Place succeeded")
+	}
+
+	// 手数料の分も拘束し、約定で払う
+	sell = paperOrder(x, "BTC_JPY", bitflyer.SideSell, bitflyer.OrderTypeLimit, "", "105", "0.5")
+	if _, err := x.Place(sell, board); err != nil {
+		t.Fatal(err)
+	}
+	checkPaperBalance(t, x.Account, "BTC", "1", "0.4995")
+	x.Feed("BTC_JPY", &bitflyer.Execution{Price: bitflyer.MustDecimal("106"), Size: bitflyer.MustDecimal("0.2")})
+	checkPaperBalance(t, x.Account, "BTC", "0.7998", "0.4995")
+	x.Feed("BTC_JPY", &bitflyer.Execution{Price: bitflyer.MustDecimal("106"), Size: bitflyer.MustDecimal("0.3")})
+	checkPaperOrder(t, sell, bitflyer.StateCompleted, "0.5", "0", "0")
+	checkPaperBalance(t, x.Account, "BTC", "0.4995", "0.4995")
+	checkPaperBalance(t, x.Account, "JPY", "52.5", "52.5")
+
+	// 残り全部を手数料込みで売っても利用可能額は負にならない
+	sell = paperOrder(x, "BTC_JPY", bitflyer.SideSell, bitflyer.OrderTypeMarket, "", "", "0.49900099")
+	if _, err := x.Place(sell, board); err != nil {
+		t.Fatal(err)
+	}
+	if _, available := x.Account.Balance("BTC"); available.Sign() < 0 {
+		t.Errorf("available = %s", available)
+	}
+}
+
+// Accountがなければ資金を確かめず、手数料と時刻とIDは呼び出す側が決める
+func TestPaperExchangeHooks(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	var fills, cancels []string
+	x := &bitflyer.PaperExchange{
+		Now:      func() time.Time { return now },
+		FormatID: func(kind string, id int) string { return fmt.Sprintf("T-%s-%d", kind, id) },
+		Commission: func(o *bitflyer.PaperOrder, price, size bitflyer.Decimal, maker bool) bitflyer.Decimal {
+			if maker {
+				return bitflyer.Decimal{}
+			}
+			return price.Mul(size).Mul(bitflyer.MustDecimal("0.01"))
+		},
+		OnFill: func(o *bitflyer.PaperOrder, e *bitflyer.PaperExecution, maker bool) {
+			fills = append(fills, o.ChildOrderAcceptanceID+" "+e.Size.String()+" "+string(o.ChildOrderState))
+		},
+		OnCancel: func(o *bitflyer.PaperOrder) {
+			cancels = append(cancels, string(o.ChildOrderState))
+		},
+	}
+	board := paperBoard("100", nil, [][2]string{{"100", "1"}})
+
+	o := paperOrder(x, "BTC_JPY", bitflyer.SideBuy, bitflyer.OrderTypeMarket, "", "", "1")
+	if o.ChildOrderAcceptanceID != "T-JRF-1" || o.ChildOrderID != "T-JOR-1" || !o.ChildOrderDate.Equal(now) {
+		t.Errorf("order = %+v", o.ChildorderInfo)
+	}
+	execs, err := x.Place(o, board)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(execs) != 1 || !execs[0].Commission.Equal(bitflyer.MustDecimal("1")) || !execs[0].ExecDate.Equal(now) {
+		t.Errorf("executions = %+v", execs)
+	}
+	if len(fills) != 1 || fills[0] != "T-JRF-1 1 COMPLETED" {
+		t.Errorf("fills = %v", fills)
+	}
+
+	// 市場の約定は古い注文から順に割り当てる
+	first := paperOrder(x, "BTC_JPY", bitflyer.SideSell, bitflyer.OrderTypeLimit, "", "110", "1")
+	second := paperOrder(x, "BTC_JPY", bitflyer.SideSell, bitflyer.OrderTypeLimit, "", "105", "1")
+	for _, o := range []*bitflyer.PaperOrder{first, second} {
+		if _, err := x.Place(o, board); err != nil {
+			t.Fatal(err)
+		}
+	}
+	x.Feed("BTC_JPY", &bitflyer.Execution{Price: bitflyer.MustDecimal("111"), Size: bitflyer.MustDecimal("1.5")})
+	checkPaperOrder(t, first, bitflyer.StateCompleted, "1", "0", "0")
+	checkPaperOrder(t, second, bitflyer.StateActive, "0.5", "0.5", "0")
+	if !first.TotalCommission.IsZero() {
+		t.Errorf("maker commission = %s", first.TotalCommission)
+	}
+
+	x.Expire(second)
+	if len(cancels) != 1 || cancels[0] != string(bitflyer.StateExpired) {
+		t.Errorf("cancels = %v", cancels)
+	}
+	if o := x.ActiveOrder("BTC_JPY", "", second.ChildOrderAcceptanceID); o != nil {
+		t.Errorf("expired order is active: %+v", o)
+	}
+}
+
+func TestPaperExchangePage(t *testing.T) {
+	x := newPaperExchange()
+	x.Account.SetBalance("JPY", bitflyer.MustDecimal("1000"))
+	board := paperBoard("100", nil, nil)
+	var orders []*bitflyer.PaperOrder
+	for i := 0; i < 5; i++ {
+		o := paperOrder(x, "BTC_JPY", bitflyer.SideBuy, bitflyer.OrderTypeLimit, "", "90", "1")
+		if _, err := x.Place(o, board); err != nil {
+			t.Fatal(err)
+		}
+		orders = append(orders, o)
+	}
+	x.Cancel(orders[3])
+
+	got := x.Childorders(&bitflyer.Page{Count: 2, Before: orders[4].ID}, nil)
+	if len(got) != 2 || got[0].ID != orders[3].ID || got[1].ID != orders[2].ID {
+		t.Errorf("page = %+v", got)
+	}
+	got = x.Childorders(&bitflyer.Page{After: orders[1].ID}, func(o *bitflyer.PaperOrder) bool {
+		return o.ChildOrderState == bitflyer.StateActive
+	})
+	if len(got) != 2 || got[0].ID != orders[4].ID || got[1].ID != orders[2].ID {
+		t.Errorf("active = %+v", got)
+	}
+	if got := x.Executions(nil, nil); len(got) != 0 {
+		t.Errorf("executions = %+v", got)
+	}
+
+	var page *bitflyer.Page
+	if !page.Contains(1) || page.Limit() != 100 {
+		t.Error("nil page")
+	}
+}
+
+func TestPaperClientPositionsRequireProductCode(t *testing.T) {
+	s := bitflyertest.NewServer()
+	defer s.Close()
+	p := s.Client().NewPaperClient()
+	if _, err := p.GetMyPositions(context.Background(), ""); err == nil {
+		t.Error("GetMyPositions without product code succeeded")
+	}
+	if pos, err := p.GetMyPositions(context.Background(), "FX_BTC_JPY"); err != nil || len(*pos) != 0 {
+		t.Errorf("GetMyPositions = %+v, %v", pos, err)
+	}
+}
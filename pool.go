@@ -0,0 +1,275 @@
+package bitflyer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// * 複数アカウント
+// 名前をつけたアカウントのClientをまとめ、残高などの取得は全アカウントへ並行に投げて集計する。
+// 注文は名前で指定したアカウントに送る
+
+var ErrUnknownAccount = errors.New("bitflyer: unknown account")
+
+type ClientPool struct {
+	mu      sync.RWMutex
+	clients map[string]*Client
+	// Public APIの回数はIPごとなので全アカウントで共有する
+	public *RateBucket
+}
+
+func NewClientPool() *ClientPool {
+	return &ClientPool{clients: map[string]*Client{}, public: NewRateBucket(500, 5*time.Minute)}
+}
+
+// Add はcの写しをアカウントとして登録する。RateLimiterがなければ写しにアカウント用のものを設定し、cは変えない。
+// 登録後にcを変えても反映されないので、プールを通さずに呼ぶときはClient(name)で写しを取り出す
+func (p *ClientPool) Add(name string, c *Client) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, ok := p.clients[name]; ok {
+		return fmt.Errorf("bitflyer: account %q already exists", name)
+	}
+	cc := *c
+	if cc.RateLimiter == nil {
+		l := NewRateLimiter()
+		l.Public = p.public
+		cc.RateLimiter = l
+	}
+	p.clients[name] = &cc
+
+	return nil
+}
+
+func (p *ClientPool) Remove(name string) {
+	p.mu.Lock()
+	delete(p.clients, name)
+	p.mu.Unlock()
+}
+
+func (p *ClientPool) Client(name string) (*Client, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	c, ok := p.clients[name]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownAccount, name)
+	}
+	return c, nil
+}
+
+// Names は登録されているアカウント名を昇順で返す
+func (p *ClientPool) Names() []string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	names := make([]string, 0, len(p.clients))
+	for name := range p.clients {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// PoolError は一部のアカウントで失敗したときのアカウントごとのエラー
+type PoolError map[string]error
+
+func (e PoolError) Error() string {
+	names := make([]string, 0, len(e))
+	for name := range e {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	msgs := make([]string, len(names))
+	for i, name := range names {
+		msgs[i] = fmt.Sprintf("%s: %v", name, e[name])
+	}
+	return "bitflyer: " + strings.Join(msgs, "; ")
+}
+
+func (e PoolError) Unwrap() []error {
+	errs := make([]error, 0, len(e))
+	for _, err := range e {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+// fanOut は全アカウントでfnを並行に呼ぶ。失敗したアカウントがあればPoolErrorも返す
+func fanOut[T any](ctx context.Context, p *ClientPool, fn func(ctx context.Context, c *Client) (T, error)) (map[string]T, error) {
+	p.mu.RLock()
+	clients := make(map[string]*Client, len(p.clients))
+	for name, c := range p.clients {
+		clients[name] = c
+	}
+	p.mu.RUnlock()
+
+	var (
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		results = make(map[string]T, len(clients))
+		errs    = PoolError{}
+	)
+	for name, c := range clients {
+		wg.Add(1)
+		go func(name string, c *Client) {
+			defer wg.Done()
+			v, err := fn(ctx, c)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs[name] = err
+				return
+			}
+			results[name] = v
+		}(name, c)
+	}
+	wg.Wait()
+
+	if len(errs) > 0 {
+		return results, errs
+	}
+	return results, nil
+}
+
+// ** 残高
+type PoolBalance struct {
+	Accounts map[string]*Balance
+	// 通貨コードごとの合計
+	Total map[string]BalanceTotal
+}
+
+type BalanceTotal struct {
+	Amount    Decimal
+	Available Decimal
+}
+
+// GetMyBalance は取得できたアカウントだけで集計する。失敗したアカウントはPoolErrorで返す
+func (p *ClientPool) GetMyBalance(ctx context.Context) (*PoolBalance, error) {
+	res, err := fanOut(ctx, p, func(ctx context.Context, c *Client) (*Balance, error) {
+		return c.GetMyBalance(ctx)
+	})
+
+	pb := &PoolBalance{Accounts: res, Total: map[string]BalanceTotal{}}
+	for _, b := range res {
+		for _, v := range *b {
+			t := pb.Total[v.CurrencyCode]
+			t.Amount = t.Amount.Add(v.Amount)
+			t.Available = t.Available.Add(v.Available)
+			pb.Total[v.CurrencyCode] = t
+		}
+	}
+
+	return pb, err
+}
+
+// ** 証拠金
+type PoolCollateral struct {
+	Accounts map[string]*Collateral
+	// KeepRateは合計した証拠金から計算し直す
+	Total Collateral
+}
+
+func (p *ClientPool) GetMyCollateral(ctx context.Context) (*PoolCollateral, error) {
+	res, err := fanOut(ctx, p, func(ctx context.Context, c *Client) (*Collateral, error) {
+		return c.GetMyCollateral(ctx)
+	})
+
+	pc := &PoolCollateral{Accounts: res}
+	for _, c := range res {
+		pc.Total.Collateral = pc.Total.Collateral.Add(c.Collateral)
+		pc.Total.OpenPositionPnl = pc.Total.OpenPositionPnl.Add(c.OpenPositionPnl)
+		pc.Total.RequireCollateral = pc.Total.RequireCollateral.Add(c.RequireCollateral)
+	}
+	if pc.Total.RequireCollateral.Sign() > 0 {
+		pc.Total.KeepRate = pc.Total.Collateral.Add(pc.Total.OpenPositionPnl).Div(pc.Total.RequireCollateral, 8).Float64()
+	}
+
+	return pc, err
+}
+
+// ** 建玉
+type PoolPositions struct {
+	Accounts map[string]*Positions
+	// 銘柄コードごとの合計
+	Total map[string]PositionTotal
+}
+
+type PositionTotal struct {
+	// 買いを正、売りを負とした差し引きの数量
+	NetSize           Decimal
+	RequireCollateral Decimal
+	Pnl               Decimal
+}
+
+func (p *ClientPool) GetMyPositions(ctx context.Context, productCode string) (*PoolPositions, error) {
+	res, err := fanOut(ctx, p, func(ctx context.Context, c *Client) (*Positions, error) {
+		return c.GetMyPositions(ctx, productCode)
+	})
+
+	pp := &PoolPositions{Accounts: res, Total: map[string]PositionTotal{}}
+	for _, ps := range res {
+		for _, v := range *ps {
+			t := pp.Total[v.ProductCode]
+			if v.Side == SideSell {
+				t.NetSize = t.NetSize.Sub(v.Size)
+			} else {
+				t.NetSize = t.NetSize.Add(v.Size)
+			}
+			t.RequireCollateral = t.RequireCollateral.Add(v.RequireCollateral)
+			t.Pnl = t.Pnl.Add(v.Pnl)
+			pp.Total[v.ProductCode] = t
+		}
+	}
+
+	return pp, err
+}
+
+// ** 注文
+func (p *ClientPool) SendChildorder(ctx context.Context, account string, ch *Childorder) (*ChildOrderAcceptanceID, error) {
+	c, err := p.Client(account)
+	if err != nil {
+		return nil, err
+	}
+	return c.SendChildorder(ctx, ch)
+}
+
+func (p *ClientPool) CancelChildorder(ctx context.Context, account string, ch *Childorder) error {
+	c, err := p.Client(account)
+	if err != nil {
+		return err
+	}
+	return c.CancelChildorder(ctx, ch)
+}
+
+func (p *ClientPool) SendParentrder(ctx context.Context, account string, pa *Parentorder) (*ParentOrderAcceptanceID, error) {
+	c, err := p.Client(account)
+	if err != nil {
+		return nil, err
+	}
+	return c.SendParentrder(ctx, pa)
+}
+
+func (p *ClientPool) CancelParentorder(ctx context.Context, account string, pa *Parentorder) error {
+	c, err := p.Client(account)
+	if err != nil {
+		return err
+	}
+	return c.CancelParentorder(ctx, pa)
+}
+
+func (p *ClientPool) CancelAllChildorder(ctx context.Context, account, productCode string) error {
+	c, err := p.Client(account)
+	if err != nil {
+		return err
+	}
+	return c.CancelAllChildorder(ctx, productCode)
+}
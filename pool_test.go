@@ -0,0 +1,102 @@
+package bitflyer_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/jackpopper/bitflyer"
+	"github.com/jackpopper/bitflyer/bitflyertest"
+)
+
+func newPoolServer(t *testing.T, jpy, collateral string) *bitflyertest.Server {
+	t.Helper()
+	s := bitflyertest.NewServer()
+	t.Cleanup(s.Close)
+	s.SetBalance("JPY", bitflyer.MustDecimal(jpy))
+	s.SetCollateral(bitflyer.MustDecimal(collateral))
+	s.SetBoard("FX_BTC_JPY", &bitflyer.Board{
+		Bids: []bitflyer.PriceLevel{{Price: bitflyer.MustDecimal("9990000"), Size: bitflyer.MustDecimal("10")}},
+		Asks: []bitflyer.PriceLevel{{Price: bitflyer.MustDecimal("10010000"), Size: bitflyer.MustDecimal("10")}},
+	})
+	return s
+}
+
+func TestClientPool(t *testing.T) {
+	a, b := newPoolServer(t, "100000", "1000000"), newPoolServer(t, "50000", "500000")
+	p := bitflyer.NewClientPool()
+	ca := a.Client()
+	if err := p.Add("a", ca); err != nil {
+		t.Fatal(err)
+	}
+	cb := b.Client()
+	cb.RetryPolicy = nil
+	if err := p.Add("b", cb); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Add("a", b.Client()); err == nil {
+		t.Error("Add duplicate succeeded")
+	}
+	// 渡したClientは変えない
+	if ca.RateLimiter != nil {
+		t.Error("Add set the caller's RateLimiter")
+	}
+	if c, err := p.Client("a"); err != nil || c.RateLimiter == nil {
+		t.Errorf("Client(a) = %+v, %v", c, err)
+	}
+	if names := p.Names(); len(names) != 2 || names[0] != "a" || names[1] != "b" {
+		t.Errorf("names = %v", names)
+	}
+
+	// 注文は名前で選んだアカウントへ
+	ctx := context.Background()
+	order := func(side bitflyer.Side, size string) *bitflyer.Childorder {
+		return &bitflyer.Childorder{ProductCode: "FX_BTC_JPY", ChildOrderType: bitflyer.OrderTypeMarket, Side: side, Size: bitflyer.MustDecimal(size)}
+	}
+	if _, err := p.SendChildorder(ctx, "a", order(bitflyer.SideBuy, "0.1")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.SendChildorder(ctx, "b", order(bitflyer.SideSell, "0.03")); err != nil {
+		t.Fatal(err)
+	}
+	if len(a.Orders()) != 1 || a.Orders()[0].Side != bitflyer.SideBuy || len(b.Orders()) != 1 || b.Orders()[0].Side != bitflyer.SideSell {
+		t.Errorf("orders = %+v, %+v", a.Orders(), b.Orders())
+	}
+	if _, err := p.SendChildorder(ctx, "c", order(bitflyer.SideBuy, "0.1")); !errors.Is(err, bitflyer.ErrUnknownAccount) {
+		t.Errorf("err = %v, want %v", err, bitflyer.ErrUnknownAccount)
+	}
+
+	// 集計
+	bal, err := p.GetMyBalance(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total := bal.Total["JPY"]; !total.Amount.Equal(bitflyer.MustDecimal("150000")) || len(bal.Accounts) != 2 {
+		t.Errorf("balance = %+v", bal)
+	}
+	pos, err := p.GetMyPositions(ctx, "FX_BTC_JPY")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total := pos.Total["FX_BTC_JPY"]; !total.NetSize.Equal(bitflyer.MustDecimal("0.07")) {
+		t.Errorf("net size = %s", total.NetSize)
+	}
+	col, err := p.GetMyCollateral(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !col.Total.Collateral.Equal(bitflyer.MustDecimal("1500000")) || col.Total.RequireCollateral.Sign() <= 0 || col.Total.KeepRate <= 0 {
+		t.Errorf("collateral = %+v", col.Total)
+	}
+
+	// 失敗したアカウントはPoolErrorで返し、残りで集計する
+	b.InjectFault("me/getbalance", bitflyertest.Fault{HTTPStatus: 500, Status: -500, Message: "error"})
+	bal, err = p.GetMyBalance(ctx)
+	var pe bitflyer.PoolError
+	if !errors.As(err, &pe) || len(pe) != 1 || pe["b"] == nil {
+		t.Fatalf("err = %v", err)
+	}
+	if total := bal.Total["JPY"]; !total.Amount.Equal(bitflyer.MustDecimal("100000")) || len(bal.Accounts) != 1 {
+		t.Errorf("balance = %+v", bal)
+	}
+}
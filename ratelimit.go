@@ -0,0 +1,173 @@
+package bitflyer
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// * API呼び出し回数の制限
+// Private APIはAPIキーごと、Public APIはIPごとに一定期間の回数が決まっていて、
+// 注文系のAPIはそれとは別により少ない回数に制限されている
+
+var ErrRateLimitExceeded = errors.New("bitflyer: rate limit exceeded")
+
+// 注文系のエンドポイント。Private APIの回数にも数えられる
+var orderEndpoints = map[string]bool{
+	"me/sendchildorder":      true,
+	"me/cancelchildorder":    true,
+	"me/sendparentorder":     true,
+	"me/cancelparentorder":   true,
+	"me/cancelallchildorder": true,
+}
+
+func isPrivateEndpoint(endpoint string) bool {
+	return strings.HasPrefix(endpoint, "me/")
+}
+
+type RateLimiter struct {
+	// trueなら回数が尽きたときにリセットを待たずErrRateLimitExceededを返す
+	FailFast bool
+
+	Public  *RateBucket
+	Private *RateBucket
+	Order   *RateBucket
+}
+
+func NewRateLimiter() *RateLimiter {
+	return &RateLimiter{
+		Public:  NewRateBucket(500, 5*time.Minute),
+		Private: NewRateBucket(500, 5*time.Minute),
+		Order:   NewRateBucket(300, 5*time.Minute),
+	}
+}
+
+// Wait はendpointを呼び出せるようになるまで待つ。
+// 注文系のエンドポイントはPrivateとOrderの両方に残りがあるときだけ、両方から1回ずつ使う
+func (l *RateLimiter) Wait(ctx context.Context, endpoint string) error {
+	if !isPrivateEndpoint(endpoint) {
+		return take(ctx, l.FailFast, l.Public)
+	}
+	if orderEndpoints[endpoint] {
+		return take(ctx, l.FailFast, l.Private, l.Order)
+	}
+	return take(ctx, l.FailFast, l.Private)
+}
+
+// Update はレスポンスのX-RateLimit-*ヘッダで残り回数を合わせる。
+// ヘッダはPrivate APIの回数を表すので、注文系のエンドポイントでもPrivateを合わせる
+func (l *RateLimiter) Update(endpoint string, res *http.Response) {
+	if isPrivateEndpoint(endpoint) {
+		l.Private.update(res)
+	} else {
+		l.Public.update(res)
+	}
+}
+
+// RateBucket はPeriodごとにLimit回までの呼び出しを許す
+type RateBucket struct {
+	Limit  int
+	Period time.Duration
+
+	mu        sync.Mutex
+	remaining int
+	reset     time.Time
+}
+
+func NewRateBucket(limit int, period time.Duration) *RateBucket {
+	return &RateBucket{Limit: limit, Period: period}
+}
+
+// Remaining は現在の期間の残り回数とリセット時刻
+func (b *RateBucket) Remaining() (int, time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(time.Now())
+	return b.remaining, b.reset
+}
+
+func (b *RateBucket) refill(now time.Time) {
+	if !now.Before(b.reset) {
+		b.remaining = b.Limit
+		b.reset = now.Add(b.Period)
+	}
+}
+
+// take はbucketsのすべてに残りがあれば1回ずつ使う。
+// どれかが尽きていれば、どれも使わずにリセットを待ってやり直す
+func take(ctx context.Context, failFast bool, buckets ...*RateBucket) error {
+	var bs []*RateBucket
+	for _, b := range buckets {
+		if b != nil && (len(bs) == 0 || bs[0] != b) {
+			bs = append(bs, b)
+		}
+	}
+	if len(bs) == 0 {
+		return nil
+	}
+
+	for {
+		// いつも同じ順にロックする
+		for _, b := range bs {
+			b.mu.Lock()
+		}
+		now := time.Now()
+		var reset time.Time
+		for _, b := range bs {
+			b.refill(now)
+			if b.remaining <= 0 && b.reset.After(reset) {
+				reset = b.reset
+			}
+		}
+		if reset.IsZero() {
+			for _, b := range bs {
+				b.remaining--
+			}
+		}
+		for _, b := range bs {
+			b.mu.Unlock()
+		}
+		if reset.IsZero() {
+			return nil
+		}
+
+		if failFast {
+			return ErrRateLimitExceeded
+		}
+		t := time.NewTimer(time.Until(reset))
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+func (b *RateBucket) update(res *http.Response) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if v, err := strconv.Atoi(res.Header.Get("X-RateLimit-Remaining")); err == nil {
+		b.remaining = v
+	} else if res.StatusCode == http.StatusTooManyRequests {
+		b.remaining = 0
+	}
+	if v, err := strconv.ParseInt(res.Header.Get("X-RateLimit-Reset"), 10, 64); err == nil {
+		b.reset = time.Unix(v, 0)
+	} else if v, err := strconv.Atoi(res.Header.Get("X-RateLimit-Period")); err == nil && b.remaining == 0 {
+		b.reset = time.Now().Add(time.Duration(v) * time.Second)
+	} else if now := time.Now(); b.remaining == 0 && !now.Before(b.reset) {
+		// リセット時刻が分からなければPeriodだけ待つ
+		b.reset = now.Add(b.Period)
+	}
+}
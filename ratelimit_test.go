@@ -0,0 +1,133 @@
+package bitflyer_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/jackpopper/bitflyer"
+	"github.com/jackpopper/bitflyer/bitflyertest"
+)
+
+func TestRateLimiterOrderTokenNotConsumed(t *testing.T) {
+	ctx := context.Background()
+	l := &bitflyer.RateLimiter{
+		FailFast: true,
+		Private:  bitflyer.NewRateBucket(1, time.Hour),
+		Order:    bitflyer.NewRateBucket(5, time.Hour),
+	}
+
+	if err := l.Wait(ctx, "me/getbalance"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Wait(ctx, "me/sendchildorder"); !errors.Is(err, bitflyer.ErrRateLimitExceeded) {
+		t.Fatalf("err = %v, want %v", err, bitflyer.ErrRateLimitExceeded)
+	}
+	if n, _ := l.Order.Remaining(); n != 5 {
+		t.Errorf("order remaining = %d, want 5", n)
+	}
+
+	// 待っている間にキャンセルされても使わない
+	l.FailFast = false
+	cctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if err := l.Wait(cctx, "me/cancelchildorder"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if n, _ := l.Order.Remaining(); n != 5 {
+		t.Errorf("order remaining = %d, want 5", n)
+	}
+}
+
+func TestRateLimiterOrderBucket(t *testing.T) {
+	ctx := context.Background()
+	l := &bitflyer.RateLimiter{
+		FailFast: true,
+		Private:  bitflyer.NewRateBucket(10, time.Hour),
+		Order:    bitflyer.NewRateBucket(2, time.Hour),
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := l.Wait(ctx, "me/sendchildorder"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.Wait(ctx, "me/sendparentorder"); !errors.Is(err, bitflyer.ErrRateLimitExceeded) {
+		t.Fatalf("err = %v, want %v", err, bitflyer.ErrRateLimitExceeded)
+	}
+	// 注文以外のPrivate APIはOrderが尽きても呼べる
+	if err := l.Wait(ctx, "me/getchildorders"); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := l.Private.Remaining(); n != 7 {
+		t.Errorf("private remaining = %d, want 7", n)
+	}
+}
+
+func TestRateLimiterWaitsForReset(t *testing.T) {
+	l := &bitflyer.RateLimiter{Public: bitflyer.NewRateBucket(1, 50*time.Millisecond)}
+	ctx := context.Background()
+
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		if err := l.Wait(ctx, "ticker"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d := time.Since(start); d < 40*time.Millisecond {
+		t.Errorf("second call waited %v", d)
+	}
+}
+
+func TestRateLimiterUpdate(t *testing.T) {
+	l := bitflyer.NewRateLimiter()
+	reset := time.Now().Add(time.Minute).Truncate(time.Second)
+	res := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}}
+	res.Header.Set("X-RateLimit-Remaining", "3")
+	res.Header.Set("X-RateLimit-Reset", strconv.FormatInt(reset.Unix(), 10))
+
+	l.Update("me/sendchildorder", res)
+	if n, r := l.Private.Remaining(); n != 3 || !r.Equal(reset) {
+		t.Errorf("private = %d, %v; want 3, %v", n, r, reset)
+	}
+	if n, _ := l.Order.Remaining(); n != 300 {
+		t.Errorf("order remaining = %d, want 300", n)
+	}
+
+	res = &http.Response{StatusCode: http.StatusTooManyRequests, Header: http.Header{}}
+	l.Update("ticker", res)
+	if n, _ := l.Public.Remaining(); n != 0 {
+		t.Errorf("public remaining = %d, want 0", n)
+	}
+}
+
+func TestRateLimiterWithServer(t *testing.T) {
+	s := bitflyertest.NewServer()
+	defer s.Close()
+	s.SetRateLimit(3, time.Hour)
+	c := s.Client()
+	c.RateLimiter = bitflyer.NewRateLimiter()
+	c.RateLimiter.FailFast = true
+	ctx := context.Background()
+
+	if _, err := c.GetMyBalance(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := c.RateLimiter.Private.Remaining(); n != 2 {
+		t.Errorf("private remaining = %d, want 2", n)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := c.GetMyCollateral(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := c.GetMyBalance(ctx); !errors.Is(err, bitflyer.ErrRateLimitExceeded) {
+		t.Fatalf("err = %v, want %v", err, bitflyer.ErrRateLimitExceeded)
+	}
+	if n := s.Requests("me/getbalance"); n != 1 {
+		t.Errorf("me/getbalance requests = %d, want 1", n)
+	}
+}
@@ -0,0 +1,649 @@
+package bitflyer
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// * Realtime API (JSON-RPC 2.0 over WebSocket)
+
+const (
+	REALTIME_URL = "wss://ws.lightstream.bitflyer.com/json-rpc"
+)
+
+type Realtime struct {
+	URL               string
+	PingInterval      time.Duration
+	ReconnectDelay    time.Duration
+	MaxReconnectDelay time.Duration
+	// 購読チャネルごとのGoチャネルのバッファサイズ。
+	// 板のスナップショットとTickerは一杯なら古いものを捨て、それ以外は空くまで待つ。
+	// 待っている間は他のチャネルの配信も止まるので、読まなくなったGoチャネルはUnsubscribeする
+	Buffer int
+
+	client *Client
+	mu     sync.Mutex
+	conn   *wsConn
+	// 認証を済ませた接続
+	authConn *wsConn
+	subs     map[string][]*subscription
+	nextID   int
+	closed   bool
+
+	pending map[int]chan *rpcMessage
+}
+
+type subscription struct {
+	// 呼び出し元に返したGoチャネル。Unsubscribeで探す
+	ch      interface{}
+	deliver func(ctx context.Context, message json.RawMessage) error
+	close   func()
+
+	// Unsubscribeでcloseし、配信を待っているdeliverを戻す
+	done chan struct{}
+	once sync.Once
+	// deliverが送っている間はcloseしない
+	mu     sync.Mutex
+	closed bool
+}
+
+// newSubscription はメッセージをdecodeしてchに送る購読を作る。
+// latestならchが一杯のとき古いものを捨て、そうでなければ空くかUnsubscribeされるまで待つ
+func newSubscription[T any](ch chan T, latest bool, decode func(message json.RawMessage) ([]T, error)) *subscription {
+	s := &subscription{done: make(chan struct{})}
+	var out <-chan T = ch
+	s.ch = out
+	s.close = func() { close(ch) }
+	s.deliver = func(ctx context.Context, message json.RawMessage) error {
+		data, err := decode(message)
+		if err != nil {
+			return err
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.closed {
+			return nil
+		}
+		for _, v := range data {
+			if latest {
+				sendLatest(ch, v)
+				continue
+			}
+			select {
+			case ch <- v:
+			case <-s.done:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		return nil
+	}
+	return s
+}
+
+// sendLatest はchが一杯なら古いものを捨ててvを入れる。バッファがなく受け取る側もいなければvを捨てる
+func sendLatest[T any](ch chan T, v T) {
+	for {
+		select {
+		case ch <- v:
+			return
+		default:
+		}
+		if cap(ch) == 0 {
+			return
+		}
+		select {
+		case <-ch:
+		default:
+		}
+	}
+}
+
+// stop は配信をやめてGoチャネルをcloseする
+func (s *subscription) stop() {
+	s.once.Do(func() {
+		close(s.done)
+		s.mu.Lock()
+		s.closed = true
+		s.close()
+		s.mu.Unlock()
+	})
+}
+
+type rpcRequest struct {
+	Version string      `json:"jsonrpc"`
+	Method  string      `json:"method"`
+	Params  interface{} `json:"params,omitempty"`
+	ID      int         `json:"id,omitempty"`
+}
+
+type rpcMessage struct {
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+	ID     *int            `json:"id"`
+	Result json.RawMessage `json:"result"`
+	Error  *RPCError       `json:"error"`
+}
+
+type RPCError struct {
+	Code    int             `json:"code"`
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+func (e *RPCError) Error() string {
+	return fmt.Sprintf("json-rpc error %d: %s", e.Code, e.Message)
+}
+
+type channelMessage struct {
+	Channel string          `json:"channel"`
+	Message json.RawMessage `json:"message"`
+}
+
+func (c *Client) NewRealtime() *Realtime {
+	return &Realtime{
+		URL:               REALTIME_URL,
+		PingInterval:      30 * time.Second,
+		ReconnectDelay:    time.Second,
+		MaxReconnectDelay: time.Minute,
+		Buffer:            64,
+		client:            c,
+		subs:              map[string][]*subscription{},
+		pending:           map[int]chan *rpcMessage{},
+	}
+}
+
+// Run は接続を維持し、切断時は再接続して全チャネルを購読し直す。
+// ctxがキャンセルされるまで戻らず、戻る際に購読中のGoチャネルをすべてcloseする
+func (r *Realtime) Run(ctx context.Context) error {
+	defer r.closeAll()
+
+	delay := r.ReconnectDelay
+	for {
+		start := time.Now()
+		err := r.session(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if time.Since(start) > r.MaxReconnectDelay {
+			delay = r.ReconnectDelay
+		}
+		r.client.log(ctx, slog.LevelWarn, "bitflyer: realtime disconnected", "error", err, "reconnect_in", delay)
+		if r.client != nil {
+			r.client.Metrics.reconnect()
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if delay *= 2; delay > r.MaxReconnectDelay {
+			delay = r.MaxReconnectDelay
+		}
+	}
+}
+
+func (r *Realtime) session(ctx context.Context) error {
+	conn, err := dialWebSocket(ctx, r.URL)
+	if err != nil {
+		return err
+	}
+	if r.PingInterval > 0 {
+		conn.readTimeout = 2 * r.PingInterval
+	}
+
+	sctx, cancel := context.WithCancel(ctx)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- r.readLoop(sctx, conn)
+	}()
+	readDone := false
+
+	r.mu.Lock()
+	r.conn = conn
+	var public, private []string
+	for channel := range r.subs {
+		if isPrivateChannel(channel) {
+			private = append(private, channel)
+		} else {
+			public = append(public, channel)
+		}
+	}
+	r.mu.Unlock()
+
+	// Private channelsを購読するときだけ接続ごとに認証し直す。
+	// 認証できなくてもPublic channelsは購読し、Private channelsは次の接続で試す
+	if len(private) > 0 && !r.authenticate(sctx, conn) {
+		private = nil
+	}
+	for _, channel := range append(public, private...) {
+		if err = r.sendSubscribe(conn, channel); err != nil {
+			break
+		}
+	}
+
+	var ping <-chan time.Time
+	if r.PingInterval > 0 {
+		t := time.NewTicker(r.PingInterval)
+		defer t.Stop()
+		ping = t.C
+	}
+	for err == nil {
+		select {
+		case err = <-errc:
+			readDone = true
+		case <-ctx.Done():
+			err = ctx.Err()
+		case <-ping:
+			err = conn.Ping()
+		}
+	}
+
+	cancel()
+	conn.Close()
+	if !readDone {
+		<-errc
+	}
+	r.mu.Lock()
+	r.conn = nil
+	r.authConn = nil
+	for id, ch := range r.pending {
+		close(ch)
+		delete(r.pending, id)
+	}
+	r.mu.Unlock()
+
+	return err
+}
+
+func (r *Realtime) readLoop(ctx context.Context, conn *wsConn) error {
+	for {
+		b, err := conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+
+		var msg rpcMessage
+		if err := json.Unmarshal(b, &msg); err != nil {
+			r.client.log(ctx, slog.LevelWarn, "bitflyer: realtime invalid message", "error", err)
+			continue
+		}
+		if msg.ID != nil {
+			r.mu.Lock()
+			ch, ok := r.pending[*msg.ID]
+			delete(r.pending, *msg.ID)
+			r.mu.Unlock()
+			if ok {
+				ch <- &msg
+			} else if msg.Error != nil {
+				r.client.log(ctx, slog.LevelWarn, "bitflyer: realtime error", "error", msg.Error)
+			}
+			continue
+		}
+		if msg.Method != "channelMessage" {
+			continue
+		}
+
+		var cm channelMessage
+		if err := json.Unmarshal(msg.Params, &cm); err != nil {
+			r.client.log(ctx, slog.LevelWarn, "bitflyer: realtime invalid message", "error", err)
+			continue
+		}
+		r.mu.Lock()
+		subs := r.subs[cm.Channel]
+		r.mu.Unlock()
+		for _, s := range subs {
+			if err := s.deliver(ctx, cm.Message); err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				r.client.log(ctx, slog.LevelWarn, "bitflyer: realtime delivery failed", "channel", cm.Channel, "error", err)
+			}
+		}
+	}
+}
+
+func (r *Realtime) sendSubscribe(conn *wsConn, channel string) error {
+	return r.sendRequest(conn, "subscribe", channel)
+}
+
+// sendRequest はchannelのsubscribeかunsubscribeを送る。応答は待たない
+func (r *Realtime) sendRequest(conn *wsConn, method, channel string) error {
+	r.mu.Lock()
+	r.nextID++
+	id := r.nextID
+	r.mu.Unlock()
+
+	body, err := json.Marshal(&rpcRequest{
+		Version: "2.0",
+		Method:  method,
+		Params:  map[string]string{"channel": channel},
+		ID:      id,
+	})
+	if err != nil {
+		return err
+	}
+
+	return conn.WriteText(body)
+}
+
+// call はリクエストを送り、対応するレスポンスを待つ
+func (r *Realtime) call(ctx context.Context, conn *wsConn, method string, params interface{}) (json.RawMessage, error) {
+	ch := make(chan *rpcMessage, 1)
+	r.mu.Lock()
+	r.nextID++
+	id := r.nextID
+	r.pending[id] = ch
+	r.mu.Unlock()
+
+	body, err := json.Marshal(&rpcRequest{Version: "2.0", Method: method, Params: params, ID: id})
+	if err == nil {
+		err = conn.WriteText(body)
+	}
+	if err != nil {
+		r.mu.Lock()
+		delete(r.pending, id)
+		r.mu.Unlock()
+		return nil, err
+	}
+
+	select {
+	case res, ok := <-ch:
+		if !ok {
+			return nil, errors.New("realtime: connection closed")
+		}
+		if res.Error != nil {
+			return nil, res.Error
+		}
+		return res.Result, nil
+	case <-ctx.Done():
+		r.mu.Lock()
+		delete(r.pending, id)
+		r.mu.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+func (r *Realtime) subscribe(channel string, s *subscription) {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		s.stop()
+		return
+	}
+	_, exists := r.subs[channel]
+	r.subs[channel] = append(r.subs[channel], s)
+	conn := r.conn
+	r.mu.Unlock()
+
+	if conn == nil || exists {
+		return
+	}
+	if isPrivateChannel(channel) {
+		// 認証の応答は読み込みのgoroutineが受け取るので、呼び出し元を待たせない
+		go func() {
+			if r.authenticate(context.Background(), conn) {
+				r.subscribeOn(conn, channel)
+			}
+		}()
+		return
+	}
+	r.subscribeOn(conn, channel)
+}
+
+func (r *Realtime) subscribeOn(conn *wsConn, channel string) {
+	if err := r.sendSubscribe(conn, channel); err != nil {
+		// 次の再接続時に購読し直される
+		r.client.log(context.Background(), slog.LevelWarn, "bitflyer: realtime subscribe failed", "channel", channel, "error", err)
+	}
+}
+
+func (r *Realtime) closeAll() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.closed = true
+	for _, subs := range r.subs {
+		for _, s := range subs {
+			s.stop()
+		}
+	}
+	r.subs = map[string][]*subscription{}
+}
+
+// Unsubscribe はSubscribe...が返したGoチャネルの購読をやめてcloseする。
+// 同じチャネルを購読しているものがなくなれば、取引所への購読もやめる
+func (r *Realtime) Unsubscribe(ch interface{}) {
+	r.mu.Lock()
+	var found *subscription
+	var channel string
+	for c, subs := range r.subs {
+		for i, s := range subs {
+			if s.ch != ch {
+				continue
+			}
+			found, channel = s, c
+			// readLoopが読んでいる配列は書き換えない
+			if rest := append(subs[:i:i], subs[i+1:]...); len(rest) > 0 {
+				r.subs[c] = rest
+			} else {
+				delete(r.subs, c)
+			}
+			break
+		}
+		if found != nil {
+			break
+		}
+	}
+	_, remains := r.subs[channel]
+	conn := r.conn
+	r.mu.Unlock()
+
+	if found == nil {
+		return
+	}
+	found.stop()
+	if conn != nil && !remains {
+		if err := r.sendRequest(conn, "unsubscribe", channel); err != nil {
+			r.client.log(context.Background(), slog.LevelWarn, "bitflyer: realtime unsubscribe failed", "channel", channel, "error", err)
+		}
+	}
+}
+
+// decodeOne は1件のメッセージを1つの値にする
+func decodeOne[T any](message json.RawMessage) ([]*T, error) {
+	var data T
+	if err := json.Unmarshal(message, &data); err != nil {
+		return nil, err
+	}
+	return []*T{&data}, nil
+}
+
+// decodeEach は配列のメッセージを1件ずつの値にする
+func decodeEach[T any](message json.RawMessage) ([]*T, error) {
+	var data []*T
+	if err := json.Unmarshal(message, &data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// ** 板情報のスナップショット
+// 読むのが遅れたら古いスナップショットを捨てる
+func (r *Realtime) SubscribeBoardSnapshot(productCode string) <-chan *Board {
+	ch := make(chan *Board, r.Buffer)
+	r.subscribe("lightning_board_snapshot_"+productCode, newSubscription(ch, true, decodeOne[Board]))
+	return ch
+}
+
+// ** 板情報の差分
+func (r *Realtime) SubscribeBoard(productCode string) <-chan *Board {
+	ch := make(chan *Board, r.Buffer)
+	r.subscribe("lightning_board_"+productCode, newSubscription(ch, false, decodeOne[Board]))
+	return ch
+}
+
+// ** Ticker
+// 読むのが遅れたら古いTickerを捨てる
+func (r *Realtime) SubscribeTicker(productCode string) <-chan *Ticker {
+	ch := make(chan *Ticker, r.Buffer)
+	r.subscribe("lightning_ticker_"+productCode, newSubscription(ch, true, decodeOne[Ticker]))
+	return ch
+}
+
+// ** 約定
+func (r *Realtime) SubscribeExecutions(productCode string) <-chan *Executions {
+	ch := make(chan *Executions, r.Buffer)
+	r.subscribe("lightning_executions_"+productCode, newSubscription(ch, false, decodeOne[Executions]))
+	return ch
+}
+
+// ** デコードしないメッセージ
+// SubscribeRaw はchannel ("lightning_ticker_BTC_JPY" など) のメッセージをそのまま流す。記録などに使うので捨てない
+func (r *Realtime) SubscribeRaw(channel string) <-chan json.RawMessage {
+	ch := make(chan json.RawMessage, r.Buffer)
+	r.subscribe(channel, newSubscription(ch, false, func(message json.RawMessage) ([]json.RawMessage, error) {
+		return []json.RawMessage{message}, nil
+	}))
+	return ch
+}
+
+// * Private channels
+// ** 認証
+type realtimeAuth struct {
+	APIKey    string `json:"api_key"`
+	Timestamp int64  `json:"timestamp"`
+	Nonce     string `json:"nonce"`
+	Signature string `json:"signature"`
+}
+
+func isPrivateChannel(channel string) bool {
+	return channel == "child_order_events" || channel == "parent_order_events"
+}
+
+// authenticate はconnがまだ認証していなければ認証する。失敗したらログに出してfalseを返す
+func (r *Realtime) authenticate(ctx context.Context, conn *wsConn) bool {
+	r.mu.Lock()
+	authed := r.authConn == conn
+	r.mu.Unlock()
+	if authed {
+		return true
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	if err := r.auth(ctx, conn); err != nil {
+		r.client.log(ctx, slog.LevelError, "bitflyer: realtime auth failed", "error", err)
+		return false
+	}
+
+	r.mu.Lock()
+	r.authConn = conn
+	r.mu.Unlock()
+	return true
+}
+
+func (r *Realtime) auth(ctx context.Context, conn *wsConn) error {
+	b := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return err
+	}
+	nonce := hex.EncodeToString(b)
+	timestamp := time.Now().UnixNano() / int64(time.Millisecond)
+	key, sign, err := r.client.signer().Sign(ctx, fmt.Sprintf("%d%s", timestamp, nonce))
+	if err != nil {
+		return err
+	}
+	params := &realtimeAuth{
+		APIKey:    key,
+		Timestamp: timestamp,
+		Nonce:     nonce,
+		Signature: sign,
+	}
+
+	res, err := r.call(ctx, conn, "auth", params)
+	if err != nil {
+		return err
+	}
+	var ok bool
+	if err := json.Unmarshal(res, &ok); err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("realtime: auth failed")
+	}
+
+	return nil
+}
+
+// ** 注文イベント
+type OrderEventType string
+
+const (
+	EventOrder        OrderEventType = "ORDER"
+	EventOrderFailed  OrderEventType = "ORDER_FAILED"
+	EventCancel       OrderEventType = "CANCEL"
+	EventCancelFailed OrderEventType = "CANCEL_FAILED"
+	EventExecution    OrderEventType = "EXECUTION"
+	EventExpire       OrderEventType = "EXPIRE"
+	EventTrigger      OrderEventType = "TRIGGER"
+	EventComplete     OrderEventType = "COMPLETE"
+)
+
+type ChildOrderEvent struct {
+	ProductCode            string         `json:"product_code"`
+	ChildOrderID           string         `json:"child_order_id"`
+	ChildOrderAcceptanceID string         `json:"child_order_acceptance_id"`
+	EventDate              Time           `json:"event_date"`
+	EventType              OrderEventType `json:"event_type"`
+	ChildOrderType         OrderType      `json:"child_order_type,omitempty"`
+	ExpireDate             Time           `json:"expire_date,omitzero"`
+	Reason                 string         `json:"reason,omitempty"`
+	ExecID                 int            `json:"exec_id,omitempty"`
+	Side                   Side           `json:"side,omitempty"`
+	Price                  Decimal        `json:"price,omitzero"`
+	Size                   Decimal        `json:"size,omitzero"`
+	Commission             Decimal        `json:"commission,omitzero"`
+	SFD                    Decimal        `json:"sfd,omitzero"`
+}
+
+type ParentOrderEvent struct {
+	ProductCode             string         `json:"product_code"`
+	ParentOrderID           string         `json:"parent_order_id"`
+	ParentOrderAcceptanceID string         `json:"parent_order_acceptance_id"`
+	EventDate               Time           `json:"event_date"`
+	EventType               OrderEventType `json:"event_type"`
+	ParentOrderType         string         `json:"parent_order_type,omitempty"`
+	Reason                  string         `json:"reason,omitempty"`
+	ChildOrderType          OrderType      `json:"child_order_type,omitempty"`
+	ParameterIndex          int            `json:"parameter_index,omitempty"`
+	ChildOrderAcceptanceID  string         `json:"child_order_acceptance_id,omitempty"`
+	Side                    Side           `json:"side,omitempty"`
+	Price                   Decimal        `json:"price,omitzero"`
+	Size                    Decimal        `json:"size,omitzero"`
+	ExpireDate              Time           `json:"expire_date,omitzero"`
+}
+
+// SubscribeChildOrderEvents は自分の注文のイベントを1件ずつ配信する。ClientにAPIキーが必要
+func (r *Realtime) SubscribeChildOrderEvents() <-chan *ChildOrderEvent {
+	ch := make(chan *ChildOrderEvent, r.Buffer)
+	r.subscribe("child_order_events", newSubscription(ch, false, decodeEach[ChildOrderEvent]))
+	return ch
+}
+
+// SubscribeParentOrderEvents は自分の親注文のイベントを1件ずつ配信する。ClientにAPIキーが必要
+func (r *Realtime) SubscribeParentOrderEvents() <-chan *ParentOrderEvent {
+	ch := make(chan *ParentOrderEvent, r.Buffer)
+	r.subscribe("parent_order_events", newSubscription(ch, false, decodeEach[ParentOrderEvent]))
+	return ch
+}
@@ -0,0 +1,333 @@
+package bitflyer_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jackpopper/bitflyer"
+	"github.com/jackpopper/bitflyer/bitflyertest"
+)
+
+func startRealtime(t *testing.T, c *bitflyer.Client) (*bitflyertest.RealtimeServer, *bitflyer.Realtime, context.Context, context.CancelFunc) {
+	t.Helper()
+	s := bitflyertest.NewRealtimeServer()
+	t.Cleanup(s.Close)
+	rt := s.Realtime(c)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+	return s, rt, ctx, cancel
+}
+
+func run(ctx context.Context, rt *bitflyer.Realtime) <-chan error {
+	done := make(chan error, 1)
+	go func() { done <- rt.Run(ctx) }()
+	return done
+}
+
+func receive[T any](t *testing.T, ctx context.Context, ch <-chan T) T {
+	t.Helper()
+	select {
+	case v, ok := <-ch:
+		if !ok {
+			t.Fatal("channel closed")
+		}
+		return v
+	case <-ctx.Done():
+		t.Fatal(ctx.Err())
+	}
+	panic("unreachable")
+}
+
+func TestRealtimeSubscribe(t *testing.T) {
+	s, rt, ctx, cancel := startRealtime(t, bitflyer.NewClient("", ""))
+	ticker := rt.SubscribeTicker("BTC_JPY")
+	execs := rt.SubscribeExecutions("BTC_JPY")
+	board := rt.SubscribeBoardSnapshot("BTC_JPY")
+	done := run(ctx, rt)
+
+	channels := []string{"lightning_ticker_BTC_JPY", "lightning_executions_BTC_JPY", "lightning_board_snapshot_BTC_JPY"}
+	if err := s.Wait(ctx, func() bool {
+		for _, ch := range channels {
+			if !s.Subscribed(ch) {
+				return false
+			}
+		}
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	s.Publish("lightning_ticker_BTC_JPY", json.RawMessage(`{"product_code":"BTC_JPY","tick_id":42,"ltp":10000000}`))
+	if tk := receive(t, ctx, ticker); tk.ProductCode != "BTC_JPY" || tk.TickID != 42 {
+		t.Errorf("ticker = %+v", tk)
+	}
+
+	s.Publish("lightning_executions_BTC_JPY", json.RawMessage(`[{"id":1,"side":"BUY","price":100,"size":0.1},{"id":2,"side":"SELL","price":99,"size":0.2}]`))
+	if e := receive(t, ctx, execs); len(*e) != 2 || (*e)[1].ID != 2 || (*e)[1].Side != bitflyer.SideSell {
+		t.Errorf("executions = %+v", e)
+	}
+
+	// 126バイト以上と65536バイト以上のフレーム長を通す
+	for _, n := range []int{10, 1000, 5000} {
+		levels := make([]string, n)
+		for i := range levels {
+			levels[i] = fmt.Sprintf(`{"price":%d,"size":0.01}`, 10000000-i)
+		}
+		s.Publish("lightning_board_snapshot_BTC_JPY", json.RawMessage(`{"mid_price":10000000,"bids":[`+strings.Join(levels, ",")+`],"asks":[]}`))
+		if b := receive(t, ctx, board); len(b.Bids) != n {
+			t.Errorf("bids = %d, want %d", len(b.Bids), n)
+		}
+	}
+
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Errorf("Run = %v, want %v", err, context.Canceled)
+	}
+	for _, ok := range []bool{isOpen(ticker), isOpen(execs), isOpen(board)} {
+		if ok {
+			t.Error("channel is not closed after Run returned")
+		}
+	}
+}
+
+func isOpen[T any](ch <-chan T) bool {
+	for {
+		select {
+		case _, ok := <-ch:
+			if !ok {
+				return false
+			}
+		case <-time.After(time.Second):
+			return true
+		}
+	}
+}
+
+func TestRealtimeSubscribeWhileRunning(t *testing.T) {
+	s, rt, ctx, _ := startRealtime(t, bitflyer.NewClient("", ""))
+	run(ctx, rt)
+	if err := s.Wait(ctx, func() bool { return s.Connects() == 1 }); err != nil {
+		t.Fatal(err)
+	}
+
+	raw := rt.SubscribeRaw("lightning_ticker_FX_BTC_JPY")
+	if err := s.Wait(ctx, func() bool { return s.Subscribed("lightning_ticker_FX_BTC_JPY") }); err != nil {
+		t.Fatal(err)
+	}
+	s.Publish("lightning_ticker_FX_BTC_JPY", json.RawMessage(`{"tick_id":1}`))
+	if m := receive(t, ctx, raw); string(m) != `{"tick_id":1}` {
+		t.Errorf("message = %s", m)
+	}
+}
+
+func TestRealtimeReconnect(t *testing.T) {
+	s, rt, ctx, _ := startRealtime(t, bitflyer.NewClient("", ""))
+	ticker := rt.SubscribeTicker("BTC_JPY")
+	run(ctx, rt)
+
+	for i := 1; i <= 3; i++ {
+		if err := s.Wait(ctx, func() bool { return s.Connects() == i && s.Subscribed("lightning_ticker_BTC_JPY") }); err != nil {
+			t.Fatalf("connect %d: %v", i, err)
+		}
+		s.Publish("lightning_ticker_BTC_JPY", json.RawMessage(fmt.Sprintf(`{"tick_id":%d}`, i)))
+		if tk := receive(t, ctx, ticker); tk.TickID != i {
+			t.Errorf("tick_id = %d, want %d", tk.TickID, i)
+		}
+		s.Disconnect()
+	}
+}
+
+func TestRealtimePing(t *testing.T) {
+	s, rt, ctx, _ := startRealtime(t, bitflyer.NewClient("", ""))
+	rt.PingInterval = 20 * time.Millisecond
+	run(ctx, rt)
+
+	if err := s.Wait(ctx, func() bool { return s.Pings() >= 3 }); err != nil {
+		t.Fatal(err)
+	}
+	if n := s.Connects(); n != 1 {
+		t.Errorf("connects = %d, want 1", n)
+	}
+}
+
+func TestRealtimePingTimeout(t *testing.T) {
+	s, rt, ctx, _ := startRealtime(t, bitflyer.NewClient("", ""))
+	s.SetPong(false)
+	rt.PingInterval = 20 * time.Millisecond
+	run(ctx, rt)
+
+	// pongが返らなければ読み込みが時間切れになり、つなぎ直す
+	if err := s.Wait(ctx, func() bool { return s.Connects() >= 2 }); err != nil {
+		t.Fatal(err)
+	}
+}
+
+type countingSigner struct {
+	bitflyer.Signer
+	n atomic.Int32
+}
+
+func (s *countingSigner) Sign(ctx context.Context, message string) (string, string, error) {
+	s.n.Add(1)
+	return s.Signer.Sign(ctx, message)
+}
+
+func TestRealtimePrivate(t *testing.T) {
+	s, rt, ctx, _ := startRealtime(t, bitflyer.NewClient(bitflyertest.DefaultAPIKey, bitflyertest.DefaultAPISecret))
+	events := rt.SubscribeChildOrderEvents()
+	run(ctx, rt)
+
+	if err := s.Wait(ctx, func() bool { return s.Subscribed("child_order_events") }); err != nil {
+		t.Fatal(err)
+	}
+	s.Publish("child_order_events", json.RawMessage(`[
+		{"product_code":"BTC_JPY","child_order_acceptance_id":"JRF1","event_type":"ORDER","side":"BUY","price":100,"size":0.1},
+		{"product_code":"BTC_JPY","child_order_acceptance_id":"JRF1","event_type":"EXECUTION","exec_id":7,"price":100,"size":0.1}
+	]`))
+	if ev := receive(t, ctx, events); ev.EventType != bitflyer.EventOrder || !ev.Size.Equal(bitflyer.MustDecimal("0.1")) {
+		t.Errorf("event = %+v", ev)
+	}
+	if ev := receive(t, ctx, events); ev.EventType != bitflyer.EventExecution || ev.ExecID != 7 {
+		t.Errorf("event = %+v", ev)
+	}
+}
+
+func TestRealtimePublicDoesNotAuthenticate(t *testing.T) {
+	c := bitflyer.NewClient(bitflyertest.DefaultAPIKey, bitflyertest.DefaultAPISecret)
+	signer := &countingSigner{Signer: &bitflyer.HMACSigner{Credentials: bitflyer.StaticCredentials{APIKey: c.APIKey, APISecret: c.APISecret}}}
+	c.Signer = signer
+	s, rt, ctx, _ := startRealtime(t, c)
+	rt.SubscribeTicker("BTC_JPY")
+	run(ctx, rt)
+
+	if err := s.Wait(ctx, func() bool { return s.Subscribed("lightning_ticker_BTC_JPY") }); err != nil {
+		t.Fatal(err)
+	}
+	if n := signer.n.Load(); n != 0 {
+		t.Errorf("signed %d times, want 0", n)
+	}
+
+	// 接続中にPrivate channelを購読すると、そこで認証する
+	rt.SubscribeParentOrderEvents()
+	if err := s.Wait(ctx, func() bool { return s.Subscribed("parent_order_events") }); err != nil {
+		t.Fatal(err)
+	}
+	if n := signer.n.Load(); n != 1 {
+		t.Errorf("signed %d times, want 1", n)
+	}
+}
+
+func TestRealtimeAuthFailure(t *testing.T) {
+	tests := []struct {
+		name string
+		c    *bitflyer.Client
+	}{
+		{"wrong key", bitflyer.NewClient("wrong", "wrong")},
+		{"no credentials", &bitflyer.Client{Credentials: bitflyer.EnvCredentials{KeyVar: "BITFLYER_TEST_UNSET_KEY", SecretVar: "BITFLYER_TEST_UNSET_SECRET"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, rt, ctx, _ := startRealtime(t, tt.c)
+			ticker := rt.SubscribeTicker("BTC_JPY")
+			rt.SubscribeChildOrderEvents()
+			run(ctx, rt)
+
+			// 認証できなくてもPublic channelsは購読し、接続を保つ
+			if err := s.Wait(ctx, func() bool { return s.Subscribed("lightning_ticker_BTC_JPY") }); err != nil {
+				t.Fatal(err)
+			}
+			s.Publish("lightning_ticker_BTC_JPY", json.RawMessage(`{"tick_id":1}`))
+			receive(t, ctx, ticker)
+			if s.Subscribed("child_order_events") {
+				t.Error("child_order_events subscribed without auth")
+			}
+			if n := s.Connects(); n != 1 {
+				t.Errorf("connects = %d, want 1", n)
+			}
+		})
+	}
+}
+
+// 読まれないGoチャネルがあっても、他のチャネルの配信は止まらない
+func TestRealtimeSlowSubscriber(t *testing.T) {
+	s, rt, ctx, _ := startRealtime(t, bitflyer.NewClient("", ""))
+	rt.Buffer = 1
+	ticker := rt.SubscribeTicker("BTC_JPY")
+	abandoned := rt.SubscribeExecutions("BTC_JPY")
+	execs := rt.SubscribeExecutions("FX_BTC_JPY")
+	run(ctx, rt)
+	if err := s.Wait(ctx, func() bool {
+		return s.Subscribed("lightning_ticker_BTC_JPY") && s.Subscribed("lightning_executions_BTC_JPY") && s.Subscribed("lightning_executions_FX_BTC_JPY")
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Tickerは古いものを捨てて最新を残す
+	for i := 1; i <= 5; i++ {
+		s.Publish("lightning_ticker_BTC_JPY", json.RawMessage(fmt.Sprintf(`{"tick_id":%d}`, i)))
+	}
+	s.Publish("lightning_executions_FX_BTC_JPY", json.RawMessage(`[{"id":1}]`))
+	if e := receive(t, ctx, execs); (*e)[0].ID != 1 {
+		t.Errorf("executions = %+v", e)
+	}
+	if tk := receive(t, ctx, ticker); tk.TickID != 5 {
+		t.Errorf("tick_id = %d, want the latest", tk.TickID)
+	}
+
+	// 読まれない約定のチャネルが一杯になると配信が止まり、Unsubscribeすれば動き出す
+	for i := 1; i <= 3; i++ {
+		s.Publish("lightning_executions_BTC_JPY", json.RawMessage(fmt.Sprintf(`[{"id":%d}]`, i)))
+	}
+	s.Publish("lightning_executions_FX_BTC_JPY", json.RawMessage(`[{"id":2}]`))
+	rt.Unsubscribe(abandoned)
+	if e := receive(t, ctx, execs); (*e)[0].ID != 2 {
+		t.Errorf("executions = %+v", e)
+	}
+	if isOpen(abandoned) {
+		t.Error("channel is not closed after Unsubscribe")
+	}
+	if err := s.Wait(ctx, func() bool { return !s.Subscribed("lightning_executions_BTC_JPY") }); err != nil {
+		t.Errorf("still subscribed: %v", err)
+	}
+}
+
+func TestRealtimeUnsubscribe(t *testing.T) {
+	s, rt, ctx, _ := startRealtime(t, bitflyer.NewClient("", ""))
+	a := rt.SubscribeTicker("BTC_JPY")
+	b := rt.SubscribeTicker("BTC_JPY")
+	run(ctx, rt)
+	if err := s.Wait(ctx, func() bool { return s.Subscribed("lightning_ticker_BTC_JPY") }); err != nil {
+		t.Fatal(err)
+	}
+
+	// 同じチャネルを購読しているものが残れば取引所への購読は続ける
+	rt.Unsubscribe(a)
+	rt.Unsubscribe(a)
+	if isOpen(a) {
+		t.Error("channel is not closed after Unsubscribe")
+	}
+	s.Publish("lightning_ticker_BTC_JPY", json.RawMessage(`{"tick_id":1}`))
+	if tk := receive(t, ctx, b); tk.TickID != 1 {
+		t.Errorf("tick_id = %d", tk.TickID)
+	}
+
+	rt.Unsubscribe(b)
+	if err := s.Wait(ctx, func() bool { return !s.Subscribed("lightning_ticker_BTC_JPY") }); err != nil {
+		t.Errorf("still subscribed: %v", err)
+	}
+	// 購読し直せる
+	c := rt.SubscribeTicker("BTC_JPY")
+	if err := s.Wait(ctx, func() bool { return s.Subscribed("lightning_ticker_BTC_JPY") }); err != nil {
+		t.Fatal(err)
+	}
+	s.Publish("lightning_ticker_BTC_JPY", json.RawMessage(`{"tick_id":2}`))
+	if tk := receive(t, ctx, c); tk.TickID != 2 {
+		t.Errorf("tick_id = %d", tk.TickID)
+	}
+}
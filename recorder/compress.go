@@ -0,0 +1,58 @@
+package recorder
+
+import (
+	"compress/gzip"
+	"io"
+	"sync"
+)
+
+// Compressor はファイルの圧縮形式。標準ライブラリにないzstdなどはRegisterCompressorで加える
+type Compressor interface {
+	// Name はマニフェストに書く名前 ("gzip", "zstd" など)
+	Name() string
+	// Ext はファイルの拡張子 (".gz" など)
+	Ext() string
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+// Gzip はcompress/gzipによる圧縮
+var Gzip Compressor = gzipCompressor{}
+
+type gzipCompressor struct{}
+
+func (gzipCompressor) Name() string {
+	return "gzip"
+}
+
+func (gzipCompressor) Ext() string {
+	return ".gz"
+}
+
+func (gzipCompressor) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriter(w), nil
+}
+
+func (gzipCompressor) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+var (
+	compressorsMu sync.RWMutex
+	compressors   = map[string]Compressor{"gzip": Gzip}
+)
+
+// RegisterCompressor はReaderがマニフェストの名前から圧縮形式を引けるようにする
+func RegisterCompressor(c Compressor) {
+	compressorsMu.Lock()
+	compressors[c.Name()] = c
+	compressorsMu.Unlock()
+}
+
+func lookupCompressor(name string) (Compressor, bool) {
+	compressorsMu.RLock()
+	defer compressorsMu.RUnlock()
+
+	c, ok := compressors[name]
+	return c, ok
+}
@@ -0,0 +1,171 @@
+package recorder
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/jackpopper/bitflyer"
+)
+
+// * 再生
+
+// Message は記録したメッセージ1件
+type Message struct {
+	// 受け取った時刻
+	Time        time.Time
+	Channel     string
+	Kind        Kind
+	ProductCode string
+	Data        json.RawMessage
+}
+
+func (m *Message) Board() (*bitflyer.Board, error) {
+	var data bitflyer.Board
+	if err := m.decode(&data, KindBoardSnapshot, KindBoard); err != nil {
+		return nil, err
+	}
+	return &data, nil
+}
+
+func (m *Message) Ticker() (*bitflyer.Ticker, error) {
+	var data bitflyer.Ticker
+	if err := m.decode(&data, KindTicker); err != nil {
+		return nil, err
+	}
+	return &data, nil
+}
+
+func (m *Message) Executions() (*bitflyer.Executions, error) {
+	var data bitflyer.Executions
+	if err := m.decode(&data, KindExecutions); err != nil {
+		return nil, err
+	}
+	return &data, nil
+}
+
+// Decode はKindに応じて*bitflyer.Board, *bitflyer.Ticker, *bitflyer.Executionsのどれかを返す
+func (m *Message) Decode() (interface{}, error) {
+	switch m.Kind {
+	case KindBoardSnapshot, KindBoard:
+		return m.Board()
+	case KindTicker:
+		return m.Ticker()
+	case KindExecutions:
+		return m.Executions()
+	}
+	return nil, fmt.Errorf("recorder: unknown channel %q", m.Channel)
+}
+
+func (m *Message) decode(v interface{}, kinds ...Kind) error {
+	for _, k := range kinds {
+		if m.Kind == k {
+			return json.Unmarshal(m.Data, v)
+		}
+	}
+	return fmt.Errorf("recorder: %s is not %s", m.Channel, kinds[0])
+}
+
+type Reader struct {
+	Dir string
+	// 読む銘柄と種類。空ならすべて
+	Products []string
+	Kinds    []Kind
+	// この期間に受け取ったメッセージだけを読む。ゼロ値なら制限しない
+	Since time.Time
+	Until time.Time
+}
+
+func NewReader(dir string) *Reader {
+	return &Reader{Dir: dir}
+}
+
+// Read はマニフェストのファイルを順に読み、記録した順にfnへ渡す。
+// 書きかけのファイルは途中で切れていれば、そこまでを読む
+func (r *Reader) Read(fn func(m *Message) error) error {
+	m, err := LoadManifest(r.Dir)
+	if err != nil {
+		return err
+	}
+
+	for _, info := range m.Files {
+		if !r.Until.IsZero() && info.Start.After(r.Until) {
+			break
+		}
+		if !r.Since.IsZero() && !info.End.IsZero() && info.End.Before(r.Since) {
+			continue
+		}
+		if err := r.readFile(info, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Reader) readFile(info FileInfo, fn func(m *Message) error) error {
+	c, ok := lookupCompressor(info.Compression)
+	if !ok {
+		return fmt.Errorf("recorder: %s: unknown compression %q", info.File, info.Compression)
+	}
+	f, err := os.Open(filepath.Join(r.Dir, info.File))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	zr, err := c.NewReader(f)
+	if err != nil {
+		if info.End.IsZero() && errors.Is(err, io.EOF) {
+			return nil
+		}
+		return fmt.Errorf("recorder: %s: %v", info.File, err)
+	}
+	defer zr.Close()
+
+	dec := json.NewDecoder(zr)
+	for {
+		var rec record
+		err := dec.Decode(&rec)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			if info.End.IsZero() && errors.Is(err, io.ErrUnexpectedEOF) {
+				return nil
+			}
+			return fmt.Errorf("recorder: %s: %v", info.File, err)
+		}
+
+		kind, product := parseChannel(rec.Channel)
+		if !r.match(rec.Time, kind, product) {
+			continue
+		}
+		msg := &Message{Time: rec.Time, Channel: rec.Channel, Kind: kind, ProductCode: product, Data: rec.Message}
+		if err := fn(msg); err != nil {
+			return err
+		}
+	}
+}
+
+func (r *Reader) match(t time.Time, kind Kind, product string) bool {
+	if (!r.Since.IsZero() && t.Before(r.Since)) || (!r.Until.IsZero() && t.After(r.Until)) {
+		return false
+	}
+	if len(r.Products) > 0 && !contains(r.Products, product) {
+		return false
+	}
+	return len(r.Kinds) == 0 || contains(r.Kinds, kind)
+}
+
+func contains[T comparable](s []T, v T) bool {
+	for _, x := range s {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
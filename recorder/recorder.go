@@ -0,0 +1,489 @@
+// Package recorder records bitFlyer market data to compressed files and replays it
+// 相場情報を圧縮したJSONLファイルに記録し、Clientと同じ型で再生する
+package recorder
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jackpopper/bitflyer"
+)
+
+// * 記録
+// 1行に1メッセージを {"time", "channel", "message"} のJSONで書く。
+// channelはRealtime APIのチャネル名で、messageはRealtime APIかHTTP APIの応答そのもの。
+// ファイルはRotateIntervalかMaxFileSizeごとに切り替え、manifest.jsonに一覧を書く
+
+const (
+	manifestFile         = "manifest.json"
+	defaultPollInterval  = 5 * time.Second
+	defaultFlushInterval = time.Second
+	// pollCount はHTTP APIで1度に読む約定の数(上限)
+	pollCount = 500
+)
+
+// Kind は記録する相場情報の種類
+type Kind string
+
+const (
+	KindBoardSnapshot Kind = "board_snapshot"
+	KindBoard         Kind = "board"
+	KindTicker        Kind = "ticker"
+	KindExecutions    Kind = "executions"
+)
+
+// allKinds はboard_snapshotをboardより先に調べる順
+var allKinds = []Kind{KindBoardSnapshot, KindBoard, KindTicker, KindExecutions}
+
+// Channel はRealtime APIのチャネル名
+func Channel(kind Kind, productCode string) string {
+	return "lightning_" + string(kind) + "_" + productCode
+}
+
+func parseChannel(channel string) (Kind, string) {
+	name := strings.TrimPrefix(channel, "lightning_")
+	for _, k := range allKinds {
+		if prefix := string(k) + "_"; strings.HasPrefix(name, prefix) {
+			return k, name[len(prefix):]
+		}
+	}
+	return "", ""
+}
+
+type Recorder struct {
+	Client *bitflyer.Client
+	// ファイルとマニフェストを書くディレクトリ
+	Dir string
+	// 記録する銘柄。空ならGetMarketsのすべて
+	Products []string
+	// 記録する種類。空ならすべて
+	Kinds []Kind
+	// 設定すればRealtime APIを購読する。Realtime.Runは別に呼ぶ。
+	// nilならPollIntervalごとにHTTP APIを呼ぶ。板の差分はRealtime APIでしか記録できない
+	Realtime *bitflyer.Realtime
+	// 0以下なら5秒
+	PollInterval time.Duration
+	// nilならGzip
+	Compressor Compressor
+	// ファイルを切り替える間隔と、圧縮前の大きさ。0なら切り替えない
+	RotateInterval time.Duration
+	MaxFileSize    int64
+	// 書いたメッセージを圧縮してファイルに出す間隔。0以下なら1秒
+	FlushInterval time.Duration
+}
+
+// Manifest は記録したファイルの一覧。古い順に並ぶ
+type Manifest struct {
+	Files []FileInfo `json:"files"`
+}
+
+type FileInfo struct {
+	File        string    `json:"file"`
+	Compression string    `json:"compression"`
+	Start       time.Time `json:"start"`
+	// 書き終えていなければゼロ値
+	End      time.Time `json:"end,omitzero"`
+	Messages int       `json:"messages"`
+	// 圧縮前の大きさ
+	Bytes int64 `json:"bytes"`
+	// チャネルごとのメッセージ数
+	Channels map[string]int `json:"channels"`
+}
+
+type record struct {
+	Time    time.Time       `json:"time"`
+	Channel string          `json:"channel"`
+	Message json.RawMessage `json:"message"`
+}
+
+func NewRecorder(c *bitflyer.Client, dir string) *Recorder {
+	return &Recorder{
+		Client:         c,
+		Dir:            dir,
+		PollInterval:   defaultPollInterval,
+		Compressor:     Gzip,
+		RotateInterval: time.Hour,
+		FlushInterval:  defaultFlushInterval,
+	}
+}
+
+// Run はctxが終わるまで記録し、書きかけのファイルを閉じて戻る。
+// 以前の記録があればマニフェストに追記する
+func (r *Recorder) Run(ctx context.Context) error {
+	if err := os.MkdirAll(r.Dir, 0755); err != nil {
+		return err
+	}
+	products, err := r.products(ctx)
+	if err != nil {
+		return err
+	}
+	m, err := LoadManifest(r.Dir)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	records := make(chan *record, 256)
+	if r.Realtime != nil {
+		r.subscribe(ctx, products, records)
+	} else {
+		go r.poll(ctx, products, records)
+	}
+
+	w := &writer{r: r, m: m}
+	return w.loop(ctx, records)
+}
+
+func (r *Recorder) products(ctx context.Context) ([]string, error) {
+	if len(r.Products) > 0 {
+		return r.Products, nil
+	}
+	markets, err := r.Client.GetMarkets(ctx)
+	if err != nil {
+		return nil, err
+	}
+	products := make([]string, 0, len(*markets))
+	for _, m := range *markets {
+		products = append(products, m.ProductCode)
+	}
+	return products, nil
+}
+
+func (r *Recorder) kinds() []Kind {
+	if len(r.Kinds) > 0 {
+		return r.Kinds
+	}
+	return allKinds
+}
+
+func (r *Recorder) warn(ctx context.Context, msg string, args ...interface{}) {
+	if l := r.Client.Logger; l != nil && l.Enabled(ctx, slog.LevelWarn) {
+		l.Log(ctx, slog.LevelWarn, msg, args...)
+	}
+}
+
+func send(ctx context.Context, out chan<- *record, rec *record) bool {
+	select {
+	case out <- rec:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// ** Realtime API
+func (r *Recorder) subscribe(ctx context.Context, products []string, out chan<- *record) {
+	for _, p := range products {
+		for _, k := range r.kinds() {
+			channel := Channel(k, p)
+			in := r.Realtime.SubscribeRaw(channel)
+			go func() {
+				// 読まなくなったチャネルに配信が詰まらないよう、終わるときに購読をやめる
+				defer r.Realtime.Unsubscribe(in)
+				for {
+					select {
+					case msg, ok := <-in:
+						if !ok || !send(ctx, out, &record{Time: time.Now().UTC(), Channel: channel, Message: msg}) {
+							return
+						}
+					case <-ctx.Done():
+						return
+					}
+				}
+			}()
+		}
+	}
+}
+
+// ** HTTP API
+func (r *Recorder) poll(ctx context.Context, products []string, out chan<- *record) {
+	interval := r.PollInterval
+	if interval <= 0 {
+		interval = defaultPollInterval
+	}
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+
+	lastIDs := map[string]int{}
+	for {
+		for _, p := range products {
+			for _, k := range r.kinds() {
+				msg, err := r.fetch(ctx, k, p, lastIDs)
+				if err != nil {
+					if ctx.Err() != nil {
+						return
+					}
+					r.warn(ctx, "recorder: poll failed", "channel", Channel(k, p), "error", err)
+					continue
+				}
+				if msg != nil && !send(ctx, out, &record{Time: time.Now().UTC(), Channel: Channel(k, p), Message: msg}) {
+					return
+				}
+			}
+		}
+
+		select {
+		case <-tick.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// fetch はkindの応答をJSONにする。約定は前回より新しいものだけを古い順に返し、なければnil
+func (r *Recorder) fetch(ctx context.Context, kind Kind, productCode string, lastIDs map[string]int) (json.RawMessage, error) {
+	switch kind {
+	case KindBoardSnapshot:
+		board, err := r.Client.GetBoard(ctx, productCode)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(board)
+	case KindTicker:
+		ticker, err := r.Client.GetTicker(ctx, productCode)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(ticker)
+	case KindExecutions:
+		execs, err := r.executions(ctx, productCode, lastIDs[productCode])
+		if err != nil {
+			return nil, err
+		}
+		if len(execs) == 0 {
+			return nil, nil
+		}
+		lastIDs[productCode] = execs[len(execs)-1].ID
+		return json.Marshal(execs)
+	}
+	return nil, nil
+}
+
+// executions はafterより新しい約定を古い順に返す。新しい方から1ページずつ返ってくるので、
+// ページが一杯なら残りをbeforeで古い方へ読み足す。afterが0の初回は最新の1ページだけ
+func (r *Recorder) executions(ctx context.Context, productCode string, after int) (bitflyer.Executions, error) {
+	var all bitflyer.Executions
+	page := &bitflyer.Page{Count: pollCount, After: after}
+	for {
+		execs, err := r.Client.GetExecutions(ctx, productCode, page)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, *execs...)
+		if after == 0 || len(*execs) < page.Count {
+			break
+		}
+		before := (*execs)[0].ID
+		for _, e := range *execs {
+			if e.ID < before {
+				before = e.ID
+			}
+		}
+		page = &bitflyer.Page{Count: pollCount, Before: before, After: after}
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].ID < all[j].ID })
+	return all, nil
+}
+
+// ** ファイル
+type writer struct {
+	r *Recorder
+	m *Manifest
+
+	f      *os.File
+	zw     io.WriteCloser
+	bw     *bufio.Writer
+	bucket time.Time
+	last   time.Time
+}
+
+func (w *writer) loop(ctx context.Context, records <-chan *record) error {
+	interval := w.r.FlushInterval
+	if interval <= 0 {
+		interval = defaultFlushInterval
+	}
+	flush := time.NewTicker(interval)
+	defer flush.Stop()
+
+	for {
+		select {
+		case rec := <-records:
+			if err := w.write(rec); err != nil {
+				w.close()
+				return err
+			}
+		case <-flush.C:
+			if err := w.flush(); err != nil {
+				w.close()
+				return err
+			}
+		case <-ctx.Done():
+			if err := w.close(); err != nil {
+				return err
+			}
+			return ctx.Err()
+		}
+	}
+}
+
+func (w *writer) info() *FileInfo {
+	return &w.m.Files[len(w.m.Files)-1]
+}
+
+func (w *writer) write(rec *record) error {
+	if w.f != nil && w.rotate(rec.Time) {
+		if err := w.close(); err != nil {
+			return err
+		}
+	}
+	if w.f == nil {
+		if err := w.open(rec.Time); err != nil {
+			return err
+		}
+	}
+
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	if _, err := w.bw.Write(b); err != nil {
+		return err
+	}
+
+	info := w.info()
+	info.Messages++
+	info.Bytes += int64(len(b))
+	info.Channels[rec.Channel]++
+	w.last = rec.Time
+
+	return nil
+}
+
+func (w *writer) rotate(t time.Time) bool {
+	if d := w.r.RotateInterval; d > 0 && !t.Truncate(d).Equal(w.bucket) {
+		return true
+	}
+	return w.r.MaxFileSize > 0 && w.info().Bytes >= w.r.MaxFileSize
+}
+
+func (w *writer) open(t time.Time) error {
+	c := w.r.Compressor
+	if c == nil {
+		c = Gzip
+	}
+
+	base := "market_" + t.UTC().Format("20060102T150405Z")
+	name := base + ".jsonl" + c.Ext()
+	for i := 1; ; i++ {
+		if _, err := os.Stat(filepath.Join(w.r.Dir, name)); errors.Is(err, os.ErrNotExist) {
+			break
+		}
+		name = fmt.Sprintf("%s_%d.jsonl%s", base, i, c.Ext())
+	}
+
+	f, err := os.Create(filepath.Join(w.r.Dir, name))
+	if err != nil {
+		return err
+	}
+	zw, err := c.NewWriter(f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w.f, w.zw, w.bw = f, zw, bufio.NewWriter(zw)
+	if w.r.RotateInterval > 0 {
+		w.bucket = t.Truncate(w.r.RotateInterval)
+	}
+
+	w.m.Files = append(w.m.Files, FileInfo{File: name, Compression: c.Name(), Start: t, Channels: map[string]int{}})
+	return w.m.save(w.r.Dir)
+}
+
+// flush は書いたメッセージを圧縮してファイルに出す。途中で止まっても読めるところまでは残る
+func (w *writer) flush() error {
+	if w.f == nil {
+		return nil
+	}
+	if err := w.bw.Flush(); err != nil {
+		return err
+	}
+	if f, ok := w.zw.(interface{ Flush() error }); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+func (w *writer) close() error {
+	if w.f == nil {
+		return nil
+	}
+	f := w.f
+	w.f = nil
+
+	err := w.bw.Flush()
+	if e := w.zw.Close(); err == nil {
+		err = e
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		return err
+	}
+
+	w.info().End = w.last
+	return w.m.save(w.r.Dir)
+}
+
+// ** マニフェスト
+// LoadManifest はdirのマニフェストを読む。なければ空
+func LoadManifest(dir string) (*Manifest, error) {
+	b, err := os.ReadFile(filepath.Join(dir, manifestFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return &Manifest{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var m Manifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, fmt.Errorf("recorder: %s: %v", manifestFile, err)
+	}
+	return &m, nil
+}
+
+// save は一時ファイルに書いてからrenameする
+func (m *Manifest) save(dir string) error {
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, "."+manifestFile+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filepath.Join(dir, manifestFile))
+}
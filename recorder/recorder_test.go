@@ -0,0 +1,244 @@
+package recorder_test
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jackpopper/bitflyer"
+	"github.com/jackpopper/bitflyer/bitflyertest"
+	"github.com/jackpopper/bitflyer/recorder"
+)
+
+func newServer(t *testing.T) *bitflyertest.Server {
+	t.Helper()
+	s := bitflyertest.NewServer()
+	t.Cleanup(s.Close)
+	s.SetBoard("BTC_JPY", &bitflyer.Board{
+		Bids: []bitflyer.PriceLevel{{Price: bitflyer.MustDecimal("99"), Size: bitflyer.MustDecimal("1")}},
+		Asks: []bitflyer.PriceLevel{{Price: bitflyer.MustDecimal("101"), Size: bitflyer.MustDecimal("1")}},
+	})
+	s.AddExecutions("BTC_JPY",
+		bitflyer.Execution{Price: bitflyer.MustDecimal("100"), Size: bitflyer.MustDecimal("1")},
+		bitflyer.Execution{Price: bitflyer.MustDecimal("101"), Size: bitflyer.MustDecimal("2")},
+	)
+	return s
+}
+
+func record(t *testing.T, r *recorder.Recorder, d time.Duration, during func()) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	defer cancel()
+	if during != nil {
+		go during()
+	}
+	if err := r.Run(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Run = %v", err)
+	}
+}
+
+func saveManifest(t *testing.T, dir string, m *recorder.Manifest) {
+	t.Helper()
+	b, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "manifest.json"), b, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRecordAndRead(t *testing.T) {
+	s := newServer(t)
+	dir := t.TempDir()
+	r := recorder.NewRecorder(s.Client(), dir)
+	r.Products = []string{"BTC_JPY"}
+	r.PollInterval = 20 * time.Millisecond
+	r.MaxFileSize = 600
+	record(t, r, 150*time.Millisecond, func() {
+		time.Sleep(60 * time.Millisecond)
+		s.AddExecutions("BTC_JPY", bitflyer.Execution{Price: bitflyer.MustDecimal("102"), Size: bitflyer.MustDecimal("3")})
+	})
+
+	m, err := recorder.LoadManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Files) < 2 {
+		t.Fatalf("files = %d, want rotation", len(m.Files))
+	}
+	for _, info := range m.Files {
+		if info.End.IsZero() || info.Compression != "gzip" {
+			t.Errorf("file = %+v", info)
+		}
+	}
+
+	var boards, tickers int
+	var ids []int
+	err = recorder.NewReader(dir).Read(func(msg *recorder.Message) error {
+		if msg.ProductCode != "BTC_JPY" {
+			t.Errorf("product = %q", msg.ProductCode)
+		}
+		v, err := msg.Decode()
+		if err != nil {
+			return err
+		}
+		switch v := v.(type) {
+		case *bitflyer.Board:
+			boards++
+			if !v.MidPrice.Equal(bitflyer.MustDecimal("100")) {
+				t.Errorf("mid = %s", v.MidPrice)
+			}
+		case *bitflyer.Ticker:
+			tickers++
+		case *bitflyer.Executions:
+			for _, e := range *v {
+				ids = append(ids, e.ID)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if boards < 2 || tickers < 2 {
+		t.Errorf("boards = %d, tickers = %d", boards, tickers)
+	}
+	// 約定は重ならずに古い順
+	if len(ids) != 3 || ids[0] >= ids[1] || ids[1] >= ids[2] {
+		t.Errorf("ids = %v", ids)
+	}
+
+	rd := recorder.NewReader(dir)
+	rd.Kinds = []recorder.Kind{recorder.KindTicker}
+	n := 0
+	if err := rd.Read(func(*recorder.Message) error { n++; return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if n != tickers {
+		t.Errorf("tickers = %d, want %d", n, tickers)
+	}
+}
+
+func TestRecordExecutionPages(t *testing.T) {
+	s := newServer(t)
+	dir := t.TempDir()
+	r := recorder.NewRecorder(s.Client(), dir)
+	r.Products = []string{"BTC_JPY"}
+	r.Kinds = []recorder.Kind{recorder.KindExecutions}
+	r.PollInterval = 20 * time.Millisecond
+	// 1回のポーリングの間に1ページ(500件)より多く約定する
+	execs := make([]bitflyer.Execution, 1201)
+	for i := range execs {
+		execs[i] = bitflyer.Execution{Price: bitflyer.MustDecimal("100"), Size: bitflyer.MustDecimal("0.01")}
+	}
+	record(t, r, time.Second, func() {
+		time.Sleep(30 * time.Millisecond)
+		s.AddExecutions("BTC_JPY", execs...)
+	})
+
+	var ids []int
+	err := recorder.NewReader(dir).Read(func(msg *recorder.Message) error {
+		v, err := msg.Decode()
+		if err != nil {
+			return err
+		}
+		for _, e := range *v.(*bitflyer.Executions) {
+			ids = append(ids, e.ID)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 2+len(execs) {
+		t.Fatalf("executions = %d, want %d", len(ids), 2+len(execs))
+	}
+	for i := 1; i < len(ids); i++ {
+		if ids[i] <= ids[i-1] {
+			t.Fatalf("ids[%d] = %d after %d", i, ids[i], ids[i-1])
+		}
+	}
+}
+
+func TestRecordRealtimeUnsubscribe(t *testing.T) {
+	s := newServer(t)
+	rs := bitflyertest.NewRealtimeServer()
+	t.Cleanup(rs.Close)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	rt := rs.Realtime(s.Client())
+	go rt.Run(ctx)
+
+	r := recorder.NewRecorder(s.Client(), t.TempDir())
+	r.Realtime = rt
+	r.Products = []string{"BTC_JPY"}
+	r.Kinds = []recorder.Kind{recorder.KindTicker}
+	channel := "lightning_ticker_BTC_JPY"
+	record(t, r, 100*time.Millisecond, func() {
+		if err := rs.Wait(ctx, func() bool { return rs.Subscribed(channel) }); err != nil {
+			t.Error(err)
+		}
+	})
+
+	// 記録をやめたら取引所への購読もやめる
+	if err := rs.Wait(ctx, func() bool { return !rs.Subscribed(channel) }); err != nil {
+		t.Errorf("still subscribed: %v", err)
+	}
+}
+
+func TestRecordDefaultIntervals(t *testing.T) {
+	s := newServer(t)
+	dir := t.TempDir()
+	r := &recorder.Recorder{Client: s.Client(), Dir: dir, Products: []string{"BTC_JPY"}, Kinds: []recorder.Kind{recorder.KindTicker}}
+	// 間隔が0でも止まらずに記録する
+	record(t, r, 50*time.Millisecond, nil)
+
+	n := 0
+	if err := recorder.NewReader(dir).Read(func(*recorder.Message) error { n++; return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("messages = %d, want 1", n)
+	}
+}
+
+func TestReadTruncated(t *testing.T) {
+	s := newServer(t)
+	dir := t.TempDir()
+	r := recorder.NewRecorder(s.Client(), dir)
+	r.Products = []string{"BTC_JPY"}
+	r.PollInterval = 10 * time.Millisecond
+	record(t, r, 50*time.Millisecond, nil)
+
+	m, err := recorder.LoadManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := &m.Files[len(m.Files)-1]
+	file := filepath.Join(dir, last.File)
+	b, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(file, b[:len(b)/2], 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// 書きかけのファイルは切れたところまで読む
+	end := last.End
+	last.End = time.Time{}
+	saveManifest(t, dir, m)
+	if err := recorder.NewReader(dir).Read(func(*recorder.Message) error { return nil }); err != nil {
+		t.Errorf("unfinished file: %v", err)
+	}
+
+	last.End = end
+	saveManifest(t, dir, m)
+	if err := recorder.NewReader(dir).Read(func(*recorder.Message) error { return nil }); err == nil {
+		t.Error("finished file: want error")
+	}
+}
@@ -0,0 +1,135 @@
+package bitflyer
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+)
+
+// * リトライ
+// 既定ではGETのエンドポイントだけをリトライする。
+// 注文などGET以外はWithIdempotencyCheckでチェックを渡したときだけリトライする。
+// Retry-Afterヘッダーがあれば、MaxDelayまではその時間を待つ
+
+var ErrAlreadyApplied = errors.New("bitflyer: request already applied")
+
+type RetryPolicy struct {
+	// 最初の1回を含む試行回数。1以下ならリトライしない
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+	// 待ち時間をランダムに減らす割合 (0〜1)
+	Jitter float64
+	// リトライするHTTPステータスコード
+	RetryableStatus []int
+	// nilならタイムアウトや接続のリセットをリトライする
+	RetryableError func(error) bool
+}
+
+func DefaultRetryPolicy() *RetryPolicy {
+	return &RetryPolicy{
+		MaxAttempts: 3,
+		BaseDelay:   200 * time.Millisecond,
+		MaxDelay:    5 * time.Second,
+		Jitter:      0.2,
+		RetryableStatus: []int{
+			http.StatusInternalServerError,
+			http.StatusBadGateway,
+			http.StatusServiceUnavailable,
+			http.StatusGatewayTimeout,
+		},
+	}
+}
+
+func (p *RetryPolicy) retryable(err error) bool {
+	if e, ok := asAPIError(err); ok {
+		for _, code := range p.RetryableStatus {
+			if e.HTTPStatus == code {
+				return true
+			}
+		}
+		return false
+	}
+	if p.RetryableError != nil {
+		return p.RetryableError(err)
+	}
+	return isTemporaryError(err)
+}
+
+func isTemporaryError(err error) bool {
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// backoff はattempt回目の失敗後の待ち時間
+func (p *RetryPolicy) backoff(attempt int) time.Duration {
+	d := p.BaseDelay << uint(attempt-1)
+	if d > p.MaxDelay || d <= 0 {
+		d = p.MaxDelay
+	}
+	if p.Jitter > 0 {
+		d -= time.Duration(float64(d) * p.Jitter * rand.Float64())
+	}
+
+	return d
+}
+
+// IdempotencyCheck は失敗したように見えたリクエストが実際には処理されていたかを調べる
+type IdempotencyCheck func(ctx context.Context) (applied bool, err error)
+
+type idempotencyCheckKey struct{}
+
+// WithIdempotencyCheck はGET以外のリクエストをリトライ可能にする。
+// リトライの前にcheckを呼び、処理済みならErrAlreadyAppliedを返して再送しない
+func WithIdempotencyCheck(ctx context.Context, check IdempotencyCheck) context.Context {
+	return context.WithValue(ctx, idempotencyCheckKey{}, check)
+}
+
+func (c *Client) retryPolicyFor(req *http.Request) (*RetryPolicy, IdempotencyCheck) {
+	if c.RetryPolicy == nil || c.RetryPolicy.MaxAttempts <= 1 {
+		return nil, nil
+	}
+	if req.Method == "GET" {
+		return c.RetryPolicy, nil
+	}
+	if check, ok := req.Context().Value(idempotencyCheckKey{}).(IdempotencyCheck); ok {
+		return c.RetryPolicy, check
+	}
+	return nil, nil
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// rewindRequest は再送用にボディを読み直したリクエストを作る
+func rewindRequest(req *http.Request) (*http.Request, error) {
+	r := req.Clone(req.Context())
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		r.Body = body
+	}
+
+	return r, nil
+}
@@ -0,0 +1,231 @@
+package bitflyer_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackpopper/bitflyer"
+)
+
+// retryServer はresponsesの順に応答し、受け取ったボディを覚える。使い切ったら200を返す
+type retryServer struct {
+	mu        sync.Mutex
+	bodies    []string
+	responses []func(w http.ResponseWriter)
+}
+
+func (s *retryServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b, _ := io.ReadAll(r.Body)
+	s.mu.Lock()
+	s.bodies = append(s.bodies, string(b))
+	var respond func(w http.ResponseWriter)
+	if len(s.responses) > 0 {
+		respond, s.responses = s.responses[0], s.responses[1:]
+	}
+	s.mu.Unlock()
+
+	if respond != nil {
+		respond(w)
+		return
+	}
+	w.Write([]byte(`{"child_order_acceptance_id":"JRF-1","mid_price":100}`))
+}
+
+func (s *retryServer) attempts() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.bodies)
+}
+
+func status(code int, header ...string) func(w http.ResponseWriter) {
+	return func(w http.ResponseWriter) {
+		for i := 0; i+1 < len(header); i += 2 {
+			w.Header().Set(header[i], header[i+1])
+		}
+		w.WriteHeader(code)
+	}
+}
+
+// reset は応答せずに接続を切る
+func reset(w http.ResponseWriter) {
+	conn, _, err := w.(http.Hijacker).Hijack()
+	if err == nil {
+		conn.Close()
+	}
+}
+
+func newRetryClient(t *testing.T, s *retryServer) *bitflyer.Client {
+	t.Helper()
+	ts := httptest.NewServer(s)
+	t.Cleanup(ts.Close)
+	c := bitflyer.NewClient("key", "secret")
+	c.URL, _ = url.Parse(ts.URL + "/v1")
+	c.RetryPolicy = &bitflyer.RetryPolicy{
+		MaxAttempts:     3,
+		BaseDelay:       20 * time.Millisecond,
+		MaxDelay:        2 * time.Second,
+		RetryableStatus: []int{http.StatusInternalServerError, http.StatusServiceUnavailable},
+	}
+	return c
+}
+
+func TestRetryBackoff(t *testing.T) {
+	s := &retryServer{responses: []func(http.ResponseWriter){status(500), status(503)}}
+	c := newRetryClient(t, s)
+
+	start := time.Now()
+	if _, err := c.GetBoard(context.Background(), "BTC_JPY"); err != nil {
+		t.Fatal(err)
+	}
+	// ジッターなしで20ms, 40ms待つ
+	if d := time.Since(start); d < 60*time.Millisecond {
+		t.Errorf("elapsed = %s, want at least 60ms", d)
+	}
+	if s.attempts() != 3 {
+		t.Errorf("attempts = %d, want 3", s.attempts())
+	}
+
+	// MaxDelayで頭打ちにする
+	s = &retryServer{responses: []func(http.ResponseWriter){status(500), status(500)}}
+	c = newRetryClient(t, s)
+	c.RetryPolicy.BaseDelay = time.Hour
+	c.RetryPolicy.MaxDelay = 10 * time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := c.GetBoard(ctx, "BTC_JPY"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRetryGiveUp(t *testing.T) {
+	tests := []struct {
+		name      string
+		responses []func(http.ResponseWriter)
+		attempts  int
+	}{
+		{"not retryable status", []func(http.ResponseWriter){status(400)}, 1},
+		{"max attempts", []func(http.ResponseWriter){status(500), status(500), status(500)}, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &retryServer{responses: tt.responses}
+			c := newRetryClient(t, s)
+			if _, err := c.GetBoard(context.Background(), "BTC_JPY"); err == nil {
+				t.Fatal("GetBoard succeeded")
+			}
+			if s.attempts() != tt.attempts {
+				t.Errorf("attempts = %d, want %d", s.attempts(), tt.attempts)
+			}
+		})
+	}
+
+	// ctxが切れたら待つのをやめる
+	s := &retryServer{responses: []func(http.ResponseWriter){status(500)}}
+	c := newRetryClient(t, s)
+	c.RetryPolicy.BaseDelay = time.Hour
+	c.RetryPolicy.MaxDelay = time.Hour
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := c.GetBoard(ctx, "BTC_JPY"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("err = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	s := &retryServer{responses: []func(http.ResponseWriter){status(503, "Retry-After", "1")}}
+	c := newRetryClient(t, s)
+	start := time.Now()
+	if _, err := c.GetBoard(context.Background(), "BTC_JPY"); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < time.Second {
+		t.Errorf("elapsed = %s, want at least Retry-After", d)
+	}
+
+	// MaxDelayより長ければリトライしない
+	s = &retryServer{responses: []func(http.ResponseWriter){status(503, "Retry-After", "60")}}
+	c = newRetryClient(t, s)
+	_, err := c.GetBoard(context.Background(), "BTC_JPY")
+	var e *bitflyer.APIError
+	if !errors.As(err, &e) || e.RetryAfter != time.Minute {
+		t.Fatalf("err = %#v", err)
+	}
+	if s.attempts() != 1 {
+		t.Errorf("attempts = %d, want 1", s.attempts())
+	}
+
+	// HTTPの日付でもよい
+	date := time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+	s = &retryServer{responses: []func(http.ResponseWriter){status(503, "Retry-After", date)}}
+	c = newRetryClient(t, s)
+	_, err = c.GetBoard(context.Background(), "BTC_JPY")
+	if !errors.As(err, &e) || e.RetryAfter < 59*time.Minute || e.RetryAfter > time.Hour {
+		t.Errorf("RetryAfter = %s", e.RetryAfter)
+	}
+}
+
+func sendOrder(ctx context.Context, c *bitflyer.Client) error {
+	_, err := c.SendChildorder(ctx, &bitflyer.Childorder{ProductCode: "BTC_JPY", ChildOrderType: bitflyer.OrderTypeMarket, Side: bitflyer.SideBuy, Size: bitflyer.MustDecimal("0.01")})
+	return err
+}
+
+func TestRetryIdempotencyCheck(t *testing.T) {
+	// チェックがなければGET以外はリトライしない
+	s := &retryServer{responses: []func(http.ResponseWriter){status(500)}}
+	c := newRetryClient(t, s)
+	if err := sendOrder(context.Background(), c); err == nil {
+		t.Fatal("SendChildorder succeeded")
+	}
+	if s.attempts() != 1 {
+		t.Errorf("attempts = %d, want 1", s.attempts())
+	}
+
+	// 処理されていなければ同じボディで送り直す
+	s = &retryServer{responses: []func(http.ResponseWriter){reset}}
+	c = newRetryClient(t, s)
+	checks := 0
+	ctx := bitflyer.WithIdempotencyCheck(context.Background(), func(ctx context.Context) (bool, error) {
+		checks++
+		return false, nil
+	})
+	if err := sendOrder(ctx, c); err != nil {
+		t.Fatal(err)
+	}
+	if checks != 1 || len(s.bodies) != 2 || s.bodies[0] == "" || s.bodies[0] != s.bodies[1] {
+		t.Errorf("checks = %d, bodies = %q", checks, s.bodies)
+	}
+
+	// 処理されていればErrAlreadyApplied
+	s = &retryServer{responses: []func(http.ResponseWriter){status(500)}}
+	c = newRetryClient(t, s)
+	ctx = bitflyer.WithIdempotencyCheck(context.Background(), func(ctx context.Context) (bool, error) {
+		return true, nil
+	})
+	if err := sendOrder(ctx, c); !errors.Is(err, bitflyer.ErrAlreadyApplied) {
+		t.Errorf("err = %v, want %v", err, bitflyer.ErrAlreadyApplied)
+	}
+	if s.attempts() != 1 {
+		t.Errorf("attempts = %d, want 1", s.attempts())
+	}
+
+	// チェックが失敗したら元のエラーを返して送り直さない
+	s = &retryServer{responses: []func(http.ResponseWriter){status(500)}}
+	c = newRetryClient(t, s)
+	ctx = bitflyer.WithIdempotencyCheck(context.Background(), func(ctx context.Context) (bool, error) {
+		return false, errors.New("check failed")
+	})
+	var e *bitflyer.APIError
+	if err := sendOrder(ctx, c); !errors.As(err, &e) || e.HTTPStatus != 500 {
+		t.Errorf("err = %v", err)
+	}
+	if s.attempts() != 1 {
+		t.Errorf("attempts = %d, want 1", s.attempts())
+	}
+}
@@ -0,0 +1,128 @@
+package bitflyer
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// * 注文の二重発注防止
+// タイムアウトなどで注文が受け付けられたか分からないとき、
+// 再送する前に同じ内容の注文が直近に作られていないかを注文一覧で確かめる
+
+const (
+	// 取引所とローカルの時計のずれの許容幅
+	safeSendClockSkew = 5 * time.Second
+	// 注文一覧で確かめるときの時間切れ。呼び出し元のctxが切れていても確かめる
+	safeSendCheckTimeout = 10 * time.Second
+)
+
+// safeSendLocks はClientと銘柄ごとのSafeSendChildorderを1つずつにする
+var safeSendLocks sync.Map
+
+type safeSendKey struct {
+	client      *Client
+	productCode string
+}
+
+func safeSendLock(c *Client, productCode string) *sync.Mutex {
+	mu, _ := safeSendLocks.LoadOrStore(safeSendKey{c, productCode}, new(sync.Mutex))
+	return mu.(*sync.Mutex)
+}
+
+// SafeSendChildorder はSendChildorderと同じだが、曖昧な失敗のあとは
+// GetMyChildordersで一致する注文を探し、見つかればそのChildOrderAcceptanceIDを返す。
+// 送る前にも注文一覧を取り、そこにあった注文は同じ内容でも別の注文として扱う。
+// 同じClientと銘柄への呼び出しは、他の注文と取り違えないように1つずつ送る
+func (c *Client) SafeSendChildorder(ctx context.Context, ch *Childorder) (*ChildOrderAcceptanceID, error) {
+	if err := ch.Validate(); err != nil {
+		return nil, err
+	}
+	mu := safeSendLock(c, ch.ProductCode)
+	mu.Lock()
+	defer mu.Unlock()
+
+	known, err := c.childorderAcceptanceIDs(ctx, ch.ProductCode)
+	if err != nil {
+		return nil, err
+	}
+	since := time.Now().Add(-safeSendClockSkew)
+
+	var found string
+	check := func(ctx context.Context) (bool, error) {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), safeSendCheckTimeout)
+		defer cancel()
+
+		id, err := c.findChildorder(ctx, ch, since, known)
+		if err != nil {
+			return false, err
+		}
+		found = id
+		return id != "", nil
+	}
+
+	data, err := c.SendChildorder(WithIdempotencyCheck(ctx, check), ch)
+	switch {
+	case errors.Is(err, ErrAlreadyApplied):
+		return &ChildOrderAcceptanceID{ChildOrderAcceptanceID: found}, nil
+	case err != nil && isAmbiguousError(err):
+		// リトライしなかった、または最後の試行も曖昧に失敗した
+		if ok, cerr := check(ctx); cerr == nil && ok {
+			return &ChildOrderAcceptanceID{ChildOrderAcceptanceID: found}, nil
+		}
+	}
+
+	return data, err
+}
+
+// isAmbiguousError は取引所に届いたかどうか分からない失敗か
+func isAmbiguousError(err error) bool {
+	if e, ok := asAPIError(err); ok {
+		return e.HTTPStatus >= 500
+	}
+	return isTemporaryError(err) || errors.Is(err, context.DeadlineExceeded)
+}
+
+func (c *Client) childorderAcceptanceIDs(ctx context.Context, productCode string) (map[string]bool, error) {
+	orders, err := c.GetMyChildorders(ctx, productCode, &Page{Count: 100}, "", "")
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make(map[string]bool, len(*orders))
+	for _, o := range *orders {
+		ids[o.ChildOrderAcceptanceID] = true
+	}
+	return ids, nil
+}
+
+// findChildorder はsince以降に作られたchと同じ内容の注文をknownの外から探す
+func (c *Client) findChildorder(ctx context.Context, ch *Childorder, since time.Time, known map[string]bool) (string, error) {
+	orders, err := c.GetMyChildorders(ctx, ch.ProductCode, &Page{Count: 100}, "", "")
+	if err != nil {
+		return "", err
+	}
+	return matchChildorder(*orders, ch, since, known), nil
+}
+
+// matchChildorder はordersからsince以降に作られたchと同じ内容の注文をknownの外から探す
+func matchChildorder(orders Childorders, ch *Childorder, since time.Time, known map[string]bool) string {
+	for _, o := range orders {
+		if known[o.ChildOrderAcceptanceID] {
+			continue
+		}
+		if o.Side != ch.Side || o.ChildOrderType != ch.ChildOrderType || !o.Size.Equal(ch.Size) {
+			continue
+		}
+		if ch.ChildOrderType == OrderTypeLimit && !o.Price.Equal(ch.Price) {
+			continue
+		}
+		if o.ChildOrderDate.Before(since) {
+			continue
+		}
+		return o.ChildOrderAcceptanceID
+	}
+
+	return ""
+}
@@ -0,0 +1,166 @@
+package bitflyer_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackpopper/bitflyer"
+	"github.com/jackpopper/bitflyer/bitflyertest"
+)
+
+func newSafeSendServer(t *testing.T) (*bitflyertest.Server, *bitflyer.Client) {
+	t.Helper()
+	s := bitflyertest.NewServer()
+	t.Cleanup(s.Close)
+	s.SetBalance("BTC", bitflyer.MustDecimal("1"))
+	c := s.Client()
+	c.RetryPolicy.BaseDelay = time.Millisecond
+	return s, c
+}
+
+func sellOrder() *bitflyer.Childorder {
+	return &bitflyer.Childorder{
+		ProductCode:    "BTC_JPY",
+		ChildOrderType: bitflyer.OrderTypeLimit,
+		Side:           bitflyer.SideSell,
+		Price:          bitflyer.MustDecimal("20000000"),
+		Size:           bitflyer.MustDecimal("0.01"),
+	}
+}
+
+func TestSafeSendChildorderTimeout(t *testing.T) {
+	s, c := newSafeSendServer(t)
+	s.InjectFault("me/sendchildorder", bitflyertest.Fault{Delay: time.Second, AfterHandle: true})
+
+	// 注文は受け付けられたが、応答が届く前にctxが切れる
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	acc, err := c.SafeSendChildorder(ctx, sellOrder())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	orders := s.Orders()
+	if len(orders) != 1 {
+		t.Fatalf("orders = %d, want 1", len(orders))
+	}
+	if acc.ChildOrderAcceptanceID != orders[0].ChildOrderAcceptanceID {
+		t.Errorf("acceptance id = %s, want %s", acc.ChildOrderAcceptanceID, orders[0].ChildOrderAcceptanceID)
+	}
+}
+
+func TestSafeSendChildorderRetryAfterApplied(t *testing.T) {
+	s, c := newSafeSendServer(t)
+	s.InjectFault("me/sendchildorder", bitflyertest.Fault{CloseConnection: true, AfterHandle: true})
+
+	acc, err := c.SafeSendChildorder(context.Background(), sellOrder())
+	if err != nil {
+		t.Fatal(err)
+	}
+	orders := s.Orders()
+	if len(orders) != 1 || acc.ChildOrderAcceptanceID != orders[0].ChildOrderAcceptanceID {
+		t.Fatalf("orders = %+v, acceptance id = %s", orders, acc.ChildOrderAcceptanceID)
+	}
+	if n := s.Requests("me/sendchildorder"); n != 1 {
+		t.Errorf("me/sendchildorder requests = %d, want 1", n)
+	}
+}
+
+func TestSafeSendChildorderRetryNotApplied(t *testing.T) {
+	s, c := newSafeSendServer(t)
+	s.InjectFault("me/sendchildorder", bitflyertest.Fault{CloseConnection: true})
+
+	if _, err := c.SafeSendChildorder(context.Background(), sellOrder()); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(s.Orders()); n != 1 {
+		t.Errorf("orders = %d, want 1", n)
+	}
+	if n := s.Requests("me/sendchildorder"); n != 2 {
+		t.Errorf("me/sendchildorder requests = %d, want 2", n)
+	}
+}
+
+func TestSafeSendChildorderIdenticalOrders(t *testing.T) {
+	s, c := newSafeSendServer(t)
+	ctx := context.Background()
+
+	first, err := c.SafeSendChildorder(ctx, sellOrder())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 同じ内容の2つ目の注文は、曖昧に失敗しても1つ目と取り違えない
+	s.InjectFault("me/sendchildorder", bitflyertest.Fault{CloseConnection: true, AfterHandle: true})
+	second, err := c.SafeSendChildorder(ctx, sellOrder())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.ChildOrderAcceptanceID == first.ChildOrderAcceptanceID {
+		t.Errorf("second order got the first order's acceptance id %s", first.ChildOrderAcceptanceID)
+	}
+	if n := len(s.Orders()); n != 2 {
+		t.Errorf("orders = %d, want 2", n)
+	}
+
+	// 受け付けられずに切れたときは再送して3つ目を作る
+	s.InjectFault("me/sendchildorder", bitflyertest.Fault{CloseConnection: true})
+	third, err := c.SafeSendChildorder(ctx, sellOrder())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if third.ChildOrderAcceptanceID == first.ChildOrderAcceptanceID || third.ChildOrderAcceptanceID == second.ChildOrderAcceptanceID {
+		t.Errorf("third order got an earlier acceptance id %s", third.ChildOrderAcceptanceID)
+	}
+	if n := len(s.Orders()); n != 3 {
+		t.Errorf("orders = %d, want 3", n)
+	}
+}
+
+func TestSafeSendChildorderConcurrent(t *testing.T) {
+	s, c := newSafeSendServer(t)
+	s.InjectFault("me/sendchildorder", bitflyertest.Fault{Delay: 100 * time.Millisecond, CloseConnection: true, AfterHandle: true})
+
+	// 応答を待つあいだに同じ内容の注文が通っても、それを自分の注文と取り違えない
+	ids := make([]string, 2)
+	var wg sync.WaitGroup
+	for i := range ids {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			acc, err := c.SafeSendChildorder(context.Background(), sellOrder())
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			ids[i] = acc.ChildOrderAcceptanceID
+		}()
+		time.Sleep(20 * time.Millisecond)
+	}
+	wg.Wait()
+
+	orders := s.Orders()
+	if len(orders) != 2 {
+		t.Fatalf("orders = %d, want 2", len(orders))
+	}
+	if ids[0] == ids[1] {
+		t.Errorf("both sends got acceptance id %s", ids[0])
+	}
+}
+
+func TestSafeSendChildorderNotAccepted(t *testing.T) {
+	s, c := newSafeSendServer(t)
+	s.InjectFault("me/sendchildorder", bitflyertest.Fault{Delay: time.Second})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := c.SafeSendChildorder(ctx, sellOrder()); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if n := len(s.Orders()); n != 0 {
+		t.Errorf("orders = %d, want 0", n)
+	}
+}
@@ -0,0 +1,58 @@
+package bitflyer
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// * 日時
+// bitFlyerの日時はタイムゾーンなしのUTCで、小数点以下の桁数が一定でない
+// ("2015-07-08T02:43:34.823", "2015-07-08T02:43:34.8236781", "2015-07-08T02:43:34")。
+// タイムゾーン付きで返ってきた場合も読めるようにしておく
+
+const TimeLayout = "2006-01-02T15:04:05.999999999"
+
+type Time struct {
+	time.Time
+}
+
+func ParseTime(s string) (Time, error) {
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return Time{t.UTC()}, nil
+	}
+	t, err := time.ParseInLocation(TimeLayout, s, time.UTC)
+	if err != nil {
+		return Time{}, err
+	}
+	return Time{t}, nil
+}
+
+func (t Time) String() string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(TimeLayout)
+}
+
+func (t Time) MarshalJSON() ([]byte, error) {
+	return json.Marshal(t.String())
+}
+
+func (t *Time) UnmarshalJSON(b []byte) error {
+	var s *string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	if s == nil || *s == "" {
+		*t = Time{}
+		return nil
+	}
+
+	v, err := ParseTime(*s)
+	if err != nil {
+		return err
+	}
+	*t = v
+
+	return nil
+}
@@ -0,0 +1,76 @@
+package bitflyer_test
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/jackpopper/bitflyer"
+)
+
+func TestParseTime(t *testing.T) {
+	tests := []struct {
+		in   string
+		want time.Time
+	}{
+		{"2015-07-08T02:43:34", time.Date(2015, 7, 8, 2, 43, 34, 0, time.UTC)},
+		{"2015-07-08T02:43:34.8", time.Date(2015, 7, 8, 2, 43, 34, 800000000, time.UTC)},
+		{"2015-07-08T02:43:34.823", time.Date(2015, 7, 8, 2, 43, 34, 823000000, time.UTC)},
+		{"2015-07-08T02:43:34.8236781", time.Date(2015, 7, 8, 2, 43, 34, 823678100, time.UTC)},
+		// タイムゾーン付き
+		{"2015-07-08T02:43:34.823Z", time.Date(2015, 7, 8, 2, 43, 34, 823000000, time.UTC)},
+		{"2015-07-08T11:43:34+09:00", time.Date(2015, 7, 8, 2, 43, 34, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		got, err := bitflyer.ParseTime(tt.in)
+		if err != nil {
+			t.Errorf("ParseTime(%q): %v", tt.in, err)
+			continue
+		}
+		if !got.Equal(tt.want) || got.Location() != time.UTC {
+			t.Errorf("ParseTime(%q) = %v, want %v", tt.in, got.Time, tt.want)
+		}
+	}
+
+	for _, in := range []string{"2015-07-08", "2015/07/08 02:43:34", "yesterday"} {
+		if _, err := bitflyer.ParseTime(in); err == nil {
+			t.Errorf("ParseTime(%q) succeeded", in)
+		}
+	}
+}
+
+func TestTimeJSON(t *testing.T) {
+	var v struct {
+		Date bitflyer.Time `json:"date"`
+	}
+	if err := json.Unmarshal([]byte(`{"date":"2015-07-08T02:43:34.8236781"}`), &v); err != nil {
+		t.Fatal(err)
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 小数点以下の末尾の0は付けずにタイムゾーンなしで書く
+	if string(b) != `{"date":"2015-07-08T02:43:34.8236781"}` {
+		t.Errorf("Marshal = %s", b)
+	}
+
+	// nullと空文字列はゼロ値
+	for _, in := range []string{`{"date":null}`, `{"date":""}`} {
+		v.Date = bitflyer.Time{Time: time.Now()}
+		if err := json.Unmarshal([]byte(in), &v); err != nil || !v.Date.IsZero() {
+			t.Errorf("Unmarshal(%s) = %v, %v", in, v.Date, err)
+		}
+	}
+	if err := json.Unmarshal([]byte(`{"date":"soon"}`), &v); err == nil {
+		t.Error("Unmarshal(soon) succeeded")
+	}
+
+	// ゼロ値は空文字列にする
+	b, err = json.Marshal(struct {
+		Date bitflyer.Time `json:"date"`
+	}{})
+	if err != nil || string(b) != `{"date":""}` {
+		t.Errorf("Marshal(zero) = %s, %v", b, err)
+	}
+}
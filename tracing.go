@@ -0,0 +1,145 @@
+package bitflyer
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+)
+
+// * トレース
+// Client.Tracerを設定すると、メソッドの呼び出しごとにスパンを作る。リトライもひとつのスパンに含む。
+// 親スパンは各メソッドに渡したctxから取るので、OpenTelemetryなどはTracerを実装するだけで繋がる
+
+type Tracer interface {
+	// Start はctxを親とするスパンを始め、そのスパンを持つctxを返す
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+type Span interface {
+	SetAttribute(key string, value interface{})
+	RecordError(err error)
+	End()
+}
+
+// spanNames はエンドポイントからスパン名 (Clientのメソッド名) を引く
+var spanNames = map[string]string{
+	"markets":                 "GetMarkets",
+	"board":                   "GetBoard",
+	"ticker":                  "GetTicker",
+	"executions":              "GetExecutions",
+	"gethealth":               "GetHealth",
+	"getchats":                "GetChats",
+	"me/getpermissions":       "GetMyPermissions",
+	"me/getbalance":           "GetMyBalance",
+	"me/getcollateral":        "GetMyCollateral",
+	"me/getaddress":           "GetMyAddress",
+	"me/getcoinins":           "GetMyCoinins",
+	"me/getcoinouts":          "GetMyCoinouts",
+	"me/getbankaccounts":      "GetMyBankAccounts",
+	"me/getdeposits":          "GetMyDeposits",
+	"me/withdraw":             "Withdraw",
+	"me/getwithdrawals":       "GetMyWithdrawals",
+	"me/sendchildorder":       "SendChildorder",
+	"me/cancelchildorder":     "CancelChildorder",
+	"me/sendparentorder":      "SendParentrder",
+	"me/cancelparentorder":    "CancelParentorder",
+	"me/cancelallchildorder":  "CancelAllChildorder",
+	"me/getchildorders":       "GetMyChildorders",
+	"me/getparentorders":      "GetMyParentorders",
+	"me/getparentorder":       "GetMyParentorder",
+	"me/getexecutions":        "GetMyExecutions",
+	"me/getpositions":         "GetMyPositions",
+	"me/gettradingcommission": "GetMyTradingCommission",
+}
+
+func spanName(endpoint string) string {
+	if name, ok := spanNames[endpoint]; ok {
+		return "bitflyer." + name
+	}
+	return "bitflyer." + endpoint
+}
+
+// startSpan はスパンを始め、そのctxを持つリクエストを返す
+func (c *Client) startSpan(req *http.Request) (*http.Request, Span) {
+	endpoint := c.endpoint(req)
+	ctx, span := c.Tracer.Start(req.Context(), spanName(endpoint))
+	span.SetAttribute("bitflyer.endpoint", endpoint)
+	span.SetAttribute("http.method", req.Method)
+	for k, v := range requestAttributes(req) {
+		span.SetAttribute(k, v)
+	}
+
+	return req.WithContext(ctx), span
+}
+
+func endSpan(span Span, err error) {
+	if err == nil {
+		span.SetAttribute("http.status_code", http.StatusOK)
+	} else {
+		if e, ok := asAPIError(err); ok {
+			span.SetAttribute("http.status_code", e.HTTPStatus)
+			if e.Status != 0 {
+				span.SetAttribute("bitflyer.error_code", e.Status)
+			}
+		}
+		span.RecordError(err)
+	}
+	span.End()
+}
+
+// requestAttributes はクエリとJSONボディから注文の内容を取り出す
+func requestAttributes(req *http.Request) map[string]interface{} {
+	attrs := map[string]interface{}{}
+	q := req.URL.Query()
+	for _, k := range []string{"product_code", "child_order_state", "parent_order_state"} {
+		if v := q.Get(k); v != "" {
+			attrs["bitflyer."+k] = v
+		}
+	}
+
+	b, err := requestBody(req)
+	if err != nil || len(b) == 0 {
+		return attrs
+	}
+	var body struct {
+		ProductCode    string   `json:"product_code"`
+		Side           string   `json:"side"`
+		Size           *Decimal `json:"size"`
+		Price          *Decimal `json:"price"`
+		ChildOrderType string   `json:"child_order_type"`
+		OrderMethod    string   `json:"order_method"`
+		Parameters     []struct {
+			ProductCode   string   `json:"product_code"`
+			ConditionType string   `json:"condition_type"`
+			Side          string   `json:"side"`
+			Size          *Decimal `json:"size"`
+			Price         *Decimal `json:"price"`
+		} `json:"parameters"`
+	}
+	if json.Unmarshal(b, &body) != nil {
+		return attrs
+	}
+	// 親注文は最初の注文の内容を使い、執行条件をchild_order_typeに入れる
+	if len(body.Parameters) > 0 {
+		p := body.Parameters[0]
+		body.ProductCode, body.Side, body.Size, body.Price = p.ProductCode, p.Side, p.Size, p.Price
+		body.ChildOrderType = p.ConditionType
+	}
+	set := func(k, v string) {
+		if v != "" {
+			attrs["bitflyer."+k] = v
+		}
+	}
+	set("product_code", body.ProductCode)
+	set("side", body.Side)
+	set("child_order_type", body.ChildOrderType)
+	set("order_method", body.OrderMethod)
+	if body.Size != nil && !body.Size.IsZero() {
+		set("size", body.Size.String())
+	}
+	if body.Price != nil && !body.Price.IsZero() {
+		set("price", body.Price.String())
+	}
+
+	return attrs
+}
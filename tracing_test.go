@@ -0,0 +1,110 @@
+package bitflyer_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackpopper/bitflyer"
+	"github.com/jackpopper/bitflyer/bitflyertest"
+)
+
+type spanKey struct{}
+
+type testSpan struct {
+	name   string
+	parent interface{}
+	attrs  map[string]interface{}
+	errs   []error
+	ended  bool
+}
+
+func (s *testSpan) SetAttribute(key string, value interface{}) { s.attrs[key] = value }
+func (s *testSpan) RecordError(err error)                      { s.errs = append(s.errs, err) }
+func (s *testSpan) End()                                       { s.ended = true }
+
+type testTracer struct {
+	mu    sync.Mutex
+	spans []*testSpan
+}
+
+func (tr *testTracer) Start(ctx context.Context, name string) (context.Context, bitflyer.Span) {
+	s := &testSpan{name: name, parent: ctx.Value(spanKey{}), attrs: map[string]interface{}{}}
+	tr.mu.Lock()
+	tr.spans = append(tr.spans, s)
+	tr.mu.Unlock()
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+func (tr *testTracer) take() []*testSpan {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	spans := tr.spans
+	tr.spans = nil
+	return spans
+}
+
+func TestTracer(t *testing.T) {
+	s := bitflyertest.NewServer()
+	defer s.Close()
+	s.SetBalance("BTC", bitflyer.MustDecimal("1"))
+	tr := &testTracer{}
+	c := s.Client()
+	c.RetryPolicy.BaseDelay = time.Millisecond
+	c.Tracer = tr
+	ctx := context.WithValue(context.Background(), spanKey{}, "parent")
+
+	_, err := c.SendChildorder(ctx, &bitflyer.Childorder{
+		ProductCode:    "BTC_JPY",
+		ChildOrderType: bitflyer.OrderTypeLimit,
+		Side:           bitflyer.SideSell,
+		Price:          bitflyer.MustDecimal("20000000"),
+		Size:           bitflyer.MustDecimal("0.01"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	spans := tr.take()
+	if len(spans) != 1 {
+		t.Fatalf("spans = %d, want 1", len(spans))
+	}
+	span := spans[0]
+	if span.name != "bitflyer.SendChildorder" || span.parent != "parent" || !span.ended || len(span.errs) != 0 {
+		t.Errorf("span = %+v", span)
+	}
+	for k, want := range map[string]interface{}{
+		"bitflyer.endpoint":         "me/sendchildorder",
+		"http.method":               "POST",
+		"http.status_code":          200,
+		"bitflyer.product_code":     "BTC_JPY",
+		"bitflyer.side":             "SELL",
+		"bitflyer.child_order_type": "LIMIT",
+		"bitflyer.size":             "0.01",
+		"bitflyer.price":            "20000000",
+	} {
+		if got := span.attrs[k]; got != want {
+			t.Errorf("%s = %v, want %v", k, got, want)
+		}
+	}
+
+	// リトライしてもスパンは1つで、最後のエラーを記録する
+	s.InjectFault("ticker", bitflyertest.Fault{HTTPStatus: 503, Status: -1, Message: "down"})
+	s.InjectFault("ticker", bitflyertest.Fault{HTTPStatus: 503, Status: -1, Message: "down"})
+	s.InjectFault("ticker", bitflyertest.Fault{HTTPStatus: 503, Status: -1, Message: "down"})
+	_, err = c.GetTicker(ctx, "BTC_JPY")
+	if err == nil {
+		t.Fatal("GetTicker succeeded")
+	}
+	spans = tr.take()
+	if len(spans) != 1 {
+		t.Fatalf("spans = %d, want 1", len(spans))
+	}
+	span = spans[0]
+	if span.name != "bitflyer.GetTicker" || !span.ended || len(span.errs) != 1 || span.errs[0] != err {
+		t.Errorf("span = %+v, err = %v", span, err)
+	}
+	if span.attrs["http.status_code"] != 503 || span.attrs["bitflyer.error_code"] != -1 || span.attrs["bitflyer.product_code"] != "BTC_JPY" {
+		t.Errorf("attrs = %v", span.attrs)
+	}
+}